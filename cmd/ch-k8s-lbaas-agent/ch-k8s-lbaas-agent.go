@@ -15,11 +15,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
 	"k8s.io/klog"
@@ -28,6 +31,8 @@ import (
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/agent"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/tlsconfig"
 )
 
 var (
@@ -48,9 +53,28 @@ func main() {
 		klog.Fatalf("invalid configuration: %s", err.Error())
 	}
 
-	sharedSecret, err := base64.StdEncoding.DecodeString(fileCfg.SharedSecret)
+	keys := []signing.Key{}
+	for _, key := range fileCfg.AllVerificationKeys() {
+		sharedSecret, err := base64.StdEncoding.DecodeString(key.SharedSecret)
+		if err != nil {
+			klog.Fatalf("shared-secret of key %q failed to decode: %s", key.ID, err.Error())
+		}
+		keys = append(keys, signing.Key{ID: key.ID, SharedSecret: sharedSecret, KeyFile: key.PublicKeyFile})
+	}
+
+	verifier, err := signing.NewVerifier(fileCfg.SigningMethod, keys)
 	if err != nil {
-		klog.Fatalf("shared-secret failed to decode: %s", err.Error())
+		klog.Fatalf("Failed to set up token verification: %s", err.Error())
+	}
+
+	err = os.MkdirAll(fileCfg.StateDir, 0700)
+	if err != nil {
+		klog.Fatalf("Failed to create state directory: %s", err.Error())
+	}
+
+	generations, err := agent.NewGenerationStore(filepath.Join(fileCfg.StateDir, "generation"))
+	if err != nil {
+		klog.Fatalf("Failed to load last config generation: %s", err.Error())
 	}
 
 	nftablesConfig := &agent.ConfigManager{
@@ -60,6 +84,16 @@ func main() {
 		},
 	}
 
+	if fileCfg.Nftables.Backend == config.NftablesBackendNetlink {
+		nftablesNetlink := agent.NewNftablesNetlink(fileCfg.Nftables)
+		nftablesConfig.Generator = nftablesNetlink.Generator
+		nftablesConfig.Applier = nftablesNetlink
+		// the ruleset is programmed without the nftables service
+		nftablesConfig.Service.ReloadCommand = nil
+		nftablesConfig.Service.StatusCommand = nil
+		nftablesConfig.Service.StartCommand = nil
+	}
+
 	var keepalivedConfig *agent.ConfigManager
 
 	if fileCfg.Keepalived.Enabled {
@@ -74,17 +108,37 @@ func main() {
 		}
 	}
 
-	// If PartialReload is enabled, reload nftables config directly after start to apply last state
-	if fileCfg.Nftables.PartialReload {
-		nftablesConfig.Reload()
-	}
-
-	http.Handle("/v1/apply", &agent.ApplyHandlerv1{
+	applyHandler := &agent.ApplyHandlerv1{
 		MaxRequestSize:   1048576,
-		SharedSecret:     sharedSecret,
+		Verifier:         verifier,
+		Generations:      generations,
+		State:            agent.NewStateStore(filepath.Join(fileCfg.StateDir, "last-applied.json")),
 		KeepalivedConfig: keepalivedConfig,
 		NftablesConfig:   nftablesConfig,
-	})
+	}
+
+	// Apply the last state directly after start, so that the agent serves
+	// traffic before the controller pushes a config again
+	restored, err := applyHandler.Restore()
+	if err != nil {
+		klog.Errorf("Failed to restore last applied config: %s", err.Error())
+	}
+	// Without persisted config, reload the nftables config of the last run
+	// for partial reload
+	if !restored && fileCfg.Nftables.PartialReload && nftablesConfig.Applier == nil {
+		nftablesConfig.Reload()
+	}
+	statusHandler := &agent.StatusHandlerv1{
+		Apply:    applyHandler,
+		Verifier: verifier,
+	}
+	if fileCfg.TLS.ClientCAFile != "" {
+		http.Handle("/v1/apply", tlsconfig.RequireClientCertificate(applyHandler))
+		http.Handle("/v1/status", tlsconfig.RequireClientCertificate(statusHandler))
+	} else {
+		http.Handle("/v1/apply", applyHandler)
+		http.Handle("/v1/status", statusHandler)
+	}
 
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -93,6 +147,14 @@ func main() {
 		klog.Fatalf("Failed to set up HTTP listener: %s", err.Error())
 	}
 
+	if fileCfg.TLS.CertFile != "" {
+		tlsConfig, err := tlsconfig.NewServerConfig(fileCfg.TLS.CertFile, fileCfg.TLS.KeyFile, fileCfg.TLS.ClientCAFile)
+		if err != nil {
+			klog.Fatalf("Failed to set up TLS: %s", err.Error())
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
 	s := &http.Server{
 		Handler:           nil,
 		ReadTimeout:       2 * time.Second,
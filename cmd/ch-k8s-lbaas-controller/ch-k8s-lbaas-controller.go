@@ -24,7 +24,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/ippool"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/static"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/webhook"
 
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
@@ -85,7 +87,12 @@ func main() {
 			klog.Fatalf("Failed to connect to OpenStack: %s", err.Error())
 		}
 
-		l3portmanager, err = osClient.NewOpenStackL3PortManager(
+		err = osClient.Preflight(&fileCfg.OpenStack.Networking, fileCfg.Agents.Agents)
+		if err != nil {
+			klog.Fatalf("OpenStack preflight checks failed: %s", err.Error())
+		}
+
+		osPortManager, err := osClient.NewOpenStackL3PortManager(
 			&fileCfg.OpenStack.Networking,
 			fileCfg.Agents.Agents,
 			fileCfg.Agents.AdditionalIps,
@@ -93,11 +100,23 @@ func main() {
 		if err != nil {
 			klog.Fatalf("Failed to create openstack L3 port manager: %s", err.Error())
 		}
+		go osPortManager.RunPortCacheRefresh(stopCh)
+		l3portmanager = osPortManager
 	} else if fileCfg.PortManager == config.PortManagerStatic {
 		l3portmanager, err = static.NewStaticL3PortManager(&fileCfg.Static)
 		if err != nil {
 			klog.Fatalf("Failed to create static L3 port manager: %s", err.Error())
 		}
+	} else if fileCfg.PortManager == config.PortManagerIPPool {
+		l3portmanager, err = ippool.NewIPPoolL3PortManager(&fileCfg.IPPool, kubeClient)
+		if err != nil {
+			klog.Fatalf("Failed to create ip-pool L3 port manager: %s", err.Error())
+		}
+	} else if fileCfg.PortManager == config.PortManagerWebhook {
+		l3portmanager, err = webhook.NewWebhookL3PortManager(&fileCfg.Webhook)
+		if err != nil {
+			klog.Fatalf("Failed to create webhook L3 port manager: %s", err.Error())
+		}
 	}
 
 	agentController, err := controller.NewHTTPAgentController(fileCfg.Agents)
@@ -107,7 +126,7 @@ func main() {
 
 	servicesInformer := kubeInformerFactory.Core().V1().Services()
 	nodesInformer := kubeInformerFactory.Core().V1().Nodes()
-	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints()
+	endpointSlicesInformer := kubeInformerFactory.Discovery().V1().EndpointSlices()
 	networkPoliciesInformer := kubeInformerFactory.Networking().V1().NetworkPolicies()
 	podsInformer := kubeInformerFactory.Core().V1().Pods() // TODO: I don't want to be informed about pods. Just need to list them
 
@@ -116,7 +135,7 @@ func main() {
 		l3portmanager,
 		servicesInformer.Lister(),
 		nodesInformer.Lister(),
-		endpointsInformer.Lister(),
+		endpointSlicesInformer.Lister(),
 		networkPoliciesInformer.Lister(),
 		podsInformer.Lister(),
 	)
@@ -128,16 +147,16 @@ func main() {
 	}
 
 	if fileCfg.BackendLayer != config.BackendLayerPod {
-		// Setting the endpoints informer to nil causes the controller
-		// not to subscribe to it, saving cycles.
-		endpointsInformer = nil
+		// Setting the endpoint slices informer to nil causes the
+		// controller not to subscribe to it, saving cycles.
+		endpointSlicesInformer = nil
 	}
 
 	lbcontroller, err := controller.NewController(
 		kubeClient,
 		servicesInformer,
 		nodesInformer,
-		endpointsInformer,
+		endpointSlicesInformer,
 		networkPoliciesInformer,
 		l3portmanager,
 		agentController,
@@ -1,6 +1,6 @@
 #!/usr/bin/env python3
 
-import jwt, requests, base64, yaml, toml
+import jwt, requests, base64, yaml, toml, time, uuid
 
 with open("agent-config.toml", "r") as fp:
     config = toml.load(fp)
@@ -11,6 +11,10 @@ headers = {"Content-Type": "application/jwt"}
 with open("request.yaml", "r") as fp:
     payload = yaml.safe_load(fp)
 
+# the agent only accepts configs with a newer generation than the last one
+payload["generation"] = time.time_ns()
+payload["jti"] = str(uuid.uuid4())
+
 data = jwt.encode(payload, base64.b64decode(config["shared-secret"]))
 try:
     r = requests.post(url, headers=headers, data=data)
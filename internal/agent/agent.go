@@ -30,8 +30,6 @@ import (
 
 	"k8s.io/klog"
 
-	"github.com/golang-jwt/jwt"
-
 	"github.com/go-playground/validator/v10"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,6 +37,7 @@ import (
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
 )
 
 var (
@@ -55,16 +54,45 @@ var (
 
 type ApplyHandlerv1 struct {
 	mutex sync.Mutex
+	// serializes accepting, applying and persisting configs, so that an
+	// older config cannot be applied or saved after a newer one
+	applyLock sync.Mutex
 
 	KeepalivedConfig *ConfigManager
 	NftablesConfig   *ConfigManager
 	MaxRequestSize   int64
-	SharedSecret     []byte
+	Verifier         *signing.Verifier
+	Generations      *GenerationStore
+	State            *StateStore
+
+	// the config applied last, protected by mutex
+	appliedGeneration uint64
+	appliedHash       string
+	appliedAt         time.Time
+	// whether the config applied last was restored from State
+	restored bool
+}
+
+// ConfigApplier programs a config into a service directly instead of via
+// the config file and the reload command of the service.
+type ConfigApplier interface {
+	// Apply programs the config atomically: if it fails, the service keeps
+	// its previous config.
+	Apply(lb *model.LoadBalancer) error
 }
 
 type ConfigManager struct {
 	Generator ConfigGenerator
 	Service   config.ServiceConfig
+	// If set, the Applier replaces the reload command and the config file
+	// is only written for debugging
+	Applier ConfigApplier
+
+	statusLock sync.Mutex
+	lastApply  *applyResult
+
+	// the config programmed last by the Applier
+	applied *model.LoadBalancer
 }
 
 func diffFiles(oldFile, newFile string) (changed bool, diff string, err error) {
@@ -170,80 +198,6 @@ func (m *ConfigManager) ReloadAndCheck() error {
 	return m.Check()
 }
 
-func (m *ConfigManager) WriteWithRollback(cfg *model.LoadBalancer) (bool, error) {
-	klog.V(1).Infof("writing configuration file %s", m.Service.ConfigFile)
-
-	dir := filepath.Dir(m.Service.ConfigFile)
-	fout, err := ioutil.TempFile(dir, ".tmp-*")
-	if err != nil {
-		return false, err
-	}
-	defer os.Remove(fout.Name())
-
-	err = func() error {
-		defer fout.Close()
-		return m.Generator.GenerateConfig(cfg, fout)
-	}()
-	if err != nil {
-		return false, err
-	}
-
-	backupFile, err := m.MakeBackup()
-	if err != nil {
-		return false, fmt.Errorf("failed to create backup of current configuration: %s", err.Error())
-	}
-	defer os.Remove(backupFile)
-
-	var changed bool
-	if backupFile != "" {
-		var diff string
-		changed, diff, err = diffFiles(backupFile, fout.Name())
-		if err != nil {
-			return false, fmt.Errorf("failed diff config: %s", err.Error())
-		}
-		if changed {
-			klog.Infof("configuration diff for %s:\n%s", m.Service.ConfigFile, diff)
-		}
-	} else {
-		changed = true
-		klog.V(2).Infof("no old configuration file\n")
-	}
-
-	if !changed {
-		klog.V(1).Infof("configuration had no changes, skipping reload")
-		return false, nil
-	}
-
-	// all files in place, do the swappety swap
-	os.Rename(fout.Name(), m.Service.ConfigFile)
-	klog.V(1).Infof("updating configuration file %s", m.Service.ConfigFile)
-	err = m.ReloadAndCheck()
-	if err != nil {
-		// failed -> swap back
-		if backupFile != "" {
-			restoreErr := os.Rename(backupFile, m.Service.ConfigFile)
-			if restoreErr != nil {
-				klog.Warningf("failed to restore config backup: %s!", restoreErr.Error())
-			}
-		} else {
-			// no backup exists, we delete the new file
-			restoreErr := os.Remove(m.Service.ConfigFile)
-			if restoreErr != nil {
-				klog.Warningf("failed to remove invalid config: %s!", restoreErr.Error())
-			}
-		}
-
-		fixErr := m.Fix()
-		if fixErr != nil {
-			klog.Errorf("failed to recover broken service: %s!", fixErr.Error())
-		}
-
-		return false, err
-	}
-
-	return true, nil
-}
-
 func (h *ApplyHandlerv1) preflightCheck(w http.ResponseWriter, r *http.Request) (content_length int64, success bool) {
 	if r.Method != "POST" {
 		w.WriteHeader(405) // Method Not Allowed
@@ -277,43 +231,109 @@ func (h *ApplyHandlerv1) preflightCheck(w http.ResponseWriter, r *http.Request)
 	return content_length, true
 }
 
-func (h *ApplyHandlerv1) ProcessRequest(lbcfg *model.LoadBalancer) (int, string) {
-	klog.V(1).Infof("received config: %#v", lbcfg)
+// Return the HTTP status and body for the result of apply
+func applyResponse(err error) (int, string) {
+	if err == nil {
+		return 200, "success"
+	}
+	if applyErr, ok := err.(*ApplyError); ok {
+		if applyErr.Stage == StageValidate || applyErr.Stage == StageValidateFiles {
+			return 400, err.Error() // Bad Request
+		}
+	}
+	return 500, fmt.Sprintf("Failed to apply config: %s", err.Error())
+}
 
+// A config manager with the name of its service
+type namedConfigManager struct {
+	name    string
+	manager *ConfigManager
+}
+
+// Return the configured config managers in the order in which they are
+// applied: nftables comes first, so that keepalived only announces new VIPs
+// once the forwarding rules for them are in place.
+func (h *ApplyHandlerv1) configManagers() []namedConfigManager {
+	managers := []namedConfigManager{}
+	if h.NftablesConfig != nil {
+		managers = append(managers, namedConfigManager{"nftables", h.NftablesConfig})
+	}
+	if h.KeepalivedConfig != nil {
+		managers = append(managers, namedConfigManager{"keepalived", h.KeepalivedConfig})
+	}
+	return managers
+}
+
+// apply validates the config and applies it to all services in one
+// transaction, see configTransaction. If force is set, the services are
+// reloaded even if their config did not change.
+func (h *ApplyHandlerv1) apply(lbcfg *model.LoadBalancer, force bool) error {
 	err := validate.Struct(lbcfg)
 	if err != nil {
 		for _, e := range err.(validator.ValidationErrors) {
 			klog.Errorf("%s\n", e.Error())
 			klog.V(1).Infof("%#v\n", e)
 		}
-		return 400, err.Error() // Bad Request
+		return &ApplyError{Stage: StageValidate, Err: err}
 	}
 
-	keepalivedChanged, nftablesChanged := false, false
+	t := &configTransaction{force: force}
+	defer t.cleanup()
 
-	if h.KeepalivedConfig != nil {
-		keepalivedChanged, err = h.KeepalivedConfig.WriteWithRollback(lbcfg)
+	for _, m := range h.configManagers() {
+		p, err := m.manager.render(m.name, lbcfg)
 		if err != nil {
-			msg := fmt.Sprintf("Failed to apply keepalived config: %s", err.Error())
-			klog.Error(msg)
-			return 500, msg
+			applyErr := &ApplyError{Stage: StageRender, Service: m.name, Err: err}
+			m.manager.recordApply(false, applyErr)
+			h.recordTransaction(t, applyErr)
+			klog.Error(applyErr.Error())
+			return applyErr
 		}
+		t.pending = append(t.pending, p)
 	}
 
-	if h.NftablesConfig != nil {
-		nftablesChanged, err = h.NftablesConfig.WriteWithRollback(lbcfg)
-		if err != nil {
-			msg := fmt.Sprintf("Failed to apply nftables config: %s", err.Error())
-			klog.Error(msg)
-			return 500, msg
+	applyErr := t.run()
+	h.recordTransaction(t, applyErr)
+	if applyErr != nil {
+		klog.Error(applyErr.Error())
+		return applyErr
+	}
+
+	for _, p := range t.pending {
+		p.manager.applied = lbcfg
+	}
+	for _, p := range t.pending {
+		if p.changed {
+			klog.Infof("Applied configuration update: %#v", lbcfg)
+			break
+		}
+	}
+	return nil
+}
+
+// Record the result of the transaction for the status of the services
+func (h *ApplyHandlerv1) recordTransaction(t *configTransaction, applyErr *ApplyError) {
+	for _, p := range t.pending {
+		if applyErr == nil {
+			p.manager.recordApply(p.changed, nil)
+		} else {
+			p.manager.recordApply(false, applyErr)
 		}
 	}
+}
 
-	if keepalivedChanged || nftablesChanged {
-		klog.Infof("Applied configuration update: %#v", lbcfg)
+func (h *ApplyHandlerv1) recordApplied(generation uint64, lbcfg *model.LoadBalancer, restored bool) {
+	hash, err := lbcfg.Hash()
+	if err != nil {
+		klog.Warningf("Failed to hash applied config: %s", err.Error())
 	}
 
-	return 200, "success"
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.appliedGeneration = generation
+	h.appliedHash = hash
+	h.appliedAt = time.Now()
+	h.restored = restored
 }
 
 func (h *ApplyHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -334,15 +354,13 @@ func (h *ApplyHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	claims := &model.ConfigClaim{}
-	token, err := jwt.ParseWithClaims(body_buffer.String(), claims, func(*jwt.Token) (interface{}, error) {
-		return h.SharedSecret, nil
-	})
-	if err != nil {
+	token, err := h.Verifier.Parse(body_buffer.String(), claims)
+	if err != nil && signing.IsMalformed(err) {
 		klog.V(5).Infof("Failed to parse token: %s", err.Error())
 		w.WriteHeader(400) // Bad Request
 		return
 	}
-	if !token.Valid {
+	if err != nil || !token.Valid {
 		klog.V(5).Infof("Failed to validate token")
 		w.WriteHeader(401) // Unauthorized
 		return
@@ -360,7 +378,45 @@ func (h *ApplyHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Add("Content-Type", "text/plain")
 
-	status, body := h.ProcessRequest(&claims.Config)
+	if claims.Id == "" {
+		klog.Warning("Rejecting config without token ID")
+		w.WriteHeader(400) // Bad Request
+		return
+	}
+
+	h.applyLock.Lock()
+	defer h.applyLock.Unlock()
+
+	err = h.Generations.Accept(claims.Generation)
+	if err == ErrStaleGeneration {
+		last := h.Generations.Last()
+		klog.Warningf("Rejecting config %s with generation %d, last accepted generation is %d", claims.Id, claims.Generation, last)
+		w.Header().Set(model.GenerationHeader, strconv.FormatUint(last, 10))
+		w.WriteHeader(409) // Conflict
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		klog.Errorf("Failed to accept config %s: %s", claims.Id, err.Error())
+		w.WriteHeader(500) // Internal Server Error
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	klog.V(1).Infof("received config: %#v", &claims.Config)
+	err = h.apply(&claims.Config, false)
+	if applyErr, ok := err.(*ApplyError); ok {
+		w.Header().Set(model.ApplyStageHeader, applyErr.Stage)
+	}
+	status, body := applyResponse(err)
+	if status == 200 {
+		h.recordApplied(claims.Generation, &claims.Config, false)
+		if h.State != nil {
+			if err := h.State.Save(claims.Generation, &claims.Config); err != nil {
+				klog.Warningf("Failed to persist applied config: %s", err.Error())
+			}
+		}
+	}
 	w.WriteHeader(status)
 	w.Write([]byte(body))
 	metricLastUpdateTimestamp.With(prometheus.Labels{"status": strconv.FormatInt(int64(status), 10)}).Set(float64(time.Now().UnixNano()) / 1000000000)
@@ -0,0 +1,93 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// AppliedState is the config applied last together with its generation.
+type AppliedState struct {
+	Generation uint64             `json:"generation"`
+	Config     model.LoadBalancer `json:"load-balancer-config"`
+}
+
+// StateStore persists the config applied last, so that the agent can restore
+// it on start before the controller pushes a config again.
+type StateStore struct {
+	path string
+}
+
+func NewStateStore(path string) *StateStore {
+	return &StateStore{path: path}
+}
+
+// Save replaces the persisted state atomically.
+func (s *StateStore) Save(generation uint64, cfg *model.LoadBalancer) error {
+	data, err := json.Marshal(&AppliedState{Generation: generation, Config: *cfg})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Load returns the persisted state or nil if there is none.
+func (s *StateStore) Load() (*AppliedState, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	state := &AppliedState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid state in %s: %s", s.path, err)
+	}
+	return state, nil
+}
+
+// Restore applies the persisted config to all services, reloading them even
+// if their config files are unchanged. It returns false if there is no
+// persisted config.
+func (h *ApplyHandlerv1) Restore() (bool, error) {
+	if h.State == nil {
+		return false, nil
+	}
+
+	state, err := h.State.Load()
+	if err != nil || state == nil {
+		return false, err
+	}
+
+	h.applyLock.Lock()
+	defer h.applyLock.Unlock()
+
+	klog.Infof("Restoring config with generation %d", state.Generation)
+	err = h.apply(&state.Config, true)
+	if err != nil {
+		return false, fmt.Errorf("failed to restore config with generation %d: %s", state.Generation, err)
+	}
+
+	h.recordApplied(state.Generation, &state.Config, true)
+	return true, nil
+}
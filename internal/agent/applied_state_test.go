@@ -0,0 +1,164 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+func TestStateStoreSaveAndLoad(t *testing.T) {
+	s := NewStateStore(filepath.Join(t.TempDir(), "last-applied.json"))
+
+	state, err := s.Load()
+	assert.Nil(t, err)
+	assert.Nil(t, state)
+
+	cfg := &model.LoadBalancer{Ingress: []model.IngressIP{{Address: "172.23.42.1"}}}
+	require.Nil(t, s.Save(3, cfg))
+
+	state, err = s.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, &AppliedState{Generation: 3, Config: *cfg}, state)
+}
+
+func TestStateStoreRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last-applied.json")
+	require.Nil(t, os.WriteFile(path, []byte("{"), 0600))
+
+	_, err := NewStateStore(path).Load()
+	assert.NotNil(t, err)
+}
+
+func countReloads(t *testing.T, m *ConfigManager) func() int {
+	counter := filepath.Join(t.TempDir(), "reloads")
+	m.Service.ReloadCommand = []string{"sh", "-c", "echo >> " + counter}
+	return func() int {
+		data, err := os.ReadFile(counter)
+		if os.IsNotExist(err) {
+			return 0
+		}
+		require.Nil(t, err)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+func TestRestoreAppliesPersistedConfig(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "last-applied.json")
+	nftables := newTestConfigManager(t)
+	reloads := countReloads(t, nftables)
+
+	h := newTestApplyHandler(t)
+	h.State = NewStateStore(stateFile)
+	h.NftablesConfig = nftables
+
+	restored, err := h.Restore()
+	assert.Nil(t, err)
+	assert.False(t, restored)
+
+	assert.Equal(t, 200, apply(h, newTestToken(t, 4, "first")).Code)
+	assert.Equal(t, 1, reloads())
+
+	// the restarted agent reloads the unchanged config
+	h = newTestApplyHandler(t)
+	h.State = NewStateStore(stateFile)
+	h.NftablesConfig = nftables
+	status := &StatusHandlerv1{Apply: h, Verifier: h.Verifier}
+
+	restored, err = h.Restore()
+	assert.Nil(t, err)
+	assert.True(t, restored)
+	assert.Equal(t, 2, reloads())
+
+	_, agentStatus := getStatus(t, status, model.StatusSubject)
+	assert.True(t, agentStatus.Restored)
+	assert.Equal(t, uint64(4), agentStatus.Generation)
+
+	assert.Equal(t, 200, apply(h, newTestToken(t, 5, "second")).Code)
+	_, agentStatus = getStatus(t, status, model.StatusSubject)
+	assert.False(t, agentStatus.Restored)
+	assert.Equal(t, uint64(5), agentStatus.Generation)
+}
+
+func TestRestoreReportsFailure(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "last-applied.json")
+	require.Nil(t, NewStateStore(stateFile).Save(2, &model.LoadBalancer{}))
+
+	h := newTestApplyHandler(t)
+	h.State = NewStateStore(stateFile)
+	h.NftablesConfig = newTestConfigManager(t)
+	h.NftablesConfig.Service.ReloadCommand = []string{"false"}
+
+	restored, err := h.Restore()
+	assert.False(t, restored)
+	assert.ErrorContains(t, err, "generation 2")
+}
+
+func TestConcurrentAppliesPersistTheNewestConfig(t *testing.T) {
+	h := newTestApplyHandler(t)
+	h.State = NewStateStore(filepath.Join(t.TempDir(), "last-applied.json"))
+	h.NftablesConfig = newTestConfigManager(t)
+	// older configs take longer to reload, so that they would finish last if
+	// applies overlapped
+	h.NftablesConfig.Service.ReloadCommand = []string{
+		"sh", "-c", "sleep 0.0$(( 9 - $(cat " + h.NftablesConfig.Service.ConfigFile + ") / 2 ))",
+	}
+
+	// the number of ingress IPs identifies the config of a generation
+	configOf := func(generation uint64) model.LoadBalancer {
+		cfg := model.LoadBalancer{Ingress: []model.IngressIP{}}
+		for i := uint64(0); i < generation; i++ {
+			cfg.Ingress = append(cfg.Ingress, model.IngressIP{Address: fmt.Sprintf("172.23.42.%d", i+1)})
+		}
+		return cfg
+	}
+
+	tokens := []string{}
+	for generation := uint64(1); generation <= 16; generation++ {
+		tokens = append(tokens, newTestConfigToken(t, generation, fmt.Sprintf("config-%d", generation), configOf(generation)))
+	}
+
+	// push the configs in order while the older ones are still applied
+	var wg sync.WaitGroup
+	for _, token := range tokens {
+		wg.Add(1)
+		go func(token string) {
+			defer wg.Done()
+			code := apply(h, token).Code
+			assert.True(t, code == 200 || code == 409, "unexpected status %d", code)
+		}(token)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	last := h.Generations.Last()
+	state, err := h.State.Load()
+	require.Nil(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, last, state.Generation)
+	assert.Equal(t, configOf(last), state.Config)
+	assert.Equal(t, fmt.Sprintf("%d\n", last), readConfig(t, h.NftablesConfig))
+	assert.Equal(t, last, (&StatusHandlerv1{Apply: h}).Status().Generation)
+}
@@ -0,0 +1,106 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrStaleGeneration = errors.New("config generation is not newer than the last accepted one")
+)
+
+// writeFileAtomic replaces the file with the data, so that readers see either
+// the old or the new content even if the agent crashes while writing.
+func writeFileAtomic(path string, data []byte) error {
+	fout, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fout.Name())
+
+	_, err = fout.Write(data)
+	if err == nil {
+		err = fout.Sync()
+	}
+	if closeErr := fout.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fout.Name(), path)
+}
+
+// GenerationStore keeps track of the generation of the last accepted config
+// and persists it, so that replayed configs are also rejected after a
+// restart of the agent.
+type GenerationStore struct {
+	mutex sync.Mutex
+	path  string
+	last  uint64
+}
+
+// NewGenerationStore loads the last accepted generation from the file. A
+// missing file means that no config has been accepted yet.
+func NewGenerationStore(path string) (*GenerationStore, error) {
+	s := &GenerationStore{path: path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+
+	s.last, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generation in %s: %s", path, err)
+	}
+	return s, nil
+}
+
+// Last returns the last accepted generation.
+func (s *GenerationStore) Last() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last
+}
+
+// Accept records the generation if it is newer than the last accepted one and
+// returns ErrStaleGeneration otherwise.
+func (s *GenerationStore) Accept(generation uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if generation <= s.last {
+		return ErrStaleGeneration
+	}
+
+	err := writeFileAtomic(s.path, []byte(strconv.FormatUint(generation, 10)+"\n"))
+	if err != nil {
+		return fmt.Errorf("failed to persist generation: %s", err)
+	}
+	s.last = generation
+	return nil
+}
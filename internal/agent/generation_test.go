@@ -0,0 +1,123 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
+)
+
+func TestGenerationStoreRejectsStaleGenerations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "generation")
+
+	s, err := NewGenerationStore(path)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), s.Last())
+
+	assert.Equal(t, ErrStaleGeneration, s.Accept(0))
+	assert.Nil(t, s.Accept(5))
+	assert.Equal(t, ErrStaleGeneration, s.Accept(5))
+	assert.Equal(t, ErrStaleGeneration, s.Accept(4))
+	assert.Nil(t, s.Accept(7))
+	assert.Equal(t, uint64(7), s.Last())
+
+	// a restarted agent still rejects old generations
+	s, err = NewGenerationStore(path)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(7), s.Last())
+	assert.Equal(t, ErrStaleGeneration, s.Accept(6))
+}
+
+func TestGenerationStoreRejectsInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "generation")
+	require.Nil(t, os.WriteFile(path, []byte("garbage"), 0600))
+
+	_, err := NewGenerationStore(path)
+	assert.NotNil(t, err)
+}
+
+func newTestApplyHandler(t *testing.T) *ApplyHandlerv1 {
+	generations, err := NewGenerationStore(filepath.Join(t.TempDir(), "generation"))
+	require.Nil(t, err)
+
+	return &ApplyHandlerv1{
+		MaxRequestSize: 1048576,
+		Verifier:       signing.NewHMACVerifier([]byte("0123456789ab")),
+		Generations:    generations,
+	}
+}
+
+func newTestToken(t *testing.T, generation uint64, id string) string {
+	return newTestConfigToken(t, generation, id, model.LoadBalancer{})
+}
+
+func newTestConfigToken(t *testing.T, generation uint64, id string, cfg model.LoadBalancer) string {
+	token, err := signing.NewHMACSigner([]byte("0123456789ab")).Sign(&model.ConfigClaim{
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+			Id:        id,
+		},
+		Generation: generation,
+		Config:     cfg,
+	})
+	require.Nil(t, err)
+	return token
+}
+
+func apply(h http.Handler, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/v1/apply", strings.NewReader(token))
+	r.Header.Set("Content-Type", "application/jwt")
+	r.Header.Set("Content-Length", strconv.Itoa(len(token)))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestApplyRejectsReplayedConfigs(t *testing.T) {
+	h := newTestApplyHandler(t)
+
+	token := newTestToken(t, 3, "first")
+	assert.Equal(t, 200, apply(h, token).Code)
+
+	w := apply(h, token)
+	assert.Equal(t, 409, w.Code)
+	assert.Equal(t, "3", w.Header().Get(model.GenerationHeader))
+
+	w = apply(h, newTestToken(t, 2, "older"))
+	assert.Equal(t, 409, w.Code)
+
+	assert.Equal(t, 200, apply(h, newTestToken(t, 4, "newer")).Code)
+	assert.Equal(t, uint64(4), h.Generations.Last())
+}
+
+func TestApplyRequiresTokenID(t *testing.T) {
+	h := newTestApplyHandler(t)
+
+	assert.Equal(t, 400, apply(h, newTestToken(t, 1, "")).Code)
+	assert.Equal(t, uint64(0), h.Generations.Last())
+}
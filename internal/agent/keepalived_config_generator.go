@@ -40,16 +40,22 @@ vrrp_instance LBaaS_{{ .Name }} {
         auth_pass {{ .Password }}
     }
     virtual_ipaddress {
-{{ range .Addresses }}        {{ .Address }}/32 dev {{ .Device }}
+{{ range .Addresses }}        {{ .Address }}/{{ .PrefixLength }} dev {{ .Device }}
 {{ end }}    }
+{{- if .ExcludedAddresses }}
+    virtual_ipaddress_excluded {
+{{ range .ExcludedAddresses }}        {{ .Address }}/{{ .PrefixLength }} dev {{ .Device }}
+{{ end }}    }
+{{- end }}
 }
 {{ end }}
 `))
 )
 
 type keepalivedVRRPAddress struct {
-	Address string
-	Device  string
+	Address      string
+	PrefixLength int
+	Device       string
 }
 
 type keepalivedVRRPInstance struct {
@@ -59,6 +65,10 @@ type keepalivedVRRPInstance struct {
 	VRID      int
 	Password  string
 	Addresses []keepalivedVRRPAddress
+	// The VRRP instance advertises via IPv4, which is why IPv6 addresses
+	// cannot be part of the VRRP packets. keepalived still moves excluded
+	// addresses together with the instance state.
+	ExcludedAddresses []keepalivedVRRPAddress
 }
 
 type keepalivedConfig struct {
@@ -94,21 +104,35 @@ func (g *KeepalivedConfigGenerator) GenerateStructuredConfig(lb *model.LoadBalan
 
 	instance := &result.Instances[0]
 	for _, ingress := range lb.Ingress {
+		if addressFamily(ingress.Address) == "ip6" {
+			instance.ExcludedAddresses = append(instance.ExcludedAddresses, keepalivedVRRPAddress{
+				Address:      ingress.Address,
+				PrefixLength: 128,
+				Device:       g.Interface,
+			})
+			continue
+		}
 		instance.Addresses = append(instance.Addresses, keepalivedVRRPAddress{
-			Address: ingress.Address,
-			Device:  g.Interface,
+			Address:      ingress.Address,
+			PrefixLength: 32,
+			Device:       g.Interface,
 		})
 	}
 
-	sort.SliceStable(instance.Addresses, func(i, j int) bool {
+	sortKeepalivedAddresses(instance.Addresses)
+	sortKeepalivedAddresses(instance.ExcludedAddresses)
+
+	return result, nil
+}
+
+func sortKeepalivedAddresses(addresses []keepalivedVRRPAddress) {
+	sort.SliceStable(addresses, func(i, j int) bool {
 		// TODO: if we ever switch to a multi interface setup, we’ll have to
 		// take the interface into account, too.
-		aA := instance.Addresses[i]
-		aB := instance.Addresses[j]
+		aA := addresses[i]
+		aB := addresses[j]
 		return aA.Address < aB.Address
 	})
-
-	return result, nil
 }
 
 func (g *KeepalivedConfigGenerator) WriteStructuredConfig(cfg *keepalivedConfig, out io.Writer) error {
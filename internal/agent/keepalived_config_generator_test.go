@@ -75,9 +75,9 @@ func TestKeepalivedGenerateStructuredConfigFromNonEmptyLBModel(t *testing.T) {
 	assert.Equal(t, g.VRRPPassword, i.Password)
 	assert.Equal(t, "VIPs", i.Name)
 	assert.Equal(t, []keepalivedVRRPAddress{
-		{Address: "127.0.0.1", Device: g.Interface},
-		{Address: "127.0.0.2", Device: g.Interface},
-		{Address: "127.0.0.3", Device: g.Interface},
+		{Address: "127.0.0.1", PrefixLength: 32, Device: g.Interface},
+		{Address: "127.0.0.2", PrefixLength: 32, Device: g.Interface},
+		{Address: "127.0.0.3", PrefixLength: 32, Device: g.Interface},
 	}, i.Addresses)
 }
 
@@ -111,9 +111,9 @@ func TestKeepalivedGenerateStructuredConfigSortsByAddress(t *testing.T) {
 	assert.Equal(t, g.VRRPPassword, i.Password)
 	assert.Equal(t, "VIPs", i.Name)
 	assert.Equal(t, []keepalivedVRRPAddress{
-		{Address: "127.0.0.1", Device: g.Interface},
-		{Address: "127.0.0.2", Device: g.Interface},
-		{Address: "127.0.0.3", Device: g.Interface},
+		{Address: "127.0.0.1", PrefixLength: 32, Device: g.Interface},
+		{Address: "127.0.0.2", PrefixLength: 32, Device: g.Interface},
+		{Address: "127.0.0.3", PrefixLength: 32, Device: g.Interface},
 	}, i.Addresses)
 }
 
@@ -139,3 +139,42 @@ func TestKeepalivedGenerateConfigFromNonEmptyLBModel(t *testing.T) {
 	err := g.GenerateConfig(m, out)
 	assert.Nil(t, err)
 }
+
+func TestKeepalivedGenerateStructuredConfigExcludesIPv6Addresses(t *testing.T) {
+	g := newKeepalivedGenerator()
+
+	m := &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "2001:db8::2",
+			},
+			{
+				Address: "127.0.0.1",
+			},
+			{
+				Address: "2001:db8::1",
+			},
+		},
+	}
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.NotNil(t, scfg)
+	assert.Equal(t, 1, len(scfg.Instances))
+
+	i := scfg.Instances[0]
+
+	assert.Equal(t, []keepalivedVRRPAddress{
+		{Address: "127.0.0.1", PrefixLength: 32, Device: g.Interface},
+	}, i.Addresses)
+	assert.Equal(t, []keepalivedVRRPAddress{
+		{Address: "2001:db8::1", PrefixLength: 128, Device: g.Interface},
+		{Address: "2001:db8::2", PrefixLength: 128, Device: g.Interface},
+	}, i.ExcludedAddresses)
+
+	out := bytes.NewBuffer([]byte{})
+	err = g.WriteStructuredConfig(scfg, out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "127.0.0.1/32 dev ethfoo")
+	assert.Contains(t, out.String(), "virtual_ipaddress_excluded {\n        2001:db8::1/128 dev ethfoo\n")
+}
@@ -19,6 +19,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/netip"
 	"os"
 	"os/exec"
 	"sort"
@@ -47,16 +48,39 @@ var funcMap = template.FuncMap{
 	"replaceColons": func (ipString string) string {
 		return strings.ReplaceAll(ipString, ":", "-")
 	},
+	// nftables family keyword ("ip" or "ip6") of an address or CIDR
+	"addressFamily": addressFamily,
 }
 
 var (
 	nftablesTemplate = template.Must(template.New("nftables.conf").Funcs(funcMap).Parse(`
 {{ $cfg := . }}
 
+{{- if $cfg.DedicatedTables }}
+# The tables are owned by lbaas and replaced as a whole. Declaring them before
+# deleting them prevents an error when they do not exist yet.
+{{- if ne .FilterTableName "" }}
+table {{ .FilterTableType }} {{ .FilterTableName }} {}
+delete table {{ .FilterTableType }} {{ .FilterTableName }}
+{{- end }}
+{{- range $table := $cfg.NATTables }}
+table {{ $table.Family }} {{ $cfg.NATTableName }} {}
+delete table {{ $table.Family }} {{ $cfg.NATTableName }}
+{{- end }}
+{{- end }}
+
 {{- if $cfg.PartialReload }}
 # When partial reload is enabled, flush chains.
-flush chain ip {{ .NATTableName }} {{ .NATPreroutingChainName }}
-flush chain ip {{ .NATTableName }} {{ .NATPostroutingChainName }}
+{{- range $table := $cfg.NATTables }}
+{{- if ne $table.Family $cfg.NATTableType }}
+# The {{ $table.Family }} table is not necessarily part of the base ruleset, create it before flushing.
+add table {{ $table.Family }} {{ $cfg.NATTableName }}
+add chain {{ $table.Family }} {{ $cfg.NATTableName }} {{ $cfg.NATPreroutingChainName }} { type nat hook prerouting priority {{ $cfg.NATPreroutingPriority }}; policy accept; }
+add chain {{ $table.Family }} {{ $cfg.NATTableName }} {{ $cfg.NATPostroutingChainName }} { type nat hook postrouting priority {{ $cfg.NATPostroutingPriority }}; policy accept; }
+{{- end }}
+flush chain {{ $table.Family }} {{ $cfg.NATTableName }} {{ $cfg.NATPreroutingChainName }}
+flush chain {{ $table.Family }} {{ $cfg.NATTableName }} {{ $cfg.NATPostroutingChainName }}
+{{- end }}
 
 {{- if ne .FilterTableName "" }}
 flush chain {{ .FilterTableType }} {{ .FilterTableName }} {{ .FilterForwardChainName }}
@@ -75,6 +99,9 @@ delete chain {{ $cfg.FilterTableType }} {{ $cfg.FilterTableName }} {{ $chain }}
 {{- if ne .FilterTableName "" }}
 table {{ .FilterTableType }} {{ .FilterTableName }} {
 	chain {{ .FilterForwardChainName }} {
+		{{- if $cfg.DedicatedTables }}
+		type filter hook forward priority {{ $cfg.FilterForwardPriority }}; policy accept;
+		{{- end }}
 		{{- range $dest := $cfg.PolicyAssignments }}
 		ct mark {{ $cfg.FWMarkBits | printf "0x%x" }} and {{ $cfg.FWMarkMask | printf "0x%x" }} {{if isIPv4Address $dest.Address }}ip{{else if isIPv6Address $dest.Address}}ip6{{end}} daddr {{ $dest.Address }} goto {{ $cfg.PolicyPrefix }}POD-{{replaceColons $dest.Address}};
 		{{- end }}
@@ -111,7 +138,7 @@ table {{ .FilterTableType }} {{ .FilterTableName }} {
 		{{- if ne ($entry.SaddrMatch.Except | len) 0 }}
 	chain {{ $cfg.PolicyPrefix }}{{ $policy.Name }}-RULE{{ $ruleIndex }}-CIDR{{ $entryIndex }} {
 		{{- range $addr := $entry.SaddrMatch.Except }}
-		ip saddr {{ $addr }} return;
+		{{ addressFamily $addr }} saddr {{ $addr }} return;
 		{{- end}}
 		accept;
 	}
@@ -124,11 +151,16 @@ table {{ .FilterTableType }} {{ .FilterTableName }} {
 }
 {{- end }}
 
-table ip {{ .NATTableName }} {
-	chain {{ .NATPreroutingChainName }} {
-{{- range $fwd := .Forwards }}
+{{- range $table := $cfg.NATTables }}
+
+table {{ $table.Family }} {{ $cfg.NATTableName }} {
+	chain {{ $cfg.NATPreroutingChainName }} {
+{{- if $table.BaseChains }}
+		type nat hook prerouting priority {{ $cfg.NATPreroutingPriority }}; policy accept;
+{{- end }}
+{{- range $fwd := $table.Forwards }}
 {{- if ne ($fwd.DestinationAddresses | len) 0 }}
-		ip daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ $cfg.FWMarkBits | printf "0x%x" }} and {{ $cfg.FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat to numgen inc mod {{ $fwd.DestinationAddresses | len }} map {
+		{{ $fwd.Family }} daddr {{ $fwd.InboundIP }} {{ $fwd.Protocol }} dport {{ $fwd.InboundPort }} mark set {{ $cfg.FWMarkBits | printf "0x%x" }} and {{ $cfg.FWMarkMask | printf "0x%x" }} ct mark set meta mark dnat {{ if eq $table.Family "inet" }}{{ $fwd.Family }} {{ end }}to numgen inc mod {{ $fwd.DestinationAddresses | len }} map {
 {{- range $index, $daddr := $fwd.DestinationAddresses }}{{ $index }} : {{ $daddr }}, {{ end -}}
 		} : {{ $fwd.DestinationPort }};
 {{- end }}
@@ -136,11 +168,15 @@ table ip {{ .NATTableName }} {
 	}
 
 {{- if $cfg.EnableSNAT }}
-	chain {{ .NATPostroutingChainName }} {
+	chain {{ $cfg.NATPostroutingChainName }} {
+{{- if $table.BaseChains }}
+		type nat hook postrouting priority {{ $cfg.NATPostroutingPriority }}; policy accept;
+{{- end }}
 		mark {{ $cfg.FWMarkBits | printf "0x%x" }} and {{ $cfg.FWMarkMask | printf "0x%x" }} masquerade;
 	}
 {{- end }}
 }
+{{- end }}
 `))
 
 	ErrProtocolNotSupported = fmt.Errorf("Protocol is not supported")
@@ -151,6 +187,9 @@ type SAddrMatch struct {
 	// May be "" so the rule doesn't match on source addresses (allow all)
 	Match string
 
+	// The cidr matched by Match, "" if Match is ""
+	Allow string
+
 	// List of cidrs to block. If empty, set verdict to 'accept'.
 	// If nonempty, set verdict to 'jump $c' and generate a new
 	// chain $c that drops all address ranges and defaults to 'accept'
@@ -164,6 +203,11 @@ type ingressRuleChainEntry struct {
 	// String like eg. "tcp dport {80,443,8080-8090}" ready to be used in an nftables rule.
 	// May be "" so the rule doesn't match on destination ports (allow all)
 	PortMatch string
+
+	// The protocol and ports matched by PortMatch, "" and nil if PortMatch
+	// is ""
+	Protocol string
+	Ports    []string
 }
 
 type ingressRuleChain struct {
@@ -181,6 +225,7 @@ type policyAssignment struct {
 }
 
 type nftablesForward struct {
+	Family               string
 	Protocol             string
 	InboundIP            string
 	InboundPort          int32
@@ -188,26 +233,46 @@ type nftablesForward struct {
 	DestinationPort      int32
 }
 
+// A NAT table of a single nftables family. With the "ip" NAT table type, IPv6
+// forwards are placed in a separate "ip6" table of the same name.
+type nftablesNATTable struct {
+	Family   string
+	Forwards []nftablesForward
+	// Whether the chains are declared as base chains by lbaas. Otherwise,
+	// the base ruleset has to hook them.
+	BaseChains bool
+}
+
 type nftablesConfig struct {
 	FilterTableType         string
 	FilterTableName         string
 	FilterForwardChainName  string
 	NATTableName            string
+	NATTableType            string
 	NATPostroutingChainName string
 	NATPreroutingChainName  string
 	PolicyPrefix            string
 	FWMarkBits              uint32
 	FWMarkMask              uint32
 	Forwards                []nftablesForward
+	NATTables               []nftablesNATTable
 	NetworkPolicies         map[string]networkPolicy
 	PolicyAssignments       []policyAssignment
 	ExistingPolicyChains    []string
 	EnableSNAT              bool
 	PartialReload           bool
+	DedicatedTables         bool
+	FilterForwardPriority   int
+	NATPreroutingPriority   int
+	NATPostroutingPriority  int
 }
 
 type NftablesGenerator struct {
 	Cfg config.Nftables
+
+	// lists the chains of a table family; if nil, they are listed via
+	// Cfg.NftCommand
+	listChains func(tableType string) (nftablesChainListResult, error)
 }
 
 type nftablesChainListResultChain struct {
@@ -235,27 +300,70 @@ func makeNftablesList(items []string) (string, error) {
 
 //TODO: func to validate if a string is an ip address or cidr
 
-// Generates a list of strings like "tcp dport match {80,443,8080-8090}"" ready to
-// be used in nftables rules.
-// returns []string{""} if 'in' is empty, so the rule doesn't match on
-// destination ports (allow all)
-func makePortMatches(in []model.PortFilter) (portMatches []string, err error) {
+// Returns the nftables family keyword ("ip" or "ip6") matching the given
+// address or CIDR.
+func addressFamily(address string) string {
+	if prefix, err := netip.ParsePrefix(address); err == nil {
+		address = prefix.Addr().String()
+	}
+	if addr, err := netip.ParseAddr(address); err == nil {
+		if addr.Is4() {
+			return "ip"
+		}
+		return "ip6"
+	}
+	// not parseable, fall back to the same heuristic as isIPv6Address
+	if strings.Count(address, ":") >= 2 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// Keeps only the addresses which belong to the given nftables family; nftables
+// cannot translate between address families.
+func filterAddressesByFamily(addresses []string, family string) []string {
+	result := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		if addressFamily(addr) == family {
+			result = append(result, addr)
+		}
+	}
+	return result
+}
+
+// The destination ports of a protocol matched by a rule
+type portMatch struct {
+	// String like eg. "tcp dport match {80,443,8080-8090}" ready to be used
+	// in nftables rules
+	Match    string
+	Protocol string
+	Ports    []string
+}
+
+// Generates a list of port matches like "tcp dport match {80,443,8080-8090}"
+// to be used in nftables rules.
+// returns a singleton with an empty portMatch if 'in' is empty, so the rule
+// doesn't match on destination ports (allow all)
+func makePortMatches(in []model.PortFilter) (portMatches []portMatch, err error) {
 	portMap, err := makePortMap(in)
 	if err != nil {
 		return nil, err
 	}
-	portMatches = make([]string, 0, len(portMap)+1)
+	portMatches = make([]portMatch, 0, len(portMap)+1)
 	for proto, ports := range portMap {
 		nftablesList, err := makeNftablesList(ports)
 		if err != nil {
 			return nil, err
 		}
-		newMatch := proto + " dport " + nftablesList
-		portMatches = append(portMatches, newMatch)
+		portMatches = append(portMatches, portMatch{
+			Match:    proto + " dport " + nftablesList,
+			Protocol: proto,
+			Ports:    ports,
+		})
 	}
 	// if there are no port matches, all ports are allowed
 	if len(portMatches) == 0 {
-		portMatches = append(portMatches, "")
+		portMatches = append(portMatches, portMatch{})
 	}
 	return portMatches, nil
 }
@@ -277,7 +385,8 @@ func makeSAddrMatches(in []model.IPBlockFilter) (SAddrMatches []SAddrMatch) {
 	for _, block := range in {
 		SAddrMatches = append(
 			SAddrMatches, SAddrMatch{
-				Match:  "ip saddr " + block.Allow,
+				Match:  addressFamily(block.Allow) + " saddr " + block.Allow,
+				Allow:  block.Allow,
 				Except: copyAddresses(block.Block),
 			},
 		)
@@ -293,10 +402,12 @@ func makeIngressRuleChain(rule model.AllowedIngress) (chain ingressRuleChain, er
 	sAddrMatches := makeSAddrMatches(rule.IPBlockFilters)
 	chain.Entries = make([]ingressRuleChainEntry, 0, len(sAddrMatches)*len(portMatches))
 	for _, sAddrMatch := range sAddrMatches {
-		for _, portMatch := range portMatches {
+		for _, match := range portMatches {
 			newEntry := ingressRuleChainEntry{
 				SaddrMatch: sAddrMatch,
-				PortMatch:  portMatch,
+				PortMatch:  match.Match,
+				Protocol:   match.Protocol,
+				Ports:      match.Ports,
 			}
 			chain.Entries = append(chain.Entries, newEntry)
 		}
@@ -455,6 +566,52 @@ func getExistingPolicyChains(nftCommand []string, filterTableName string, filter
 	return existingChains, nil
 }
 
+// existingPolicyChains returns the names of the policy chains in the filter
+// table.
+func (g *NftablesGenerator) existingPolicyChains() ([]string, error) {
+	if g.listChains == nil {
+		return getExistingPolicyChains(
+			g.Cfg.NftCommand,
+			g.Cfg.FilterTableName,
+			g.Cfg.FilterTableType,
+			g.Cfg.PolicyPrefix)
+	}
+
+	chains, err := g.listChains(g.Cfg.FilterTableType)
+	if err != nil {
+		return nil, err
+	}
+	return filterNftablesChainListByPrefix(chains, g.Cfg.FilterTableName, g.Cfg.FilterTableType, g.Cfg.PolicyPrefix)
+}
+
+// Distributes the forwards over the NAT tables to render. An "inet" NAT table
+// holds all forwards. Otherwise, IPv4 forwards go into the "ip" table and IPv6
+// forwards into an "ip6" table of the same name. The latter is only rendered if
+// it is needed or if partial reload or dedicated tables may have to remove
+// stale rules from it. As the base ruleset only knows about the table of the
+// configured type, the chains of the "ip6" table are always declared as base
+// chains.
+func (g *NftablesGenerator) groupNATTables(forwards []nftablesForward) []nftablesNATTable {
+	if g.Cfg.NATTableType == "inet" {
+		return []nftablesNATTable{{Family: "inet", Forwards: forwards, BaseChains: g.Cfg.DedicatedTables}}
+	}
+
+	ipv4 := nftablesNATTable{Family: "ip", Forwards: []nftablesForward{}, BaseChains: g.Cfg.DedicatedTables}
+	ipv6 := nftablesNATTable{Family: "ip6", Forwards: []nftablesForward{}, BaseChains: true}
+	for _, fwd := range forwards {
+		if fwd.Family == "ip6" {
+			ipv6.Forwards = append(ipv6.Forwards, fwd)
+		} else {
+			ipv4.Forwards = append(ipv4.Forwards, fwd)
+		}
+	}
+
+	if len(ipv6.Forwards) == 0 && !g.Cfg.PartialReload && !g.Cfg.DedicatedTables {
+		return []nftablesNATTable{ipv4}
+	}
+	return []nftablesNATTable{ipv4, ipv6}
+}
+
 // Generates a config suitable for nftablesTemplate from a LoadBalancer model
 func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nftablesConfig, error) {
 	result := &nftablesConfig{
@@ -462,6 +619,7 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		FilterTableType:         g.Cfg.FilterTableType,
 		FilterForwardChainName:  g.Cfg.FilterForwardChainName,
 		NATTableName:            g.Cfg.NATTableName,
+		NATTableType:            g.Cfg.NATTableType,
 		NATPostroutingChainName: g.Cfg.NATPostroutingChainName,
 		NATPreroutingChainName:  g.Cfg.NATPreroutingChainName,
 		PolicyPrefix:            g.Cfg.PolicyPrefix,
@@ -473,6 +631,10 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		ExistingPolicyChains:    []string{},
 		EnableSNAT:              g.Cfg.EnableSNAT,
 		PartialReload:           g.Cfg.PartialReload,
+		DedicatedTables:         g.Cfg.DedicatedTables,
+		FilterForwardPriority:   g.Cfg.FilterForwardPriority,
+		NATPreroutingPriority:   g.Cfg.NATPreroutingPriority,
+		NATPostroutingPriority:  g.Cfg.NATPostroutingPriority,
 	}
 
 	for _, ingress := range m.Ingress {
@@ -482,10 +644,19 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 				return nil, err
 			}
 
-			addrs := copyAddresses(port.DestinationAddresses)
+			family := addressFamily(ingress.Address)
+			addrs := filterAddressesByFamily(port.DestinationAddresses, family)
+			if len(addrs) != len(port.DestinationAddresses) {
+				klog.Warningf(
+					"ignoring %d destination address(es) for %s port %d which do not match its address family",
+					len(port.DestinationAddresses)-len(addrs),
+					ingress.Address,
+					port.InboundPort)
+			}
 			sort.Strings(addrs)
 
 			result.Forwards = append(result.Forwards, nftablesForward{
+				Family:               family,
 				Protocol:             mappedProtocol,
 				InboundIP:            ingress.Address,
 				InboundPort:          port.InboundPort,
@@ -509,6 +680,8 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		return fwdA.InboundPort < fwdB.InboundPort
 	})
 
+	result.NATTables = g.groupNATTables(result.Forwards)
+
 	if g.Cfg.FilterTableName != "" {
 		result.PolicyAssignments = copyPolicyAssignment(m.PolicyAssignments)
 		policies, err := copyNetworkPolicies(m.NetworkPolicies)
@@ -522,11 +695,10 @@ func (g *NftablesGenerator) GenerateStructuredConfig(m *model.LoadBalancer) (*nf
 		if g.Cfg.PartialReload {
 			// When partial reload is enabled, get all existing policy chain names to delete
 			// them in the template
-			result.ExistingPolicyChains, err = getExistingPolicyChains(
-				g.Cfg.NftCommand,
-				g.Cfg.FilterTableName,
-				g.Cfg.FilterTableType,
-				g.Cfg.PolicyPrefix)
+			result.ExistingPolicyChains, err = g.existingPolicyChains()
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
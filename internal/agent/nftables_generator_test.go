@@ -15,6 +15,7 @@
 package agent
 
 import (
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -400,3 +401,154 @@ func TestNftablesStructuredConfigWithDisabledPolicies(t *testing.T) {
 	assert.NotNil(t, scfg.NetworkPolicies)
 	assert.Equal(t, 0, len(scfg.NetworkPolicies))
 }
+
+func newDualStackLBModel() *model.LoadBalancer {
+	return &model.LoadBalancer{
+		Ingress: []model.IngressIP{
+			{
+				Address: "172.23.42.1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      30080,
+						DestinationAddresses: []string{"192.168.0.1", "fd00::1"},
+					},
+				},
+			},
+			{
+				Address: "2001:db8::1",
+				Ports: []model.PortForward{
+					{
+						InboundPort:          80,
+						Protocol:             corev1.ProtocolTCP,
+						DestinationPort:      30080,
+						DestinationAddresses: []string{"192.168.0.1", "fd00::1"},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestNftablesStructuredConfigSplitsIPv6NATTable(t *testing.T) {
+	g := newNftablesGenerator(true)
+	m := newDualStackLBModel()
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scfg.Forwards))
+
+	assert.Equal(t, 2, len(scfg.NATTables))
+	assert.Equal(t, "ip", scfg.NATTables[0].Family)
+	assert.Equal(t, 1, len(scfg.NATTables[0].Forwards))
+	assert.Equal(t, "172.23.42.1", scfg.NATTables[0].Forwards[0].InboundIP)
+	assert.Equal(t, []string{"192.168.0.1"}, scfg.NATTables[0].Forwards[0].DestinationAddresses)
+
+	assert.Equal(t, "ip6", scfg.NATTables[1].Family)
+	assert.Equal(t, 1, len(scfg.NATTables[1].Forwards))
+	assert.Equal(t, "2001:db8::1", scfg.NATTables[1].Forwards[0].InboundIP)
+	assert.Equal(t, []string{"fd00::1"}, scfg.NATTables[1].Forwards[0].DestinationAddresses)
+
+	out := &strings.Builder{}
+	err = g.WriteStructuredConfig(scfg, out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "table ip nat {")
+	assert.Contains(t, out.String(), "table ip6 nat {")
+	assert.Contains(t, out.String(), "ip6 daddr 2001:db8::1 tcp dport 80")
+	assert.NotContains(t, out.String(), "dnat ip6 to")
+
+	// only the ip6 table is unknown to the base ruleset and needs base chains
+	assert.False(t, scfg.NATTables[0].BaseChains)
+	assert.True(t, scfg.NATTables[1].BaseChains)
+	assert.Equal(t, 1, strings.Count(out.String(), "type nat hook prerouting priority -100; policy accept;"))
+}
+
+func TestNftablesStructuredConfigOmitsUnusedIPv6NATTable(t *testing.T) {
+	g := newNftablesGenerator(true)
+	m := newDualStackLBModel()
+	m.Ingress = m.Ingress[:1]
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(scfg.NATTables))
+	assert.Equal(t, "ip", scfg.NATTables[0].Family)
+
+	// with partial reload, stale IPv6 rules need to be flushed
+	g.Cfg.PartialReload = true
+	scfg, err = g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(scfg.NATTables))
+	assert.Equal(t, 0, len(scfg.NATTables[1].Forwards))
+
+	out := &strings.Builder{}
+	err = g.WriteStructuredConfig(scfg, out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "add table ip6 nat\n")
+	assert.Contains(t, out.String(), "add chain ip6 nat prerouting { type nat hook prerouting priority -100; policy accept; }\n")
+	assert.Contains(t, out.String(), "add chain ip6 nat postrouting { type nat hook postrouting priority 100; policy accept; }\n")
+	assert.Contains(t, out.String(), "flush chain ip6 nat prerouting\n")
+}
+
+func TestNftablesStructuredConfigWithInetNATTable(t *testing.T) {
+	g := newNftablesGenerator(true)
+	g.Cfg.NATTableType = "inet"
+	m := newDualStackLBModel()
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(scfg.NATTables))
+	assert.Equal(t, "inet", scfg.NATTables[0].Family)
+	assert.Equal(t, 2, len(scfg.NATTables[0].Forwards))
+
+	out := &strings.Builder{}
+	err = g.WriteStructuredConfig(scfg, out)
+	assert.Nil(t, err)
+	assert.Contains(t, out.String(), "table inet nat {")
+	assert.Contains(t, out.String(), "ip daddr 172.23.42.1 tcp dport 80 mark set 0x1 and 0x1 ct mark set meta mark dnat ip to")
+	assert.Contains(t, out.String(), "ip6 daddr 2001:db8::1 tcp dport 80 mark set 0x1 and 0x1 ct mark set meta mark dnat ip6 to")
+}
+
+func TestNftablesSAddrMatchesAreFamilyAware(t *testing.T) {
+	matches := makeSAddrMatches([]model.IPBlockFilter{
+		{Allow: "0.0.0.0/0", Block: []string{"192.168.2.0/24"}},
+		{Allow: "2001:db8::/32", Block: []string{"2001:db8:1::/48"}},
+	})
+
+	assert.Equal(t, "ip saddr 0.0.0.0/0", matches[0].Match)
+	assert.Equal(t, "ip6 saddr 2001:db8::/32", matches[1].Match)
+
+	assert.Equal(t, "ip", addressFamily("192.168.2.0/24"))
+	assert.Equal(t, "ip6", addressFamily("2001:db8:1::/48"))
+	assert.Equal(t, "ip", addressFamily("10.0.0.1"))
+	assert.Equal(t, "ip6", addressFamily("fd00::1"))
+}
+
+func TestNftablesDedicatedTablesAreReplacedAsAWhole(t *testing.T) {
+	g := newNftablesGenerator(false)
+	g.Cfg.DedicatedTables = true
+	g.Cfg.FilterTableName = "lbaas-filter"
+	g.Cfg.NATTableName = "lbaas-nat"
+	g.Cfg.FilterForwardPriority = 10
+	m := newDualStackLBModel()
+	m.Ingress = m.Ingress[:1]
+
+	scfg, err := g.GenerateStructuredConfig(m)
+	assert.Nil(t, err)
+	// the stale IPv6 table needs to be replaced as well
+	assert.Equal(t, 2, len(scfg.NATTables))
+
+	out := &strings.Builder{}
+	err = g.WriteStructuredConfig(scfg, out)
+	assert.Nil(t, err)
+	for _, table := range []string{"inet lbaas-filter", "ip lbaas-nat", "ip6 lbaas-nat"} {
+		assert.Contains(t, out.String(), "table "+table+" {}\ndelete table "+table+"\n")
+		assert.Contains(t, out.String(), "table "+table+" {\n")
+	}
+	assert.Contains(t, out.String(), "type filter hook forward priority 10; policy accept;")
+	assert.Contains(t, out.String(), "type nat hook prerouting priority -100; policy accept;")
+	assert.Contains(t, out.String(), "type nat hook postrouting priority 100; policy accept;")
+	assert.NotContains(t, out.String(), "flush chain")
+	assert.NotContains(t, out.String(), " nat {")
+	assert.NotContains(t, out.String(), " filter {")
+}
@@ -0,0 +1,595 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// nftablesConn is the part of *nftables.Conn used to program the ruleset
+type nftablesConn interface {
+	AddTable(t *nftables.Table) *nftables.Table
+	DelTable(t *nftables.Table)
+	AddChain(c *nftables.Chain) *nftables.Chain
+	FlushChain(c *nftables.Chain)
+	DelChain(c *nftables.Chain)
+	AddRule(r *nftables.Rule) *nftables.Rule
+	AddSet(s *nftables.Set, vals []nftables.SetElement) error
+	ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error)
+	Flush() error
+}
+
+// NftablesNetlink programs the ruleset of its Generator via netlink instead
+// of loading a config file with nft. All changes are sent in a single batch,
+// which the kernel applies atomically. As nothing else removes the rules of
+// the previous config, they are always replaced like with partial reload,
+// unless the tables are dedicated and replaced as a whole anyway.
+type NftablesNetlink struct {
+	// Generator renders the same ruleset as text, for debugging
+	Generator *NftablesGenerator
+
+	// opens a connection with an empty batch
+	dial func() (nftablesConn, error)
+}
+
+func NewNftablesNetlink(cfg config.Nftables) *NftablesNetlink {
+	return newNftablesNetlink(cfg, func() (nftablesConn, error) {
+		return nftables.New()
+	})
+}
+
+func newNftablesNetlink(cfg config.Nftables, dial func() (nftablesConn, error)) *NftablesNetlink {
+	cfg.PartialReload = !cfg.DedicatedTables
+	n := &NftablesNetlink{dial: dial}
+	n.Generator = &NftablesGenerator{Cfg: cfg, listChains: n.listChains}
+	return n
+}
+
+// Returns the nftables family of the table type ("ip", "ip6" or "inet").
+func nftablesFamily(tableType string) (nftables.TableFamily, error) {
+	switch tableType {
+	case "ip":
+		return nftables.TableFamilyIPv4, nil
+	case "ip6":
+		return nftables.TableFamilyIPv6, nil
+	case "inet":
+		return nftables.TableFamilyINet, nil
+	default:
+		return nftables.TableFamilyUnspecified, fmt.Errorf("unsupported nftables table type %q", tableType)
+	}
+}
+
+// listChains lists the chains of the table type in the same form as
+// fetchNftablesChainList.
+func (n *NftablesNetlink) listChains(tableType string) (result nftablesChainListResult, err error) {
+	family, err := nftablesFamily(tableType)
+	if err != nil {
+		return result, err
+	}
+
+	conn, err := n.dial()
+	if err != nil {
+		return result, err
+	}
+	chains, err := conn.ListChainsOfTableFamily(family)
+	if err != nil {
+		return result, fmt.Errorf("failed to list chains via netlink: %s", err.Error())
+	}
+
+	for _, chain := range chains {
+		if chain.Table == nil {
+			continue
+		}
+		result.Nftables = append(result.Nftables, nftablesChainListResultEntry{
+			Chain: nftablesChainListResultChain{
+				Family: tableType,
+				Table:  chain.Table.Name,
+				Name:   chain.Name,
+			},
+		})
+	}
+	return result, nil
+}
+
+// Apply programs the ruleset for the load balancer in a single batch. If
+// building or sending the batch fails, the kernel keeps the previous ruleset.
+func (n *NftablesNetlink) Apply(lb *model.LoadBalancer) error {
+	cfg, err := n.Generator.GenerateStructuredConfig(lb)
+	if err != nil {
+		return err
+	}
+
+	conn, err := n.dial()
+	if err != nil {
+		return err
+	}
+
+	// nothing is sent before Flush, so an error here leaves the ruleset
+	// untouched
+	b := &nftablesBatch{conn: conn, cfg: cfg, mark: cfg.FWMarkBits & cfg.FWMarkMask}
+	if err := b.build(); err != nil {
+		return err
+	}
+
+	klog.V(3).Infof("programming nftables ruleset via netlink")
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to program nftables ruleset via netlink: %s", err.Error())
+	}
+	return nil
+}
+
+// nftablesBatch builds the netlink messages equivalent to nftablesTemplate
+// with partial reload or dedicated tables.
+type nftablesBatch struct {
+	conn nftablesConn
+	cfg  *nftablesConfig
+	// the template renders "mark and mask", which nft evaluates to a
+	// single value
+	mark uint32
+
+	// rules are added after all chains, so that their jumps resolve
+	rules []*nftables.Rule
+}
+
+func (b *nftablesBatch) table(tableType, name string) (*nftables.Table, error) {
+	family, err := nftablesFamily(tableType)
+	if err != nil {
+		return nil, err
+	}
+	return &nftables.Table{Name: name, Family: family}, nil
+}
+
+func (b *nftablesBatch) rule(chain *nftables.Chain, exprs ...[]expr.Any) {
+	rule := &nftables.Rule{Table: chain.Table, Chain: chain}
+	for _, e := range exprs {
+		rule.Exprs = append(rule.Exprs, e...)
+	}
+	b.rules = append(b.rules, rule)
+}
+
+func (b *nftablesBatch) build() error {
+	err := b.flush()
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.FilterTableName != "" {
+		err = b.addFilterTable()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, natTable := range b.cfg.NATTables {
+		err = b.addNATTable(natTable)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range b.rules {
+		b.conn.AddRule(rule)
+	}
+	return nil
+}
+
+// flush removes the rules and policy chains of the previous config.
+func (b *nftablesBatch) flush() error {
+	cfg := b.cfg
+	if cfg.DedicatedTables {
+		return b.deleteDedicatedTables()
+	}
+
+	for _, natTable := range cfg.NATTables {
+		table, err := b.table(natTable.Family, cfg.NATTableName)
+		if err != nil {
+			return err
+		}
+		prerouting := &nftables.Chain{Name: cfg.NATPreroutingChainName, Table: table}
+		postrouting := &nftables.Chain{Name: cfg.NATPostroutingChainName, Table: table}
+		if natTable.Family != cfg.NATTableType {
+			// not necessarily part of the base ruleset
+			b.conn.AddTable(table)
+			prerouting = b.baseChain(table, cfg.NATPreroutingChainName, nftables.ChainTypeNAT, nftables.ChainHookPrerouting, cfg.NATPreroutingPriority, natTable.BaseChains)
+			postrouting = b.baseChain(table, cfg.NATPostroutingChainName, nftables.ChainTypeNAT, nftables.ChainHookPostrouting, cfg.NATPostroutingPriority, natTable.BaseChains)
+		}
+		b.conn.FlushChain(prerouting)
+		b.conn.FlushChain(postrouting)
+	}
+
+	if cfg.FilterTableName == "" {
+		return nil
+	}
+
+	table, err := b.table(cfg.FilterTableType, cfg.FilterTableName)
+	if err != nil {
+		return err
+	}
+	b.conn.FlushChain(&nftables.Chain{Name: cfg.FilterForwardChainName, Table: table})
+	// policy chains jump to each other, so they can only be deleted once
+	// none of them has rules left
+	for _, name := range cfg.ExistingPolicyChains {
+		b.conn.FlushChain(&nftables.Chain{Name: name, Table: table})
+	}
+	for _, name := range cfg.ExistingPolicyChains {
+		b.conn.DelChain(&nftables.Chain{Name: name, Table: table})
+	}
+	return nil
+}
+
+// deleteDedicatedTables removes the tables owned by lbaas. Adding them first
+// prevents an error when they do not exist yet.
+func (b *nftablesBatch) deleteDedicatedTables() error {
+	cfg := b.cfg
+	tables := []*nftables.Table{}
+	if cfg.FilterTableName != "" {
+		table, err := b.table(cfg.FilterTableType, cfg.FilterTableName)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+	for _, natTable := range cfg.NATTables {
+		table, err := b.table(natTable.Family, cfg.NATTableName)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, table)
+	}
+
+	for _, table := range tables {
+		b.conn.AddTable(table)
+		b.conn.DelTable(table)
+	}
+	return nil
+}
+
+// baseChain returns the chain, which is declared as a base chain with the
+// hook if declare is set.
+func (b *nftablesBatch) baseChain(table *nftables.Table, name string, chainType nftables.ChainType, hook *nftables.ChainHook, priority int, declare bool) *nftables.Chain {
+	chain := &nftables.Chain{Name: name, Table: table}
+	if declare {
+		policy := nftables.ChainPolicyAccept
+		chain.Type = chainType
+		chain.Hooknum = hook
+		chain.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(priority))
+		chain.Policy = &policy
+	}
+	return b.conn.AddChain(chain)
+}
+
+func (b *nftablesBatch) addFilterTable() error {
+	cfg := b.cfg
+	table, err := b.table(cfg.FilterTableType, cfg.FilterTableName)
+	if err != nil {
+		return err
+	}
+	b.conn.AddTable(table)
+	forward := b.baseChain(table, cfg.FilterForwardChainName, nftables.ChainTypeFilter, nftables.ChainHookForward, cfg.FilterForwardPriority, cfg.DedicatedTables)
+
+	for _, assignment := range cfg.PolicyAssignments {
+		daddr, err := addressMatch(table, assignment.Address, false)
+		if err != nil {
+			return err
+		}
+		podChain := b.conn.AddChain(&nftables.Chain{
+			Name:  cfg.PolicyPrefix + "POD-" + strings.ReplaceAll(assignment.Address, ":", "-"),
+			Table: table,
+		})
+		b.rule(forward, ctMarkMatch(b.mark), daddr, verdict(expr.VerdictGoto, podChain.Name))
+
+		for _, policy := range assignment.NetworkPolicies {
+			b.rule(podChain, verdict(expr.VerdictJump, cfg.PolicyPrefix+policy))
+		}
+		b.rule(podChain, verdict(expr.VerdictDrop, ""))
+	}
+	b.rule(forward, ctMarkMatch(b.mark), verdict(expr.VerdictAccept, ""))
+
+	// same order as in the template
+	names := make([]string, 0, len(cfg.NetworkPolicies))
+	for name := range cfg.NetworkPolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err = b.addPolicyChains(table, cfg.NetworkPolicies[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *nftablesBatch) addPolicyChains(table *nftables.Table, policy networkPolicy) error {
+	policyChain := b.conn.AddChain(&nftables.Chain{Name: b.cfg.PolicyPrefix + policy.Name, Table: table})
+
+	for ruleIndex, ingressRule := range policy.IngressRuleChains {
+		ruleChain := b.conn.AddChain(&nftables.Chain{
+			Name:  fmt.Sprintf("%s-RULE%d", policyChain.Name, ruleIndex),
+			Table: table,
+		})
+		b.rule(policyChain, verdict(expr.VerdictJump, ruleChain.Name))
+
+		for entryIndex, entry := range ingressRule.Entries {
+			var saddr []expr.Any
+			if entry.SaddrMatch.Allow != "" {
+				var err error
+				saddr, err = addressMatch(table, entry.SaddrMatch.Allow, true)
+				if err != nil {
+					return err
+				}
+			}
+
+			action := verdict(expr.VerdictAccept, "")
+			if len(entry.SaddrMatch.Except) != 0 {
+				cidrChain := b.conn.AddChain(&nftables.Chain{
+					Name:  fmt.Sprintf("%s-CIDR%d", ruleChain.Name, entryIndex),
+					Table: table,
+				})
+				for _, addr := range entry.SaddrMatch.Except {
+					except, err := addressMatch(table, addr, true)
+					if err != nil {
+						return err
+					}
+					b.rule(cidrChain, except, verdict(expr.VerdictReturn, ""))
+				}
+				b.rule(cidrChain, verdict(expr.VerdictAccept, ""))
+				action = verdict(expr.VerdictJump, cidrChain.Name)
+			}
+
+			if entry.Protocol == "" {
+				b.rule(ruleChain, saddr, action)
+				continue
+			}
+			// one rule per port instead of an anonymous interval set
+			for _, port := range entry.Ports {
+				dport, err := dportMatch(entry.Protocol, port)
+				if err != nil {
+					return err
+				}
+				b.rule(ruleChain, saddr, dport, action)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *nftablesBatch) addNATTable(natTable nftablesNATTable) error {
+	cfg := b.cfg
+	table, err := b.table(natTable.Family, cfg.NATTableName)
+	if err != nil {
+		return err
+	}
+	b.conn.AddTable(table)
+	prerouting := b.baseChain(table, cfg.NATPreroutingChainName, nftables.ChainTypeNAT, nftables.ChainHookPrerouting, cfg.NATPreroutingPriority, natTable.BaseChains)
+
+	for _, fwd := range natTable.Forwards {
+		if len(fwd.DestinationAddresses) == 0 {
+			continue
+		}
+		exprs, err := b.dnat(table, fwd)
+		if err != nil {
+			return err
+		}
+		b.rule(prerouting, exprs)
+	}
+
+	if cfg.EnableSNAT {
+		postrouting := b.baseChain(table, cfg.NATPostroutingChainName, nftables.ChainTypeNAT, nftables.ChainHookPostrouting, cfg.NATPostroutingPriority, natTable.BaseChains)
+		b.rule(postrouting, []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(b.mark)},
+			&expr.Masq{},
+		})
+	}
+	return nil
+}
+
+// dnat returns the expressions of the rule which marks the packets of the
+// forward and distributes them round robin over its destinations, like
+// "dnat to numgen inc mod N map { ... } : port".
+func (b *nftablesBatch) dnat(table *nftables.Table, fwd nftablesForward) ([]expr.Any, error) {
+	exprs, err := addressMatch(table, fwd.InboundIP, false)
+	if err != nil {
+		return nil, err
+	}
+	dport, err := dportMatch(fwd.Protocol, strconv.Itoa(int(fwd.InboundPort)))
+	if err != nil {
+		return nil, err
+	}
+	exprs = append(exprs, dport...)
+
+	// mark set ... ct mark set meta mark
+	exprs = append(exprs,
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(b.mark)},
+		&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1},
+		&expr.Ct{Key: expr.CtKeyMARK, SourceRegister: true, Register: 1},
+	)
+
+	dataType, natFamily := nftables.TypeIPAddr, uint32(unix.NFPROTO_IPV4)
+	if fwd.Family == "ip6" {
+		dataType, natFamily = nftables.TypeIP6Addr, uint32(unix.NFPROTO_IPV6)
+	}
+	destinations := &nftables.Set{
+		Table:     table,
+		Anonymous: true,
+		Constant:  true,
+		IsMap:     true,
+		KeyType:   nftables.TypeInteger,
+		DataType:  dataType,
+	}
+	elements := make([]nftables.SetElement, len(fwd.DestinationAddresses))
+	for i, daddr := range fwd.DestinationAddresses {
+		addr, err := netip.ParseAddr(daddr)
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = nftables.SetElement{
+			Key: binaryutil.NativeEndian.PutUint32(uint32(i)),
+			Val: addr.Unmap().AsSlice(),
+		}
+	}
+	err = b.conn.AddSet(destinations, elements)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(exprs,
+		&expr.Numgen{Register: 1, Modulus: uint32(len(elements)), Type: unix.NFT_NG_INCREMENTAL},
+		&expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: destinations.Name, SetID: destinations.ID},
+		&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(fwd.DestinationPort))},
+		&expr.NAT{Type: expr.NATTypeDestNAT, Family: natFamily, RegAddrMin: 1, RegProtoMin: 2},
+	), nil
+}
+
+func verdict(kind expr.VerdictKind, chain string) []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: kind, Chain: chain}}
+}
+
+// Matches "ct mark <mark>"
+func ctMarkMatch(mark uint32) []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(mark)},
+	}
+}
+
+// Returns the prefix of an address or CIDR.
+func parsePrefix(address string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(address); err == nil {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()).Masked(), nil
+	}
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", address)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Matches the source or destination address of packets against an address
+// or CIDR, like "ip saddr 10.0.0.0/8". Tables of the inet family check the
+// protocol of the packets first, like nft does.
+func addressMatch(table *nftables.Table, address string, source bool) ([]expr.Any, error) {
+	prefix, err := parsePrefix(address)
+	if err != nil {
+		return nil, err
+	}
+
+	exprs := []expr.Any{}
+	is4 := prefix.Addr().Is4()
+	switch {
+	case table.Family == nftables.TableFamilyINet:
+		nfproto := byte(unix.NFPROTO_IPV6)
+		if is4 {
+			nfproto = unix.NFPROTO_IPV4
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		)
+	case table.Family == nftables.TableFamilyIPv4 && !is4,
+		table.Family == nftables.TableFamilyIPv6 && is4:
+		return nil, fmt.Errorf("cannot match address %q in table %s of another family", address, table.Name)
+	}
+
+	// offsets of the addresses in the IPv4 and IPv6 headers
+	offset, length := uint32(16), uint32(4)
+	if is4 && source {
+		offset = 12
+	} else if !is4 {
+		offset, length = 24, 16
+		if source {
+			offset = 8
+		}
+	}
+	exprs = append(exprs, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          length,
+	})
+
+	if prefix.Bits() < prefix.Addr().BitLen() {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			Xor:            make([]byte, length),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: prefix.Addr().AsSlice()}), nil
+}
+
+// Matches the destination port or port range like "8080-8090" of the
+// protocol, like "tcp dport 80".
+func dportMatch(protocol string, port string) ([]expr.Any, error) {
+	var l4proto byte
+	switch protocol {
+	case "tcp":
+		l4proto = unix.IPPROTO_TCP
+	case "udp":
+		l4proto = unix.IPPROTO_UDP
+	default:
+		return nil, ErrProtocolNotSupported
+	}
+
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+	}
+
+	first, last, isRange := strings.Cut(port, "-")
+	from, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	if !isRange {
+		return append(exprs, &expr.Cmp{
+			Op:       expr.CmpOpEq,
+			Register: 1,
+			Data:     binaryutil.BigEndian.PutUint16(uint16(from)),
+		}), nil
+	}
+
+	to, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q", port)
+	}
+	return append(exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: binaryutil.BigEndian.PutUint16(uint16(from)),
+		ToData:   binaryutil.BigEndian.PutUint16(uint16(to)),
+	}), nil
+}
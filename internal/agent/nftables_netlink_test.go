@@ -0,0 +1,342 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+var familyNames = map[nftables.TableFamily]string{
+	nftables.TableFamilyIPv4: "ip",
+	nftables.TableFamilyIPv6: "ip6",
+	nftables.TableFamilyINet: "inet",
+}
+
+// Records the operations of a batch instead of sending them to the kernel
+type fakeNftablesConn struct {
+	chains   []*nftables.Chain
+	ops      []string
+	rules    []*nftables.Rule
+	sets     map[string][]nftables.SetElement
+	batches  int
+	flushErr error
+}
+
+func (c *fakeNftablesConn) record(format string, args ...interface{}) {
+	c.ops = append(c.ops, fmt.Sprintf(format, args...))
+}
+
+func chainName(ch *nftables.Chain) string {
+	return fmt.Sprintf("%s %s %s", familyNames[ch.Table.Family], ch.Table.Name, ch.Name)
+}
+
+func (c *fakeNftablesConn) AddTable(t *nftables.Table) *nftables.Table {
+	c.record("add table %s %s", familyNames[t.Family], t.Name)
+	return t
+}
+
+func (c *fakeNftablesConn) DelTable(t *nftables.Table) {
+	c.record("delete table %s %s", familyNames[t.Family], t.Name)
+}
+
+func (c *fakeNftablesConn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	if ch.Hooknum != nil {
+		c.record("add chain %s { type %s hook %d priority %d; policy %d; }",
+			chainName(ch), ch.Type, *ch.Hooknum, *ch.Priority, *ch.Policy)
+		return ch
+	}
+	c.record("add chain %s", chainName(ch))
+	return ch
+}
+
+func (c *fakeNftablesConn) FlushChain(ch *nftables.Chain) {
+	c.record("flush chain %s", chainName(ch))
+}
+
+func (c *fakeNftablesConn) DelChain(ch *nftables.Chain) {
+	c.record("delete chain %s", chainName(ch))
+}
+
+func (c *fakeNftablesConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	c.record("add rule %s", chainName(r.Chain))
+	c.rules = append(c.rules, r)
+	return r
+}
+
+func (c *fakeNftablesConn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	s.ID = uint32(len(c.sets) + 1)
+	s.Name = fmt.Sprintf("__map%d", s.ID)
+	c.sets[s.Name] = vals
+	return nil
+}
+
+func (c *fakeNftablesConn) ListChainsOfTableFamily(family nftables.TableFamily) ([]*nftables.Chain, error) {
+	result := []*nftables.Chain{}
+	for _, ch := range c.chains {
+		if ch.Table.Family == family {
+			result = append(result, ch)
+		}
+	}
+	return result, nil
+}
+
+func (c *fakeNftablesConn) Flush() error {
+	c.batches++
+	return c.flushErr
+}
+
+func newTestNftablesNetlink(t *testing.T, dedicatedTables bool) (*NftablesNetlink, *fakeNftablesConn) {
+	cfg := config.Nftables{}
+	config.FillNftablesConfig(&cfg)
+	cfg.PolicyPrefix = "lbaas-"
+	if dedicatedTables {
+		cfg.DedicatedTables = true
+		cfg.FilterTableName = "lbaas-filter"
+		cfg.NATTableName = "lbaas-nat"
+	}
+
+	filter := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	conn := &fakeNftablesConn{
+		chains: []*nftables.Chain{
+			{Name: "forward", Table: filter},
+			{Name: "lbaas-old-policy", Table: filter},
+			{Name: "lbaas-old-policy", Table: &nftables.Table{Name: "other", Family: nftables.TableFamilyINet}},
+			{Name: "docker", Table: filter},
+		},
+		sets: map[string][]nftables.SetElement{},
+	}
+	return newNftablesNetlink(cfg, func() (nftablesConn, error) { return conn, nil }), conn
+}
+
+func findRules(conn *fakeNftablesConn, chain string) []*nftables.Rule {
+	rules := []*nftables.Rule{}
+	for _, r := range conn.rules {
+		if chainName(r.Chain) == chain {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func indexOf(ops []string, op string) int {
+	for i := range ops {
+		if ops[i] == op {
+			return i
+		}
+	}
+	return -1
+}
+
+var netlinkTestModel = model.LoadBalancer{
+	Ingress: []model.IngressIP{
+		{
+			Address: "172.23.42.1",
+			Ports: []model.PortForward{
+				{
+					InboundPort:          80,
+					Protocol:             corev1.ProtocolTCP,
+					DestinationPort:      30080,
+					DestinationAddresses: []string{"192.168.0.2", "192.168.0.1"},
+				},
+			},
+		},
+	},
+	NetworkPolicies: []model.NetworkPolicy{
+		{
+			Name: "allow-http",
+			AllowedIngresses: []model.AllowedIngress{
+				{
+					IPBlockFilters: []model.IPBlockFilter{
+						{Allow: "10.0.0.0/8", Block: []string{"10.1.0.0/16"}},
+					},
+					PortFilters: []model.PortFilter{
+						{
+							Protocol: corev1.ProtocolTCP,
+							Port:     func(i int32) *int32 { return &i }(8080),
+							EndPort:  func(i int32) *int32 { return &i }(8090),
+						},
+					},
+				},
+			},
+		},
+	},
+	PolicyAssignments: []model.PolicyAssignment{
+		{Address: "192.168.0.1", NetworkPolicies: []string{"allow-http"}},
+	},
+}
+
+func TestNftablesNetlinkProgramsRulesetInOneBatch(t *testing.T) {
+	n, conn := newTestNftablesNetlink(t, false)
+
+	err := n.Apply(&netlinkTestModel)
+	require.Nil(t, err)
+	assert.Equal(t, 1, conn.batches)
+
+	// the chains of the last config are removed before the new ones are
+	// added, other chains are left alone
+	deleteOld := indexOf(conn.ops, "delete chain inet filter lbaas-old-policy")
+	assert.NotEqual(t, -1, deleteOld)
+	assert.Less(t, indexOf(conn.ops, "flush chain inet filter lbaas-old-policy"), deleteOld)
+	assert.Less(t, deleteOld, indexOf(conn.ops, "add chain inet filter lbaas-allow-http"))
+	assert.NotContains(t, conn.ops, "delete chain inet filter docker")
+	assert.NotContains(t, conn.ops, "delete chain inet other lbaas-old-policy")
+	assert.Contains(t, conn.ops, "flush chain ip nat prerouting")
+	assert.Contains(t, conn.ops, "flush chain inet filter forward")
+
+	// all chains exist before the first rule jumps to them
+	lastChain := 0
+	for i, op := range conn.ops {
+		if strings.HasPrefix(op, "add chain") {
+			lastChain = i
+		}
+	}
+	assert.Less(t, lastChain, indexOf(conn.ops, "add rule inet filter forward"))
+
+	for _, chain := range []string{
+		"inet filter lbaas-POD-192.168.0.1",
+		"inet filter lbaas-allow-http",
+		"inet filter lbaas-allow-http-RULE0",
+		"inet filter lbaas-allow-http-RULE0-CIDR0",
+	} {
+		assert.Contains(t, conn.ops, "add chain "+chain)
+	}
+
+	forward := findRules(conn, "inet filter forward")
+	require.Len(t, forward, 2)
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictGoto, Chain: "lbaas-POD-192.168.0.1"}, forward[0].Exprs[len(forward[0].Exprs)-1])
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictAccept}, forward[1].Exprs[len(forward[1].Exprs)-1])
+
+	ruleChain := findRules(conn, "inet filter lbaas-allow-http-RULE0")
+	require.Len(t, ruleChain, 1)
+	assert.Contains(t, ruleChain[0].Exprs, &expr.Range{
+		Op:       expr.CmpOpEq,
+		Register: 1,
+		FromData: []byte{0x1f, 0x90},
+		ToData:   []byte{0x1f, 0x9a},
+	})
+	assert.Equal(t, &expr.Verdict{Kind: expr.VerdictJump, Chain: "lbaas-allow-http-RULE0-CIDR0"}, ruleChain[0].Exprs[len(ruleChain[0].Exprs)-1])
+
+	prerouting := findRules(conn, "ip nat prerouting")
+	require.Len(t, prerouting, 1)
+	dnat := prerouting[0].Exprs
+	assert.Equal(t, &expr.NAT{Type: expr.NATTypeDestNAT, Family: 2, RegAddrMin: 1, RegProtoMin: 2}, dnat[len(dnat)-1])
+	assert.Contains(t, dnat, &expr.Numgen{Register: 1, Modulus: 2})
+	assert.Contains(t, dnat, &expr.Lookup{SourceRegister: 1, DestRegister: 1, IsDestRegSet: true, SetName: "__map1", SetID: 1})
+
+	// destinations are sorted like in the rendered config
+	require.Len(t, conn.sets["__map1"], 2)
+	assert.Equal(t, []byte{192, 168, 0, 1}, conn.sets["__map1"][0].Val)
+	assert.Equal(t, []byte{192, 168, 0, 2}, conn.sets["__map1"][1].Val)
+
+	assert.Len(t, findRules(conn, "ip nat postrouting"), 1)
+
+	// the chains of the ip table are hooked by the base ruleset, the ones of
+	// the ip6 table are not known to it
+	assert.Contains(t, conn.ops, "add chain ip nat prerouting")
+	assert.Contains(t, conn.ops, "add chain ip6 nat prerouting { type nat hook 0 priority -100; policy 1; }")
+	assert.Contains(t, conn.ops, "add chain ip6 nat postrouting { type nat hook 4 priority 100; policy 1; }")
+}
+
+func TestNftablesNetlinkSendsNothingIfBuildFails(t *testing.T) {
+	n, conn := newTestNftablesNetlink(t, false)
+
+	lb := netlinkTestModel
+	lb.PolicyAssignments = []model.PolicyAssignment{{Address: "not-an-ip"}}
+	err := n.Apply(&lb)
+	assert.ErrorContains(t, err, `invalid address "not-an-ip"`)
+	assert.Equal(t, 0, conn.batches)
+}
+
+func TestNftablesNetlinkReportsFailedBatch(t *testing.T) {
+	n, conn := newTestNftablesNetlink(t, false)
+	conn.flushErr = fmt.Errorf("operation not permitted")
+
+	err := n.Apply(&netlinkTestModel)
+	assert.ErrorContains(t, err, "failed to program nftables ruleset via netlink: operation not permitted")
+}
+
+func TestNftablesNetlinkRendersExistingChainsForDebugging(t *testing.T) {
+	n, _ := newTestNftablesNetlink(t, false)
+
+	out := &strings.Builder{}
+	err := n.Generator.GenerateConfig(&netlinkTestModel, out)
+	require.Nil(t, err)
+	assert.Contains(t, out.String(), "delete chain inet filter lbaas-old-policy\n")
+	assert.NotContains(t, out.String(), "docker")
+}
+
+func TestNftablesAddressMatchChecksFamily(t *testing.T) {
+	ip := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+	inet := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+
+	_, err := addressMatch(ip, "2001:db8::1", false)
+	assert.ErrorContains(t, err, "cannot match address")
+
+	exprs, err := addressMatch(inet, "2001:db8::/32", true)
+	require.Nil(t, err)
+	assert.Equal(t, []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            16,
+			Mask:           []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			Xor:            make([]byte, 16),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	}, exprs)
+}
+
+func TestNftablesNetlinkReplacesDedicatedTables(t *testing.T) {
+	n, conn := newTestNftablesNetlink(t, true)
+
+	err := n.Apply(&netlinkTestModel)
+	require.Nil(t, err)
+	assert.Equal(t, 1, conn.batches)
+
+	assert.Equal(t, []string{
+		"add table inet lbaas-filter",
+		"delete table inet lbaas-filter",
+		"add table ip lbaas-nat",
+		"delete table ip lbaas-nat",
+		"add table ip6 lbaas-nat",
+		"delete table ip6 lbaas-nat",
+		"add table inet lbaas-filter",
+		"add chain inet lbaas-filter forward { type filter hook 2 priority 0; policy 1; }",
+	}, conn.ops[:8])
+	assert.Contains(t, conn.ops, "add chain ip lbaas-nat prerouting { type nat hook 0 priority -100; policy 1; }")
+	assert.Contains(t, conn.ops, "add chain ip lbaas-nat postrouting { type nat hook 4 priority 100; policy 1; }")
+	assert.Contains(t, conn.ops, "add chain ip6 lbaas-nat prerouting { type nat hook 0 priority -100; policy 1; }")
+
+	// other tables and chains are neither flushed nor deleted
+	for _, op := range conn.ops {
+		assert.False(t, strings.HasPrefix(op, "flush chain"), op)
+		assert.False(t, strings.HasPrefix(op, "delete chain"), op)
+	}
+}
@@ -0,0 +1,148 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
+)
+
+// Version of the agent, set at build time
+var Version = "dev"
+
+// Result of the last apply of a ConfigManager
+type applyResult struct {
+	time    time.Time
+	changed bool
+	err     error
+}
+
+func (m *ConfigManager) recordApply(changed bool, err error) {
+	m.statusLock.Lock()
+	defer m.statusLock.Unlock()
+	m.lastApply = &applyResult{time: time.Now(), changed: changed, err: err}
+}
+
+// CheckOutput runs the status command like Check and returns its output.
+func (m *ConfigManager) CheckOutput() (string, error) {
+	cmd := m.Service.StatusCommand
+	if len(cmd) == 0 {
+		return "", nil
+	}
+	output, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	return string(output), err
+}
+
+// Status returns the result of the last apply and of the status command.
+func (m *ConfigManager) Status(name string) model.ServiceStatus {
+	status := model.ServiceStatus{Name: name}
+
+	m.statusLock.Lock()
+	if m.lastApply != nil {
+		lastApply := m.lastApply.time
+		status.LastApply = &lastApply
+		status.LastChanged = m.lastApply.changed
+		if m.lastApply.err != nil {
+			status.LastError = m.lastApply.err.Error()
+		}
+	}
+	m.statusLock.Unlock()
+
+	output, err := m.CheckOutput()
+	status.Healthy = err == nil
+	status.CheckOutput = output
+	if err != nil && output == "" {
+		status.CheckOutput = err.Error()
+	}
+	return status
+}
+
+// StatusHandlerv1 serves the state of the agent and the configs applied by
+// the ApplyHandlerv1.
+type StatusHandlerv1 struct {
+	Apply    *ApplyHandlerv1
+	Verifier *signing.Verifier
+}
+
+// Check the bearer token of the request, which must be signed like the
+// tokens of the apply requests and have the status subject.
+func (h *StatusHandlerv1) authorize(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return false
+	}
+
+	claims := &jwt.StandardClaims{}
+	parsed, err := h.Verifier.Parse(token, claims)
+	if err != nil || !parsed.Valid {
+		klog.V(5).Infof("Failed to validate status token: %v", err)
+		return false
+	}
+	return claims.Subject == model.StatusSubject
+}
+
+func (h *StatusHandlerv1) Status() model.AgentStatus {
+	status := model.AgentStatus{
+		Version:  Version,
+		Services: []model.ServiceStatus{},
+	}
+
+	h.Apply.mutex.Lock()
+	status.Generation = h.Apply.appliedGeneration
+	status.ConfigHash = h.Apply.appliedHash
+	status.Restored = h.Apply.restored
+	if !h.Apply.appliedAt.IsZero() {
+		appliedAt := h.Apply.appliedAt
+		status.AppliedAt = &appliedAt
+	}
+	h.Apply.mutex.Unlock()
+
+	for _, m := range h.Apply.configManagers() {
+		status.Services = append(status.Services, m.manager.Status(m.name))
+	}
+	return status
+}
+
+func (h *StatusHandlerv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405) // Method Not Allowed
+		return
+	}
+
+	if !h.authorize(r) {
+		w.WriteHeader(401) // Unauthorized
+		return
+	}
+
+	body, err := json.Marshal(h.Status())
+	if err != nil {
+		klog.Errorf("Failed to encode status: %s", err.Error())
+		w.WriteHeader(500) // Internal Server Error
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+}
@@ -0,0 +1,132 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
+)
+
+// Generates the number of ingress IPs as config
+type countingGenerator struct{}
+
+func (g *countingGenerator) GenerateConfig(cfg *model.LoadBalancer, out io.Writer) error {
+	_, err := fmt.Fprintf(out, "%d\n", len(cfg.Ingress))
+	return err
+}
+
+func newTestConfigManager(t *testing.T) *ConfigManager {
+	return &ConfigManager{
+		Generator: &countingGenerator{},
+		Service: config.ServiceConfig{
+			ConfigFile:    filepath.Join(t.TempDir(), "service.conf"),
+			ReloadCommand: []string{"true"},
+			StatusCommand: []string{"echo", "running"},
+		},
+	}
+}
+
+func getStatus(t *testing.T, h *StatusHandlerv1, subject string) (int, model.AgentStatus) {
+	token, err := signing.NewHMACSigner([]byte("0123456789ab")).Sign(&jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Subject:   subject,
+	})
+	require.Nil(t, err)
+
+	r := httptest.NewRequest("GET", "/v1/status", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	status := model.AgentStatus{}
+	if w.Code == 200 {
+		require.Nil(t, json.Unmarshal(w.Body.Bytes(), &status))
+	}
+	return w.Code, status
+}
+
+func TestStatusReportsAppliedConfig(t *testing.T) {
+	applyHandler := newTestApplyHandler(t)
+	applyHandler.NftablesConfig = newTestConfigManager(t)
+	h := &StatusHandlerv1{Apply: applyHandler, Verifier: applyHandler.Verifier}
+
+	code, status := getStatus(t, h, model.StatusSubject)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, Version, status.Version)
+	assert.Equal(t, uint64(0), status.Generation)
+	assert.Nil(t, status.AppliedAt)
+	require.Len(t, status.Services, 1)
+	assert.Equal(t, "nftables", status.Services[0].Name)
+	assert.Nil(t, status.Services[0].LastApply)
+	assert.True(t, status.Services[0].Healthy)
+	assert.Equal(t, "running\n", status.Services[0].CheckOutput)
+
+	assert.Equal(t, 200, apply(applyHandler, newTestToken(t, 5, "first")).Code)
+
+	code, status = getStatus(t, h, model.StatusSubject)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, uint64(5), status.Generation)
+	hash, err := (&model.LoadBalancer{}).Hash()
+	require.Nil(t, err)
+	assert.Equal(t, hash, status.ConfigHash)
+	assert.NotNil(t, status.AppliedAt)
+	assert.NotNil(t, status.Services[0].LastApply)
+	assert.True(t, status.Services[0].LastChanged)
+	assert.Equal(t, "", status.Services[0].LastError)
+}
+
+func TestStatusReportsFailedApply(t *testing.T) {
+	applyHandler := newTestApplyHandler(t)
+	applyHandler.NftablesConfig = newTestConfigManager(t)
+	applyHandler.NftablesConfig.Service.ReloadCommand = []string{"false"}
+	applyHandler.NftablesConfig.Service.StatusCommand = []string{"false"}
+	h := &StatusHandlerv1{Apply: applyHandler, Verifier: applyHandler.Verifier}
+
+	assert.Equal(t, 500, apply(applyHandler, newTestToken(t, 1, "first")).Code)
+
+	_, status := getStatus(t, h, model.StatusSubject)
+	assert.Equal(t, uint64(0), status.Generation)
+	assert.NotEqual(t, "", status.Services[0].LastError)
+	assert.False(t, status.Services[0].Healthy)
+}
+
+func TestStatusRequiresStatusToken(t *testing.T) {
+	applyHandler := newTestApplyHandler(t)
+	h := &StatusHandlerv1{Apply: applyHandler, Verifier: applyHandler.Verifier}
+
+	code, _ := getStatus(t, h, "")
+	assert.Equal(t, 401, code)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/v1/status", nil))
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/v1/status", nil))
+	assert.Equal(t, 405, w.Code)
+}
@@ -0,0 +1,316 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// Stages of applying a config to the services
+const (
+	// The load-balancer config is checked
+	StageValidate = "validate"
+	// The config files of all services are generated next to the current ones
+	StageRender = "render"
+	// The generated config files are checked by the validate commands
+	StageValidateFiles = "validate-files"
+	// A validate command could not be run, e.g. because it does not exist
+	StageRunValidateCommand = "run-validate-command"
+	// The new config files replace the current ones
+	StageSwap = "swap"
+	// The services are reloaded and checked
+	StageReload = "reload"
+)
+
+// ApplyError reports the stage and the service in which applying a config
+// failed.
+type ApplyError struct {
+	Stage   string
+	Service string
+	Err     error
+	// Services which have been rolled back to their previous config
+	RolledBack []string
+}
+
+func (e *ApplyError) Error() string {
+	msg := fmt.Sprintf("stage %s failed", e.Stage)
+	if e.Service != "" {
+		msg = fmt.Sprintf("stage %s of %s failed", e.Stage, e.Service)
+	}
+	msg = fmt.Sprintf("%s: %s", msg, e.Err)
+	if len(e.RolledBack) > 0 {
+		msg = fmt.Sprintf("%s (rolled back %s)", msg, strings.Join(e.RolledBack, ", "))
+	}
+	return msg
+}
+
+func (e *ApplyError) Unwrap() error {
+	return e.Err
+}
+
+// pendingConfig is a config file rendered by a ConfigManager which has not
+// been swapped in yet.
+type pendingConfig struct {
+	name    string
+	manager *ConfigManager
+	config  *model.LoadBalancer
+	// the rendered file, next to the config file
+	tmpFile string
+	// copy of the current config file; empty if there is none
+	backupFile string
+	changed    bool
+	swapped    bool
+	// whether the service has been reloaded (successfully or not) with
+	// the new config; with an Applier only if it succeeded
+	reloaded bool
+}
+
+// render generates the config into a temporary file and takes a backup of
+// the current config file.
+func (m *ConfigManager) render(name string, cfg *model.LoadBalancer) (*pendingConfig, error) {
+	klog.V(1).Infof("writing configuration file %s", m.Service.ConfigFile)
+
+	dir := filepath.Dir(m.Service.ConfigFile)
+	fout, err := ioutil.TempFile(dir, ".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingConfig{name: name, manager: m, config: cfg, tmpFile: fout.Name()}
+
+	err = func() error {
+		defer fout.Close()
+		return m.Generator.GenerateConfig(cfg, fout)
+	}()
+	if err != nil {
+		p.cleanup()
+		return nil, err
+	}
+
+	p.backupFile, err = m.MakeBackup()
+	if err != nil {
+		p.cleanup()
+		return nil, fmt.Errorf("failed to create backup of current configuration: %s", err.Error())
+	}
+
+	if p.backupFile != "" {
+		var diff string
+		p.changed, diff, err = diffFiles(p.backupFile, p.tmpFile)
+		if err != nil {
+			p.cleanup()
+			return nil, fmt.Errorf("failed diff config: %s", err.Error())
+		}
+		if p.changed {
+			klog.Infof("configuration diff for %s:\n%s", m.Service.ConfigFile, diff)
+		}
+	} else {
+		p.changed = true
+		klog.V(2).Infof("no old configuration file\n")
+	}
+
+	return p, nil
+}
+
+// validateCommand returns the validate command of the service for the file.
+func validateCommand(cmd []string, file string) []string {
+	args := make([]string, len(cmd))
+	replaced := false
+	for i, arg := range cmd {
+		args[i] = strings.ReplaceAll(arg, "{file}", file)
+		replaced = replaced || args[i] != arg
+	}
+	if !replaced {
+		args = append(args, file)
+	}
+	return args
+}
+
+// validate runs the validate command of the service against the rendered
+// file. If the command rejects the file, the error wraps an *exec.ExitError
+// and contains the output of the command.
+func (p *pendingConfig) validate() error {
+	cmd := p.manager.Service.ValidateCommand
+	if len(cmd) == 0 {
+		return nil
+	}
+
+	args := validateCommand(cmd, p.tmpFile)
+	klog.V(4).Infof("executing validate: %#v", args)
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run validate command %#v: %s", args, err)
+	}
+	return nil
+}
+
+// swap replaces the config file with the rendered one.
+func (p *pendingConfig) swap() error {
+	klog.V(1).Infof("updating configuration file %s", p.manager.Service.ConfigFile)
+	if err := os.Rename(p.tmpFile, p.manager.Service.ConfigFile); err != nil {
+		return err
+	}
+	p.swapped = true
+	return nil
+}
+
+// reload reloads and checks the service with the swapped config.
+func (p *pendingConfig) reload() error {
+	if p.manager.Applier != nil {
+		// a failed Apply leaves the previous config in place, so there
+		// is nothing to roll back in the service
+		if err := p.manager.Applier.Apply(p.config); err != nil {
+			return err
+		}
+		p.reloaded = true
+		return nil
+	}
+
+	p.reloaded = true
+	return p.manager.ReloadAndCheck()
+}
+
+// rollback restores the previous config file. If the service has already
+// been reloaded with the new config, it is reloaded with the previous one;
+// only if that fails, it is restarted.
+func (p *pendingConfig) rollback() {
+	if !p.swapped {
+		return
+	}
+
+	configFile := p.manager.Service.ConfigFile
+	if p.backupFile != "" {
+		restoreErr := os.Rename(p.backupFile, configFile)
+		if restoreErr != nil {
+			klog.Warningf("failed to restore config backup: %s!", restoreErr.Error())
+		}
+	} else {
+		// no backup exists, we delete the new file
+		restoreErr := os.Remove(configFile)
+		if restoreErr != nil {
+			klog.Warningf("failed to remove invalid config: %s!", restoreErr.Error())
+		}
+	}
+	p.swapped = false
+
+	if p.reloaded && p.manager.Applier != nil {
+		previous := p.manager.applied
+		if previous == nil {
+			previous = &model.LoadBalancer{}
+		}
+		applyErr := p.manager.Applier.Apply(previous)
+		if applyErr != nil {
+			klog.Errorf("failed to apply previous config: %s!", applyErr.Error())
+		}
+	} else if p.reloaded {
+		reloadErr := p.manager.ReloadAndCheck()
+		if reloadErr == nil {
+			return
+		}
+		klog.Warningf("failed to reload previous config: %s!", reloadErr.Error())
+		fixErr := p.manager.Fix()
+		if fixErr != nil {
+			klog.Errorf("failed to recover broken service: %s!", fixErr.Error())
+		}
+	}
+}
+
+// cleanup removes the temporary files left over.
+func (p *pendingConfig) cleanup() {
+	os.Remove(p.tmpFile)
+	if p.backupFile != "" {
+		os.Remove(p.backupFile)
+	}
+}
+
+// configTransaction applies a config to several services: all configs are
+// rendered before any is swapped in, and if any service fails to reload, all
+// services are rolled back to their previous config.
+type configTransaction struct {
+	pending []*pendingConfig
+	// reload services even if their config did not change
+	force bool
+}
+
+func (t *configTransaction) cleanup() {
+	for _, p := range t.pending {
+		p.cleanup()
+	}
+}
+
+func (t *configTransaction) rollback() []string {
+	rolledBack := []string{}
+	for i := len(t.pending) - 1; i >= 0; i-- {
+		p := t.pending[i]
+		if p.swapped {
+			p.rollback()
+			rolledBack = append(rolledBack, p.name)
+		}
+	}
+	return rolledBack
+}
+
+func (t *configTransaction) needsApply(p *pendingConfig) bool {
+	return p.changed || t.force
+}
+
+// run executes all stages after rendering.
+func (t *configTransaction) run() *ApplyError {
+	for _, p := range t.pending {
+		if !t.needsApply(p) {
+			continue
+		}
+		if err := p.validate(); err != nil {
+			// only a config rejected by the validate command is invalid; a
+			// validate command which cannot be run is an error of the agent
+			var exitErr *exec.ExitError
+			if !errors.As(err, &exitErr) {
+				return &ApplyError{Stage: StageRunValidateCommand, Service: p.name, Err: err}
+			}
+			return &ApplyError{Stage: StageValidateFiles, Service: p.name, Err: err}
+		}
+	}
+
+	for _, p := range t.pending {
+		if !t.needsApply(p) {
+			continue
+		}
+		if err := p.swap(); err != nil {
+			return &ApplyError{Stage: StageSwap, Service: p.name, Err: err, RolledBack: t.rollback()}
+		}
+	}
+
+	for _, p := range t.pending {
+		if !t.needsApply(p) {
+			continue
+		}
+		if err := p.reload(); err != nil {
+			return &ApplyError{Stage: StageReload, Service: p.name, Err: err, RolledBack: t.rollback()}
+		}
+	}
+	return nil
+}
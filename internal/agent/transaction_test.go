@@ -0,0 +1,225 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package agent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+type failingGenerator struct{}
+
+func (g *failingGenerator) GenerateConfig(cfg *model.LoadBalancer, out io.Writer) error {
+	return errors.New("cannot render")
+}
+
+func readConfig(t *testing.T, m *ConfigManager) string {
+	data, err := os.ReadFile(m.Service.ConfigFile)
+	require.Nil(t, err)
+	return string(data)
+}
+
+// Return an apply handler for keepalived and nftables which have both
+// applied a config with no ingress IPs
+func newTransactionFixture(t *testing.T) *ApplyHandlerv1 {
+	h := newTestApplyHandler(t)
+	h.KeepalivedConfig = newTestConfigManager(t)
+	h.NftablesConfig = newTestConfigManager(t)
+
+	assert.Equal(t, 200, apply(h, newTestToken(t, 1, "initial")).Code)
+	assert.Equal(t, "0\n", readConfig(t, h.KeepalivedConfig))
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+	return h
+}
+
+// Make the start command of the service count its invocations
+func countStarts(t *testing.T, m *ConfigManager) func() int {
+	counter := filepath.Join(t.TempDir(), "starts")
+	m.Service.StartCommand = []string{"sh", "-c", "echo >> " + counter}
+	return func() int {
+		data, err := os.ReadFile(counter)
+		if os.IsNotExist(err) {
+			return 0
+		}
+		require.Nil(t, err)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+var oneIngressConfig = model.LoadBalancer{Ingress: []model.IngressIP{{Address: "172.23.42.1"}}}
+
+func TestApplyUpdatesAllServices(t *testing.T) {
+	h := newTransactionFixture(t)
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "", w.Header().Get(model.ApplyStageHeader))
+	assert.Equal(t, "1\n", readConfig(t, h.KeepalivedConfig))
+	assert.Equal(t, "1\n", readConfig(t, h.NftablesConfig))
+}
+
+func TestApplyRollsBackAllServicesIfOneFailsToReload(t *testing.T) {
+	h := newTransactionFixture(t)
+	nftablesReloads := countReloads(t, h.NftablesConfig)
+	nftablesStarts := countStarts(t, h.NftablesConfig)
+	keepalivedStarts := countStarts(t, h.KeepalivedConfig)
+	// keepalived only accepts the config without ingress IPs
+	h.KeepalivedConfig.Service.ReloadCommand = []string{"grep", "-qx", "0", h.KeepalivedConfig.Service.ConfigFile}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, StageReload, w.Header().Get(model.ApplyStageHeader))
+	assert.Contains(t, w.Body.String(), "stage reload of keepalived failed")
+	assert.Contains(t, w.Body.String(), "rolled back keepalived, nftables")
+
+	assert.Equal(t, "0\n", readConfig(t, h.KeepalivedConfig))
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+	// nftables was reloaded with the new and again with the old config
+	assert.Equal(t, 2, nftablesReloads())
+	// the previous configs reload fine, so no service is restarted
+	assert.Equal(t, 0, nftablesStarts())
+	assert.Equal(t, 0, keepalivedStarts())
+
+	status := (&StatusHandlerv1{Apply: h}).Status()
+	for _, service := range status.Services {
+		assert.Contains(t, service.LastError, "stage reload of keepalived failed")
+	}
+	assert.Equal(t, uint64(1), status.Generation)
+
+	entries, err := os.ReadDir(filepath.Dir(h.NftablesConfig.Service.ConfigFile))
+	require.Nil(t, err)
+	assert.Len(t, entries, 1, "temporary files are removed")
+}
+
+func TestApplyRestartsServiceIfPreviousConfigFailsToReload(t *testing.T) {
+	h := newTransactionFixture(t)
+	keepalivedStarts := countStarts(t, h.KeepalivedConfig)
+	// keepalived fails to reload any config, e.g. because it crashed
+	h.KeepalivedConfig.Service.ReloadCommand = []string{"false"}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, StageReload, w.Header().Get(model.ApplyStageHeader))
+
+	assert.Equal(t, "0\n", readConfig(t, h.KeepalivedConfig))
+	assert.Equal(t, 1, keepalivedStarts())
+}
+
+func TestApplyDoesNotSwapAnyServiceIfOneFailsToRender(t *testing.T) {
+	h := newTransactionFixture(t)
+	nftablesReloads := countReloads(t, h.NftablesConfig)
+	h.KeepalivedConfig.Generator = &failingGenerator{}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, StageRender, w.Header().Get(model.ApplyStageHeader))
+	assert.Contains(t, w.Body.String(), "stage render of keepalived failed: cannot render")
+
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+	assert.Equal(t, 0, nftablesReloads())
+}
+
+func TestApplyReportsValidationStage(t *testing.T) {
+	h := newTestApplyHandler(t)
+
+	invalid := model.LoadBalancer{Ingress: []model.IngressIP{{Address: "not-an-ip"}}}
+	w := apply(h, newTestConfigToken(t, 1, "invalid", invalid))
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, StageValidate, w.Header().Get(model.ApplyStageHeader))
+}
+
+func TestValidateCommand(t *testing.T) {
+	assert.Equal(t, []string{"nft", "-c", "-f", "/tmp/x"}, validateCommand([]string{"nft", "-c", "-f"}, "/tmp/x"))
+	assert.Equal(t, []string{"keepalived", "-t", "-f", "/tmp/x", "-l"}, validateCommand([]string{"keepalived", "-t", "-f", "{file}", "-l"}, "/tmp/x"))
+	assert.Equal(t, []string{"sh", "-c", "check --config=/tmp/x"}, validateCommand([]string{"sh", "-c", "check --config={file}"}, "/tmp/x"))
+}
+
+func TestApplyRejectsConfigFailingValidation(t *testing.T) {
+	h := newTransactionFixture(t)
+	nftablesReloads := countReloads(t, h.NftablesConfig)
+	h.NftablesConfig.Service.ValidateCommand = []string{"sh", "-c", "echo 'syntax error in {file}' >&2; exit 1"}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, StageValidateFiles, w.Header().Get(model.ApplyStageHeader))
+	assert.Contains(t, w.Body.String(), "stage validate-files of nftables failed")
+	assert.Contains(t, w.Body.String(), "syntax error in "+filepath.Dir(h.NftablesConfig.Service.ConfigFile))
+
+	assert.Equal(t, "0\n", readConfig(t, h.KeepalivedConfig))
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+	assert.Equal(t, 0, nftablesReloads())
+}
+
+func TestApplyReportsValidateCommandWhichCannotBeRun(t *testing.T) {
+	h := newTransactionFixture(t)
+	nftablesReloads := countReloads(t, h.NftablesConfig)
+	h.NftablesConfig.Service.ValidateCommand = []string{"/nonexistent/nft", "-c", "-f"}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 500, w.Code)
+	assert.Equal(t, StageRunValidateCommand, w.Header().Get(model.ApplyStageHeader))
+	assert.Contains(t, w.Body.String(), "stage run-validate-command of nftables failed")
+
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+	assert.Equal(t, 0, nftablesReloads())
+}
+
+func TestApplyValidatesRenderedConfig(t *testing.T) {
+	h := newTransactionFixture(t)
+	// only passes for the rendered config with one ingress IP
+	h.NftablesConfig.Service.ValidateCommand = []string{"grep", "-qx", "1"}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "1\n", readConfig(t, h.NftablesConfig))
+}
+
+// Records the configs applied to it instead of programming a service
+type recordingApplier struct {
+	applied []*model.LoadBalancer
+}
+
+func (a *recordingApplier) Apply(lb *model.LoadBalancer) error {
+	a.applied = append(a.applied, lb)
+	return nil
+}
+
+func TestApplyRollsBackApplierToPreviousConfig(t *testing.T) {
+	h := newTransactionFixture(t)
+	applier := &recordingApplier{}
+	h.NftablesConfig.Applier = applier
+	nftablesReloads := countReloads(t, h.NftablesConfig)
+	h.KeepalivedConfig.Service.ReloadCommand = []string{"grep", "-qx", "0", h.KeepalivedConfig.Service.ConfigFile}
+
+	w := apply(h, newTestConfigToken(t, 2, "update", oneIngressConfig))
+	assert.Equal(t, 500, w.Code)
+	assert.Contains(t, w.Body.String(), "rolled back keepalived, nftables")
+
+	// the applier replaces the reload command
+	assert.Equal(t, 0, nftablesReloads())
+	require.Len(t, applier.applied, 2)
+	assert.Equal(t, oneIngressConfig, *applier.applied[0])
+	assert.Empty(t, applier.applied[1].Ingress)
+	assert.Equal(t, "0\n", readConfig(t, h.NftablesConfig))
+}
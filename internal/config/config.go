@@ -17,9 +17,15 @@ package config
 import (
 	"fmt"
 	"io"
+	"net/netip"
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/ippool"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/static"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/webhook"
 
 	"github.com/BurntSushi/toml"
 )
@@ -37,6 +43,18 @@ type PortManager string
 const (
 	PortManagerOpenstack PortManager = "openstack"
 	PortManagerStatic    PortManager = "static"
+	PortManagerIPPool    PortManager = "ip-pool"
+	PortManagerWebhook   PortManager = "webhook"
+)
+
+type NftablesBackend string
+
+const (
+	// The rendered config file is loaded by reloading the nftables service
+	NftablesBackendFile NftablesBackend = "file"
+	// The ruleset is programmed via netlink in a single batch; the config
+	// file is only rendered for debugging
+	NftablesBackendNetlink NftablesBackend = "netlink"
 )
 
 type Agent struct {
@@ -49,7 +67,11 @@ type ServiceConfig struct {
 	ReloadCommand []string `toml:"reload-command"`
 	StatusCommand []string `toml:"status-command"`
 	StartCommand  []string `toml:"start-command"`
-	CheckDelay    int      `toml:"check-delay"`
+	// ValidateCommand checks a generated config before it replaces the
+	// current one; "{file}" is replaced by the path of the generated config,
+	// which is appended if no argument contains "{file}"
+	ValidateCommand []string `toml:"validate-command"`
+	CheckDelay      int      `toml:"check-delay"`
 }
 
 type Keepalived struct {
@@ -70,6 +92,7 @@ type Nftables struct {
 	FilterTableType         string   `toml:"filter-table-type"`
 	FilterForwardChainName  string   `toml:"filter-forward-chain"`
 	NATTableName            string   `toml:"nat-table-name"`
+	NATTableType            string   `toml:"nat-table-type"`
 	NATPreroutingChainName  string   `toml:"nat-prerouting-chain"`
 	NATPostroutingChainName string   `toml:"nat-postrouting-chain"`
 	PolicyPrefix            string   `toml:"policy-prefix"`
@@ -79,14 +102,52 @@ type Nftables struct {
 	FWMarkBits              uint32   `toml:"fwmark-bits"`
 	FWMarkMask              uint32   `toml:"fwmark-mask"`
 
-	Service ServiceConfig `toml:"service"`
+	// DedicatedTables makes the agent own the filter and NAT tables: they
+	// are replaced as a whole and have their own base chains with the
+	// priorities below, so that tables of other software are never touched
+	DedicatedTables        bool `toml:"dedicated-tables"`
+	FilterForwardPriority  int  `toml:"filter-forward-priority"`
+	NATPreroutingPriority  int  `toml:"nat-prerouting-priority"`
+	NATPostroutingPriority int  `toml:"nat-postrouting-priority"`
+
+	Backend NftablesBackend `toml:"backend"`
+	Service ServiceConfig   `toml:"service"`
+}
+
+// SigningKey is a key of the controller, identified by the ID in the kid
+// header of the tokens
+type SigningKey struct {
+	ID             string `toml:"id"`
+	SharedSecret   string `toml:"shared-secret"`
+	PrivateKeyFile string `toml:"private-key-file"`
+}
+
+// VerificationKey is a key accepted by the agent for tokens with the ID in
+// their kid header
+type VerificationKey struct {
+	ID            string `toml:"id"`
+	SharedSecret  string `toml:"shared-secret"`
+	PublicKeyFile string `toml:"public-key-file"`
 }
 
 type Agents struct {
-	SharedSecret  string   `toml:"shared-secret"`
-	TokenLifetime int      `toml:"token-lifetime"`
-	AdditionalIps []string `toml:"additional-address-pairs"`
-	Agents        []Agent  `toml:"agent"`
+	SharedSecret string `toml:"shared-secret"`
+	// SigningMethod of the tokens: "hmac" (default) signs with SharedSecret,
+	// "ed25519" and "rs256" sign with the private key from PrivateKeyFile
+	SigningMethod  string `toml:"signing-method"`
+	PrivateKeyFile string `toml:"private-key-file"`
+	// SigningKeys replace SharedSecret and PrivateKeyFile to rotate keys
+	// without downtime; the key with the ID ActiveKey signs the tokens
+	SigningKeys   []SigningKey `toml:"signing-key"`
+	ActiveKey     string       `toml:"active-key"`
+	TokenLifetime int          `toml:"token-lifetime"`
+	AdditionalIps []string     `toml:"additional-address-pairs"`
+	Agents        []Agent      `toml:"agent"`
+	// CAFile verifies the certificates of HTTPS agents instead of the
+	// system CAs; CertFile and KeyFile are presented as client certificate
+	CAFile   string `toml:"ca-file"`
+	CertFile string `toml:"cert-file"`
+	KeyFile  string `toml:"key-file"`
 }
 
 type ControllerConfig struct {
@@ -96,15 +157,36 @@ type ControllerConfig struct {
 	PortManager  PortManager  `toml:"port-manager"`
 	BackendLayer BackendLayer `toml:"backend-layer"`
 
-	OpenStack Config        `toml:"openstack"`
-	Static    static.Config `toml:"static"`
-	Agents    Agents        `toml:"agents"`
+	OpenStack Config         `toml:"openstack"`
+	Static    static.Config  `toml:"static"`
+	IPPool    ippool.Config  `toml:"ip-pool"`
+	Webhook   webhook.Config `toml:"webhook"`
+	Agents    Agents         `toml:"agents"`
+}
+
+// AgentTLS enables HTTPS on the agent if CertFile and KeyFile are set. If
+// ClientCAFile is set too, configs are only accepted from clients with a
+// certificate signed by one of its CAs.
+type AgentTLS struct {
+	CertFile     string `toml:"cert-file"`
+	KeyFile      string `toml:"key-file"`
+	ClientCAFile string `toml:"client-ca-file"`
 }
 
 type AgentConfig struct {
 	SharedSecret string `toml:"shared-secret"`
-	BindAddress  string `toml:"bind-address"`
-	BindPort     int32  `toml:"bind-port"`
+	// SigningMethod must match the one of the controller; "ed25519" and
+	// "rs256" verify with the public key from PublicKeyFile
+	SigningMethod string `toml:"signing-method"`
+	PublicKeyFile string `toml:"public-key-file"`
+	// VerificationKeys are accepted in addition to SharedSecret or
+	// PublicKeyFile, which verify tokens without kid
+	VerificationKeys []VerificationKey `toml:"verification-key"`
+	BindAddress      string            `toml:"bind-address"`
+	BindPort         int32             `toml:"bind-port"`
+	// StateDir holds the state the agent keeps across restarts
+	StateDir string   `toml:"state-dir"`
+	TLS      AgentTLS `toml:"tls"`
 
 	Keepalived Keepalived `toml:"keepalived"`
 	Nftables   Nftables   `toml:"nftables"`
@@ -160,6 +242,9 @@ func ReadAgentConfigFromFile(path string, withDefaults bool) (AgentConfig, error
 	if err != nil {
 		return AgentConfig{}, err
 	}
+	if withDefaults {
+		FillDedicatedTablesDefaults(&config.Nftables)
+	}
 
 	return config, nil
 }
@@ -174,10 +259,12 @@ func FillKeepalivedConfig(cfg *Keepalived) {
 }
 
 func FillNftablesConfig(cfg *Nftables) {
+	cfg.Backend = NftablesBackendFile
 	cfg.FilterTableName = "filter"
 	cfg.FilterTableType = "inet"
 	cfg.FilterForwardChainName = "forward"
 	cfg.NATTableName = "nat"
+	cfg.NATTableType = "ip"
 	cfg.NATPreroutingChainName = "prerouting"
 	cfg.NATPostroutingChainName = "postrouting"
 	cfg.NftCommand = []string{"sudo", "nft"}
@@ -186,12 +273,41 @@ func FillNftablesConfig(cfg *Nftables) {
 	cfg.FWMarkBits = 1
 	cfg.FWMarkMask = 1
 
+	cfg.NATPreroutingPriority = -100
+	cfg.NATPostroutingPriority = 100
+
 	cfg.Service.ReloadCommand = []string{"sudo", "systemctl", "reload", "nftables"}
 	cfg.Service.StatusCommand = []string{"sudo", "systemctl", "is-active", "nftables"}
 	cfg.Service.StartCommand = []string{"sudo", "systemctl", "restart", "nftables"}
 }
 
+// FillDedicatedTablesDefaults replaces the default commands of the nftables
+// service if dedicated-tables is enabled for the file backend: the nftables
+// service loads the base ruleset, which usually starts with "flush ruleset"
+// and thus also drops the tables of other software. Instead, only the config
+// file of the agent is loaded via nft, and there is no service to check or
+// start. It must be called after the config has been read, as it depends on
+// the config file and leaves commands set in the config untouched.
+func FillDedicatedTablesDefaults(cfg *Nftables) {
+	if !cfg.DedicatedTables || cfg.Backend != NftablesBackendFile {
+		return
+	}
+
+	defaults := Nftables{}
+	FillNftablesConfig(&defaults)
+	if slices.Equal(cfg.Service.ReloadCommand, defaults.Service.ReloadCommand) {
+		cfg.Service.ReloadCommand = append(slices.Clone(cfg.NftCommand), "-f", cfg.Service.ConfigFile)
+	}
+	if slices.Equal(cfg.Service.StatusCommand, defaults.Service.StatusCommand) {
+		cfg.Service.StatusCommand = nil
+	}
+	if slices.Equal(cfg.Service.StartCommand, defaults.Service.StartCommand) {
+		cfg.Service.StartCommand = nil
+	}
+}
+
 func FillAgentConfig(cfg *AgentConfig) {
+	cfg.StateDir = "/var/lib/ch-k8s-lbaas-agent"
 	FillKeepalivedConfig(&cfg.Keepalived)
 	FillNftablesConfig(&cfg.Nftables)
 }
@@ -200,6 +316,11 @@ func FillControllerConfig(cfg *ControllerConfig) {
 	cfg.PortManager = PortManagerOpenstack
 	cfg.BindPort = 15203
 	cfg.BackendLayer = BackendLayerNodePort
+	cfg.IPPool.ConfigMapNamespace = "kube-system"
+	cfg.IPPool.ConfigMapName = "ch-k8s-lbaas-ip-pool"
+	cfg.Webhook.Timeout = 10
+	cfg.OpenStack.Networking.PortCacheTTL = 30
+	cfg.OpenStack.Networking.PortCacheRefreshInterval = 300
 }
 
 func ValidateControllerConfig(cfg *ControllerConfig) error {
@@ -215,17 +336,20 @@ func ValidateControllerConfig(cfg *ControllerConfig) error {
 	}
 
 	if cfg.PortManager == PortManagerOpenstack {
-		// TODO: Add openstack config validation.
+		if err := validateOpenStackConfig(&cfg.OpenStack, cfg.Agents.Agents); err != nil {
+			return err
+		}
 	} else if cfg.PortManager == PortManagerStatic {
-		if len(cfg.Static.IPv4Addresses) == 0 {
-			return fmt.Errorf("static.ipv4-addresses must have at least one " +
-				"entry if static port manager is used")
-		} else {
-			for _, addr := range cfg.Static.IPv4Addresses {
-				if !addr.Is4() {
-					return fmt.Errorf("%s isn't a valid IPv4 address", addr.String())
-				}
-			}
+		if err := validateStaticConfig(&cfg.Static); err != nil {
+			return err
+		}
+	} else if cfg.PortManager == PortManagerIPPool {
+		if err := validateIPPoolConfig(&cfg.IPPool); err != nil {
+			return err
+		}
+	} else if cfg.PortManager == PortManagerWebhook {
+		if err := validateWebhookConfig(&cfg.Webhook); err != nil {
+			return err
 		}
 	} else {
 		return fmt.Errorf("%s is not a valid port-manager implementation", cfg.PortManager)
@@ -234,6 +358,195 @@ func ValidateControllerConfig(cfg *ControllerConfig) error {
 	return nil
 }
 
+func validateOpenStackConfig(cfg *Config, agents []Agent) error {
+	auth, err := cfg.Global.Resolve()
+	if err != nil {
+		return fmt.Errorf("openstack.auth.clouds-file is invalid: %s", err)
+	}
+	if _, err := auth.ToAuthOptions(); err != nil {
+		return fmt.Errorf("openstack.auth is invalid: %s", err)
+	}
+	if auth.ApplicationCredentialSecret != "" {
+		if auth.ApplicationCredentialID == "" &&
+			(auth.ApplicationCredentialName == "" || (auth.UserID == "" && auth.Username == "")) {
+			return fmt.Errorf("openstack.auth.application-credential-secret requires " +
+				"application-credential-id or application-credential-name with user-id or username")
+		}
+	} else if auth.Password == "" || (auth.UserID == "" && auth.Username == "") {
+		return fmt.Errorf("openstack.auth requires user-id or username with password, " +
+			"or an application credential")
+	}
+
+	network := &cfg.Networking
+	if network.SubnetID == "" {
+		return fmt.Errorf("openstack.network.subnet-id must be set if openstack port manager is used")
+	}
+	if network.UseFloatingIPs && network.FloatingIPNetworkID == "" {
+		return fmt.Errorf("openstack.network.use-floating-ips requires openstack.network.floating-ip-network-id")
+	}
+	if !network.UseFloatingIPs && len(network.AllowedFloatingIPNetworkIDs) > 0 {
+		return fmt.Errorf("openstack.network.allowed-floating-ip-network-ids requires openstack.network.use-floating-ips")
+	}
+	if network.DNSNameTemplate != "" && network.DNSDomain == "" {
+		return fmt.Errorf("openstack.network.dns-name-template requires openstack.network.dns-domain")
+	}
+	if network.PortCacheTTL < 0 {
+		return fmt.Errorf("openstack.network.port-cache-ttl must not be negative")
+	}
+
+	for _, agent := range agents {
+		if agent.PortId == "" {
+			return fmt.Errorf("agents.agent.port-id of %s must be set if openstack port manager is used", agent.URL)
+		}
+	}
+
+	return nil
+}
+
+func validateStaticConfig(cfg *static.Config) error {
+	if len(cfg.IPv4Addresses) == 0 && len(cfg.IPv6Addresses) == 0 &&
+		len(cfg.IPv4Ranges) == 0 && len(cfg.IPv6Ranges) == 0 {
+		return fmt.Errorf("static.ipv4-addresses, static.ipv6-addresses, " +
+			"static.ipv4-ranges or static.ipv6-ranges must have at least one " +
+			"entry if static port manager is used")
+	}
+
+	for _, addr := range cfg.IPv4Addresses {
+		if !addr.Is4() {
+			return fmt.Errorf("%s isn't a valid IPv4 address", addr.String())
+		}
+	}
+	for _, addr := range cfg.IPv6Addresses {
+		if !addr.Is6() || addr.Is4In6() {
+			return fmt.Errorf("%s isn't a valid IPv6 address", addr.String())
+		}
+	}
+
+	return validateRanges(cfg.IPv4Ranges, cfg.IPv6Ranges)
+}
+
+func validateRanges(ipv4Ranges, ipv6Ranges []netip.Prefix) error {
+	for _, prefix := range ipv4Ranges {
+		if !prefix.Addr().Is4() {
+			return fmt.Errorf("%s isn't a valid IPv4 range", prefix.String())
+		}
+	}
+	for _, prefix := range ipv6Ranges {
+		if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+			return fmt.Errorf("%s isn't a valid IPv6 range", prefix.String())
+		}
+	}
+
+	return nil
+}
+
+func validateIPPoolConfig(cfg *ippool.Config) error {
+	if len(cfg.IPv4Ranges) == 0 && len(cfg.IPv6Ranges) == 0 {
+		return fmt.Errorf("ip-pool.ipv4-ranges or ip-pool.ipv6-ranges must " +
+			"have at least one entry if ip-pool port manager is used")
+	}
+
+	if cfg.ConfigMapNamespace == "" || cfg.ConfigMapName == "" {
+		return fmt.Errorf("ip-pool.configmap-namespace and " +
+			"ip-pool.configmap-name must be set")
+	}
+
+	return validateRanges(cfg.IPv4Ranges, cfg.IPv6Ranges)
+}
+
+func validateWebhookConfig(cfg *webhook.Config) error {
+	if !strings.HasPrefix(cfg.URL, "http://") && !strings.HasPrefix(cfg.URL, "https://") {
+		return fmt.Errorf("webhook.url must be an HTTP(S) url (got %q)", cfg.URL)
+	}
+
+	if cfg.Timeout <= 0 {
+		return fmt.Errorf("webhook.timeout must be greater than zero")
+	}
+
+	if cfg.BearerToken != "" && cfg.Username != "" {
+		return fmt.Errorf("webhook.bearer-token and webhook.username are mutually exclusive")
+	}
+
+	return nil
+}
+
+// AllVerificationKeys returns the configured verification keys including the
+// one for tokens without kid, if SharedSecret or PublicKeyFile is set.
+func (cfg *AgentConfig) AllVerificationKeys() []VerificationKey {
+	keys := []VerificationKey{}
+	if cfg.SharedSecret != "" || cfg.PublicKeyFile != "" {
+		keys = append(keys, VerificationKey{SharedSecret: cfg.SharedSecret, PublicKeyFile: cfg.PublicKeyFile})
+	}
+	return append(keys, cfg.VerificationKeys...)
+}
+
+func validateVerificationKeys(cfg *AgentConfig) error {
+	if err := signing.ValidateMethod(cfg.SigningMethod); err != nil {
+		return fmt.Errorf("signing-method is invalid: %s", err)
+	}
+
+	asymmetric := signing.IsAsymmetric(cfg.SigningMethod)
+	if len(cfg.VerificationKeys) == 0 {
+		if asymmetric && cfg.PublicKeyFile == "" {
+			return fmt.Errorf("public-key-file must be set for signing-method %q", cfg.SigningMethod)
+		}
+		if !asymmetric && cfg.SharedSecret == "" {
+			return fmt.Errorf("shared-secret must be set")
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i, key := range cfg.VerificationKeys {
+		if key.ID == "" {
+			return fmt.Errorf("verification-key %d must have an id", i+1)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("verification-key id %q is not unique", key.ID)
+		}
+		ids[key.ID] = true
+
+		if asymmetric && key.PublicKeyFile == "" {
+			return fmt.Errorf("verification-key %q must have a public-key-file for signing-method %q", key.ID, cfg.SigningMethod)
+		}
+		if !asymmetric && key.SharedSecret == "" {
+			return fmt.Errorf("verification-key %q must have a shared-secret", key.ID)
+		}
+	}
+	return nil
+}
+
+// The agent deletes dedicated tables on every update, so they must not be
+// the tables shared with other software.
+func validateDedicatedTables(cfg *Nftables) error {
+	if cfg.PartialReload {
+		return fmt.Errorf("nftables.partial-reload cannot be used with dedicated-tables")
+	}
+	if cfg.FilterTableName == "filter" {
+		return fmt.Errorf("nftables.filter-table-name must not be the shared \"filter\" table with dedicated-tables")
+	}
+	if cfg.NATTableName == "nat" {
+		return fmt.Errorf("nftables.nat-table-name must not be the shared \"nat\" table with dedicated-tables")
+	}
+	if cfg.FilterTableName == cfg.NATTableName {
+		return fmt.Errorf("nftables.filter-table-name and nat-table-name must differ with dedicated-tables")
+	}
+	if cfg.Backend == NftablesBackendFile {
+		if isNftablesUnitCommand(cfg.Service.ReloadCommand) {
+			return fmt.Errorf("nftables.service.reload-command must not reload the nftables service with dedicated-tables, as it flushes the ruleset; load the config-file via \"nft -f\" instead")
+		}
+		if isNftablesUnitCommand(cfg.Service.StartCommand) {
+			return fmt.Errorf("nftables.service.start-command must not start the nftables service with dedicated-tables, as it flushes the ruleset")
+		}
+	}
+	return nil
+}
+
+// Return true if the command manages the nftables service via systemctl
+func isNftablesUnitCommand(cmd []string) bool {
+	return slices.Contains(cmd, "systemctl") &&
+		(slices.Contains(cmd, "nftables") || slices.Contains(cmd, "nftables.service"))
+}
+
 func ValidateAgentConfig(cfg *AgentConfig) error {
 	if cfg.Keepalived.Enabled {
 		if cfg.Keepalived.VRIDBase <= 0 {
@@ -257,14 +570,31 @@ func ValidateAgentConfig(cfg *AgentConfig) error {
 		return fmt.Errorf("nftables.service.config-file must be set")
 	}
 
+	if cfg.Nftables.NATTableType != "ip" && cfg.Nftables.NATTableType != "inet" {
+		return fmt.Errorf("nftables.nat-table-type must be either \"ip\" or \"inet\"")
+	}
+
+	if cfg.Nftables.Backend != NftablesBackendFile && cfg.Nftables.Backend != NftablesBackendNetlink {
+		return fmt.Errorf("nftables.backend must be either \"file\" or \"netlink\"")
+	}
+
 	if cfg.Nftables.PartialReload {
 		if cfg.Nftables.PolicyPrefix == "" {
 			return fmt.Errorf("nftables.policy-prefix must be set if partial-reload is enabled")
 		}
 	}
 
-	if cfg.SharedSecret == "" {
-		return fmt.Errorf("shared-secret must be set")
+	if cfg.Nftables.DedicatedTables {
+		if err := validateDedicatedTables(&cfg.Nftables); err != nil {
+			return err
+		}
+	} else if cfg.Nftables.Backend == NftablesBackendNetlink && cfg.Nftables.PolicyPrefix == "" {
+		// the netlink backend replaces the rules like partial-reload
+		return fmt.Errorf("nftables.policy-prefix must be set for the netlink backend")
+	}
+
+	if err := validateVerificationKeys(cfg); err != nil {
+		return err
 	}
 
 	if cfg.BindAddress == "" {
@@ -275,5 +605,17 @@ func ValidateAgentConfig(cfg *AgentConfig) error {
 		return fmt.Errorf("bind-port must be set")
 	}
 
+	if cfg.StateDir == "" {
+		return fmt.Errorf("state-dir must be set")
+	}
+
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.cert-file and tls.key-file must be set together")
+	}
+
+	if cfg.TLS.ClientCAFile != "" && cfg.TLS.CertFile == "" {
+		return fmt.Errorf("tls.client-ca-file requires tls.cert-file and tls.key-file")
+	}
+
 	return nil
 }
@@ -16,6 +16,8 @@ package config
 
 import (
 	"net/netip"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -30,6 +32,9 @@ backend-layer = "Pod"
 
 [static]
 ipv4-addresses=["203.0.113.113"]
+ipv6-addresses=["2001:db8::113"]
+ipv4-ranges=["198.51.100.0/28"]
+ipv6-ranges=["2001:db8:1::/64"]
 
 [openstack.auth]
 auth-url="http://foo"
@@ -52,11 +57,19 @@ tls-insecure=true
 application-credential-id="1548"
 application-credential-name="credential_name"
 application-credential-secret="sup3rs3cr3t"
+clouds-file="/etc/openstack/clouds.yaml"
+cloud="production"
 
 [openstack.network]
 use-floating-ips=true
 floating-ip-network-id="123abc"
 subnet-id="456def"
+cluster-id="prod"
+adopt-legacy-resources=true
+allowed-subnet-ids=["789ghi"]
+allowed-floating-ip-network-ids=["transit", "none"]
+dns-domain="lb.example.com."
+dns-name-template="{{name}}.{{namespace}}.lb.example.com"
 
 [agents]
 shared-secret="base64-encoded-string"
@@ -125,15 +138,29 @@ func TestCanReadControllerConfig(t *testing.T) {
 	assert.Equal(t, "1548", osa.ApplicationCredentialID)
 	assert.Equal(t, "credential_name", osa.ApplicationCredentialName)
 	assert.Equal(t, "sup3rs3cr3t", osa.ApplicationCredentialSecret)
+	assert.Equal(t, "/etc/openstack/clouds.yaml", osa.CloudsFile)
+	assert.Equal(t, "production", osa.Cloud)
 
 	osn := &cfg.OpenStack.Networking
 	assert.True(t, osn.UseFloatingIPs)
 	assert.Equal(t, "123abc", osn.FloatingIPNetworkID)
 	assert.Equal(t, "456def", osn.SubnetID)
+	assert.Equal(t, "prod", osn.ClusterID)
+	assert.True(t, osn.AdoptLegacyResources)
+	assert.Equal(t, []string{"789ghi"}, osn.AllowedSubnetIDs)
+	assert.Equal(t, []string{"transit", "none"}, osn.AllowedFloatingIPNetworkIDs)
+	assert.Equal(t, "lb.example.com.", osn.DNSDomain)
+	assert.Equal(t, "{{name}}.{{namespace}}.lb.example.com", osn.DNSNameTemplate)
 
 	// check static options
 	addr, err := netip.ParseAddr("203.0.113.113")
 	assert.Equal(t, []netip.Addr{addr}, cfg.Static.IPv4Addresses)
+	addr, err = netip.ParseAddr("2001:db8::113")
+	assert.Equal(t, []netip.Addr{addr}, cfg.Static.IPv6Addresses)
+	prefix, err := netip.ParsePrefix("198.51.100.0/28")
+	assert.Equal(t, []netip.Prefix{prefix}, cfg.Static.IPv4Ranges)
+	prefix, err = netip.ParsePrefix("2001:db8:1::/64")
+	assert.Equal(t, []netip.Prefix{prefix}, cfg.Static.IPv6Ranges)
 
 	// agent config
 	agents := &cfg.Agents
@@ -179,6 +206,7 @@ func TestFillAgentConfig(t *testing.T) {
 	cfg := AgentConfig{}
 	FillAgentConfig(&cfg)
 	assert.Equal(t, "", cfg.SharedSecret)
+	assert.Equal(t, "/var/lib/ch-k8s-lbaas-agent", cfg.StateDir)
 	assert.Equal(t, "", cfg.BindAddress)
 	assert.Equal(t, int32(0), cfg.BindPort)
 
@@ -194,12 +222,18 @@ func TestFillAgentConfig(t *testing.T) {
 	assert.Equal(t, "inet", nftc.FilterTableType)
 	assert.Equal(t, "forward", nftc.FilterForwardChainName)
 	assert.Equal(t, "nat", nftc.NATTableName)
+	assert.Equal(t, "ip", nftc.NATTableType)
 	assert.Equal(t, "postrouting", nftc.NATPostroutingChainName)
 	assert.Equal(t, "prerouting", nftc.NATPreroutingChainName)
 	assert.Equal(t, "", nftc.PolicyPrefix)
 	assert.Equal(t, []string{"sudo", "nft"}, nftc.NftCommand)
 	assert.Equal(t, false, nftc.PartialReload)
 	assert.Equal(t, true, nftc.EnableSNAT)
+	assert.Equal(t, NftablesBackendFile, nftc.Backend)
+	assert.Equal(t, false, nftc.DedicatedTables)
+	assert.Equal(t, 0, nftc.FilterForwardPriority)
+	assert.Equal(t, -100, nftc.NATPreroutingPriority)
+	assert.Equal(t, 100, nftc.NATPostroutingPriority)
 }
 
 func TestAgentConfigWithDefaults(t *testing.T) {
@@ -224,4 +258,399 @@ func TestFillControllerConfig(t *testing.T) {
 	assert.Equal(t, PortManagerOpenstack, cfg.PortManager)
 	assert.Equal(t, BackendLayerNodePort, cfg.BackendLayer)
 	assert.Equal(t, int32(15203), cfg.BindPort)
+	assert.Equal(t, "kube-system", cfg.IPPool.ConfigMapNamespace)
+	assert.Equal(t, "ch-k8s-lbaas-ip-pool", cfg.IPPool.ConfigMapName)
+	assert.Equal(t, 10, cfg.Webhook.Timeout)
+	assert.Equal(t, 30, cfg.OpenStack.Networking.PortCacheTTL)
+	assert.Equal(t, 300, cfg.OpenStack.Networking.PortCacheRefreshInterval)
+}
+
+func TestValidateStaticControllerConfig(t *testing.T) {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.PortManager = PortManagerStatic
+
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Static.IPv6Ranges = []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")}
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Static.IPv6Addresses = []netip.Addr{netip.MustParseAddr("203.0.113.1")}
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Static.IPv6Addresses = nil
+	cfg.Static.IPv4Ranges = []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")}
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateIPPoolControllerConfig(t *testing.T) {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.PortManager = PortManagerIPPool
+
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.IPPool.IPv4Ranges = []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.IPPool.IPv6Ranges = []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")}
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.IPPool.IPv6Ranges = nil
+	cfg.IPPool.ConfigMapName = ""
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateWebhookControllerConfig(t *testing.T) {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.PortManager = PortManagerWebhook
+
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Webhook.URL = "https://ipam-adapter.example"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Webhook.BearerToken = "token"
+	cfg.Webhook.Username = "user"
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Webhook.Username = ""
+	cfg.Webhook.Timeout = 0
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func newValidOpenStackControllerConfig() ControllerConfig {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.OpenStack.Global.AuthURL = "http://keystone:5000/v3"
+	cfg.OpenStack.Global.Username = "lbaas"
+	cfg.OpenStack.Global.Password = "secret"
+	cfg.OpenStack.Global.ProjectID = "project"
+	cfg.OpenStack.Global.UserDomainName = "Default"
+	cfg.OpenStack.Networking.SubnetID = "subnet"
+	return cfg
+}
+
+func TestValidateOpenStackControllerConfig(t *testing.T) {
+	cfg := newValidOpenStackControllerConfig()
+
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.AllowedFloatingIPNetworkIDs = []string{"transit"}
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.UseFloatingIPs = true
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.FloatingIPNetworkID = "public"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.DNSNameTemplate = "{{name}}.lb.example.com"
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.DNSDomain = "lb.example.com"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Networking.PortCacheTTL = -1
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateOpenStackControllerConfigRequiresSettings(t *testing.T) {
+	cfg := newValidOpenStackControllerConfig()
+	cfg.OpenStack.Networking.SubnetID = ""
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg = newValidOpenStackControllerConfig()
+	cfg.Agents.Agents = []Agent{{URL: "http://127.0.0.1:15203", PortId: "agent-port"}}
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.Agents.Agents = append(cfg.Agents.Agents, Agent{URL: "http://127.0.0.2:15203"})
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestToAuthOptionsReportsErrors(t *testing.T) {
+	cfg := newValidOpenStackControllerConfig()
+
+	opts, err := cfg.OpenStack.Global.ToAuthOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, "lbaas", opts.Username)
+	assert.True(t, opts.AllowReauth)
+
+	cfg.OpenStack.Global.AuthURL = ""
+	_, err = cfg.OpenStack.Global.ToAuthOptions()
+	assert.NotNil(t, err)
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateOpenStackControllerConfigChecksCredentials(t *testing.T) {
+	cfg := newValidOpenStackControllerConfig()
+	cfg.OpenStack.Global.Password = ""
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.ApplicationCredentialSecret = "sup3rs3cr3t"
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.ApplicationCredentialName = "lbaas"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.Username = ""
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.ApplicationCredentialID = "1548"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+}
+
+const cloudsYAMLBlob = `
+clouds:
+  production:
+    auth:
+      auth_url: "http://keystone:5000/v3"
+      username: "lbaas"
+      password: "from-clouds-yaml"
+      project_id: "project"
+      user_domain_name: "Default"
+    region_name: "RegionOne"
+    verify: false
+  other:
+    auth:
+      auth_url: "http://other:5000/v3"
+`
+
+func writeCloudsYAML(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "clouds.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte(cloudsYAMLBlob), 0600))
+	return path
+}
+
+func TestResolveAuthOptsFromCloudsYAML(t *testing.T) {
+	auth := AuthOpts{
+		CloudsFile: writeCloudsYAML(t),
+		Cloud:      "production",
+		Password:   "from-toml",
+	}
+
+	resolved, err := auth.Resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, AuthOpts{
+		AuthURL:        "http://keystone:5000/v3",
+		Username:       "lbaas",
+		Password:       "from-toml",
+		ProjectID:      "project",
+		UserDomainName: "Default",
+		Region:         "RegionOne",
+		TLSInsecure:    true,
+	}, resolved)
+
+	opts, err := auth.ToAuthOptions()
+	assert.Nil(t, err)
+	assert.Equal(t, "http://keystone:5000/v3", opts.IdentityEndpoint)
+	assert.Equal(t, "from-toml", opts.Password)
+}
+
+func TestResolveAuthOptsRejectsUnknownCloud(t *testing.T) {
+	auth := AuthOpts{CloudsFile: writeCloudsYAML(t), Cloud: "missing"}
+	_, err := auth.Resolve()
+	assert.NotNil(t, err)
+
+	auth = AuthOpts{CloudsFile: filepath.Join(t.TempDir(), "missing.yaml"), Cloud: "production"}
+	_, err = auth.Resolve()
+	assert.NotNil(t, err)
+}
+
+func TestResolveAuthOptsWithoutCloudsYAML(t *testing.T) {
+	auth := AuthOpts{AuthURL: "http://keystone:5000/v3", Username: "lbaas"}
+	resolved, err := auth.Resolve()
+	assert.Nil(t, err)
+	assert.Equal(t, auth, resolved)
+}
+
+func TestValidateOpenStackControllerConfigWithCloudsYAML(t *testing.T) {
+	cfg := ControllerConfig{}
+	FillControllerConfig(&cfg)
+	cfg.OpenStack.Networking.SubnetID = "subnet"
+	cfg.OpenStack.Global.CloudsFile = writeCloudsYAML(t)
+	cfg.OpenStack.Global.Cloud = "production"
+	assert.Nil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.Cloud = "other"
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+
+	cfg.OpenStack.Global.Cloud = "missing"
+	assert.NotNil(t, ValidateControllerConfig(&cfg))
+}
+
+func TestValidateAgentConfigChecksSigning(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft/nft.d/lbaas.conf"
+	cfg.BindAddress = "0.0.0.0"
+	cfg.BindPort = 15203
+
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "shared-secret must be set")
+
+	cfg.SharedSecret = "some-base64-blob"
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+
+	cfg.SigningMethod = "ed25519"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "public-key-file must be set")
+
+	cfg.SharedSecret = ""
+	cfg.PublicKeyFile = "/etc/ch-k8s-lbaas-agent/controller.pem"
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+
+	cfg.SigningMethod = "hs512"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "signing-method is invalid")
+}
+
+func TestValidateAgentConfigChecksTLS(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft/nft.d/lbaas.conf"
+	cfg.SharedSecret = "some-base64-blob"
+	cfg.BindAddress = "0.0.0.0"
+	cfg.BindPort = 15203
+
+	cfg.TLS.ClientCAFile = "/etc/ch-k8s-lbaas-agent/ca.crt"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "tls.client-ca-file requires")
+
+	cfg.TLS.CertFile = "/etc/ch-k8s-lbaas-agent/tls.crt"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "must be set together")
+
+	cfg.TLS.KeyFile = "/etc/ch-k8s-lbaas-agent/tls.key"
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+}
+
+func TestValidateAgentConfigChecksVerificationKeys(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft/nft.d/lbaas.conf"
+	cfg.BindAddress = "0.0.0.0"
+	cfg.BindPort = 15203
+
+	cfg.VerificationKeys = []VerificationKey{
+		{ID: "2024", SharedSecret: "b2xkLXNlY3JldC0wMTIz"},
+		{ID: "2025", SharedSecret: "bmV3LXNlY3JldC0wMTIz"},
+	}
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+	assert.Len(t, cfg.AllVerificationKeys(), 2)
+
+	cfg.SharedSecret = "MDEyMzQ1Njc4OWFi"
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+	assert.Equal(t, "", cfg.AllVerificationKeys()[0].ID)
+	assert.Len(t, cfg.AllVerificationKeys(), 3)
+
+	cfg.VerificationKeys[1].ID = "2024"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "not unique")
+
+	cfg.VerificationKeys[1].ID = ""
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "verification-key 2 must have an id")
+
+	cfg.VerificationKeys[1].ID = "2025"
+	cfg.SigningMethod = "rs256"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), `verification-key "2024" must have a public-key-file`)
+}
+
+func TestValidateAgentConfigChecksNftablesBackend(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft/nft.d/lbaas.conf"
+	cfg.SharedSecret = "some-base64-blob"
+	cfg.BindAddress = "0.0.0.0"
+	cfg.BindPort = 15203
+
+	cfg.Nftables.Backend = "iptables"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "nftables.backend must be either")
+
+	cfg.Nftables.Backend = NftablesBackendNetlink
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "policy-prefix must be set for the netlink backend")
+
+	cfg.Nftables.PolicyPrefix = "lbaas-"
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+}
+
+func TestValidateAgentConfigChecksDedicatedTables(t *testing.T) {
+	cfg := AgentConfig{}
+	FillAgentConfig(&cfg)
+	cfg.Keepalived.Enabled = false
+	cfg.Nftables.Service.ConfigFile = "/etc/nft/nft.d/lbaas.conf"
+	cfg.SharedSecret = "some-base64-blob"
+	cfg.BindAddress = "0.0.0.0"
+	cfg.BindPort = 15203
+	cfg.Nftables.DedicatedTables = true
+
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), `must not be the shared "filter" table`)
+
+	cfg.Nftables.FilterTableName = "lbaas"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), `must not be the shared "nat" table`)
+
+	cfg.Nftables.NATTableName = "lbaas"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "must differ")
+
+	cfg.Nftables.NATTableName = "lbaas-nat"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "reload-command must not reload the nftables service")
+
+	cfg.Nftables.Service.ReloadCommand = []string{"sudo", "nft", "-f", "/etc/nft/nft.d/lbaas.conf"}
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "start-command must not start the nftables service")
+
+	cfg.Nftables.Service.StartCommand = nil
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+
+	// no policy-prefix is needed, as the tables are replaced as a whole
+	cfg.Nftables.Backend = NftablesBackendNetlink
+	assert.Nil(t, ValidateAgentConfig(&cfg))
+
+	cfg.Nftables.PartialReload = true
+	cfg.Nftables.PolicyPrefix = "lbaas-"
+	assert.ErrorContains(t, ValidateAgentConfig(&cfg), "partial-reload cannot be used with dedicated-tables")
+}
+
+func TestDedicatedTablesReplaceDefaultNftablesCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.toml")
+	err := os.WriteFile(path, []byte(`
+[nftables]
+dedicated-tables = true
+nft-command = ["nft"]
+
+[nftables.service]
+config-file = "/etc/nft/lbaas.conf"
+`), 0o600)
+	assert.Nil(t, err)
+
+	cfg, err := ReadAgentConfigFromFile(path, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"nft", "-f", "/etc/nft/lbaas.conf"}, cfg.Nftables.Service.ReloadCommand)
+	assert.Nil(t, cfg.Nftables.Service.StatusCommand)
+	assert.Nil(t, cfg.Nftables.Service.StartCommand)
+
+	// commands from the config file are kept
+	err = os.WriteFile(path, []byte(`
+[nftables]
+dedicated-tables = true
+
+[nftables.service]
+config-file = "/etc/nft/lbaas.conf"
+reload-command = ["sudo", "/usr/local/bin/load-lbaas-rules"]
+status-command = ["true"]
+`), 0o600)
+	assert.Nil(t, err)
+
+	cfg, err = ReadAgentConfigFromFile(path, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sudo", "/usr/local/bin/load-lbaas-rules"}, cfg.Nftables.Service.ReloadCommand)
+	assert.Equal(t, []string{"true"}, cfg.Nftables.Service.StatusCommand)
+	assert.Nil(t, cfg.Nftables.Service.StartCommand)
+
+	// the netlink backend does not use the commands
+	cfg = AgentConfig{}
+	FillAgentConfig(&cfg)
+	defaultReload := cfg.Nftables.Service.ReloadCommand
+	cfg.Nftables.DedicatedTables = true
+	cfg.Nftables.Backend = NftablesBackendNetlink
+	FillDedicatedTablesDefaults(&cfg.Nftables)
+	assert.Equal(t, defaultReload, cfg.Nftables.Service.ReloadCommand)
 }
@@ -15,9 +15,12 @@
 package config
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/utils/openstack/clientconfig"
-	"k8s.io/klog"
+	"gopkg.in/yaml.v2"
 )
 
 type AuthOpts struct {
@@ -41,12 +44,40 @@ type AuthOpts struct {
 	ApplicationCredentialID     string `toml:"application-credential-id"`
 	ApplicationCredentialName   string `toml:"application-credential-name"`
 	ApplicationCredentialSecret string `toml:"application-credential-secret"`
+
+	// CloudsFile is the path of a clouds.yaml file from which the entry named
+	// Cloud is used. Without CloudsFile, the standard locations of clouds.yaml
+	// are searched. Options set above take precedence over the entry.
+	CloudsFile string `toml:"clouds-file"`
+	Cloud      string `toml:"cloud"`
 }
 
 type NetworkingOpts struct {
 	UseFloatingIPs      bool   `toml:"use-floating-ips"`
 	FloatingIPNetworkID string `toml:"floating-ip-network-id"`
 	SubnetID            string `toml:"subnet-id"`
+	// Subnets and floating IP networks which services may select via
+	// annotations in addition to the defaults above. "none" in
+	// AllowedFloatingIPNetworkIDs allows services without floating IP.
+	AllowedSubnetIDs            []string `toml:"allowed-subnet-ids"`
+	AllowedFloatingIPNetworkIDs []string `toml:"allowed-floating-ip-network-ids"`
+	// DNS domain in which the names of load-balancer addresses are
+	// registered via the Neutron DNS integration; empty disables DNS names
+	DNSDomain string `toml:"dns-domain"`
+	// DNSNameTemplate is the DNS name of services without dns-name
+	// annotation; {{name}} and {{namespace}} are replaced accordingly
+	DNSNameTemplate string `toml:"dns-name-template"`
+	// ClusterID scopes the ports and floating IPs managed by this controller
+	// so that multiple clusters can share an OpenStack project.
+	ClusterID string `toml:"cluster-id"`
+	// AdoptLegacyResources tags managed resources without any cluster ID with
+	// the configured cluster ID on startup.
+	AdoptLegacyResources bool `toml:"adopt-legacy-resources"`
+	// Time in seconds for which Neutron port lookups are cached; 0 disables
+	// the cache
+	PortCacheTTL int `toml:"port-cache-ttl"`
+	// Interval in seconds in which the port cache is refreshed completely
+	PortCacheRefreshInterval int `toml:"port-cache-refresh-interval"`
 }
 
 type Config struct {
@@ -54,7 +85,100 @@ type Config struct {
 	Networking NetworkingOpts `toml:"network"`
 }
 
-func (cfg AuthOpts) ToAuthOptions() gophercloud.AuthOptions {
+// Loads the clouds from a single clouds.yaml file, ignoring secure.yaml and
+// clouds-public.yaml.
+type cloudsYAMLFile string
+
+func (path cloudsYAMLFile) LoadCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	content, err := os.ReadFile(string(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var clouds clientconfig.Clouds
+	err = yaml.Unmarshal(content, &clouds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return clouds.Clouds, nil
+}
+
+func (path cloudsYAMLFile) LoadSecureCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func (path cloudsYAMLFile) LoadPublicCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func setIfEmpty(value *string, fallback string) {
+	if *value == "" {
+		*value = fallback
+	}
+}
+
+// Resolve returns the options with the unset ones filled in from the
+// configured clouds.yaml entry. Options without clouds.yaml entry are
+// returned unchanged.
+func (cfg AuthOpts) Resolve() (AuthOpts, error) {
+	if cfg.CloudsFile == "" && cfg.Cloud == "" {
+		return cfg, nil
+	}
+
+	opts := clientconfig.ClientOpts{
+		Cloud: cfg.Cloud,
+		// this is needed to disable the clientconfig env detection
+		EnvPrefix: "_",
+	}
+	if cfg.CloudsFile != "" {
+		opts.YAMLOpts = cloudsYAMLFile(cfg.CloudsFile)
+	}
+
+	cloud, err := clientconfig.GetCloudFromYAML(&opts)
+	if err != nil {
+		return AuthOpts{}, err
+	}
+
+	resolved := cfg
+	resolved.CloudsFile = ""
+	resolved.Cloud = ""
+
+	if auth := cloud.AuthInfo; auth != nil {
+		setIfEmpty(&resolved.AuthURL, auth.AuthURL)
+		setIfEmpty(&resolved.UserID, auth.UserID)
+		setIfEmpty(&resolved.Username, auth.Username)
+		setIfEmpty(&resolved.Password, auth.Password)
+		setIfEmpty(&resolved.ProjectID, auth.ProjectID)
+		setIfEmpty(&resolved.ProjectName, auth.ProjectName)
+		setIfEmpty(&resolved.DomainID, auth.DomainID)
+		setIfEmpty(&resolved.DomainName, auth.DomainName)
+		setIfEmpty(&resolved.ProjectDomainID, auth.ProjectDomainID)
+		setIfEmpty(&resolved.ProjectDomainName, auth.ProjectDomainName)
+		setIfEmpty(&resolved.UserDomainID, auth.UserDomainID)
+		setIfEmpty(&resolved.UserDomainName, auth.UserDomainName)
+		setIfEmpty(&resolved.ApplicationCredentialID, auth.ApplicationCredentialID)
+		setIfEmpty(&resolved.ApplicationCredentialName, auth.ApplicationCredentialName)
+		setIfEmpty(&resolved.ApplicationCredentialSecret, auth.ApplicationCredentialSecret)
+		if resolved.ProjectDomainID == "" && resolved.ProjectDomainName == "" &&
+			resolved.UserDomainID == "" && resolved.UserDomainName == "" {
+			setIfEmpty(&resolved.DomainName, auth.DefaultDomain)
+		}
+	}
+	setIfEmpty(&resolved.Region, cloud.RegionName)
+	setIfEmpty(&resolved.CAFile, cloud.CACertFile)
+	if cloud.Verify != nil && !*cloud.Verify {
+		resolved.TLSInsecure = true
+	}
+
+	return resolved, nil
+}
+
+func (cfg AuthOpts) ToAuthOptions() (gophercloud.AuthOptions, error) {
+	cfg, err := cfg.Resolve()
+	if err != nil {
+		return gophercloud.AuthOptions{}, err
+	}
+
 	opts := clientconfig.ClientOpts{
 		// this is needed to disable the clientconfig.AuthOptions func env detection
 		EnvPrefix: "_",
@@ -79,12 +203,11 @@ func (cfg AuthOpts) ToAuthOptions() gophercloud.AuthOptions {
 
 	ao, err := clientconfig.AuthOptions(&opts)
 	if err != nil {
-		klog.V(1).Infof("Error parsing auth: %s", err)
-		return gophercloud.AuthOptions{}
+		return gophercloud.AuthOptions{}, err
 	}
 
 	// Persistent service, so we need to be able to renew tokens.
 	ao.AllowReauth = true
 
-	return *ao
+	return *ao, nil
 }
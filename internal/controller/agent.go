@@ -15,33 +15,53 @@
 package controller
 
 import (
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	goerrors "errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt"
+	"k8s.io/klog"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/tlsconfig"
+)
+
+const (
+	// Maximum size of a status response which is read from an agent
+	maxStatusSize = 1 << 20
+	// Maximum size of an error message which is read from an agent
+	maxErrorSize = 4096
 )
 
 type AgentController interface {
 	PushConfig(m *model.LoadBalancer) error
+	OutOfSyncAgents(m *model.LoadBalancer) ([]string, error)
 }
 
 type SimplifiedHTTPClient interface {
 	Post(url, contentType string, body io.Reader) (resp *http.Response, err error)
+	Do(req *http.Request) (*http.Response, error)
 }
 
 type HTTPAgentController struct {
 	AgentURLs     []string
-	SharedSecret  []byte
+	Signer        *signing.Signer
 	Client        SimplifiedHTTPClient
 	TimeTolerance int
+
+	// generation of the last generated token; accessed atomically
+	generation uint64
 }
 
 func NewHTTPAgentController(cfg config.Agents) (*HTTPAgentController, error) {
@@ -56,17 +76,9 @@ func NewHTTPAgentController(cfg config.Agents) (*HTTPAgentController, error) {
 		agentURLs[i] = agent.URL
 	}
 
-	if cfg.SharedSecret == "" {
-		return nil, fmt.Errorf("shared-secret must not be empty")
-	}
-
-	sharedSecret, err := base64.StdEncoding.DecodeString(cfg.SharedSecret)
+	signer, err := newSigner(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("shared-secret must be valid base64: %s", err.Error())
-	}
-
-	if len(sharedSecret) < 12 {
-		return nil, fmt.Errorf("shared-secret must have at least 12 bytes (got %d)", len(sharedSecret))
+		return nil, err
 	}
 
 	timeTolerance := cfg.TokenLifetime
@@ -78,24 +90,225 @@ func NewHTTPAgentController(cfg config.Agents) (*HTTPAgentController, error) {
 		return nil, fmt.Errorf("token-lifetime must be between 1 and 120 (got %d)", timeTolerance)
 	}
 
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("cert-file and key-file must be set together")
+	}
+
+	client := &http.Client{}
+	if cfg.CAFile != "" || cfg.CertFile != "" {
+		client.Transport, err = tlsconfig.NewClientTransport(cfg.CAFile, cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up TLS for the agents: %s", err)
+		}
+	}
+
 	return &HTTPAgentController{
 		AgentURLs:     agentURLs,
-		SharedSecret:  sharedSecret,
-		Client:        &http.Client{},
+		Signer:        signer,
+		Client:        client,
 		TimeTolerance: timeTolerance,
 	}, nil
 }
 
+func decodeSharedSecret(secret string) ([]byte, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("shared-secret must not be empty")
+	}
+
+	sharedSecret, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, fmt.Errorf("shared-secret must be valid base64: %s", err.Error())
+	}
+
+	if len(sharedSecret) < 12 {
+		return nil, fmt.Errorf("shared-secret must have at least 12 bytes (got %d)", len(sharedSecret))
+	}
+	return sharedSecret, nil
+}
+
+// Return the key which signs the tokens: the active one of the signing keys
+// or, if there are none, the one without ID from SharedSecret or
+// PrivateKeyFile.
+func activeSigningKey(cfg config.Agents) (config.SigningKey, error) {
+	if len(cfg.SigningKeys) == 0 {
+		if cfg.ActiveKey != "" {
+			return config.SigningKey{}, fmt.Errorf("active-key requires signing-key entries")
+		}
+		return config.SigningKey{SharedSecret: cfg.SharedSecret, PrivateKeyFile: cfg.PrivateKeyFile}, nil
+	}
+
+	if cfg.SharedSecret != "" || cfg.PrivateKeyFile != "" {
+		return config.SigningKey{}, fmt.Errorf("shared-secret and private-key-file must not be set together with signing-key entries")
+	}
+	if cfg.ActiveKey == "" {
+		return config.SigningKey{}, fmt.Errorf("active-key must be set to one of the signing-key ids")
+	}
+	for _, key := range cfg.SigningKeys {
+		if key.ID == cfg.ActiveKey {
+			return key, nil
+		}
+	}
+	return config.SigningKey{}, fmt.Errorf("active-key %q does not match any signing-key id", cfg.ActiveKey)
+}
+
+func newSigner(cfg config.Agents) (*signing.Signer, error) {
+	if err := signing.ValidateMethod(cfg.SigningMethod); err != nil {
+		return nil, fmt.Errorf("signing-method is invalid: %s", err)
+	}
+
+	key, err := activeSigningKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if signing.IsAsymmetric(cfg.SigningMethod) {
+		if key.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("private-key-file must be set for signing-method %q", cfg.SigningMethod)
+		}
+		return signing.NewSigner(cfg.SigningMethod, signing.Key{ID: key.ID, KeyFile: key.PrivateKeyFile})
+	}
+
+	sharedSecret, err := decodeSharedSecret(key.SharedSecret)
+	if err != nil {
+		return nil, err
+	}
+	return signing.NewSigner(cfg.SigningMethod, signing.Key{ID: key.ID, SharedSecret: sharedSecret})
+}
+
+// resyncGeneration makes sure that the next generated token has a generation
+// newer than the one the agent accepted last.
+func (c *HTTPAgentController) resyncGeneration(agentGeneration uint64) {
+	for {
+		current := atomic.LoadUint64(&c.generation)
+		if current >= agentGeneration {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&c.generation, current, agentGeneration) {
+			klog.Infof("Resynchronized config generation from %d to %d", current, agentGeneration)
+			return
+		}
+	}
+}
+
+func newTokenID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
 func (c *HTTPAgentController) GenerateToken(m *model.LoadBalancer) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &model.ConfigClaim{
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: time.Now().Add(time.Duration(c.TimeTolerance) * time.Second).Unix(),
+			Id:        id,
 		},
-		Config: *m,
+		Generation: atomic.AddUint64(&c.generation, 1),
+		Config:     *m,
+	}
+
+	return c.Signer.Sign(claims)
+}
+
+// GenerateStatusToken returns a token which authorizes requests to the status
+// API of the agents.
+func (c *HTTPAgentController) GenerateStatusToken() (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	return c.Signer.Sign(&jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Duration(c.TimeTolerance) * time.Second).Unix(),
+		Id:        id,
+		Subject:   model.StatusSubject,
+	})
+}
+
+// GetStatus queries the status API of the agent with the URL. Use
+// AgentStatus.InSync to check if the agent has applied the current config.
+func (c *HTTPAgentController) GetStatus(agentUrl string) (*model.AgentStatus, error) {
+	token, err := c.GenerateStatusToken()
+	if err != nil {
+		return nil, err
+	}
+
+	fullUrl := fmt.Sprintf("%s/v1/status", agentUrl)
+	req, err := http.NewRequest(http.MethodGet, fullUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to get status of agent %q: HTTP status %d", fullUrl, resp.StatusCode)
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(c.SharedSecret)
+	status := &model.AgentStatus{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxStatusSize)).Decode(status)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode status of agent %q: %s", fullUrl, err)
+	}
+	return status, nil
+}
+
+// OutOfSyncAgents returns the URLs of the agents which have not applied the
+// config, e.g. because they were restarted with an outdated state. Agents
+// whose status cannot be queried are logged and skipped; pushing the config
+// to them would fail as well.
+func (c *HTTPAgentController) OutOfSyncAgents(m *model.LoadBalancer) ([]string, error) {
+	outOfSync := []string{}
+	for _, agentUrl := range c.AgentURLs {
+		status, err := c.GetStatus(agentUrl)
+		if err != nil {
+			klog.Warningf("Failed to check if agent %q is in sync: %s", agentUrl, err)
+			continue
+		}
+		inSync, err := status.InSync(m)
+		if err != nil {
+			return nil, err
+		}
+		if !inSync {
+			outOfSync = append(outOfSync, agentUrl)
+		}
+	}
+	return outOfSync, nil
+}
+
+// Response of an agent to a pushed config
+type pushResponse struct {
+	StatusCode int
+	Header     http.Header
+	// Body of an unsuccessful response, which explains the error
+	Body string
+}
+
+func (c *HTTPAgentController) post(url, token string) (*pushResponse, error) {
+	resp, err := c.Client.Post(url, "application/jwt", strings.NewReader(token))
+	if err != nil {
+		return nil, err
+	}
+	result := &pushResponse{StatusCode: resp.StatusCode, Header: resp.Header}
+	if resp.Body != nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorSize))
+			result.Body = strings.TrimSpace(string(body))
+		}
+	}
+	return result, nil
 }
 
 func (c *HTTPAgentController) PushConfig(m *model.LoadBalancer) error {
@@ -108,20 +321,43 @@ func (c *HTTPAgentController) PushConfig(m *model.LoadBalancer) error {
 
 	for _, agentUrl := range c.AgentURLs {
 		fullUrl := fmt.Sprintf("%s/v1/apply", agentUrl)
-		buf := strings.NewReader(token)
-		resp, err := c.Client.Post(fullUrl, "application/jwt", buf)
+		resp, err := c.post(fullUrl, token)
 		if err != nil {
 			errors = append(errors, err)
 			continue
 		}
-		if resp.Body != nil {
-			defer resp.Body.Close()
+		if resp.StatusCode == http.StatusConflict {
+			// the agent has already accepted a newer generation, e.g. from
+			// before a restart of the controller: catch up and retry once
+			agentGeneration, parseErr := strconv.ParseUint(resp.Header.Get(model.GenerationHeader), 10, 64)
+			if parseErr != nil {
+				errors = append(errors, fmt.Errorf(
+					"agent %q rejected the config generation without reporting its own: %s",
+					fullUrl,
+					parseErr))
+				continue
+			}
+			c.resyncGeneration(agentGeneration)
+
+			token, err = c.GenerateToken(m)
+			if err != nil {
+				return err
+			}
+			resp, err = c.post(fullUrl, token)
+			if err != nil {
+				errors = append(errors, err)
+				continue
+			}
 		}
 		if resp.StatusCode != 200 {
-			errors = append(errors, fmt.Errorf(
-				"failed to push config to agent %q: HTTP status %d",
-				fullUrl,
-				resp.StatusCode))
+			msg := fmt.Sprintf("failed to push config to agent %q: HTTP status %d", fullUrl, resp.StatusCode)
+			if stage := resp.Header.Get(model.ApplyStageHeader); stage != "" {
+				msg = fmt.Sprintf("%s in stage %s", msg, stage)
+			}
+			if resp.Body != "" {
+				msg = fmt.Sprintf("%s: %s", msg, resp.Body)
+			}
+			errors = append(errors, goerrors.New(msg))
 			continue
 		}
 	}
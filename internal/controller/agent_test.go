@@ -16,22 +16,35 @@ package controller
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/golang-jwt/jwt"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/signing"
 )
 
 type mockSimplifiedHTTPClient struct {
 	mock.Mock
-	sharedSecret []byte
+	verifier *signing.Verifier
+	// generations and IDs of the received tokens
+	generations []uint64
+	tokenIDs    []string
 }
 
 func (m *mockSimplifiedHTTPClient) Post(url, contentType string, body io.Reader) (resp *http.Response, err error) {
@@ -44,9 +57,7 @@ func (m *mockSimplifiedHTTPClient) Post(url, contentType string, body io.Reader)
 	buf := bytes.NewBuffer([]byte{})
 	io.Copy(buf, body)
 	claims := &model.ConfigClaim{}
-	token, err := jwt.ParseWithClaims(string(buf.Bytes()), claims, func(*jwt.Token) (interface{}, error) {
-		return m.sharedSecret, nil
-	})
+	token, err := m.verifier.Parse(string(buf.Bytes()), claims)
 
 	if err != nil || !token.Valid {
 		return &http.Response{
@@ -61,6 +72,9 @@ func (m *mockSimplifiedHTTPClient) Post(url, contentType string, body io.Reader)
 		}, nil
 	}
 
+	m.generations = append(m.generations, claims.Generation)
+	m.tokenIDs = append(m.tokenIDs, claims.Id)
+
 	a := m.Called(url, contentType, claims.Config)
 	resp_untyped := a.Get(0)
 	if resp_untyped == nil {
@@ -69,13 +83,32 @@ func (m *mockSimplifiedHTTPClient) Post(url, contentType string, body io.Reader)
 	return resp_untyped.(*http.Response), a.Error(1)
 }
 
+func (m *mockSimplifiedHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	claims := &jwt.StandardClaims{}
+	parsed, err := m.verifier.Parse(token, claims)
+	if err != nil || !parsed.Valid || claims.Subject != model.StatusSubject {
+		return &http.Response{
+			StatusCode: 401,
+			Body:       &dummyBody{},
+		}, nil
+	}
+
+	a := m.Called(req.Method, req.URL.String())
+	resp_untyped := a.Get(0)
+	if resp_untyped == nil {
+		return nil, a.Error(1)
+	}
+	return resp_untyped.(*http.Response), a.Error(1)
+}
+
 type acFixture struct {
 	t *testing.T
 
 	client *mockSimplifiedHTTPClient
 
-	sharedSecret []byte
-	agents       []string
+	signer *signing.Signer
+	agents []string
 }
 
 func newACFixture(t *testing.T) *acFixture {
@@ -86,19 +119,19 @@ func newACFixture(t *testing.T) *acFixture {
 	if err != nil {
 		panic(err.Error())
 	}
-	f.sharedSecret = secret
+	f.signer = signing.NewHMACSigner(secret)
 	f.agents = []string{"http://127.1.0.1", "http://127.1.0.2/subpath"}
 	f.client = &mockSimplifiedHTTPClient{
-		sharedSecret: secret,
+		verifier: signing.NewHMACVerifier(secret),
 	}
 	return f
 }
 
 func (f *acFixture) newAgentController() *HTTPAgentController {
 	return &HTTPAgentController{
-		SharedSecret: f.sharedSecret,
-		AgentURLs:    f.agents,
-		Client:       f.client,
+		Signer:    f.signer,
+		AgentURLs: f.agents,
+		Client:    f.client,
 	}
 }
 
@@ -130,3 +163,249 @@ func TestPushJWTViaHTTP(t *testing.T) {
 		assert.Nil(t, err)
 	})
 }
+
+func writeEd25519KeyPair(t *testing.T) (privateKeyFile, publicKeyFile string) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+
+	dir := t.TempDir()
+	privateKeyFile = filepath.Join(dir, "private.pem")
+	publicKeyFile = filepath.Join(dir, "public.pem")
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(privateKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	der, err = x509.MarshalPKIXPublicKey(publicKey)
+	require.Nil(t, err)
+	require.Nil(t, os.WriteFile(publicKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return privateKeyFile, publicKeyFile
+}
+
+func TestPushJWTSignedWithEd25519(t *testing.T) {
+	f := newACFixture(t)
+	privateKeyFile, publicKeyFile := writeEd25519KeyPair(t)
+
+	c, err := NewHTTPAgentController(config.Agents{
+		SigningMethod:  signing.MethodEd25519,
+		PrivateKeyFile: privateKeyFile,
+		Agents:         []config.Agent{{URL: "http://127.1.0.1"}},
+	})
+	require.Nil(t, err)
+
+	f.client.verifier, err = signing.NewVerifier(signing.MethodEd25519, []signing.Key{{KeyFile: publicKeyFile}})
+	require.Nil(t, err)
+	c.Client = f.client
+
+	m := &model.LoadBalancer{}
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 200, Body: &dummyBody{}}, nil).Times(1)
+
+	err = c.PushConfig(m)
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestNewHTTPAgentControllerChecksSigningConfig(t *testing.T) {
+	agents := []config.Agent{{URL: "http://127.1.0.1"}}
+
+	_, err := NewHTTPAgentController(config.Agents{Agents: agents})
+	assert.ErrorContains(t, err, "shared-secret must not be empty")
+
+	_, err = NewHTTPAgentController(config.Agents{SigningMethod: signing.MethodEd25519, Agents: agents})
+	assert.ErrorContains(t, err, "private-key-file must be set")
+
+	_, err = NewHTTPAgentController(config.Agents{SigningMethod: "none", SharedSecret: "MDEyMzQ1Njc4OWFi", Agents: agents})
+	assert.ErrorContains(t, err, "signing-method is invalid")
+
+	_, err = NewHTTPAgentController(config.Agents{SharedSecret: "MDEyMzQ1Njc4OWFi", CertFile: "/tls.crt", Agents: agents})
+	assert.ErrorContains(t, err, "cert-file and key-file must be set together")
+
+	_, err = NewHTTPAgentController(config.Agents{SharedSecret: "MDEyMzQ1Njc4OWFi", CAFile: "/nonexistent/ca.crt", Agents: agents})
+	assert.ErrorContains(t, err, "failed to set up TLS")
+}
+
+func TestPushConfigIncreasesGeneration(t *testing.T) {
+	f := newACFixture(t)
+	f.agents = f.agents[:1]
+	m := &model.LoadBalancer{}
+
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 200, Body: &dummyBody{}}, nil).Times(2)
+
+	f.run(func(c *HTTPAgentController) {
+		assert.Nil(t, c.PushConfig(m))
+		assert.Nil(t, c.PushConfig(m))
+	})
+
+	assert.Equal(t, []uint64{1, 2}, f.client.generations)
+	assert.NotEmpty(t, f.client.tokenIDs[0])
+	assert.NotEqual(t, f.client.tokenIDs[0], f.client.tokenIDs[1])
+}
+
+func TestPushConfigResynchronizesGeneration(t *testing.T) {
+	f := newACFixture(t)
+	m := &model.LoadBalancer{}
+
+	conflict := &http.Response{
+		StatusCode: 409,
+		Header:     http.Header{model.GenerationHeader: []string{"41"}},
+		Body:       &dummyBody{},
+	}
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(conflict, nil).Once()
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 200, Body: &dummyBody{}}, nil).Once()
+	f.client.On("Post", "http://127.1.0.2/subpath/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 200, Body: &dummyBody{}}, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		assert.Nil(t, c.PushConfig(m))
+	})
+
+	assert.Equal(t, []uint64{1, 42, 42}, f.client.generations)
+}
+
+func TestPushConfigFailsOnConflictWithoutGeneration(t *testing.T) {
+	f := newACFixture(t)
+	f.agents = f.agents[:1]
+	m := &model.LoadBalancer{}
+
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(&http.Response{StatusCode: 409, Body: &dummyBody{}}, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		assert.NotNil(t, c.PushConfig(m))
+	})
+}
+
+func TestNewHTTPAgentControllerSignsWithActiveKey(t *testing.T) {
+	cfg := config.Agents{
+		SigningKeys: []config.SigningKey{
+			{ID: "old", SharedSecret: "b2xkLXNlY3JldC0wMTIz"},
+			{ID: "new", SharedSecret: "bmV3LXNlY3JldC0wMTIz"},
+		},
+		ActiveKey: "new",
+		Agents:    []config.Agent{{URL: "http://127.1.0.1"}},
+	}
+
+	c, err := NewHTTPAgentController(cfg)
+	require.Nil(t, err)
+
+	token, err := c.GenerateToken(&model.LoadBalancer{})
+	require.Nil(t, err)
+
+	verifier, err := signing.NewVerifier(signing.MethodHMAC, []signing.Key{
+		{ID: "old", SharedSecret: []byte("old-secret-0123")},
+		{ID: "new", SharedSecret: []byte("new-secret-0123")},
+	})
+	require.Nil(t, err)
+	parsed, err := verifier.Parse(token, &model.ConfigClaim{})
+	assert.Nil(t, err)
+	assert.Equal(t, "new", parsed.Header["kid"])
+
+	cfg.ActiveKey = "other"
+	_, err = NewHTTPAgentController(cfg)
+	assert.ErrorContains(t, err, `active-key "other" does not match`)
+
+	cfg.ActiveKey = ""
+	_, err = NewHTTPAgentController(cfg)
+	assert.ErrorContains(t, err, "active-key must be set")
+
+	cfg.ActiveKey = "new"
+	cfg.SharedSecret = "MDEyMzQ1Njc4OWFi"
+	_, err = NewHTTPAgentController(cfg)
+	assert.ErrorContains(t, err, "must not be set together with signing-key")
+}
+
+func TestGetStatus(t *testing.T) {
+	f := newACFixture(t)
+	m := &model.LoadBalancer{Ingress: []model.IngressIP{{Address: "172.23.42.1"}}}
+	hash, err := m.Hash()
+	require.Nil(t, err)
+
+	body := io.NopCloser(strings.NewReader(`{"version": "v1.2.3", "generation": 7, "config-hash": "` + hash + `", "services": [{"name": "nftables", "healthy": true}]}`))
+	f.client.On("Do", "GET", "http://127.1.0.1/v1/status").Return(&http.Response{StatusCode: 200, Body: body}, nil).Once()
+	f.client.On("Do", "GET", "http://127.1.0.2/subpath/v1/status").Return(&http.Response{StatusCode: 500, Body: &dummyBody{}}, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		status, err := c.GetStatus("http://127.1.0.1")
+		require.Nil(t, err)
+		assert.Equal(t, "v1.2.3", status.Version)
+		assert.Equal(t, uint64(7), status.Generation)
+		assert.Equal(t, []model.ServiceStatus{{Name: "nftables", Healthy: true}}, status.Services)
+
+		inSync, err := status.InSync(m)
+		assert.Nil(t, err)
+		assert.True(t, inSync)
+
+		inSync, err = status.InSync(&model.LoadBalancer{})
+		assert.Nil(t, err)
+		assert.False(t, inSync)
+
+		_, err = c.GetStatus("http://127.1.0.2/subpath")
+		assert.ErrorContains(t, err, "HTTP status 500")
+	})
+}
+
+func TestOutOfSyncAgents(t *testing.T) {
+	f := newACFixture(t)
+	m := &model.LoadBalancer{Ingress: []model.IngressIP{{Address: "172.23.42.1"}}}
+	hash, err := m.Hash()
+	require.Nil(t, err)
+
+	body := io.NopCloser(strings.NewReader(`{"generation": 7, "config-hash": "` + hash + `"}`))
+	f.client.On("Do", "GET", "http://127.1.0.1/v1/status").Return(&http.Response{StatusCode: 200, Body: body}, nil).Once()
+	body = io.NopCloser(strings.NewReader(`{"generation": 3, "config-hash": "outdated", "restored": true}`))
+	f.client.On("Do", "GET", "http://127.1.0.2/subpath/v1/status").Return(&http.Response{StatusCode: 200, Body: body}, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		outOfSync, err := c.OutOfSyncAgents(m)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"http://127.1.0.2/subpath"}, outOfSync)
+	})
+}
+
+func TestOutOfSyncAgentsSkipsUnreachableAgents(t *testing.T) {
+	f := newACFixture(t)
+	m := &model.LoadBalancer{}
+
+	f.client.On("Do", "GET", "http://127.1.0.1/v1/status").Return(nil, errors.New("connection refused")).Once()
+	f.client.On("Do", "GET", "http://127.1.0.2/subpath/v1/status").Return(&http.Response{StatusCode: 500, Body: &dummyBody{}}, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		outOfSync, err := c.OutOfSyncAgents(m)
+		assert.Nil(t, err)
+		assert.Empty(t, outOfSync)
+	})
+}
+
+func TestPushConfigReportsFailedStage(t *testing.T) {
+	f := newACFixture(t)
+	f.agents = f.agents[:1]
+	m := &model.LoadBalancer{}
+
+	failed := &http.Response{
+		StatusCode: 500,
+		Header:     http.Header{model.ApplyStageHeader: []string{"reload"}},
+		Body:       &dummyBody{},
+	}
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(failed, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		err := c.PushConfig(m)
+		assert.ErrorContains(t, err, "HTTP status 500 in stage reload")
+	})
+}
+
+func TestPushConfigReportsAgentError(t *testing.T) {
+	f := newACFixture(t)
+	f.agents = f.agents[:1]
+	m := &model.LoadBalancer{}
+
+	failed := &http.Response{
+		StatusCode: 400,
+		Header:     http.Header{model.ApplyStageHeader: []string{"validate-files"}},
+		Body:       io.NopCloser(strings.NewReader("Failed to apply config: syntax error\n")),
+	}
+	f.client.On("Post", "http://127.1.0.1/v1/apply", "application/jwt", *m).Return(failed, nil).Once()
+
+	f.run(func(c *HTTPAgentController) {
+		err := c.PushConfig(m)
+		assert.EqualError(t, err, `failed to push config to agent "http://127.1.0.1/v1/apply": HTTP status 400 in stage validate-files: Failed to apply config: syntax error`)
+	})
+}
@@ -23,10 +23,13 @@ import (
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	discoveryinformers "k8s.io/client-go/informers/discovery/v1"
 	networkinginformers "k8s.io/client-go/informers/networking/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -81,7 +84,7 @@ func NewController(
 	kubeclientset kubernetes.Interface,
 	serviceInformer coreinformers.ServiceInformer,
 	nodeInformer coreinformers.NodeInformer,
-	endpointsInformer coreinformers.EndpointsInformer,
+	endpointSlicesInformer discoveryinformers.EndpointSliceInformer,
 	networkPoliciesInformer networkinginformers.NetworkPolicyInformer,
 	l3portmanager L3PortManager,
 	agentController AgentController,
@@ -154,19 +157,20 @@ func NewController(
 		})
 	}
 
-	if endpointsInformer != nil {
-		endpointsInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+	if endpointSlicesInformer != nil {
+		endpointSlicesInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 			AddFunc: controller.handleAuxUpdated,
 			UpdateFunc: func(old, new interface{}) {
-				oldEndpoints := old.(*corev1.Endpoints)
-				newEndpoints := new.(*corev1.Endpoints)
+				oldSlice := old.(*discoveryv1.EndpointSlice)
+				newSlice := new.(*discoveryv1.EndpointSlice)
 
-				// addresses is all we care about
-				if reflect.DeepEqual(oldEndpoints.Subsets, newEndpoints.Subsets) {
+				// endpoints and ports is all we care about
+				if reflect.DeepEqual(oldSlice.Endpoints, newSlice.Endpoints) &&
+					reflect.DeepEqual(oldSlice.Ports, newSlice.Ports) {
 					return
 				}
 
-				controller.handleAuxUpdated(newEndpoints)
+				controller.handleAuxUpdated(newSlice)
 			},
 			DeleteFunc: controller.handleAuxUpdated,
 		})
@@ -204,6 +208,10 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	}
 	klog.Info("Informer caches are synchronized, enqueueing job to remove the cleanup barrier")
 
+	if err := claimExistingPorts(c.worker.l3portmanager, c.servicesLister); err != nil {
+		return fmt.Errorf("failed to claim the ports of the existing services: %s", err)
+	}
+
 	klog.Info("Starting workers")
 	go wait.Until(c.worker.Run, time.Second, stopCh)
 
@@ -230,6 +238,8 @@ func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 
 	go wait.Until(c.ensureAgentsState, 300*time.Second, stopCh)
 
+	go wait.Until(c.checkAgentsSync, 60*time.Second, stopCh)
+
 	klog.Info("Started workers")
 	<-stopCh
 	klog.Info("Shutting down workers")
@@ -255,10 +265,34 @@ func (c *Controller) periodicCleanup() {
 	}
 }
 
+// claimExistingPorts claims the ports of all services at port managers which
+// do not persist their allocations. It must run before the workers start.
+func claimExistingPorts(l3portmanager L3PortManager, servicesLister corelisters.ServiceLister) error {
+	claimManager, ok := l3portmanager.(L3PortClaimManager)
+	if !ok {
+		return nil
+	}
+
+	services, err := servicesLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	portIDs := []string{}
+	for _, svc := range services {
+		portIDs = append(portIDs, getPortAnnotations(svc)...)
+	}
+	return claimManager.ClaimPorts(portIDs)
+}
+
 func (c *Controller) ensureAgentsState() {
 	c.worker.EnqueueJob(&EnsureAgentsStateJob{})
 }
 
+func (c *Controller) checkAgentsSync() {
+	c.worker.EnqueueJob(&CheckAgentsSyncJob{})
+}
+
 // handleObject will take any resource implementing metav1.Object and attempt
 // to find the Foo resource that 'owns' it. It does this by looking at the
 // objects metadata.ownerReferences field for an appropriate OwnerReference.
@@ -18,6 +18,7 @@
 package controller
 
 import (
+	"net/netip"
 	"reflect"
 	"testing"
 	"time"
@@ -29,13 +30,18 @@ import (
 	"k8s.io/apimachinery/pkg/util/diff"
 	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	core "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/klog"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	controllertesting "github.com/cloudandheat/ch-k8s-lbaas/internal/controller/testing"
 	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/static"
 )
 
 var (
@@ -74,7 +80,7 @@ func (f *fixture) newController() (*Controller, kubeinformers.SharedInformerFact
 		f.kubeclient,
 		k8sI.Core().V1().Services(),
 		k8sI.Core().V1().Nodes(),
-		k8sI.Core().V1().Endpoints(),
+		k8sI.Discovery().V1().EndpointSlices(),
 		k8sI.Networking().V1().NetworkPolicies(),
 		ostesting.NewMockL3PortManager(),
 		controllertesting.NewMockAgentController(),
@@ -190,3 +196,27 @@ func getKey(svc *corev1.Service, t *testing.T) string {
 }
 
 func int32Ptr(i int32) *int32 { return &i }
+
+func TestClaimExistingPortsSeedsPortManager(t *testing.T) {
+	l3portmanager, err := static.NewStaticL3PortManager(&static.Config{
+		IPv4Ranges: []netip.Prefix{netip.MustParsePrefix("203.0.113.0/29")},
+	})
+	require.Nil(t, err)
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	svc := newService("in-use")
+	svc.Annotations = map[string]string{AnnotationInboundPort: "203.0.113.1,2001:db8::1"}
+	require.Nil(t, indexer.Add(svc))
+	require.Nil(t, indexer.Add(newService("unmapped")))
+
+	err = claimExistingPorts(l3portmanager, corelisters.NewServiceLister(indexer))
+	assert.Nil(t, err)
+
+	portID, err := l3portmanager.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", portID)
+
+	// port managers which persist their allocations are skipped
+	err = claimExistingPorts(ostesting.NewMockL3PortManager(), corelisters.NewServiceLister(indexer))
+	assert.Nil(t, err)
+}
@@ -18,6 +18,7 @@ import (
 	"fmt"
 
 	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	networkinglisters "k8s.io/client-go/listers/networking/v1"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
@@ -25,7 +26,7 @@ import (
 )
 
 type LoadBalancerModelGenerator interface {
-	GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error)
+	GenerateModel(portAssignment map[string][]string) (*model.LoadBalancer, error)
 }
 
 func NewLoadBalancerModelGenerator(
@@ -33,7 +34,7 @@ func NewLoadBalancerModelGenerator(
 	l3portmanager L3PortManager,
 	services corelisters.ServiceLister,
 	nodes corelisters.NodeLister,
-	endpoints corelisters.EndpointsLister,
+	endpointSlices discoverylisters.EndpointSliceLister,
 	networkpolicies networkinglisters.NetworkPolicyLister,
 	pods corelisters.PodLister) (LoadBalancerModelGenerator, error) {
 	switch backendLayer {
@@ -47,7 +48,7 @@ func NewLoadBalancerModelGenerator(
 		), nil
 	case config.BackendLayerPod:
 		return NewPodLoadBalancerModelGenerator(
-			l3portmanager, services, endpoints, networkpolicies, pods,
+			l3portmanager, services, endpointSlices, networkpolicies, pods,
 		), nil
 	default:
 		return nil, fmt.Errorf("invalid backend type: %q", backendLayer)
@@ -15,7 +15,9 @@
 package controller
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 )
@@ -34,40 +36,74 @@ func NewClusterIPLoadBalancerModelGenerator(
 	}
 }
 
-func (g *ClusterIPLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error) {
+// Return the cluster IP of the service which has the same address family as
+// the given ingress address. Falls back to the primary cluster IP if the
+// family cannot be determined. Values which are no IP addresses, like "None"
+// of headless services, are skipped.
+func getClusterIPForIngress(svc *corev1.Service, ingressAddress string) string {
+	clusterIPs := svc.Spec.ClusterIPs
+	if len(clusterIPs) == 0 {
+		clusterIPs = []string{svc.Spec.ClusterIP}
+	}
+
+	family, familyErr := getIPFamily(ingressAddress)
+	for _, clusterIP := range clusterIPs {
+		clusterIPFamily, err := getIPFamily(clusterIP)
+		if err != nil {
+			continue
+		}
+		if familyErr != nil || clusterIPFamily == family {
+			return clusterIP
+		}
+	}
+	return ""
+}
+
+func (g *ClusterIPLoadBalancerModelGenerator) GenerateModel(portAssignment map[string][]string) (*model.LoadBalancer, error) {
 	result := &model.LoadBalancer{}
 
 	ingressMap := map[string]model.IngressIP{}
 
-	for serviceKey, portID := range portAssignment {
+	for serviceKey, portIDs := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
 			return nil, err
 		}
 
-		ingress, ok := ingressMap[portID]
-		if !ok {
-			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
-			if err != nil {
-				return nil, err
+		for _, portID := range portIDs {
+			ingress, ok := ingressMap[portID]
+			if !ok {
+				ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
+				if err != nil {
+					return nil, err
+				}
+				ingress = model.IngressIP{
+					Address: ingressIP,
+					Ports:   []model.PortForward{},
+				}
 			}
-			ingress = model.IngressIP{
-				Address: ingressIP,
-				Ports:   []model.PortForward{},
+
+			destAddress := getClusterIPForIngress(svc, ingress.Address)
+			if destAddress == "" {
+				klog.Warningf(
+					"service %q has no cluster IP matching the address family of ingress IP %q",
+					serviceKey,
+					ingress.Address)
+				continue
 			}
-		}
 
-		for _, svcPort := range svc.Spec.Ports {
-			ingress.Ports = append(ingress.Ports, model.PortForward{
-				Protocol:             svcPort.Protocol,
-				InboundPort:          svcPort.Port,
-				DestinationPort:      svcPort.Port,
-				DestinationAddresses: []string{svc.Spec.ClusterIP},
-			})
-		}
+			for _, svcPort := range svc.Spec.Ports {
+				ingress.Ports = append(ingress.Ports, model.PortForward{
+					Protocol:             svcPort.Protocol,
+					InboundPort:          svcPort.Port,
+					DestinationPort:      svcPort.Port,
+					DestinationAddresses: []string{destAddress},
+				})
+			}
 
-		ingressMap[portID] = ingress
+			ingressMap[portID] = ingress
+		}
 	}
 
 	result.Ingress = make([]model.IngressIP, len(ingressMap))
@@ -84,7 +84,7 @@ func TestClusterIPReturnsEmptyModelForEmptyAssignment(t *testing.T) {
 	f := newClusterIPGeneratorFixture(t)
 
 	f.runWith(func(g *ClusterIPLoadBalancerModelGenerator) {
-		m, err := g.GenerateModel(map[string]string{})
+		m, err := g.GenerateModel(map[string][]string{})
 		assert.Nil(t, err)
 		assert.NotNil(t, m)
 		assert.Equal(t, 0, len(m.Ingress))
@@ -112,8 +112,8 @@ func TestClusterIPSinglePortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc)
 
-	a := map[string]string{
-		model.FromService(svc).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -154,9 +154,9 @@ func TestClusterIPMultiPortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc2)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -219,10 +219,10 @@ func TestClusterIPMultiPortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc3)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
-		model.FromService(svc3).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
+		model.FromService(svc3).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -268,3 +268,53 @@ func TestClusterIPMultiPortMultiServiceAssignment(t *testing.T) {
 		})
 	})
 }
+
+func TestClusterIPDualStackServiceUsesClusterIPOfIngressFamily(t *testing.T) {
+	f := newClusterIPGeneratorFixture(t)
+
+	svc := newService("svc-1")
+	svc.Spec.ClusterIP = "10.20.30.40"
+	svc.Spec.ClusterIPs = []string{"10.20.30.40", "fd00::40"}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP},
+	}
+	f.addService(svc)
+
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1", "port-id-2"},
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("172.16.0.1", nil).Times(1)
+	f.l3portmanager.On("GetInternalAddress", "port-id-2").Return("fd01::1", nil).Times(1)
+
+	f.runWith(func(g *ClusterIPLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.NotNil(t, m)
+		assert.Equal(t, 2, len(m.Ingress))
+
+		anyIngressIP(t, m.Ingress, "172.16.0.1", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"10.20.30.40"}, p.DestinationAddresses)
+			})
+		})
+
+		anyIngressIP(t, m.Ingress, "fd01::1", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"fd00::40"}, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
+func TestClusterIPSkipsClusterIPsWhichAreNoAddresses(t *testing.T) {
+	svc := newService("svc-1")
+	svc.Spec.ClusterIP = "None"
+	svc.Spec.ClusterIPs = []string{"None"}
+
+	assert.Equal(t, "", getClusterIPForIngress(svc, "172.16.0.1"))
+	assert.Equal(t, "", getClusterIPForIngress(svc, "ingress-ip-1"))
+
+	svc.Spec.ClusterIPs = []string{"None", "fd00::40"}
+	assert.Equal(t, "fd00::40", getClusterIPForIngress(svc, "ingress-ip-1"))
+}
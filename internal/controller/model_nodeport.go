@@ -91,7 +91,7 @@ func (g *NodePortLoadBalancerModelGenerator) getDestinationAddresses() (addresse
 	return addressesV4, addressesV6, nil
 }
 
-func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error) {
+func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[string][]string) (*model.LoadBalancer, error) {
 	addressesV4, addressesV6, err := g.getDestinationAddresses()
 	if err != nil {
 		return nil, err
@@ -101,53 +101,55 @@ func (g *NodePortLoadBalancerModelGenerator) GenerateModel(portAssignment map[st
 
 	ingressMap := map[string]model.IngressIP{}
 
-	for serviceKey, portID := range portAssignment {
+	for serviceKey, portIDs := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
 			return nil, err
 		}
 
-		ingress, ok := ingressMap[portID]
-		if !ok {
-			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
-			if err != nil {
-				return nil, err
+		for _, portID := range portIDs {
+			ingress, ok := ingressMap[portID]
+			if !ok {
+				ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
+				if err != nil {
+					return nil, err
+				}
+				ingress = model.IngressIP{
+					Address: ingressIP,
+					Ports:   []model.PortForward{},
+				}
 			}
-			ingress = model.IngressIP{
-				Address: ingressIP,
-				Ports:   []model.PortForward{},
+
+			if validateIpAddress(ingress.Address) != nil {
+				continue
 			}
-		}
 
-		if validateIpAddress(ingress.Address) != nil {
-			continue
-		}
+			var destAddresses []string
 
-		var destAddresses []string
-
-		if isIPv4Address(ingress.Address) {
-			destAddresses = append(destAddresses, addressesV4...)
-		} else if isIPv6Address(ingress.Address) {
-			destAddresses = append(destAddresses, addressesV6...)
-		} else {
-			klog.Warningf(
-				"could not determine address family of ingress IP %q for service %q",
-				ingress.Address,
-				svc.Name)
-			continue
-		}
+			if isIPv4Address(ingress.Address) {
+				destAddresses = append(destAddresses, addressesV4...)
+			} else if isIPv6Address(ingress.Address) {
+				destAddresses = append(destAddresses, addressesV6...)
+			} else {
+				klog.Warningf(
+					"could not determine address family of ingress IP %q for service %q",
+					ingress.Address,
+					svc.Name)
+				continue
+			}
 
-		for _, svcPort := range svc.Spec.Ports {
-			ingress.Ports = append(ingress.Ports, model.PortForward{
-				Protocol:             svcPort.Protocol,
-				InboundPort:          svcPort.Port,
-				DestinationPort:      svcPort.NodePort,
-				DestinationAddresses: destAddresses,
-			})
-		}
+			for _, svcPort := range svc.Spec.Ports {
+				ingress.Ports = append(ingress.Ports, model.PortForward{
+					Protocol:             svcPort.Protocol,
+					InboundPort:          svcPort.Port,
+					DestinationPort:      svcPort.NodePort,
+					DestinationAddresses: destAddresses,
+				})
+			}
 
-		ingressMap[portID] = ingress
+			ingressMap[portID] = ingress
+		}
 	}
 
 	result.Ingress = make([]model.IngressIP, len(ingressMap))
@@ -148,7 +148,7 @@ func TestNodePortReturnsEmptyModelForEmptyAssignment(t *testing.T) {
 	f := newNodePortGeneratorFixture(t)
 
 	f.runWith(func(g *NodePortLoadBalancerModelGenerator) {
-		m, err := g.GenerateModel(map[string]string{})
+		m, err := g.GenerateModel(map[string][]string{})
 		assert.Nil(t, err)
 		assert.NotNil(t, m)
 		assert.Equal(t, 0, len(m.Ingress))
@@ -175,8 +175,8 @@ func TestNodePortSinglePortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc)
 
-	a := map[string]string{
-		model.FromService(svc).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
@@ -215,9 +215,9 @@ func TestNodePortSinglePortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc2)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
@@ -268,9 +268,9 @@ func TestNodePortMultiPortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc2)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
@@ -333,10 +333,10 @@ func TestNodePortMultiPortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc3)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
-		model.FromService(svc3).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
+		model.FromService(svc3).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("10.0.0.2", nil).Times(1)
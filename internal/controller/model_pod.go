@@ -16,12 +16,15 @@ package controller
 
 import (
 	goerrors "errors"
+	"sort"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
 	networkinglisters "k8s.io/client-go/listers/networking/v1"
 
 	"k8s.io/klog"
@@ -30,44 +33,52 @@ import (
 )
 
 var (
-	errPortNotFoundInSubset = goerrors.New("port not found in subset")
+	errPortNotFoundInSlice = goerrors.New("port not found in endpoint slice")
 )
 
 type PodLoadBalancerModelGenerator struct {
 	l3portmanager   L3PortManager
 	services        corelisters.ServiceLister
 	networkpolicies networkinglisters.NetworkPolicyLister
-	endpoints       corelisters.EndpointsLister
+	endpointSlices  discoverylisters.EndpointSliceLister
 	pods            corelisters.PodLister
 }
 
 func NewPodLoadBalancerModelGenerator(
 	l3portmanager L3PortManager,
 	services corelisters.ServiceLister,
-	endpoints corelisters.EndpointsLister,
+	endpointSlices discoverylisters.EndpointSliceLister,
 	networkpolicies networkinglisters.NetworkPolicyLister,
 	pods corelisters.PodLister) *PodLoadBalancerModelGenerator {
 	return &PodLoadBalancerModelGenerator{
 		l3portmanager:   l3portmanager,
 		services:        services,
-		endpoints:       endpoints,
+		endpointSlices:  endpointSlices,
 		networkpolicies: networkpolicies,
 		pods:            pods,
 	}
 }
 
-func (g *PodLoadBalancerModelGenerator) findPort(subset *corev1.EndpointSubset, name string, targetPort int32, protocol corev1.Protocol) (int32, error) {
+func (g *PodLoadBalancerModelGenerator) findPort(slice *discoveryv1.EndpointSlice, name string, targetPort int32, protocol corev1.Protocol) (int32, error) {
 	nameMatch := int32(-1)
 	portMatch := int32(-1)
-	for _, epPort := range subset.Ports {
-		if epPort.Protocol != protocol {
+	for _, epPort := range slice.Ports {
+		if epPort.Port == nil {
 			continue
 		}
-		if name != "" && epPort.Name == name {
-			nameMatch = epPort.Port
+		// The API defaults an unset protocol to TCP
+		epProtocol := corev1.ProtocolTCP
+		if epPort.Protocol != nil {
+			epProtocol = *epPort.Protocol
 		}
-		if epPort.Port == targetPort {
-			portMatch = epPort.Port
+		if epProtocol != protocol {
+			continue
+		}
+		if name != "" && epPort.Name != nil && *epPort.Name == name {
+			nameMatch = *epPort.Port
+		}
+		if *epPort.Port == targetPort {
+			portMatch = *epPort.Port
 		}
 	}
 
@@ -77,7 +88,55 @@ func (g *PodLoadBalancerModelGenerator) findPort(subset *corev1.EndpointSubset,
 	if portMatch >= 0 {
 		return portMatch, nil
 	}
-	return -1, errPortNotFoundInSubset
+	return -1, errPortNotFoundInSlice
+}
+
+// Return the endpoint slices of the service which hold addresses of the given
+// family, ordered by name.
+func (g *PodLoadBalancerModelGenerator) getEndpointSlices(svc *corev1.Service, family corev1.IPFamily) ([]*discoveryv1.EndpointSlice, error) {
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.Name})
+	slices, err := g.endpointSlices.EndpointSlices(svc.Namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*discoveryv1.EndpointSlice, 0, len(slices))
+	for _, slice := range slices {
+		if string(slice.AddressType) == string(family) {
+			result = append(result, slice)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// Return the addresses of the ready endpoints in the slice. Endpoints without
+// ready condition are considered ready, as the API demands.
+func getReadyAddresses(slice *discoveryv1.EndpointSlice) []string {
+	result := []string{}
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+			continue
+		}
+		result = append(result, endpoint.Addresses...)
+	}
+	return result
+}
+
+// Return the IP family of the endpoints for the given ingress address. Falls
+// back to the primary family of the service if the family of the address
+// cannot be determined.
+func getEndpointFamilyForIngress(svc *corev1.Service, ingressAddress string) corev1.IPFamily {
+	family, err := getIPFamily(ingressAddress)
+	if err == nil {
+		return family
+	}
+	if len(svc.Spec.IPFamilies) > 0 {
+		return svc.Spec.IPFamilies[0]
+	}
+	return corev1.IPv4Protocol
 }
 
 // Return an AllowedIngress which by default allows all traffic.
@@ -156,7 +215,7 @@ func hasPolicyType(policy *networkingv1.NetworkPolicy, policyType networkingv1.P
 	return false
 }
 
-func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error) {
+func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string][]string) (*model.LoadBalancer, error) {
 	result := &model.LoadBalancer{}
 
 	allPolicies, err := g.networkpolicies.List(labels.Everything())
@@ -196,80 +255,90 @@ func (g *PodLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]
 
 	ingressMap := map[string]model.IngressIP{}
 
-	for serviceKey, portID := range portAssignment {
+	for serviceKey, portIDs := range portAssignment {
 		id, _ := model.FromKey(serviceKey)
 		svc, err := g.services.Services(id.Namespace).Get(id.Name)
 		if err != nil {
 			return nil, err
 		}
 
-		ep, err := g.endpoints.Endpoints(id.Namespace).Get(id.Name)
-		if err != nil {
-			// no endpoints exist or are not retrievable -> we ignore that for
-			// now because this may happen during bootstrapping of a service
-			continue
-		}
-		if len(ep.Subsets) < 1 {
-			// no point in doing anything with the service here
-			continue
-		}
-		// TODO: handle multiple subsets. This is tricky because our model
-		// currently does not support different ports per destination IP.
-		epSubset := ep.Subsets[0]
-		if len(ep.Subsets) > 1 {
-			klog.Warningf(
-				"LB model for service %s will be inaccurate: more than one subset",
-				serviceKey,
-			)
-		}
+		for _, portID := range portIDs {
+			ingress, ok := ingressMap[portID]
+			if !ok {
+				klog.Infof("Calling GetInternalAddress for portID=%q, serviceKey=%q", portID, serviceKey)
+				ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
+				if err != nil {
+					return nil, err
+				}
+				ingress = model.IngressIP{
+					Address: ingressIP,
+					Ports:   []model.PortForward{},
+				}
+			}
 
-		ingress, ok := ingressMap[portID]
-		if !ok {
-			klog.Infof("Calling GetInternalAddress for portID=%q, serviceKey=%q", portID, serviceKey)
-			ingressIP, err := g.l3portmanager.GetInternalAddress(portID)
+			// Each ingress IP only forwards to pods of its own family, which
+			// are listed in separate endpoint slices.
+			slices, err := g.getEndpointSlices(svc, getEndpointFamilyForIngress(svc, ingress.Address))
 			if err != nil {
 				return nil, err
 			}
-			ingress = model.IngressIP{
-				Address: ingressIP,
-				Ports:   []model.PortForward{},
-			}
-		}
-
-		for _, svcPort := range svc.Spec.Ports {
-			targetPort := int32(svcPort.TargetPort.IntValue())
-			portName := svcPort.Name
-			if targetPort == 0 {
-				targetPort = svcPort.Port
-				portName = svcPort.TargetPort.String()
-			}
-			destinationPort, err := g.findPort(
-				&epSubset,
-				portName, targetPort, svcPort.Protocol,
-			)
-			if err != nil {
-				klog.Warningf(
-					"LB model for service %s is inaccurate: failed to find matching Endpoints for Service Port %#v",
-					serviceKey,
-					svcPort,
-				)
+			if len(slices) < 1 {
+				// no endpoints exist (yet) -> we ignore that for now because
+				// this may happen during bootstrapping of a service
 				continue
 			}
 
-			addresses := make([]string, len(epSubset.Addresses))
-			for i, addr := range epSubset.Addresses {
-				addresses[i] = addr.IP
+			for _, svcPort := range svc.Spec.Ports {
+				targetPort := int32(svcPort.TargetPort.IntValue())
+				portName := svcPort.Name
+				if targetPort == 0 {
+					targetPort = svcPort.Port
+					portName = svcPort.TargetPort.String()
+				}
+
+				// TODO: handle slices which resolve the port differently.
+				// This is tricky because our model currently does not
+				// support different ports per destination IP.
+				destinationPort := int32(-1)
+				addresses := []string{}
+				for _, slice := range slices {
+					slicePort, err := g.findPort(
+						slice,
+						portName, targetPort, svcPort.Protocol,
+					)
+					if err != nil {
+						continue
+					}
+					if destinationPort < 0 {
+						destinationPort = slicePort
+					} else if slicePort != destinationPort {
+						klog.Warningf(
+							"LB model for service %s will be inaccurate: endpoint slices disagree on the destination port",
+							serviceKey,
+						)
+						continue
+					}
+					addresses = append(addresses, getReadyAddresses(slice)...)
+				}
+				if destinationPort < 0 {
+					klog.Warningf(
+						"LB model for service %s is inaccurate: failed to find matching EndpointSlice for Service Port %#v",
+						serviceKey,
+						svcPort,
+					)
+					continue
+				}
+
+				ingress.Ports = append(ingress.Ports, model.PortForward{
+					Protocol:             svcPort.Protocol,
+					InboundPort:          svcPort.Port,
+					DestinationPort:      destinationPort,
+					DestinationAddresses: addresses,
+				})
 			}
 
-			ingress.Ports = append(ingress.Ports, model.PortForward{
-				Protocol:             svcPort.Protocol,
-				InboundPort:          svcPort.Port,
-				DestinationPort:      destinationPort,
-				DestinationAddresses: addresses,
-			})
+			ingressMap[portID] = ingress
 		}
-
-		ingressMap[portID] = ingress
 	}
 
 	result.Ingress = make([]model.IngressIP, len(ingressMap))
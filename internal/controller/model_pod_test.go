@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -38,7 +39,7 @@ type podGeneratorFixture struct {
 
 	kubeclient          *k8sfake.Clientset
 	serviceLister       []*corev1.Service
-	endpointsLister     []*corev1.Endpoints
+	endpointSliceLister []*discoveryv1.EndpointSlice
 	networkpolicyLister []*networkingv1.NetworkPolicy
 	podLister           []*corev1.Pod
 	kubeobjects         []runtime.Object
@@ -49,7 +50,7 @@ func newPodGeneratorFixture(t *testing.T) *podGeneratorFixture {
 	f.t = t
 	f.l3portmanager = ostesting.NewMockL3PortManager()
 	f.serviceLister = []*corev1.Service{}
-	f.endpointsLister = []*corev1.Endpoints{}
+	f.endpointSliceLister = []*discoveryv1.EndpointSlice{}
 	f.networkpolicyLister = []*networkingv1.NetworkPolicy{}
 	f.podLister = []*corev1.Pod{}
 	f.kubeobjects = []runtime.Object{}
@@ -61,7 +62,7 @@ func (f *podGeneratorFixture) newGenerator() (*PodLoadBalancerModelGenerator, ku
 	f.kubeclient = k8sfake.NewSimpleClientset(f.kubeobjects...)
 	k8sI := kubeinformers.NewSharedInformerFactory(f.kubeclient, noResyncPeriodFunc())
 	services := k8sI.Core().V1().Services()
-	endpoints := k8sI.Core().V1().Endpoints()
+	endpointSlices := k8sI.Discovery().V1().EndpointSlices()
 	networkpolicies := k8sI.Networking().V1().NetworkPolicies()
 	pods := k8sI.Core().V1().Pods()
 
@@ -69,8 +70,8 @@ func (f *podGeneratorFixture) newGenerator() (*PodLoadBalancerModelGenerator, ku
 		services.Informer().GetIndexer().Add(s)
 	}
 
-	for _, e := range f.endpointsLister {
-		endpoints.Informer().GetIndexer().Add(e)
+	for _, e := range f.endpointSliceLister {
+		endpointSlices.Informer().GetIndexer().Add(e)
 	}
 
 	for _, pol := range f.networkpolicyLister {
@@ -84,7 +85,7 @@ func (f *podGeneratorFixture) newGenerator() (*PodLoadBalancerModelGenerator, ku
 	g := NewPodLoadBalancerModelGenerator(
 		f.l3portmanager,
 		services.Lister(),
-		endpoints.Lister(),
+		endpointSlices.Lister(),
 		networkpolicies.Lister(),
 		pods.Lister(),
 	)
@@ -96,9 +97,9 @@ func (f *podGeneratorFixture) addService(svc *corev1.Service) {
 	f.kubeobjects = append(f.kubeobjects, svc)
 }
 
-func (f *podGeneratorFixture) addEndpoints(svc *corev1.Endpoints) {
-	f.endpointsLister = append(f.endpointsLister, svc)
-	f.kubeobjects = append(f.kubeobjects, svc)
+func (f *podGeneratorFixture) addEndpointSlice(slice *discoveryv1.EndpointSlice) {
+	f.endpointSliceLister = append(f.endpointSliceLister, slice)
+	f.kubeobjects = append(f.kubeobjects, slice)
 }
 
 func (f *podGeneratorFixture) addNetworkPolicy(pol *networkingv1.NetworkPolicy) {
@@ -122,13 +123,31 @@ func (f *podGeneratorFixture) runWith(body func(g *PodLoadBalancerModelGenerator
 	f.l3portmanager.AssertExpectations(f.t)
 }
 
-func newEndpoints(name string) *corev1.Endpoints {
-	return &corev1.Endpoints{
-		TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String()},
+func newEndpointSlice(name string, serviceName string, addressType discoveryv1.AddressType) *discoveryv1.EndpointSlice {
+	return &discoveryv1.EndpointSlice{
+		TypeMeta: metav1.TypeMeta{APIVersion: discoveryv1.SchemeGroupVersion.String()},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: metav1.NamespaceDefault,
+			Labels:    map[string]string{discoveryv1.LabelServiceName: serviceName},
 		},
+		AddressType: addressType,
+	}
+}
+
+func newSliceEndpoints(addresses ...string) []discoveryv1.Endpoint {
+	result := make([]discoveryv1.Endpoint, len(addresses))
+	for i, address := range addresses {
+		result[i].Addresses = []string{address}
+	}
+	return result
+}
+
+func newSlicePort(name string, port int32, protocol corev1.Protocol) discoveryv1.EndpointPort {
+	return discoveryv1.EndpointPort{
+		Name:     &name,
+		Port:     &port,
+		Protocol: &protocol,
 	}
 }
 
@@ -220,7 +239,7 @@ func TestPodReturnsEmptyModelForEmptyAssignment(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
 	f.runWith(func(g *PodLoadBalancerModelGenerator) {
-		m, err := g.GenerateModel(map[string]string{})
+		m, err := g.GenerateModel(map[string][]string{})
 		assert.Nil(t, err)
 		assert.NotNil(t, m)
 		assert.Equal(t, 0, len(m.Ingress))
@@ -241,21 +260,13 @@ func TestPodReturnsEmptyModelForNilAssignment(t *testing.T) {
 func TestPodSinglePortSingleServiceAssignment(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
-	ep1 := newEndpoints("svc-1")
-	ep1.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.1"},
-				{IP: "10.224.1.1"},
-				{IP: "10.224.2.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8080, Protocol: corev1.ProtocolTCP},
-				{Port: 8443, Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep1 := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1", "10.224.2.1")
+	ep1.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+		newSlicePort("", 8443, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep1)
+	f.addEndpointSlice(ep1)
 
 	svc := newService("svc-1")
 	svc.Spec.Ports = []corev1.ServicePort{
@@ -263,8 +274,8 @@ func TestPodSinglePortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc)
 
-	a := map[string]string{
-		model.FromService(svc).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -290,21 +301,13 @@ func TestPodSinglePortSingleServiceAssignment(t *testing.T) {
 func TestPodSinglePortSingleServiceAssignmentByName(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
-	ep1 := newEndpoints("svc-1")
-	ep1.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.1"},
-				{IP: "10.224.1.1"},
-				{IP: "10.224.2.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8080, Protocol: corev1.ProtocolTCP},
-				{Port: 8443, Name: "http", Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep1 := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1", "10.224.2.1")
+	ep1.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+		newSlicePort("http", 8443, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep1)
+	f.addEndpointSlice(ep1)
 
 	svc := newService("svc-1")
 	svc.Spec.Ports = []corev1.ServicePort{
@@ -312,8 +315,8 @@ func TestPodSinglePortSingleServiceAssignmentByName(t *testing.T) {
 	}
 	f.addService(svc)
 
-	a := map[string]string{
-		model.FromService(svc).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -336,34 +339,26 @@ func TestPodSinglePortSingleServiceAssignmentByName(t *testing.T) {
 	})
 }
 
-func TestPodSinglePortMultiSubsetSingleServiceAssignment(t *testing.T) {
+func TestPodSinglePortMultiSliceSingleServiceAssignment(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
-	ep1 := newEndpoints("svc-1")
-	ep1.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.1"},
-				{IP: "10.224.2.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8080, Protocol: corev1.ProtocolTCP},
-				{Port: 8443, Protocol: corev1.ProtocolTCP},
-			},
-		},
-		// NOTE: this test shows that we currently do not support endpoint
-		// objects with more than one subset, since the ports may differ.
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.1.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8081, Protocol: corev1.ProtocolTCP},
-				{Port: 8444, Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep1a := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1a.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.2.1")
+	ep1a.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+		newSlicePort("", 8443, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep1)
+	f.addEndpointSlice(ep1a)
+
+	// NOTE: this test shows that we currently do not support endpoint
+	// slices which resolve the service port differently.
+	ep1b := newEndpointSlice("svc-1-b", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1b.Endpoints = newSliceEndpoints("10.224.1.1")
+	ep1b.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8081, corev1.ProtocolTCP),
+		newSlicePort("", 8444, corev1.ProtocolTCP),
+	}
+	f.addEndpointSlice(ep1b)
 
 	svc := newService("svc-1")
 	svc.Spec.Ports = []corev1.ServicePort{
@@ -371,8 +366,8 @@ func TestPodSinglePortMultiSubsetSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc)
 
-	a := map[string]string{
-		model.FromService(svc).ToKey(): "port-id-1",
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -398,21 +393,13 @@ func TestPodSinglePortMultiSubsetSingleServiceAssignment(t *testing.T) {
 func TestPodMultiPortSingleServiceAssignment(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
-	ep1 := newEndpoints("svc-1")
-	ep1.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.1"},
-				{IP: "10.224.1.1"},
-				{IP: "10.224.2.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8080, Protocol: corev1.ProtocolTCP},
-				{Port: 8443, Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep1 := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1", "10.224.2.1")
+	ep1.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+		newSlicePort("", 8443, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep1)
+	f.addEndpointSlice(ep1)
 
 	svc1 := newService("svc-1")
 	svc1.Spec.Ports = []corev1.ServicePort{
@@ -421,17 +408,12 @@ func TestPodMultiPortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc1)
 
-	ep2 := newEndpoints("svc-2")
-	ep2.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.2"},
-				{IP: "10.224.1.2"},
-			},
-			Ports: []corev1.EndpointPort{{Port: 53, Protocol: corev1.ProtocolUDP}},
-		},
+	ep2 := newEndpointSlice("svc-2-a", "svc-2", discoveryv1.AddressTypeIPv4)
+	ep2.Endpoints = newSliceEndpoints("10.224.0.2", "10.224.1.2")
+	ep2.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 53, corev1.ProtocolUDP),
 	}
-	f.addEndpoints(ep2)
+	f.addEndpointSlice(ep2)
 
 	svc2 := newService("svc-2")
 	svc2.Spec.Ports = []corev1.ServicePort{
@@ -439,9 +421,9 @@ func TestPodMultiPortSingleServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc2)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -481,21 +463,13 @@ func TestPodMultiPortSingleServiceAssignment(t *testing.T) {
 func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
-	ep1 := newEndpoints("svc-1")
-	ep1.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.1"},
-				{IP: "10.224.1.1"},
-				{IP: "10.224.2.1"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 8080, Protocol: corev1.ProtocolTCP},
-				{Port: 8443, Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep1 := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1", "10.224.2.1")
+	ep1.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+		newSlicePort("", 8443, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep1)
+	f.addEndpointSlice(ep1)
 
 	svc1 := newService("svc-1")
 	svc1.Spec.Ports = []corev1.ServicePort{
@@ -504,20 +478,13 @@ func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc1)
 
-	ep2 := newEndpoints("svc-2")
-	ep2.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.2"},
-				{IP: "10.224.1.2"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 53, Name: "dns", Protocol: corev1.ProtocolUDP},
-				{Port: 5353, Name: "dns", Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep2 := newEndpointSlice("svc-2-a", "svc-2", discoveryv1.AddressTypeIPv4)
+	ep2.Endpoints = newSliceEndpoints("10.224.0.2", "10.224.1.2")
+	ep2.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("dns", 53, corev1.ProtocolUDP),
+		newSlicePort("dns", 5353, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep2)
+	f.addEndpointSlice(ep2)
 
 	svc2 := newService("svc-2")
 	svc2.Spec.Ports = []corev1.ServicePort{
@@ -526,19 +493,12 @@ func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc2)
 
-	ep3 := newEndpoints("svc-3")
-	ep3.Subsets = []corev1.EndpointSubset{
-		{
-			Addresses: []corev1.EndpointAddress{
-				{IP: "10.224.0.3"},
-				{IP: "10.224.1.3"},
-			},
-			Ports: []corev1.EndpointPort{
-				{Port: 9090, Protocol: corev1.ProtocolTCP},
-			},
-		},
+	ep3 := newEndpointSlice("svc-3-a", "svc-3", discoveryv1.AddressTypeIPv4)
+	ep3.Endpoints = newSliceEndpoints("10.224.0.3", "10.224.1.3")
+	ep3.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 9090, corev1.ProtocolTCP),
 	}
-	f.addEndpoints(ep3)
+	f.addEndpointSlice(ep3)
 
 	svc3 := newService("svc-3")
 	svc3.Spec.Ports = []corev1.ServicePort{
@@ -546,10 +506,10 @@ func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	}
 	f.addService(svc3)
 
-	a := map[string]string{
-		model.FromService(svc1).ToKey(): "port-id-1",
-		model.FromService(svc2).ToKey(): "port-id-2",
-		model.FromService(svc3).ToKey(): "port-id-2",
+	a := map[string][]string{
+		model.FromService(svc1).ToKey(): {"port-id-1"},
+		model.FromService(svc2).ToKey(): {"port-id-2"},
+		model.FromService(svc3).ToKey(): {"port-id-2"},
 	}
 
 	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("ingress-ip-1", nil).Times(1)
@@ -596,6 +556,93 @@ func TestPodMultiPortMultiServiceAssignment(t *testing.T) {
 	})
 }
 
+func TestPodDualStackServiceUsesEndpointsOfIngressFamily(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	ep4 := newEndpointSlice("svc-1-ipv4", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep4.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1")
+	ep4.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+	}
+	f.addEndpointSlice(ep4)
+
+	ep6 := newEndpointSlice("svc-1-ipv6", "svc-1", discoveryv1.AddressTypeIPv6)
+	ep6.Endpoints = newSliceEndpoints("fd00:224::1", "fd00:224::2")
+	ep6.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+	}
+	f.addEndpointSlice(ep6)
+
+	svc := newService("svc-1")
+	svc.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+	}
+	f.addService(svc)
+
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1", "port-id-2"},
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("172.16.0.1", nil).Times(1)
+	f.l3portmanager.On("GetInternalAddress", "port-id-2").Return("fd01::1", nil).Times(1)
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+		assert.NotNil(t, m)
+		assert.Equal(t, 2, len(m.Ingress))
+
+		anyIngressIP(t, m.Ingress, "172.16.0.1", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"10.224.0.1", "10.224.1.1"}, p.DestinationAddresses)
+			})
+		})
+
+		anyIngressIP(t, m.Ingress, "fd01::1", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"fd00:224::1", "fd00:224::2"}, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
+func TestPodSkipsEndpointsWhichAreNotReady(t *testing.T) {
+	f := newPodGeneratorFixture(t)
+
+	notReady := false
+	ep1 := newEndpointSlice("svc-1-a", "svc-1", discoveryv1.AddressTypeIPv4)
+	ep1.Endpoints = newSliceEndpoints("10.224.0.1", "10.224.1.1")
+	ep1.Endpoints[1].Conditions.Ready = &notReady
+	ep1.Ports = []discoveryv1.EndpointPort{
+		newSlicePort("", 8080, corev1.ProtocolTCP),
+	}
+	f.addEndpointSlice(ep1)
+
+	svc := newService("svc-1")
+	svc.Spec.Ports = []corev1.ServicePort{
+		{Port: 80, Protocol: corev1.ProtocolTCP, TargetPort: intstr.FromInt(8080)},
+	}
+	f.addService(svc)
+
+	a := map[string][]string{
+		model.FromService(svc).ToKey(): {"port-id-1"},
+	}
+
+	f.l3portmanager.On("GetInternalAddress", "port-id-1").Return("172.16.0.1", nil).Times(1)
+
+	f.runWith(func(g *PodLoadBalancerModelGenerator) {
+		m, err := g.GenerateModel(a)
+		assert.Nil(t, err)
+
+		anyIngressIP(t, m.Ingress, "172.16.0.1", func(t *testing.T, i model.IngressIP) {
+			anyPort(t, i.Ports, 80, corev1.ProtocolTCP, func(t *testing.T, p model.PortForward) {
+				assert.Equal(t, []string{"10.224.0.1"}, p.DestinationAddresses)
+			})
+		})
+	})
+}
+
 func TestNetworkPolicyAssignments(t *testing.T) {
 	f := newPodGeneratorFixture(t)
 
@@ -1,8 +1,15 @@
 package controller
 
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
 type L3PortManager interface {
-	// ProvisionPort creates a new L3 port and returns its id
-	ProvisionPort() (string, error)
+	// ProvisionPort creates a new L3 port of the given IP family and returns
+	// its id. An empty family leaves the choice to the port manager.
+	ProvisionPort(family corev1.IPFamily) (string, error)
 	// CleanUnusedPorts deletes all L3 ports that are currently not used
 	CleanUnusedPorts(usedPorts []string) error
 	// EnsureAgentsState ensures that all agents are configured correctly
@@ -16,3 +23,41 @@ type L3PortManager interface {
 	// CheckPortExists checks if there exists a port for the given portID
 	CheckPortExists(portID string) (bool, error)
 }
+
+// L3PortClaimManager is implemented by L3 port managers which do not persist
+// which of their ports are in use. Before the first port is provisioned, the
+// ports of the existing services are claimed, so that they are not handed out
+// again after a restart of the controller.
+type L3PortClaimManager interface {
+	// ClaimPorts marks the ports as in use; unknown ports are ignored
+	ClaimPorts(portIDs []string) error
+}
+
+// L3PortNetworkManager is implemented by L3 port managers which can place
+// ports in different networks, selected per service.
+type L3PortNetworkManager interface {
+	// ValidatePortNetwork checks if ports of the given service may be placed
+	// in the given network and returns it in canonical form, i.e. with fields
+	// which select the defaults cleared and fields derived from the service
+	// (like the DNS name) filled in.
+	ValidatePortNetwork(id model.ServiceIdentifier, network model.PortNetwork) (model.PortNetwork, error)
+	// ProvisionPortInNetwork creates a new L3 port of the given IP family in
+	// the given network and returns its id.
+	ProvisionPortInNetwork(family corev1.IPFamily, network model.PortNetwork) (string, error)
+	// GetPortNetwork returns the network of the port in canonical form
+	GetPortNetwork(portID string) (model.PortNetwork, error)
+	// SetPortDNSName changes the DNS name of the external address of the
+	// port in place.
+	SetPortDNSName(portID string, dnsName string) error
+	// SetPortFloatingIPReservation reserves the floating IP of the port in
+	// place, so that it keeps its address.
+	SetPortFloatingIPReservation(portID string, reservation string) error
+}
+
+// L3PortQoSManager is implemented by L3 port managers which can limit the
+// bandwidth of ports.
+type L3PortQoSManager interface {
+	// SetPortBandwidthLimit applies the bandwidth limit to the port. A zero
+	// limit removes any limit from the port.
+	SetPortBandwidthLimit(portID string, limit model.BandwidthLimit) error
+}
@@ -27,6 +27,8 @@ import (
 var (
 	ErrServiceNotMapped = errors.New("Service not mapped")
 	ErrNoSuitablePort   = errors.New("No suitable port available")
+
+	ErrPortNetworkNotSupported = errors.New("Port manager does not support selecting the network of ports")
 )
 
 type PortMapper interface {
@@ -46,12 +48,20 @@ type PortMapper interface {
 	// GetUsedL3Ports.
 	UnmapService(id model.ServiceIdentifier) error
 
-	// Return the ID of the port to which the service is mapped
+	// Return the ID of the port to which the service is mapped for its
+	// primary IP family
 	//
 	// Returns ErrServiceNotMapped if the service is currently not mapped.
 	GetServiceL3Port(id model.ServiceIdentifier) (string, error)
 
-	GetModel() map[string]string
+	// Return the IDs of the ports to which the service is mapped, one per IP
+	// family of the service, primary family first
+	//
+	// Returns ErrServiceNotMapped if the service is currently not mapped.
+	GetServiceL3Ports(id model.ServiceIdentifier) ([]string, error)
+
+	// Return the IDs of the ports of all mapped services, keyed by service
+	GetModel() map[string][]string
 
 	// Return the list of IDs of the L3 ports which currently have at least one
 	// mapped service.
@@ -67,13 +77,17 @@ type PortMapper interface {
 
 type PortMapperImpl struct {
 	l3manager L3PortManager
-	services  map[string]model.ServiceModel
-	l3ports   map[string]model.L3Port
+	// nil if the l3manager does not support selecting the network of ports
+	networks L3PortNetworkManager
+	services map[string]model.ServiceModel
+	l3ports  map[string]model.L3Port
 }
 
 func NewPortMapper(l3manager L3PortManager) (PortMapper, error) {
+	networks, _ := l3manager.(L3PortNetworkManager)
 	portManager := &PortMapperImpl{
 		l3manager: l3manager,
+		networks:  networks,
 		services:  make(map[string]model.ServiceModel),
 		l3ports:   make(map[string]model.L3Port),
 	}
@@ -95,13 +109,25 @@ func (c *PortMapperImpl) getServiceKey(svc *corev1.Service) string {
 	return model.FromService(svc).ToKey()
 }
 
-func (c *PortMapperImpl) createNewL3Port() (string, error) {
-	portID, err := c.l3manager.ProvisionPort()
+func (c *PortMapperImpl) createNewL3Port(family corev1.IPFamily, network model.PortNetwork) (string, error) {
+	var portID string
+	var err error
+	if c.networks != nil {
+		portID, err = c.networks.ProvisionPortInNetwork(family, network)
+	} else {
+		portID, err = c.l3manager.ProvisionPort(family)
+	}
 	if err != nil {
 		return "", err
 	}
 	klog.Infof("created new port with portID=%v", portID)
 	c.emplaceL3Port(portID)
+	l3port := c.l3ports[portID]
+	if family != "" {
+		l3port.Family = family
+	}
+	l3port.Network = &network
+	c.l3ports[portID] = l3port
 	return portID, nil
 }
 
@@ -123,41 +149,189 @@ func (c *PortMapperImpl) isPortSuitableFor(l3port model.L3Port, ports []model.L4
 	return true
 }
 
-// Check if any of the managed L3 ports is suitable for the given set of L4
-// ports and return the first one which matches.
+// Check if the L3 port has the given IP family. The family of a port is looked
+// up via its internal address once and remembered afterwards. An empty family
+// matches any port.
+func (c *PortMapperImpl) hasL3PortFamily(portID string, family corev1.IPFamily) (bool, error) {
+	if family == "" {
+		return true, nil
+	}
+
+	l3port := c.l3ports[portID]
+	if l3port.Family == "" {
+		address, err := c.l3manager.GetInternalAddress(portID)
+		if err != nil {
+			return false, err
+		}
+		l3port.Family, err = getIPFamily(address)
+		if err != nil {
+			return false, err
+		}
+		c.l3ports[portID] = l3port
+	}
+
+	return l3port.Family == family, nil
+}
+
+// Check if the L3 port is placed in the given (canonical) network. The DNS
+// name and the floating IP reservation are not compared, as they can be
+// changed in place. The network of a port
+// is looked up once and remembered afterwards. Ports of L3 port managers
+// without support for selecting networks are all in the default network.
+func (c *PortMapperImpl) hasL3PortNetwork(portID string, network model.PortNetwork) (bool, error) {
+	if c.networks == nil {
+		return network == model.PortNetwork{}, nil
+	}
+
+	l3port := c.l3ports[portID]
+	if l3port.Network == nil {
+		portNetwork, err := c.networks.GetPortNetwork(portID)
+		if err != nil {
+			return false, err
+		}
+		l3port.Network = &portNetwork
+		c.l3ports[portID] = l3port
+	}
+
+	return l3port.Network.Placement() == network.Placement(), nil
+}
+
+// Return the floating IP reservation of the L3 port; empty if it is not
+// reserved or its network has not been looked up yet.
+func (c *PortMapperImpl) getReservation(portID string) string {
+	network := c.l3ports[portID].Network
+	if network == nil {
+		return ""
+	}
+	return network.FloatingIPReservation
+}
+
+// Check if a service with the given floating IP reservation can keep the L3
+// port: a port which is reserved for another reservation has a different
+// address, while the floating IP of an unreserved port can be reserved in
+// place. A reservation is kept if the service does not request one anymore.
+func (c *PortMapperImpl) hasCompatibleReservation(portID string, reservation string) bool {
+	current := c.getReservation(portID)
+	return reservation == "" || current == "" || current == reservation
+}
+
+// Reserve the floating IP of the L3 port for the reservation of the service,
+// so that the service keeps its address when it is annotated with a
+// reservation.
+func (c *PortMapperImpl) applyReservation(key string, portID string, reservation string) {
+	l3port := c.l3ports[portID]
+	if c.networks == nil || reservation == "" || l3port.Network == nil || l3port.Network.FloatingIPReservation != "" {
+		return
+	}
+
+	err := c.networks.SetPortFloatingIPReservation(portID, reservation)
+	if err != nil {
+		klog.Warningf("failed to reserve the floating IP of port %s for service %q as %q: %s", portID, key, reservation, err)
+		return
+	}
+
+	network := *l3port.Network
+	network.FloatingIPReservation = reservation
+	l3port.Network = &network
+	c.l3ports[portID] = l3port
+}
+
+// Check if the DNS name can be applied to the L3 port without changing the
+// name of other services, i.e. the port has no name or the same one.
+func (c *PortMapperImpl) hasCompatibleDNSName(portID string, dnsName string) bool {
+	network := c.l3ports[portID].Network
+	return dnsName == "" || network == nil || network.DNSName == "" || network.DNSName == dnsName
+}
+
+// Apply the DNS name of the service to its L3 port. A port can only have one
+// name, so the name of a port shared with other services is kept.
+func (c *PortMapperImpl) applyDNSName(key string, portID string, dnsName string) {
+	l3port := c.l3ports[portID]
+	if c.networks == nil || dnsName == "" || l3port.Network == nil || l3port.Network.DNSName == dnsName {
+		return
+	}
+
+	if l3port.Network.DNSName != "" {
+		for _, other := range l3port.Allocations {
+			if other != key {
+				klog.Warningf(
+					"not applying DNS name %q of service %q: port %s is shared with other services and named %q",
+					dnsName,
+					key,
+					portID,
+					l3port.Network.DNSName)
+				return
+			}
+		}
+	}
+
+	err := c.networks.SetPortDNSName(portID, dnsName)
+	if err != nil {
+		klog.Warningf("failed to apply DNS name %q of service %q to port %s: %s", dnsName, key, portID, err)
+		return
+	}
+
+	network := *l3port.Network
+	network.DNSName = dnsName
+	l3port.Network = &network
+	c.l3ports[portID] = l3port
+}
+
+// Check if any of the managed L3 ports of the given IP family and network is
+// suitable for the given set of L4 ports and return the first one which
+// matches. Ports whose DNS name can be changed to the requested one are
+// preferred. Only ports with the same floating IP reservation are shared, so
+// that a new service gets the address of its reservation.
 //
 // If none matches, returns an ErrNoSuitablePort.
-func (c *PortMapperImpl) findL3PortFor(ports []model.L4Port) (string, error) {
+func (c *PortMapperImpl) findL3PortFor(ports []model.L4Port, family corev1.IPFamily, network model.PortNetwork) (string, error) {
+	fallback := ""
 	for portID, l3port := range c.l3ports {
-		if c.isPortSuitableFor(l3port, ports, "") {
+		if !c.isPortSuitableFor(l3port, ports, "") {
+			continue
+		}
+		matches, err := c.hasL3PortFamily(portID, family)
+		if err != nil {
+			return "", err
+		}
+		if !matches {
+			continue
+		}
+		matches, err = c.hasL3PortNetwork(portID, network)
+		if err != nil {
+			return "", err
+		}
+		if !matches || c.getReservation(portID) != network.FloatingIPReservation {
+			continue
+		}
+		if c.hasCompatibleDNSName(portID, network.DNSName) {
 			return portID, nil
 		}
+		if fallback == "" {
+			fallback = portID
+		}
 	}
 
+	if fallback != "" {
+		return fallback, nil
+	}
 	return "", ErrNoSuitablePort
 }
 
-func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
-	var err error
-	id := model.FromService(svc)
-	key := id.ToKey()
-
-	svcModel := model.ServiceModel{
-		L3PortID: "",
-		Ports:    make([]model.L4Port, len(svc.Spec.Ports)),
-	}
-	for i, k8sPort := range svc.Spec.Ports {
-		svcModel.Ports[i] = model.L4Port{Protocol: k8sPort.Protocol, Port: k8sPort.Port}
+// Return the IP families for which the service needs an L3 port. Services
+// without IP families (i.e. from API servers without dual-stack support) get
+// a single port of any family.
+func getServiceIPFamilies(svc *corev1.Service) []corev1.IPFamily {
+	if len(svc.Spec.IPFamilies) == 0 {
+		return []corev1.IPFamily{""}
 	}
+	return svc.Spec.IPFamilies
+}
 
-	existingSvc, hasExistingService := c.services[key]
-	var portID string
-	if hasExistingService {
-		portID = existingSvc.L3PortID
-	}
-	if portID == "" {
-		portID = getPortAnnotation(svc)
-	}
+// Find the L3 port to use for the given IP family of a service, starting with
+// the preferred port (if any).
+func (c *PortMapperImpl) mapServiceFamily(key string, ports []model.L4Port, family corev1.IPFamily, network model.PortNetwork, portID string) (string, error) {
+	var err error
 
 	if portID != "" {
 		// the service has a preferred port
@@ -165,7 +339,7 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 		// Check if port exists in backend
 		exists, err := c.l3manager.CheckPortExists(portID)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		if exists {
@@ -173,7 +347,7 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 			if known {
 				// the port is already known and thus may have allocations. we have
 				// to check if any allocations conflict
-				if !c.isPortSuitableFor(l3port, svcModel.Ports, key) {
+				if !c.isPortSuitableFor(l3port, ports, key) {
 					// and they do! so we have to relocate the service to a
 					// different port
 					// TODO: it would be good if that caused an event on the Service
@@ -197,6 +371,41 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 		}
 	}
 
+	if portID != "" {
+		matches, err := c.hasL3PortFamily(portID, family)
+		if err != nil {
+			return "", err
+		}
+		if !matches {
+			klog.Warningf(
+				"relocating service %q because port %s is not of IP family %s",
+				key,
+				portID,
+				family)
+			portID = ""
+		}
+	}
+
+	if portID != "" {
+		matches, err := c.hasL3PortNetwork(portID, network)
+		if err != nil {
+			return "", err
+		}
+		if !matches {
+			klog.Warningf(
+				"relocating service %q because port %s is not in the selected network",
+				key,
+				portID)
+			portID = ""
+		} else if !c.hasCompatibleReservation(portID, network.FloatingIPReservation) {
+			klog.Warningf(
+				"relocating service %q because port %s has the floating IP of another reservation",
+				key,
+				portID)
+			portID = ""
+		}
+	}
+
 	// TODO: if the port we have in our internal state is not suited for some
 	// reason, try the port from the annotation
 
@@ -204,21 +413,83 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 	// further
 	if portID == "" {
 		// second, try to find an existing port with non-conflicting allocations
-		portID, err = c.findL3PortFor(svcModel.Ports)
+		portID, err = c.findL3PortFor(ports, family, network)
 		if err == ErrNoSuitablePort {
 			// if no existing port can fit the bill, we move on to create a new
 			// port
-			portID, err = c.createNewL3Port()
+			portID, err = c.createNewL3Port(family, network)
 			if err != nil {
 				// if that fails too, we simply cannot map the service.
-				return err
+				return "", err
 			}
 		} else if err != nil {
+			return "", err
+		}
+	}
+
+	return portID, nil
+}
+
+func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
+	var err error
+	id := model.FromService(svc)
+	key := id.ToKey()
+
+	svcModel := model.ServiceModel{
+		L3PortIDs: []string{},
+		Ports:     make([]model.L4Port, len(svc.Spec.Ports)),
+	}
+	for i, k8sPort := range svc.Spec.Ports {
+		svcModel.Ports[i] = model.L4Port{Protocol: k8sPort.Protocol, Port: k8sPort.Port}
+	}
+
+	// services can only share ports if they select the same network (apart
+	// from the DNS name)
+	network := getPortNetworkAnnotations(svc)
+	if c.networks != nil {
+		network, err = c.networks.ValidatePortNetwork(id, network)
+		if err != nil {
 			return err
 		}
+	} else if network != (model.PortNetwork{}) {
+		return ErrPortNetworkNotSupported
 	}
 
-	svcModel.L3PortID = portID
+	existingSvc, hasExistingService := c.services[key]
+	var preferredPortIDs []string
+	if hasExistingService {
+		preferredPortIDs = existingSvc.L3PortIDs
+	}
+	if len(preferredPortIDs) == 0 {
+		preferredPortIDs = getPortAnnotations(svc)
+	}
+
+	requireAllFamilies := svc.Spec.IPFamilyPolicy != nil &&
+		*svc.Spec.IPFamilyPolicy == corev1.IPFamilyPolicyRequireDualStack
+
+	for i, family := range getServiceIPFamilies(svc) {
+		portID := ""
+		if i < len(preferredPortIDs) {
+			portID = preferredPortIDs[i]
+		}
+
+		portID, err = c.mapServiceFamily(key, svcModel.Ports, family, network, portID)
+		if err != nil {
+			if i > 0 && !requireAllFamilies {
+				// the secondary family is nice to have, unless the service
+				// requires dual-stack
+				klog.Warningf(
+					"mapping service %q without IP family %s: %s",
+					key,
+					family,
+					err)
+				continue
+			}
+			return err
+		}
+
+		svcModel.L3PortIDs = append(svcModel.L3PortIDs, portID)
+	}
 
 	if hasExistingService {
 		// we have to unmap the existing service first
@@ -230,28 +501,40 @@ func (c *PortMapperImpl) MapService(svc *corev1.Service) error {
 	}
 
 	c.services[key] = svcModel
-	l3port := c.l3ports[portID]
-	klog.Infof("Lookup l3port[%v]=%v", portID, l3port)
-	for _, port := range svcModel.Ports {
-		klog.Infof("Allocating port %v to service %v", port, key)
-		l3port.Allocations[port.Port] = key
+	for _, portID := range svcModel.L3PortIDs {
+		l3port := c.l3ports[portID]
+		klog.Infof("Lookup l3port[%v]=%v", portID, l3port)
+		for _, port := range svcModel.Ports {
+			klog.Infof("Allocating port %v to service %v", port, key)
+			l3port.Allocations[port.Port] = key
+		}
+		c.applyDNSName(key, portID, network.DNSName)
+		c.applyReservation(key, portID, network.FloatingIPReservation)
 	}
 
 	return nil
 }
 
 func (c *PortMapperImpl) GetServiceL3Port(id model.ServiceIdentifier) (string, error) {
+	portIDs, err := c.GetServiceL3Ports(id)
+	if err != nil {
+		return "", err
+	}
+	return portIDs[0], nil
+}
+
+func (c *PortMapperImpl) GetServiceL3Ports(id model.ServiceIdentifier) ([]string, error) {
 	svcModel, ok := c.services[id.ToKey()]
-	if !ok {
-		return "", ErrServiceNotMapped
+	if !ok || len(svcModel.L3PortIDs) == 0 {
+		return nil, ErrServiceNotMapped
 	}
-	return svcModel.L3PortID, nil
+	return copyStrings(svcModel.L3PortIDs), nil
 }
 
-func (c *PortMapperImpl) GetModel() map[string]string {
-	result := make(map[string]string)
+func (c *PortMapperImpl) GetModel() map[string][]string {
+	result := make(map[string][]string)
 	for key, svc := range c.services {
-		result[key] = svc.L3PortID
+		result[key] = copyStrings(svc.L3PortIDs)
 	}
 	return result
 }
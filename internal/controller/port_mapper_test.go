@@ -22,6 +22,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
@@ -84,7 +85,7 @@ func TestMapFirstUnknownServiceAssignsNewPort(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -99,7 +100,7 @@ func TestMapServicePropagatesPortAllocationError(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("dummy", provisionError)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("dummy", provisionError)
 
 	err := f.portmapper.MapService(s)
 	assert.Equal(t, err, provisionError)
@@ -110,7 +111,7 @@ func TestPortAllocationErrorLeavesServiceUnmapped(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("dummy", provisionError)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("dummy", provisionError)
 
 	err := f.portmapper.MapService(s)
 	assert.Equal(t, err, provisionError)
@@ -130,8 +131,8 @@ func TestMapServiceWithNonConflictingL4PortsReusesL3Port(t *testing.T) {
 		},
 	}
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("", fmt.Errorf("no more ports"))
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("", fmt.Errorf("no more ports"))
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -153,8 +154,8 @@ func TestMapServiceWithConflictingL4PortsAllocatesNewL3Port(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -176,8 +177,8 @@ func TestRemappingTheSameServiceDoesNotChangePorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -209,9 +210,9 @@ func TestRemappingTheSameServiceWithoutAnnotationIsHandledGracefully(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-3", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-3", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -247,7 +248,7 @@ func TestRemappingAnUpdatedServiceWithAnnotationDoesNotAllocateANewPort(t *testi
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -273,7 +274,7 @@ func TestRemappingAnUpdatedServiceWithoutAnnotationDoesNotAllocateANewPort(t *te
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -298,7 +299,7 @@ func TestRemappingAnUpdatedServiceWithStaleAnnotationDoesNotAllocateANewPort(t *
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -325,7 +326,7 @@ func TestRemappingAnUpdatedServiceWithAnnotationClearsOldAllocations(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -357,7 +358,7 @@ func TestRemappingAnUpdatedServiceWithAnnotationClearsOldAllocations(t *testing.
 func TestUnmapServiceRemovesPortAssignment(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service-1")
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -374,7 +375,7 @@ func TestUnmapServiceRemovesPortAllocations(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -403,8 +404,8 @@ func TestGetUsedL3PortsContainsMappedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -428,8 +429,8 @@ func TestGetUsedL3PortsDoesNotReturnUnusedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -467,8 +468,8 @@ func TestGetUsedL3PortsCleansUpUnusedPorts(t *testing.T) {
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -517,7 +518,7 @@ func TestMapServiceWithAnnotationRejectsInvalidPort(t *testing.T) {
 	s.Annotations[AnnotationInboundPort] = "port-id-x"
 
 	f.l3portmanager.On("CheckPortExists", "port-id-x").Return(false, nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -535,8 +536,8 @@ func TestMapServiceWithAnnotationIsMovedToAnotherPortOnConflict(t *testing.T) {
 	s2.Annotations = make(map[string]string)
 	s2.Annotations[AnnotationInboundPort] = "port-id-1"
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -559,7 +560,7 @@ func TestSetAvailableL3PortsWithSameSetOfPortsHasNoVisibleEffect(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -581,7 +582,7 @@ func TestSetAvailableL3PortsWithMorePortsHasNoVisibleEffect(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -603,7 +604,7 @@ func TestSetAvailableL3PortsWithMissingPortEvictsService(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -620,7 +621,7 @@ func TestSetAvailableL3PortsWithMissingPortRemovesPort(t *testing.T) {
 	f := newPortMapperFixture()
 	s := newPortMapperService("test-service")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id", nil)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id", nil)
 
 	err := f.portmapper.MapService(s)
 	assert.Nil(t, err)
@@ -639,8 +640,8 @@ func TestSetAvailableL3PortsWithMissingPortOnlyEvictsAffectedService(t *testing.
 	s1 := newPortMapperService("test-service-1")
 	s2 := newPortMapperService("test-service-2")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -673,8 +674,8 @@ func TestMapServiceMakesServiceAppearInModel(t *testing.T) {
 	s2i := model.FromService(s2)
 	s2k := s2i.ToKey()
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -694,18 +695,18 @@ func TestMapServiceMakesServiceAppearInModel(t *testing.T) {
 
 	port, ok := pmmodel[s1k]
 	assert.True(t, ok)
-	assert.Equal(t, s1p, port)
+	assert.Equal(t, []string{s1p}, port)
 
 	port, ok = pmmodel[s2k]
 	assert.True(t, ok)
-	assert.Equal(t, s2p, port)
+	assert.Equal(t, []string{s2p}, port)
 }
 
 func TestServiceWithInvalidPortIsRemapped(t *testing.T) {
 	f := newPortMapperFixture()
 	s1 := newPortMapperService("test-service-1")
 
-	f.l3portmanager.On("ProvisionPort").Return("port-id-1", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-1", nil).Times(1)
 
 	err := f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -722,7 +723,7 @@ func TestServiceWithInvalidPortIsRemapped(t *testing.T) {
 
 	// Port does not exist, expect change
 	f.l3portmanager.On("CheckPortExists", "port-id-1").Return(false, nil).Times(1)
-	f.l3portmanager.On("ProvisionPort").Return("port-id-2", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", mock.Anything).Return("port-id-2", nil).Times(1)
 
 	err = f.portmapper.MapService(s1)
 	assert.Nil(t, err)
@@ -731,3 +732,376 @@ func TestServiceWithInvalidPortIsRemapped(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "port-id-2", portID)
 }
+
+func TestMapDualStackServiceAssignsPortPerFamily(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+	s.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+
+	f.l3portmanager.On("ProvisionPort", corev1.IPv4Protocol).Return("port-id-v4", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", corev1.IPv6Protocol).Return("port-id-v6", nil).Times(1)
+
+	err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portIDs, err := f.portmapper.GetServiceL3Ports(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-v4", "port-id-v6"}, portIDs)
+
+	portID, err := f.portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-v4", portID)
+
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapDualStackServiceReusesPortOfMatchingFamily(t *testing.T) {
+	f := newPortMapperFixture()
+	s1 := newPortMapperService("test-service-1")
+	s1.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol}
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+	s2.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv6Protocol, corev1.IPv4Protocol}
+
+	f.l3portmanager.On("ProvisionPort", corev1.IPv4Protocol).Return("port-id-v4", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", corev1.IPv6Protocol).Return("port-id-v6", nil).Times(1)
+
+	err := f.portmapper.MapService(s1)
+	assert.Nil(t, err)
+
+	err = f.portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	portIDs, err := f.portmapper.GetServiceL3Ports(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-v6", "port-id-v4"}, portIDs)
+
+	f.l3portmanager.AssertExpectations(t)
+}
+
+func TestMapDualStackServiceToleratesMissingSecondaryFamily(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+	s.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+
+	f.l3portmanager.On("ProvisionPort", corev1.IPv4Protocol).Return("port-id-v4", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", corev1.IPv6Protocol).Return("", fmt.Errorf("no IPv6")).Times(1)
+
+	err := f.portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portIDs, err := f.portmapper.GetServiceL3Ports(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-id-v4"}, portIDs)
+}
+
+func TestMapDualStackServiceFailsIfRequiredFamilyIsMissing(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+	s.Spec.IPFamilies = []corev1.IPFamily{corev1.IPv4Protocol, corev1.IPv6Protocol}
+	policy := corev1.IPFamilyPolicyRequireDualStack
+	s.Spec.IPFamilyPolicy = &policy
+
+	provisionError := fmt.Errorf("no IPv6")
+	f.l3portmanager.On("ProvisionPort", corev1.IPv4Protocol).Return("port-id-v4", nil).Times(1)
+	f.l3portmanager.On("ProvisionPort", corev1.IPv6Protocol).Return("", provisionError).Times(1)
+
+	err := f.portmapper.MapService(s)
+	assert.Equal(t, provisionError, err)
+
+	_, err = f.portmapper.GetServiceL3Ports(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+}
+
+func newPortMapperNetworkFixture() (*ostesting.MockL3PortNetworkManager, PortMapper) {
+	l3portmanager := ostesting.NewMockL3PortNetworkManager()
+
+	l3portmanager.On("GetAvailablePorts").Return([]string{}, nil).Times(1)
+
+	portmapper, _ := NewPortMapper(l3portmanager)
+
+	return l3portmanager, portmapper
+}
+
+func TestMapServiceWithPortNetworkFailsIfNotSupported(t *testing.T) {
+	f := newPortMapperFixture()
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{AnnotationSubnetID: "subnet-2"}
+
+	err := f.portmapper.MapService(s)
+	assert.Equal(t, ErrPortNetworkNotSupported, err)
+
+	f.l3portmanager.AssertNotCalled(t, "ProvisionPort", mock.Anything)
+}
+
+func TestMapServiceWithInvalidPortNetworkFails(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{AnnotationSubnetID: "forbidden"}
+
+	validationError := errors.New("not allowed")
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, model.PortNetwork{SubnetID: "forbidden"}).Return(model.PortNetwork{}, validationError)
+
+	err := portmapper.MapService(s)
+	assert.Equal(t, validationError, err)
+
+	_, err = portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Equal(t, ErrServiceNotMapped, err)
+}
+
+func TestMapServicesWithDifferentPortNetworksUseDifferentPorts(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	transit := model.PortNetwork{FloatingIPNetworkID: "transit"}
+
+	s1 := newPortMapperService("test-service-1")
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+	s2.Annotations = map[string]string{AnnotationFloatingIPNetwork: "transit"}
+	s3 := newPortMapperService("test-service-3")
+	s3.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolTCP, Port: 22},
+	}
+	s3.Annotations = map[string]string{AnnotationFloatingIPNetwork: "transit"}
+
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, model.PortNetwork{}).Return(model.PortNetwork{}, nil)
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, transit).Return(transit, nil)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), model.PortNetwork{}).Return("port-id-1", nil).Times(1)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), transit).Return("port-id-2", nil).Times(1)
+
+	err := portmapper.MapService(s1)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s2)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s3)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s1))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	portID, err = portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	portID, err = portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServiceRelocatesIfPreferredPortIsInOtherNetwork(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	internal := model.PortNetwork{SubnetID: "internal", FloatingIPNetworkID: model.NoFloatingIP}
+
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{
+		AnnotationInboundPort:       "port-id-1",
+		AnnotationSubnetID:          "internal",
+		AnnotationFloatingIPNetwork: model.NoFloatingIP,
+	}
+
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, internal).Return(internal, nil)
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	l3portmanager.On("GetPortNetwork", "port-id-1").Return(model.PortNetwork{}, nil).Times(1)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), internal).Return("port-id-2", nil).Times(1)
+
+	err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServicesWithSameReservationNameInOtherNamespaceUseDifferentPorts(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	reserved := model.PortNetwork{FloatingIPReservation: "default/web"}
+	otherReserved := model.PortNetwork{FloatingIPReservation: "other/web"}
+
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationFloatingIPReservation: "web"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Namespace = "other"
+	s2.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+	s2.Annotations = map[string]string{AnnotationFloatingIPReservation: "web"}
+
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, reserved).Return(reserved, nil)
+	l3portmanager.On("ValidatePortNetwork", mock.Anything, otherReserved).Return(otherReserved, nil)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), reserved).Return("port-id-1", nil).Times(1)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), otherReserved).Return("port-id-2", nil).Times(1)
+
+	err := portmapper.MapService(s1)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3portmanager.AssertExpectations(t)
+}
+
+func TestMapServicesWithDifferentDNSNamesShareAPort(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	web := model.PortNetwork{DNSName: "web.lb.example.com"}
+	api := model.PortNetwork{DNSName: "api.lb.example.com"}
+
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationDNSName: "web.lb.example.com."}
+	s2 := newPortMapperService("test-service-2")
+	s2.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+	s2.Annotations = map[string]string{AnnotationDNSName: "api.lb.example.com"}
+
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s1), web).Return(web, nil)
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s2), api).Return(api, nil)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), web).Return("port-id-1", nil).Times(1)
+
+	err := portmapper.MapService(s1)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s2)
+	assert.Nil(t, err)
+
+	// the port keeps the name of the first service
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s2))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	l3portmanager.AssertExpectations(t)
+	l3portmanager.AssertNotCalled(t, "SetPortDNSName", mock.Anything, mock.Anything)
+}
+
+func TestMapServiceKeepsPortWithoutDNSNameAfterTemplateIsEnabled(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	named := model.PortNetwork{DNSName: "test-service.default.lb.example.com"}
+
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+
+	// the template fills in the DNS name
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s), model.PortNetwork{}).Return(named, nil)
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	l3portmanager.On("GetPortNetwork", "port-id-1").Return(model.PortNetwork{}, nil).Times(1)
+	l3portmanager.On("SetPortDNSName", "port-id-1", named.DNSName).Return(nil).Times(1)
+
+	err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	// the name is applied only once
+	err = portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	l3portmanager.AssertExpectations(t)
+	l3portmanager.AssertNotCalled(t, "ProvisionPortInNetwork", mock.Anything, mock.Anything)
+}
+
+func TestMapServiceReservesFloatingIPOfPlacedServiceInPlace(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	reserved := model.PortNetwork{FloatingIPReservation: "default/web"}
+
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s), model.PortNetwork{}).Return(model.PortNetwork{}, nil).Times(1)
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	l3portmanager.On("GetPortNetwork", "port-id-1").Return(model.PortNetwork{}, nil).Times(1)
+
+	err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	// the service is annotated with a reservation after it has been placed
+	s.Annotations[AnnotationFloatingIPReservation] = "web"
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s), reserved).Return(reserved, nil)
+	l3portmanager.On("SetPortFloatingIPReservation", "port-id-1", "default/web").Return(nil).Times(1)
+
+	err = portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-1", portID)
+
+	// the reservation is applied only once
+	err = portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	l3portmanager.AssertExpectations(t)
+	l3portmanager.AssertNotCalled(t, "ProvisionPortInNetwork", mock.Anything, mock.Anything)
+}
+
+func TestMapServiceRelocatesFromPortOfOtherReservation(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	reserved := model.PortNetwork{FloatingIPReservation: "default/web"}
+
+	s := newPortMapperService("test-service")
+	s.Annotations = map[string]string{
+		AnnotationInboundPort:           "port-id-1",
+		AnnotationFloatingIPReservation: "web",
+	}
+
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s), reserved).Return(reserved, nil)
+	l3portmanager.On("CheckPortExists", "port-id-1").Return(true, nil)
+	l3portmanager.On("GetPortNetwork", "port-id-1").Return(model.PortNetwork{FloatingIPReservation: "default/api"}, nil).Times(1)
+	l3portmanager.On("ProvisionPortInNetwork", corev1.IPFamily(""), reserved).Return("port-id-2", nil).Times(1)
+
+	err := portmapper.MapService(s)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3portmanager.AssertExpectations(t)
+	l3portmanager.AssertNotCalled(t, "SetPortFloatingIPReservation", mock.Anything, mock.Anything)
+}
+
+func TestMapServicePrefersPortsWithoutOtherDNSName(t *testing.T) {
+	l3portmanager, portmapper := newPortMapperNetworkFixture()
+	web := model.PortNetwork{DNSName: "web.lb.example.com"}
+	api := model.PortNetwork{DNSName: "api.lb.example.com"}
+
+	s1 := newPortMapperService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationInboundPort: "port-id-1"}
+	s2 := newPortMapperService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationInboundPort: "port-id-2"}
+	s3 := newPortMapperService("test-service-3")
+	s3.Spec.Ports = []corev1.ServicePort{
+		{Protocol: corev1.ProtocolUDP, Port: 53},
+	}
+
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s1), model.PortNetwork{}).Return(web, nil)
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s2), model.PortNetwork{}).Return(model.PortNetwork{}, nil)
+	l3portmanager.On("ValidatePortNetwork", model.FromService(s3), model.PortNetwork{}).Return(api, nil)
+	l3portmanager.On("CheckPortExists", mock.Anything).Return(true, nil)
+	l3portmanager.On("GetPortNetwork", "port-id-1").Return(web, nil).Times(1)
+	l3portmanager.On("GetPortNetwork", "port-id-2").Return(model.PortNetwork{}, nil).Times(1)
+	l3portmanager.On("SetPortDNSName", "port-id-2", api.DNSName).Return(nil).Times(1)
+
+	err := portmapper.MapService(s1)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s2)
+	assert.Nil(t, err)
+	err = portmapper.MapService(s3)
+	assert.Nil(t, err)
+
+	portID, err := portmapper.GetServiceL3Port(model.FromService(s3))
+	assert.Nil(t, err)
+	assert.Equal(t, "port-id-2", portID)
+
+	l3portmanager.AssertExpectations(t)
+}
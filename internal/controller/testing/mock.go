@@ -68,13 +68,18 @@ func (m *MockPortMapper) GetServiceL3Port(id model.ServiceIdentifier) (string, e
 	return a.String(0), a.Error(1)
 }
 
-func (m *MockPortMapper) GetModel() map[string]string {
+func (m *MockPortMapper) GetServiceL3Ports(id model.ServiceIdentifier) ([]string, error) {
+	a := m.Called(id)
+	return softCastStringArray(a.Get(0)), a.Error(1)
+}
+
+func (m *MockPortMapper) GetModel() map[string][]string {
 	a := m.Called()
 	tmp := a.Get(0)
 	if tmp == nil {
 		return nil
 	}
-	return tmp.(map[string]string)
+	return tmp.(map[string][]string)
 }
 
 func (m *MockPortMapper) GetUsedL3Ports() ([]string, error) {
@@ -91,7 +96,7 @@ func NewMockLoadBalancerModelGenerator() *MockLoadBalancerModelGenerator {
 	return new(MockLoadBalancerModelGenerator)
 }
 
-func (m *MockLoadBalancerModelGenerator) GenerateModel(portAssignment map[string]string) (*model.LoadBalancer, error) {
+func (m *MockLoadBalancerModelGenerator) GenerateModel(portAssignment map[string][]string) (*model.LoadBalancer, error) {
 	a := m.Called(portAssignment)
 	obj := a.Get(0)
 	if obj == nil {
@@ -108,3 +113,8 @@ func (m *MockAgentController) PushConfig(cfg *model.LoadBalancer) error {
 	a := m.Called(cfg)
 	return a.Error(0)
 }
+
+func (m *MockAgentController) OutOfSyncAgents(cfg *model.LoadBalancer) ([]string, error) {
+	a := m.Called(cfg)
+	return softCastStringArray(a.Get(0)), a.Error(1)
+}
@@ -15,12 +15,29 @@
 package controller
 
 import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
 	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 )
 
 const (
 	AnnotationManaged     = "cah-loadbalancer.k8s.cloudandheat.com/managed"
 	AnnotationInboundPort = "cah-loadbalancer.k8s.cloudandheat.com/inbound-port"
+
+	AnnotationSubnetID          = "cah-loadbalancer.k8s.cloudandheat.com/subnet-id"
+	AnnotationFloatingIPNetwork = "cah-loadbalancer.k8s.cloudandheat.com/floating-ip-network-id"
+
+	AnnotationFloatingIPReservation = "cah-loadbalancer.k8s.cloudandheat.com/floating-ip-reservation"
+
+	AnnotationDNSName = "cah-loadbalancer.k8s.cloudandheat.com/dns-name"
+
+	AnnotationBandwidthLimit = "cah-loadbalancer.k8s.cloudandheat.com/bandwidth-limit-kbps"
+	AnnotationBandwidthBurst = "cah-loadbalancer.k8s.cloudandheat.com/bandwidth-burst-kbps"
 )
 
 func isServiceManaged(svc *corev1.Service) bool {
@@ -55,6 +72,63 @@ func getPortAnnotation(svc *corev1.Service) string {
 	return svc.Annotations[AnnotationInboundPort]
 }
 
+// The port annotation holds one port ID per IP family of the service,
+// separated by commas.
+func getPortAnnotations(svc *corev1.Service) []string {
+	value := getPortAnnotation(svc)
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// Return the network selected for the ports of the service. Fields without
+// annotation are empty, i.e. select the defaults.
+//
+// Floating IP reservations are scoped to the namespace of the service, so
+// that services cannot claim the addresses of other namespaces.
+func getPortNetworkAnnotations(svc *corev1.Service) model.PortNetwork {
+	if svc.Annotations == nil {
+		return model.PortNetwork{}
+	}
+	network := model.PortNetwork{
+		SubnetID:            svc.Annotations[AnnotationSubnetID],
+		FloatingIPNetworkID: svc.Annotations[AnnotationFloatingIPNetwork],
+		DNSName:             strings.TrimSuffix(svc.Annotations[AnnotationDNSName], "."),
+	}
+	if reservation := svc.Annotations[AnnotationFloatingIPReservation]; reservation != "" {
+		network.FloatingIPReservation = svc.Namespace + "/" + reservation
+	}
+	return network
+}
+
+// Return the bandwidth limit requested by the service; a zero limit if it
+// requests none.
+func getBandwidthLimitAnnotations(svc *corev1.Service) (model.BandwidthLimit, error) {
+	result := model.BandwidthLimit{}
+	if svc.Annotations == nil {
+		return result, nil
+	}
+
+	var err error
+	if value, ok := svc.Annotations[AnnotationBandwidthLimit]; ok {
+		result.MaxKbps, err = strconv.Atoi(value)
+		if err != nil || result.MaxKbps <= 0 {
+			return model.BandwidthLimit{}, fmt.Errorf("%s must be a positive integer (got %q)", AnnotationBandwidthLimit, value)
+		}
+	}
+	if value, ok := svc.Annotations[AnnotationBandwidthBurst]; ok {
+		if result.MaxKbps == 0 {
+			return model.BandwidthLimit{}, fmt.Errorf("%s requires %s", AnnotationBandwidthBurst, AnnotationBandwidthLimit)
+		}
+		result.MaxBurstKbps, err = strconv.Atoi(value)
+		if err != nil || result.MaxBurstKbps < 0 {
+			return model.BandwidthLimit{}, fmt.Errorf("%s must be a non-negative integer (got %q)", AnnotationBandwidthBurst, value)
+		}
+	}
+	return result, nil
+}
+
 func setPortAnnotation(svc *corev1.Service, portID string) {
 	if svc.Annotations == nil {
 		svc.Annotations = make(map[string]string)
@@ -68,3 +142,24 @@ func clearPortAnnotation(svc *corev1.Service) {
 	}
 	delete(svc.Annotations, AnnotationInboundPort)
 }
+
+func joinPortIDs(portIDs []string) string {
+	return strings.Join(portIDs, ",")
+}
+
+func copyStrings(in []string) []string {
+	result := make([]string, len(in))
+	copy(result, in)
+	return result
+}
+
+func getIPFamily(address string) (corev1.IPFamily, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return "", ErrInvalidIpAddress
+	}
+	if addr.Is4() {
+		return corev1.IPv4Protocol, nil
+	}
+	return corev1.IPv6Protocol, nil
+}
@@ -18,6 +18,8 @@ import (
 	"context"
 	goerrors "errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
@@ -52,6 +54,9 @@ const (
 	EventServiceUnassignedForRemapping = "UnassignedForRemapping"
 	EventServiceUnassignedStale        = "UnassignedStale"
 	EventServiceUnmapped               = "Unmapped"
+	EventBandwidthLimitInvalid         = "BandwidthLimitInvalid"
+	EventBandwidthLimitConflict        = "BandwidthLimitConflict"
+	EventBandwidthLimitNotSupported    = "BandwidthLimitNotSupported"
 
 	MessageEventServiceTakenOver              = "Service taken over by cah-loadbalancer-controller"
 	MessageEventServiceReleased               = "Service released by cah-loadbalancer-controller"
@@ -62,14 +67,28 @@ const (
 	MessageEventServiceUnassignedDrop         = "Cleared IP address information because we release control over the Service"
 	MessageEventServiceRemapped               = "Service mapping changed from port %q to %q (due to conflict)"
 	MessageEventServiceUnmapped               = "Service unmapped"
+	MessageEventBandwidthLimitConflict        = "Services sharing L3 port %q request different bandwidth limits; applying %d kbit/s"
+	MessageEventBandwidthLimitNotSupported    = "The port manager does not support bandwidth limits"
 )
 
 var (
 	ErrCleanupBarrierActive = goerrors.New("Cleanup barrier is in place")
 )
 
+// Services are often synced in bursts (e.g. after a restart of the
+// controller), so the bandwidth limits are only updated once the burst is over.
+const bandwidthLimitsUpdateDelay = 2 * time.Second
+
+// Identifies a warning about the bandwidth limit of a service
+type bandwidthLimitWarning struct {
+	service string
+	reason  string
+}
+
 type Worker struct {
-	l3portmanager   L3PortManager
+	l3portmanager L3PortManager
+	// nil if the l3portmanager does not support bandwidth limits
+	qos             L3PortQoSManager
 	portmapper      PortMapper
 	servicesLister  corelisters.ServiceLister
 	kubeclientset   kubernetes.Interface
@@ -79,6 +98,10 @@ type Worker struct {
 
 	workqueue workqueue.RateLimitingInterface
 
+	// The bandwidth limit warnings posted during the last update with their
+	// messages, so that they are only posted again if they change
+	bandwidthLimitWarnings map[bandwidthLimitWarning]string
+
 	AllowCleanups bool
 }
 
@@ -162,10 +185,11 @@ func (w *Worker) mapService(svcSrc *corev1.Service) (updated bool, err error) {
 		return false, err
 	}
 
-	newPortID, err := w.portmapper.GetServiceL3Port(id)
+	newPortIDs, err := w.portmapper.GetServiceL3Ports(id)
 	if err != nil {
 		return false, err
 	}
+	newPortID := joinPortIDs(newPortIDs)
 
 	if oldPortID != newPortID {
 		svc := svcSrc.DeepCopy()
@@ -199,27 +223,139 @@ func (w *Worker) mapService(svcSrc *corev1.Service) (updated bool, err error) {
 //
 // This function will post the updated status to the k8s API.
 func (w *Worker) updateServiceStatus(svcSrc *corev1.Service) (updated bool, err error) {
-	portID := getPortAnnotation(svcSrc)
-	ipaddress, hostname, err := w.l3portmanager.GetExternalAddress(portID)
-	if err != nil {
-		return false, err
+	portIDs := getPortAnnotations(svcSrc)
+	newIngress := make([]corev1.LoadBalancerIngress, len(portIDs))
+	newIPs := make([]string, len(portIDs))
+	for i, portID := range portIDs {
+		ipaddress, hostname, err := w.l3portmanager.GetExternalAddress(portID)
+		if err != nil {
+			return false, err
+		}
+		newIngress[i] = corev1.LoadBalancerIngress{IP: ipaddress, Hostname: hostname}
+		newIPs[i] = ipaddress
 	}
 
-	newIngress := corev1.LoadBalancerIngress{IP: ipaddress, Hostname: hostname}
-
-	if len(svcSrc.Status.LoadBalancer.Ingress) != 1 ||
-		svcSrc.Status.LoadBalancer.Ingress[0].Hostname != newIngress.Hostname ||
-		svcSrc.Status.LoadBalancer.Ingress[0].IP != newIngress.IP {
+	if !isLoadBalancerIngressEqual(svcSrc.Status.LoadBalancer.Ingress, newIngress) {
 		svc := svcSrc.DeepCopy()
-		svc.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{newIngress}
+		svc.Status.LoadBalancer.Ingress = newIngress
 		_, err = w.kubeclientset.CoreV1().Services(svcSrc.Namespace).UpdateStatus(context.TODO(), svc, metav1.UpdateOptions{})
-		w.recorder.Event(svc, corev1.EventTypeNormal, EventServiceAssigned, fmt.Sprintf(MessageEventServiceAssigned, newIngress.IP))
+		w.recorder.Event(svc, corev1.EventTypeNormal, EventServiceAssigned, fmt.Sprintf(MessageEventServiceAssigned, strings.Join(newIPs, ", ")))
 		return true, err
 	}
 
 	return false, err
 }
 
+func isLoadBalancerIngressEqual(a, b []corev1.LoadBalancerIngress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Hostname != b[i].Hostname || a[i].IP != b[i].IP {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the most restrictive of the limits; a zero limit is the least
+// restrictive one.
+func stricterBandwidthLimit(a, b model.BandwidthLimit) model.BandwidthLimit {
+	if a.MaxKbps == 0 {
+		return b
+	}
+	if b.MaxKbps == 0 || a.MaxKbps < b.MaxKbps {
+		return a
+	}
+	if b.MaxKbps < a.MaxKbps {
+		return b
+	}
+	if b.MaxBurstKbps < a.MaxBurstKbps {
+		return b
+	}
+	return a
+}
+
+// Post the warning about the bandwidth limit of the service unless it was
+// already posted during the last update.
+func (w *Worker) warnAboutBandwidthLimit(warnings map[bandwidthLimitWarning]string, svc *corev1.Service, reason string, message string) {
+	key := bandwidthLimitWarning{service: model.FromService(svc).ToKey(), reason: reason}
+	warnings[key] = message
+	if previous, ok := w.bandwidthLimitWarnings[key]; ok && previous == message {
+		return
+	}
+	w.recorder.Event(svc, corev1.EventTypeWarning, reason, message)
+}
+
+// Apply the bandwidth limits requested by the services to their L3 ports.
+//
+// If services sharing an L3 port request different limits, the most
+// restrictive one is applied and an event is posted on all services whose
+// request is not met exactly. Events are only posted when the conflict of a
+// service changes.
+func (w *Worker) updateBandwidthLimits() error {
+	requests := make(map[string]map[*corev1.Service]model.BandwidthLimit)
+	warnings := make(map[bandwidthLimitWarning]string)
+
+	for key, portIDs := range w.portmapper.GetModel() {
+		id, err := model.FromKey(key)
+		if err != nil {
+			return err
+		}
+		svc, err := w.servicesLister.Services(id.Namespace).Get(id.Name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		limit, err := getBandwidthLimitAnnotations(svc)
+		if err != nil {
+			w.warnAboutBandwidthLimit(warnings, svc, EventBandwidthLimitInvalid, err.Error())
+			limit = model.BandwidthLimit{}
+		}
+
+		if w.qos == nil {
+			if limit.MaxKbps != 0 {
+				w.warnAboutBandwidthLimit(warnings, svc, EventBandwidthLimitNotSupported, MessageEventBandwidthLimitNotSupported)
+			}
+			continue
+		}
+
+		for _, portID := range portIDs {
+			if requests[portID] == nil {
+				requests[portID] = make(map[*corev1.Service]model.BandwidthLimit)
+			}
+			requests[portID][svc] = limit
+		}
+	}
+
+	var lastErr error
+	for portID, portRequests := range requests {
+		effective := model.BandwidthLimit{}
+		for _, limit := range portRequests {
+			effective = stricterBandwidthLimit(effective, limit)
+		}
+
+		for svc, limit := range portRequests {
+			if limit != effective {
+				w.warnAboutBandwidthLimit(warnings, svc, EventBandwidthLimitConflict,
+					fmt.Sprintf(MessageEventBandwidthLimitConflict, portID, effective.MaxKbps))
+			}
+		}
+
+		err := w.qos.SetPortBandwidthLimit(portID, effective)
+		if err != nil {
+			klog.Warningf("Failed to set bandwidth limit of L3 port %q: %s", portID, err)
+			lastErr = err
+		}
+	}
+
+	w.bandwidthLimitWarnings = warnings
+	return lastErr
+}
+
 func (w *Worker) cleanupPorts() error {
 	usedPorts, err := w.portmapper.GetUsedL3Ports()
 	if err != nil {
@@ -247,8 +383,11 @@ func NewWorker(
 	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
 	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
 
+	qos, _ := l3portmanager.(L3PortQoSManager)
+
 	return &Worker{
 		l3portmanager:   l3portmanager,
+		qos:             qos,
 		portmapper:      portmapper,
 		kubeclientset:   kubeclientset,
 		servicesLister:  services,
@@ -264,6 +403,12 @@ func (w *Worker) EnqueueJob(j WorkerJob) {
 	w.workqueue.Add(j)
 }
 
+// Enqueue an update of the bandwidth limits. Updates requested within
+// bandwidthLimitsUpdateDelay are coalesced into one.
+func (w *Worker) enqueueBandwidthLimitsUpdate() {
+	w.workqueue.AddAfter(updateBandwidthLimitsJob, bandwidthLimitsUpdateDelay)
+}
+
 func (w *Worker) RequeueJob(j WorkerJob) {
 	w.workqueue.AddRateLimited(j)
 }
@@ -438,6 +583,7 @@ func (j *SyncServiceJob) Run(w *Worker) (RequeueMode, error) {
 	// prevent execution of the update config job (with requeue) so that no
 	// harmful config will be generated during initial sync.
 	w.EnqueueJob(&UpdateConfigJob{})
+	w.enqueueBandwidthLimitsUpdate()
 	return Drop, nil
 }
 
@@ -465,6 +611,7 @@ func (j *RemoveServiceJob) Run(w *Worker) (RequeueMode, error) {
 
 	w.EnqueueJob(&CleanupJob{})
 	w.EnqueueJob(&UpdateConfigJob{})
+	w.enqueueBandwidthLimitsUpdate()
 	return Drop, nil
 }
 
@@ -511,6 +658,58 @@ func (j *UpdateConfigJob) ToString() string {
 	return "UpdateConfigJob"
 }
 
+type UpdateBandwidthLimitsJob struct{}
+
+// The work queue only deduplicates identical items, so all updates use the
+// same job.
+var updateBandwidthLimitsJob = &UpdateBandwidthLimitsJob{}
+
+func (j *UpdateBandwidthLimitsJob) Run(w *Worker) (RequeueMode, error) {
+	// limits must not be derived from the incomplete mapping of the initial
+	// sync
+	if !w.AllowCleanups {
+		return RequeueTail, ErrCleanupBarrierActive
+	}
+
+	err := w.updateBandwidthLimits()
+	if err != nil {
+		return RequeueTail, err
+	}
+	return Drop, nil
+}
+
+func (j *UpdateBandwidthLimitsJob) ToString() string {
+	return "UpdateBandwidthLimitsJob"
+}
+
+type CheckAgentsSyncJob struct{}
+
+func (j *CheckAgentsSyncJob) Run(w *Worker) (RequeueMode, error) {
+	// the config of the initial sync is incomplete, and it is pushed anyway
+	if !w.AllowCleanups {
+		return Drop, nil
+	}
+
+	model, err := w.generator.GenerateModel(w.portmapper.GetModel())
+	if err != nil {
+		return RequeueTail, err
+	}
+
+	outOfSync, err := w.agentController.OutOfSyncAgents(model)
+	if err != nil {
+		return RequeueTail, err
+	}
+	if len(outOfSync) > 0 {
+		klog.Warningf("Agents %s have not applied the current config, pushing it again", strings.Join(outOfSync, ", "))
+		w.EnqueueJob(&UpdateConfigJob{})
+	}
+	return Drop, nil
+}
+
+func (j *CheckAgentsSyncJob) ToString() string {
+	return "CheckAgentsSyncJob"
+}
+
 type EnsureAgentsStateJob struct{}
 
 func (j *EnsureAgentsStateJob) Run(w *Worker) (RequeueMode, error) {
@@ -24,6 +24,7 @@ import (
 	kubeinformers "k8s.io/client-go/informers"
 	k8sfake "k8s.io/client-go/kubernetes/fake"
 	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/stretchr/testify/assert"
 
@@ -268,7 +269,7 @@ func TestSyncServiceCallsMapServiceForManagedServiceAndAnnotatesPort(t *testing.
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"random-port-id"}, nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "random-port-id")
@@ -289,7 +290,7 @@ func TestSyncServiceSetsLoadBalancerStatusOnUnchangedMapping(t *testing.T) {
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"random-port-id"}, nil).Times(1)
 	f.l3portmanager.On("GetExternalAddress", "random-port-id").Return("some-ip", "some-hostname", nil).Times(1)
 
 	j := &SyncServiceJob{model.FromService(s)}
@@ -314,7 +315,7 @@ func TestSyncServiceRequeuesIfExternalAddressCannotBeObtained(t *testing.T) {
 
 	someError := fmt.Errorf("some error")
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"random-port-id"}, nil).Times(1)
 	f.l3portmanager.On("GetExternalAddress", "random-port-id").Return("", "", someError).Times(1)
 
 	j := &SyncServiceJob{model.FromService(s)}
@@ -336,7 +337,7 @@ func TestSyncServiceClearsLoadBalancerStatusIfMappingHasChanged(t *testing.T) {
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("random-port-id", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"random-port-id"}, nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	updatedS.Status.LoadBalancer.Ingress = nil
@@ -482,7 +483,7 @@ func TestPmapServiceRemovesLBStatusAndReturnsTrueIfMappingChangesAndLBStatusIsPr
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"new-port"}, nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	updatedS.Status.LoadBalancer.Ingress = nil
@@ -503,7 +504,7 @@ func TestPmapServiceDoesNothingAndReturnsFalseIfMappingIsUnchangedAndLBStatusIsP
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("old-port", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"old-port"}, nil).Times(1)
 
 	f.runWith(true, func(w *Worker) {
 		updated, err := w.mapService(s)
@@ -520,7 +521,7 @@ func TestPmapServiceUpdatesAnnotationAndReturnsTrueIfMappingChangesAndLBStatusIs
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"new-port"}, nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "new-port")
@@ -541,7 +542,7 @@ func TestPmapServiceUpdatesAnnotationAndReturnsTrueIfMappedAndLBStatusIsNotPrese
 	f.addService(s)
 
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("new-port", nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"new-port"}, nil).Times(1)
 
 	updatedS := s.DeepCopy()
 	setPortAnnotation(updatedS, "new-port")
@@ -580,7 +581,7 @@ func TestPmapServiceForwardsErrorFromGetServiceL3Port(t *testing.T) {
 
 	someError := fmt.Errorf("some error")
 	f.portmapper.On("MapService", s).Return(nil).Times(1)
-	f.portmapper.On("GetServiceL3Port", model.FromService(s)).Return("", someError).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return(nil, someError).Times(1)
 
 	f.runWith(true, func(w *Worker) {
 		updated, err := w.mapService(s)
@@ -719,7 +720,7 @@ func TestUpdateConfigJobPushesConfigToAgents(t *testing.T) {
 	f := newWorkerFixture(t)
 
 	lbm := &model.LoadBalancer{}
-	pm := make(map[string]string)
+	pm := make(map[string][]string)
 
 	f.portmapper.On("GetModel").Return(pm).Times(1)
 	f.generator.On("GenerateModel", pm).Return(lbm, nil).Times(1)
@@ -735,7 +736,7 @@ func TestUpdateConfigJobRequeuesIfPushFails(t *testing.T) {
 	f := newWorkerFixture(t)
 
 	lbm := &model.LoadBalancer{}
-	pm := make(map[string]string)
+	pm := make(map[string][]string)
 
 	someError := fmt.Errorf("random error")
 
@@ -750,10 +751,52 @@ func TestUpdateConfigJobRequeuesIfPushFails(t *testing.T) {
 	assert.Equal(t, someError, err)
 }
 
+func TestCheckAgentsSyncJobPushesConfigIfAgentsAreOutOfSync(t *testing.T) {
+	f := newWorkerFixture(t)
+	f.willAllowCleanups = true
+
+	lbm := &model.LoadBalancer{}
+	pm := make(map[string][]string)
+
+	f.portmapper.On("GetModel").Return(pm).Times(1)
+	f.generator.On("GenerateModel", pm).Return(lbm, nil).Times(1)
+	f.agentController.On("OutOfSyncAgents", lbm).Return([]string{"http://127.1.0.2"}, nil).Times(1)
+
+	w, requeue := f.run(&CheckAgentsSyncJob{})
+	assert.Equal(t, Drop, requeue)
+	assert.Equal(t, 1, w.workqueue.Len())
+	job, _ := w.workqueue.Get()
+	assert.IsType(t, &UpdateConfigJob{}, job)
+}
+
+func TestCheckAgentsSyncJobDoesNothingIfAgentsAreInSync(t *testing.T) {
+	f := newWorkerFixture(t)
+	f.willAllowCleanups = true
+
+	lbm := &model.LoadBalancer{}
+	pm := make(map[string][]string)
+
+	f.portmapper.On("GetModel").Return(pm).Times(1)
+	f.generator.On("GenerateModel", pm).Return(lbm, nil).Times(1)
+	f.agentController.On("OutOfSyncAgents", lbm).Return([]string{}, nil).Times(1)
+
+	w, requeue := f.run(&CheckAgentsSyncJob{})
+	assert.Equal(t, Drop, requeue)
+	assert.Equal(t, 0, w.workqueue.Len())
+}
+
+func TestCheckAgentsSyncJobSkipsTheInitialSync(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	w, requeue := f.run(&CheckAgentsSyncJob{})
+	assert.Equal(t, Drop, requeue)
+	assert.Equal(t, 0, w.workqueue.Len())
+}
+
 func TestUpdateConfigJobRequeuesIfModelGenerationFails(t *testing.T) {
 	f := newWorkerFixture(t)
 
-	pm := make(map[string]string)
+	pm := make(map[string][]string)
 
 	someError := fmt.Errorf("random error")
 
@@ -766,3 +809,158 @@ func TestUpdateConfigJobRequeuesIfModelGenerationFails(t *testing.T) {
 	assert.Equal(t, RequeueTail, requeue)
 	assert.Equal(t, someError, err)
 }
+
+func TestSyncServiceSetsLoadBalancerStatusForDualStackMapping(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = make(map[string]string)
+	s.Annotations["cah-loadbalancer.k8s.cloudandheat.com/managed"] = "true"
+	setPortAnnotation(s, "port-id-v4,port-id-v6")
+	f.addService(s)
+
+	f.portmapper.On("MapService", s).Return(nil).Times(1)
+	f.portmapper.On("GetServiceL3Ports", model.FromService(s)).Return([]string{"port-id-v4", "port-id-v6"}, nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-v4").Return("203.0.113.1", "", nil).Times(1)
+	f.l3portmanager.On("GetExternalAddress", "port-id-v6").Return("2001:db8::1", "", nil).Times(1)
+
+	j := &SyncServiceJob{model.FromService(s)}
+
+	updatedS := s.DeepCopy()
+	updatedS.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
+		{IP: "203.0.113.1"},
+		{IP: "2001:db8::1"},
+	}
+	f.expectUpdateServiceStatusAction(updatedS)
+
+	_, requeue := f.run(j)
+	assert.Equal(t, Drop, requeue)
+}
+
+func TestGetBandwidthLimitAnnotations(t *testing.T) {
+	s := newService("test-service")
+
+	limit, err := getBandwidthLimitAnnotations(s)
+	assert.Nil(t, err)
+	assert.Equal(t, model.BandwidthLimit{}, limit)
+
+	s.Annotations = map[string]string{
+		AnnotationBandwidthLimit: "10000",
+		AnnotationBandwidthBurst: "2000",
+	}
+	limit, err = getBandwidthLimitAnnotations(s)
+	assert.Nil(t, err)
+	assert.Equal(t, model.BandwidthLimit{MaxKbps: 10000, MaxBurstKbps: 2000}, limit)
+
+	s.Annotations = map[string]string{AnnotationBandwidthLimit: "fast"}
+	_, err = getBandwidthLimitAnnotations(s)
+	assert.NotNil(t, err)
+
+	s.Annotations = map[string]string{AnnotationBandwidthBurst: "2000"}
+	_, err = getBandwidthLimitAnnotations(s)
+	assert.NotNil(t, err)
+}
+
+func TestUpdateBandwidthLimitsAppliesStrictestLimitAndReportsConflicts(t *testing.T) {
+	f := newWorkerFixture(t)
+	s1 := newService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationBandwidthLimit: "10000"}
+	f.addService(s1)
+	s2 := newService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationBandwidthLimit: "5000"}
+	f.addService(s2)
+	s3 := newService("test-service-3")
+	f.addService(s3)
+
+	f.portmapper.On("GetModel").Return(map[string][]string{
+		model.FromService(s1).ToKey(): {"port-id-1"},
+		model.FromService(s2).ToKey(): {"port-id-1"},
+		model.FromService(s3).ToKey(): {"port-id-2"},
+	}).Times(1)
+
+	qos := &ostesting.MockL3PortQoSManager{}
+	qos.On("SetPortBandwidthLimit", "port-id-1", model.BandwidthLimit{MaxKbps: 5000}).Return(nil).Times(1)
+	qos.On("SetPortBandwidthLimit", "port-id-2", model.BandwidthLimit{}).Return(nil).Times(1)
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.qos = qos
+		w.recorder = recorder
+		err := w.updateBandwidthLimits()
+		assert.Nil(t, err)
+	})
+
+	qos.AssertExpectations(t)
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventBandwidthLimitConflict)
+}
+
+func TestUpdateBandwidthLimitsReportsConflictsOnlyWhenTheyChange(t *testing.T) {
+	f := newWorkerFixture(t)
+	s1 := newService("test-service-1")
+	s1.Annotations = map[string]string{AnnotationBandwidthLimit: "10000"}
+	f.addService(s1)
+	s2 := newService("test-service-2")
+	s2.Annotations = map[string]string{AnnotationBandwidthLimit: "5000"}
+	f.addService(s2)
+
+	f.portmapper.On("GetModel").Return(map[string][]string{
+		model.FromService(s1).ToKey(): {"port-id-1"},
+		model.FromService(s2).ToKey(): {"port-id-1"},
+	}).Times(2)
+	f.portmapper.On("GetModel").Return(map[string][]string{
+		model.FromService(s1).ToKey(): {"port-id-2"},
+		model.FromService(s2).ToKey(): {"port-id-1"},
+	}).Times(1)
+
+	qos := &ostesting.MockL3PortQoSManager{}
+	qos.On("SetPortBandwidthLimit", "port-id-1", model.BandwidthLimit{MaxKbps: 5000}).Return(nil)
+	qos.On("SetPortBandwidthLimit", "port-id-2", model.BandwidthLimit{MaxKbps: 10000}).Return(nil)
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.qos = qos
+		w.recorder = recorder
+		for i := 0; i < 2; i++ {
+			err := w.updateBandwidthLimits()
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 1, len(recorder.Events))
+		<-recorder.Events
+
+		// the conflict is resolved by remapping the service
+		err := w.updateBandwidthLimits()
+		assert.Nil(t, err)
+		assert.Empty(t, w.bandwidthLimitWarnings)
+	})
+
+	assert.Equal(t, 0, len(recorder.Events))
+}
+
+func TestUpdateBandwidthLimitsReportsMissingSupport(t *testing.T) {
+	f := newWorkerFixture(t)
+	s := newService("test-service")
+	s.Annotations = map[string]string{AnnotationBandwidthLimit: "10000"}
+	f.addService(s)
+
+	f.portmapper.On("GetModel").Return(map[string][]string{
+		model.FromService(s).ToKey(): {"port-id-1"},
+	}).Times(1)
+
+	recorder := record.NewFakeRecorder(10)
+	f.runWith(true, func(w *Worker) {
+		w.recorder = recorder
+		err := w.updateBandwidthLimits()
+		assert.Nil(t, err)
+	})
+
+	assert.Equal(t, 1, len(recorder.Events))
+	assert.Contains(t, <-recorder.Events, EventBandwidthLimitNotSupported)
+}
+
+func TestUpdateBandwidthLimitsJobWaitsForCleanupBarrier(t *testing.T) {
+	f := newWorkerFixture(t)
+
+	_, requeue, err := f.runExpectError(&UpdateBandwidthLimitsJob{})
+	assert.Equal(t, RequeueTail, requeue)
+	assert.Equal(t, ErrCleanupBarrierActive, err)
+}
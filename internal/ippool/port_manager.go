@@ -0,0 +1,280 @@
+package ippool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+const (
+	// Key of the ConfigMap data entry which holds the JSON list of allocated
+	// addresses
+	AllocationsKey = "allocations"
+)
+
+var (
+	ErrNoRangeConfigured = errors.New("no address range configured for the requested IP family")
+	ErrPoolExhausted     = errors.New("no free address left in the address pool")
+)
+
+type Config struct {
+	IPv4Ranges []netip.Prefix `toml:"ipv4-ranges"`
+	IPv6Ranges []netip.Prefix `toml:"ipv6-ranges"`
+
+	// Namespace and name of the ConfigMap in which allocations are persisted
+	ConfigMapNamespace string `toml:"configmap-namespace"`
+	ConfigMapName      string `toml:"configmap-name"`
+}
+
+// IPPoolL3PortManager allocates load-balancer IP addresses from CIDR ranges
+// on demand. The ID of a port is its address.
+//
+// Allocations are persisted in a ConfigMap so that they survive restarts of
+// the controller.
+type IPPoolL3PortManager struct {
+	cfg    *Config
+	client kubernetes.Interface
+
+	lock      sync.Mutex
+	allocated map[netip.Addr]bool
+}
+
+func NewIPPoolL3PortManager(config *Config, client kubernetes.Interface) (*IPPoolL3PortManager, error) {
+	pm := &IPPoolL3PortManager{
+		cfg:    config,
+		client: client,
+	}
+
+	configMap, _, err := pm.getConfigMap()
+	if err != nil {
+		return nil, err
+	}
+
+	pm.allocated, err = parseAllocations(configMap)
+	if err != nil {
+		return nil, err
+	}
+
+	return pm, nil
+}
+
+// Return the ConfigMap which holds the allocations and whether it exists. If
+// it does not exist yet, an empty (not yet created) ConfigMap is returned.
+func (pm *IPPoolL3PortManager) getConfigMap() (*corev1.ConfigMap, bool, error) {
+	configMap, err := pm.client.CoreV1().ConfigMaps(pm.cfg.ConfigMapNamespace).Get(
+		context.TODO(), pm.cfg.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: pm.cfg.ConfigMapNamespace,
+				Name:      pm.cfg.ConfigMapName,
+			},
+		}, false, nil
+	}
+	return configMap, err == nil, err
+}
+
+func parseAllocations(configMap *corev1.ConfigMap) (map[netip.Addr]bool, error) {
+	result := make(map[netip.Addr]bool)
+
+	data, ok := configMap.Data[AllocationsKey]
+	if !ok || data == "" {
+		return result, nil
+	}
+
+	var addresses []netip.Addr
+	err := json.Unmarshal([]byte(data), &addresses)
+	if err != nil {
+		return nil, fmt.Errorf("invalid allocations in ConfigMap %s/%s: %s", configMap.Namespace, configMap.Name, err)
+	}
+
+	for _, addr := range addresses {
+		result[addr] = true
+	}
+	return result, nil
+}
+
+func sortedAddresses(addresses map[netip.Addr]bool) []netip.Addr {
+	result := make([]netip.Addr, 0, len(addresses))
+	for addr := range addresses {
+		result = append(result, addr)
+	}
+	slices.SortFunc(result, func(a, b netip.Addr) int {
+		return a.Compare(b)
+	})
+	return result
+}
+
+// Apply the given modification to the persisted allocations. The
+// modification is retried with fresh allocations if the ConfigMap was
+// changed concurrently.
+func (pm *IPPoolL3PortManager) updateAllocations(modify func(allocated map[netip.Addr]bool) error) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, exists, err := pm.getConfigMap()
+		if err != nil {
+			return err
+		}
+
+		allocated, err := parseAllocations(configMap)
+		if err != nil {
+			return err
+		}
+
+		err = modify(allocated)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(sortedAddresses(allocated))
+		if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		configMap.Data[AllocationsKey] = string(data)
+
+		configMaps := pm.client.CoreV1().ConfigMaps(pm.cfg.ConfigMapNamespace)
+		if !exists {
+			_, err = configMaps.Create(context.TODO(), configMap, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				// someone else created it in the meantime, retry with
+				// their version
+				return apierrors.NewConflict(corev1.Resource("configmaps"), configMap.Name, err)
+			}
+		} else {
+			_, err = configMaps.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+		}
+		if err != nil {
+			return err
+		}
+
+		pm.allocated = allocated
+		return nil
+	})
+}
+
+func (pm *IPPoolL3PortManager) CheckPortExists(portID string) (bool, error) {
+	addr, err := netip.ParseAddr(portID)
+	if err != nil {
+		return false, nil
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return pm.allocated[addr], nil
+}
+
+// ProvisionPort allocates the next free address of the given family. If no
+// family is given, IPv4 ranges are tried first.
+func (pm *IPPoolL3PortManager) ProvisionPort(family corev1.IPFamily) (string, error) {
+	var ranges []netip.Prefix
+	switch family {
+	case corev1.IPv4Protocol:
+		ranges = pm.cfg.IPv4Ranges
+	case corev1.IPv6Protocol:
+		ranges = pm.cfg.IPv6Ranges
+	default:
+		ranges = append(append(ranges, pm.cfg.IPv4Ranges...), pm.cfg.IPv6Ranges...)
+	}
+
+	if len(ranges) == 0 {
+		return "", ErrNoRangeConfigured
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	var result netip.Addr
+	err := pm.updateAllocations(func(allocated map[netip.Addr]bool) error {
+		addr, ok := NextFreeAddress(ranges, func(addr netip.Addr) bool {
+			return allocated[addr]
+		})
+		if !ok {
+			return ErrPoolExhausted
+		}
+		allocated[addr] = true
+		result = addr
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	klog.Infof("allocated address %s from the pool", result)
+	return result.String(), nil
+}
+
+// CleanUnusedPorts returns all allocated addresses which are not in use to
+// the pool.
+func (pm *IPPoolL3PortManager) CleanUnusedPorts(usedPorts []string) error {
+	used := make(map[netip.Addr]bool)
+	for _, portID := range usedPorts {
+		addr, err := netip.ParseAddr(portID)
+		if err != nil {
+			continue
+		}
+		used[addr] = true
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	return pm.updateAllocations(func(allocated map[netip.Addr]bool) error {
+		for addr := range allocated {
+			if !used[addr] {
+				klog.Infof("releasing unused address %s to the pool", addr)
+				delete(allocated, addr)
+			}
+		}
+		return nil
+	})
+}
+
+func (pm *IPPoolL3PortManager) EnsureAgentsState() error {
+	return nil
+}
+
+// GetAvailablePorts returns all currently allocated addresses.
+func (pm *IPPoolL3PortManager) GetAvailablePorts() ([]string, error) {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	var ports []string
+	for _, addr := range sortedAddresses(pm.allocated) {
+		ports = append(ports, addr.String())
+	}
+
+	return ports, nil
+}
+
+func (pm *IPPoolL3PortManager) GetExternalAddress(portID string) (string, string, error) {
+	exists, err := pm.CheckPortExists(portID)
+	if !exists || err != nil {
+		return "", "", fmt.Errorf("%s is not an allocated load-balancer address", portID)
+	}
+
+	return portID, "", nil
+}
+
+func (pm *IPPoolL3PortManager) GetInternalAddress(portID string) (string, error) {
+	exists, err := pm.CheckPortExists(portID)
+	if !exists || err != nil {
+		return "", fmt.Errorf("%s is not an allocated load-balancer address", portID)
+	}
+
+	return portID, nil
+}
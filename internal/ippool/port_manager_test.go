@@ -0,0 +1,168 @@
+package ippool
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+)
+
+func newIPPoolConfig() *Config {
+	return &Config{
+		IPv4Ranges:         []netip.Prefix{netip.MustParsePrefix("203.0.113.0/30")},
+		IPv6Ranges:         []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")},
+		ConfigMapNamespace: "kube-system",
+		ConfigMapName:      "ip-pool",
+	}
+}
+
+func newIPPoolPortManagerFixture(t *testing.T, objects ...runtime.Object) (*IPPoolL3PortManager, *k8sfake.Clientset) {
+	client := k8sfake.NewSimpleClientset(objects...)
+
+	man, err := NewIPPoolL3PortManager(newIPPoolConfig(), client)
+	assert.Nil(t, err)
+
+	return man, client
+}
+
+func getAllocations(t *testing.T, client *k8sfake.Clientset) string {
+	configMap, err := client.CoreV1().ConfigMaps("kube-system").Get(context.TODO(), "ip-pool", metav1.GetOptions{})
+	assert.Nil(t, err)
+	return configMap.Data[AllocationsKey]
+}
+
+func TestNewIPPoolPortManagerWithoutConfigMap(t *testing.T) {
+	man, _ := newIPPoolPortManagerFixture(t)
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Empty(t, ports)
+}
+
+func TestNewIPPoolPortManagerRestoresAllocations(t *testing.T) {
+	man, _ := newIPPoolPortManagerFixture(t, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "ip-pool"},
+		Data: map[string]string{
+			AllocationsKey: `["203.0.113.1","2001:db8::1"]`,
+		},
+	})
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"203.0.113.1", "2001:db8::1"}, ports)
+
+	exists, err := man.CheckPortExists("2001:db8::1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	exists, err = man.CheckPortExists("2001:db8::2")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestNewIPPoolPortManagerRejectsInvalidAllocations(t *testing.T) {
+	client := k8sfake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "kube-system", Name: "ip-pool"},
+		Data: map[string]string{
+			AllocationsKey: `["not-an-address"]`,
+		},
+	})
+
+	_, err := NewIPPoolL3PortManager(newIPPoolConfig(), client)
+	assert.NotNil(t, err)
+}
+
+func TestProvisionPortPersistsAllocation(t *testing.T) {
+	man, client := newIPPoolPortManagerFixture(t)
+
+	portID, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", portID)
+
+	portID, err = man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", portID)
+
+	assert.Equal(t, `["203.0.113.1","2001:db8::1"]`, getAllocations(t, client))
+
+	// a new instance (e.g. after a restart) continues where the old one
+	// stopped
+	restarted, err := NewIPPoolL3PortManager(newIPPoolConfig(), client)
+	assert.Nil(t, err)
+
+	ports, err := restarted.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"203.0.113.1", "2001:db8::1"}, ports)
+
+	portID, err = restarted.ProvisionPort("")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", portID)
+}
+
+func TestProvisionPortFailsIfPoolIsExhausted(t *testing.T) {
+	man, _ := newIPPoolPortManagerFixture(t)
+
+	_, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Equal(t, ErrPoolExhausted, err)
+}
+
+func TestProvisionPortFailsWithoutRangeOfFamily(t *testing.T) {
+	cfg := newIPPoolConfig()
+	cfg.IPv6Ranges = nil
+	man, err := NewIPPoolL3PortManager(cfg, k8sfake.NewSimpleClientset())
+	assert.Nil(t, err)
+
+	_, err = man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Equal(t, ErrNoRangeConfigured, err)
+}
+
+func TestCleanUnusedPortsReturnsAddressesToPool(t *testing.T) {
+	man, client := newIPPoolPortManagerFixture(t)
+
+	_, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+
+	err = man.CleanUnusedPorts([]string{"203.0.113.2"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, `["203.0.113.2"]`, getAllocations(t, client))
+
+	exists, err := man.CheckPortExists("203.0.113.1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	portID, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", portID)
+}
+
+func TestGetAddressesOfAllocatedPort(t *testing.T) {
+	man, _ := newIPPoolPortManagerFixture(t)
+
+	portID, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+
+	addr, hostname, err := man.GetExternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+	assert.Equal(t, "", hostname)
+
+	addr, err = man.GetInternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+
+	_, _, err = man.GetExternalAddress("2001:db8::2")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,50 @@
+package ippool
+
+import (
+	"net/netip"
+)
+
+// IsUsableAddress checks if the address can be used as load-balancer IP
+// within the given range. This excludes the network address (and for IPv4 the
+// broadcast address) of ranges which are large enough to have them.
+func IsUsableAddress(prefix netip.Prefix, addr netip.Addr) bool {
+	prefix = prefix.Masked()
+	if !prefix.Contains(addr) {
+		return false
+	}
+	if prefix.Bits() >= addr.BitLen()-1 {
+		return true
+	}
+	if addr == prefix.Addr() {
+		return false
+	}
+	if addr.Is4() && !prefix.Contains(addr.Next()) {
+		return false
+	}
+	return true
+}
+
+// RangesContain checks if the address is a usable address of any of the
+// ranges.
+func RangesContain(ranges []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range ranges {
+		if IsUsableAddress(prefix, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextFreeAddress returns the first usable address of the ranges for which
+// inUse returns false. Returns false if all addresses are in use.
+func NextFreeAddress(ranges []netip.Prefix, inUse func(netip.Addr) bool) (netip.Addr, bool) {
+	for _, prefix := range ranges {
+		prefix = prefix.Masked()
+		for addr := prefix.Addr(); addr.IsValid() && prefix.Contains(addr); addr = addr.Next() {
+			if IsUsableAddress(prefix, addr) && !inUse(addr) {
+				return addr, true
+			}
+		}
+	}
+	return netip.Addr{}, false
+}
@@ -0,0 +1,47 @@
+package ippool
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsUsableAddress(t *testing.T) {
+	v4 := netip.MustParsePrefix("192.0.2.0/24")
+	assert.False(t, IsUsableAddress(v4, netip.MustParseAddr("192.0.2.0")))
+	assert.True(t, IsUsableAddress(v4, netip.MustParseAddr("192.0.2.1")))
+	assert.True(t, IsUsableAddress(v4, netip.MustParseAddr("192.0.2.254")))
+	assert.False(t, IsUsableAddress(v4, netip.MustParseAddr("192.0.2.255")))
+	assert.False(t, IsUsableAddress(v4, netip.MustParseAddr("192.0.3.1")))
+
+	v6 := netip.MustParsePrefix("2001:db8::/64")
+	assert.False(t, IsUsableAddress(v6, netip.MustParseAddr("2001:db8::")))
+	assert.True(t, IsUsableAddress(v6, netip.MustParseAddr("2001:db8::ffff:ffff:ffff:ffff")))
+
+	// point-to-point and host ranges have no network or broadcast address
+	assert.True(t, IsUsableAddress(netip.MustParsePrefix("192.0.2.0/31"), netip.MustParseAddr("192.0.2.0")))
+	assert.True(t, IsUsableAddress(netip.MustParsePrefix("192.0.2.1/32"), netip.MustParseAddr("192.0.2.1")))
+}
+
+func TestNextFreeAddress(t *testing.T) {
+	ranges := []netip.Prefix{
+		netip.MustParsePrefix("192.0.2.0/30"),
+		netip.MustParsePrefix("2001:db8::/126"),
+	}
+	inUse := map[netip.Addr]bool{
+		netip.MustParseAddr("192.0.2.1"): true,
+		netip.MustParseAddr("192.0.2.2"): true,
+	}
+
+	addr, ok := NextFreeAddress(ranges, func(addr netip.Addr) bool {
+		return inUse[addr]
+	})
+	assert.True(t, ok)
+	assert.Equal(t, netip.MustParseAddr("2001:db8::1"), addr)
+
+	_, ok = NextFreeAddress(ranges[:1], func(addr netip.Addr) bool {
+		return inUse[addr]
+	})
+	assert.False(t, ok)
+}
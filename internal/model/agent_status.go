@@ -0,0 +1,72 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// StatusSubject is the subject of the tokens which authorize requests to the
+// status API of the agents
+const StatusSubject = "status"
+
+// ServiceStatus is the state of a service configured by an agent.
+type ServiceStatus struct {
+	Name string `json:"name"`
+	// Time and result of the last apply; the error is empty on success
+	LastApply   *time.Time `json:"last-apply,omitempty"`
+	LastChanged bool       `json:"last-changed"`
+	LastError   string     `json:"last-error,omitempty"`
+	// Result and output of the status command of the service
+	Healthy     bool   `json:"healthy"`
+	CheckOutput string `json:"check-output"`
+}
+
+// AgentStatus is returned by the status API of the agents.
+type AgentStatus struct {
+	Version string `json:"version"`
+	// Generation and hash of the currently applied config; zero and empty
+	// if no config has been applied yet
+	Generation uint64     `json:"generation"`
+	ConfigHash string     `json:"config-hash"`
+	AppliedAt  *time.Time `json:"applied-at,omitempty"`
+	// Restored is true if the agent runs the config it persisted before its
+	// restart and has not received a config from the controller since
+	Restored bool            `json:"restored"`
+	Services []ServiceStatus `json:"services"`
+}
+
+// InSync returns true if the agent has applied the config.
+func (s *AgentStatus) InSync(lb *LoadBalancer) (bool, error) {
+	hash, err := lb.Hash()
+	if err != nil {
+		return false, err
+	}
+	return s.ConfigHash == hash, nil
+}
+
+// Hash returns a hash of the load-balancer config, which identifies the
+// config across the controller and the agents.
+func (lb *LoadBalancer) Hash() (string, error) {
+	data, err := json.Marshal(lb)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -76,7 +76,18 @@ type LoadBalancer struct {
 	PolicyAssignments []PolicyAssignment `json:"policy-assignments" validate:"dive"`
 }
 
+// GenerationHeader carries the last generation accepted by an agent in the
+// response to a rejected (replayed or outdated) config
+const GenerationHeader = "X-Config-Generation"
+
+// ApplyStageHeader carries the stage in which an agent failed to apply a
+// config, e.g. "render" or "reload"
+const ApplyStageHeader = "X-Apply-Stage"
+
 type ConfigClaim struct {
 	Config LoadBalancer `json:"load-balancer-config" validate:"required"`
+	// Generation increases with every config sent by the controller; agents
+	// only accept configs with a generation newer than the last one
+	Generation uint64 `json:"generation"`
 	jwt.StandardClaims
 }
@@ -24,11 +24,50 @@ type L4Port struct {
 }
 
 type ServiceModel struct {
-	L3PortID string
-	Ports    []L4Port
+	// One L3 port per IP family of the service, in the order of the
+	// service's IP families.
+	L3PortIDs []string
+	Ports     []L4Port
+}
+
+// The value of PortNetwork.FloatingIPNetworkID which selects a port without
+// floating IP.
+const NoFloatingIP = "none"
+
+// PortNetwork selects where an L3 port is placed. Empty fields select the
+// defaults of the port manager.
+type PortNetwork struct {
+	SubnetID string
+	// ID of the network from which the floating IP is allocated or
+	// NoFloatingIP
+	FloatingIPNetworkID string
+	// Key ("<namespace>/<name>") of the reservation which keeps the floating
+	// IP beyond the lifetime of the port
+	FloatingIPReservation string
+	// Fully qualified DNS name (without trailing dot) of the external address
+	DNSName string
+}
+
+// Placement returns the network without the DNS name and the floating IP
+// reservation. Only the placement decides whether services can share an L3
+// port; the DNS name and the reservation are applied to the port in place.
+func (n PortNetwork) Placement() PortNetwork {
+	n.DNSName = ""
+	n.FloatingIPReservation = ""
+	return n
+}
+
+// BandwidthLimit of an L3 port in kbit/s. A zero MaxKbps means no limit.
+type BandwidthLimit struct {
+	MaxKbps      int
+	MaxBurstKbps int
 }
 
 type L3Port struct {
+	// The IP family of the port; empty if it has not been looked up yet.
+	Family corev1.IPFamily
+	// The network of the port; nil if it has not been looked up yet.
+	Network     *PortNetwork
 	Allocations map[int32]string
 }
 
@@ -0,0 +1,118 @@
+package openstack
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"k8s.io/klog"
+)
+
+const (
+	// Alias of the Neutron extension which allows adding and removing single
+	// allowed address pairs without replacing the whole list
+	ExtensionAllowedAddressPairsAtomic = "allowed-address-pairs-atomic"
+
+	// The agent ports carry one tag with this prefix for each address pair
+	// added by the controller. Neutron does not allow "/" in tags, so it is
+	// replaced by "_" in the prefix lengths of networks.
+	TagLBAddressPairPrefix = "cah-loadbalancer-vip="
+
+	// How often the address pairs of an agent port are written if the port
+	// is changed concurrently by others
+	maxAddressPairsAttempts = 3
+)
+
+type addressPairsUpdate struct {
+	AllowedAddressPairs []portsv2.AddressPair `json:"allowed_address_pairs"`
+}
+
+type addressPairsRequest struct {
+	Port addressPairsUpdate `json:"port"`
+}
+
+// Call one of the atomic address pair actions of the port.
+func updateAddressPairs(c *gophercloud.ServiceClient, id string, action string, pairs []portsv2.AddressPair) error {
+	body := addressPairsRequest{Port: addressPairsUpdate{AllowedAddressPairs: pairs}}
+	resp, err := c.Put(c.ServiceURL("ports", id, action), &body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{200},
+	})
+	_, _, err = gophercloud.ParseResponse(resp, err)
+	return err
+}
+
+// Check if the update of a port failed because its revision number did not
+// match, i.e. the port was changed since it was read.
+func isRevisionConflict(err error) bool {
+	codeErr, ok := err.(gophercloud.StatusCodeError)
+	return ok && codeErr.GetStatusCode() == http.StatusPreconditionFailed
+}
+
+// Return the tag which marks the address pair as owned by the controller. It
+// fails if the address is too long to fit into a tag.
+func addressPairTag(ip string) (string, bool) {
+	tag := TagLBAddressPairPrefix + strings.ReplaceAll(ip, "/", "_")
+	if len(tag) > maxTagLength {
+		klog.Warningf("Address pair %q is too long for a tag; it will not be removed automatically", ip)
+		return "", false
+	}
+	return tag, true
+}
+
+// Return the addresses of the address pair tags.
+func ownedAddressPairs(tags []string) map[string]bool {
+	owned := make(map[string]bool)
+	for _, tag := range tags {
+		ip, found := strings.CutPrefix(tag, TagLBAddressPairPrefix)
+		if found {
+			owned[strings.ReplaceAll(ip, "_", "/")] = true
+		}
+	}
+	return owned
+}
+
+// Compute the changes needed to get from the current address pairs of an
+// agent port to the desired ones. Only addresses in desired or owned are
+// touched; all other pairs are left alone, as they belong to someone else.
+func diffAddressPairs(current []portsv2.AddressPair, desired []string, owned map[string]bool) (toAdd, toRemove []portsv2.AddressPair) {
+	currentIPs := make(map[string]bool)
+	for _, pair := range current {
+		currentIPs[pair.IPAddress] = true
+	}
+
+	desiredIPs := make(map[string]bool)
+	for _, ip := range desired {
+		if desiredIPs[ip] {
+			continue
+		}
+		desiredIPs[ip] = true
+		if !currentIPs[ip] {
+			toAdd = append(toAdd, portsv2.AddressPair{IPAddress: ip})
+		}
+	}
+
+	for _, pair := range current {
+		if owned[pair.IPAddress] && !desiredIPs[pair.IPAddress] {
+			toRemove = append(toRemove, pair)
+		}
+	}
+
+	return toAdd, toRemove
+}
+
+// Apply the changes to the full list of address pairs.
+func applyAddressPairsDiff(current, toAdd, toRemove []portsv2.AddressPair) []portsv2.AddressPair {
+	removed := make(map[string]bool)
+	for _, pair := range toRemove {
+		removed[pair.IPAddress] = true
+	}
+
+	result := []portsv2.AddressPair{}
+	for _, pair := range current {
+		if !removed[pair.IPAddress] {
+			result = append(result, pair)
+		}
+	}
+	return append(result, toAdd...)
+}
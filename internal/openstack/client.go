@@ -36,6 +36,12 @@ type OpenStackClient struct {
 }
 
 func NewProviderClient(cfg *config.AuthOpts) (*gophercloud.ProviderClient, error) {
+	resolved, err := cfg.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clouds.yaml: %s", err)
+	}
+	cfg = &resolved
+
 	provider, err := openstack.NewClient(cfg.AuthURL)
 	if err != nil {
 		return nil, err
@@ -63,13 +69,22 @@ func NewProviderClient(cfg *config.AuthOpts) (*gophercloud.ProviderClient, error
 
 	provider.HTTPClient.Transport = netutil.SetOldTransportDefaults(&http.Transport{TLSClientConfig: config})
 
-	opts := cfg.ToAuthOptions()
+	opts, err := cfg.ToAuthOptions()
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth options: %s", err)
+	}
 	err = openstack.Authenticate(provider, opts)
 
 	return provider, err
 }
 
 func NewClient(cfg *config.AuthOpts) (*OpenStackClient, error) {
+	resolved, err := cfg.Resolve()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load clouds.yaml: %s", err)
+	}
+	cfg = &resolved
+
 	provider, err := NewProviderClient(cfg)
 	if err != nil {
 		return nil, err
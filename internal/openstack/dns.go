@@ -0,0 +1,186 @@
+package openstack
+
+import (
+	"errors"
+	"strings"
+
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+var (
+	ErrDNSNotConfigured       = errors.New("DNS names require a configured dns-domain")
+	ErrDNSNameOutsideDomain   = errors.New("DNS name is not within the configured dns-domain")
+	ErrReservationDNSMismatch = errors.New("Reserved floating IP has a different DNS name")
+	ErrFloatingIPDNSImmutable = errors.New("DNS name of the floating IP cannot be changed")
+)
+
+// The DNS attributes of Neutron ports and floating IPs (DNS integration)
+type dnsAssignment struct {
+	DNSName   string `json:"dns_name,omitempty"`
+	DNSDomain string `json:"dns_domain,omitempty"`
+}
+
+// Sets the DNS attributes of a port; empty attributes clear them
+type portDNSUpdateOpts struct {
+	dnsAssignment
+}
+
+func (opts portDNSUpdateOpts) ToPortUpdateMap() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"port": map[string]interface{}{"dns_name": opts.DNSName, "dns_domain": opts.DNSDomain},
+	}, nil
+}
+
+// Return the fully qualified name without trailing dot or "" if no name is
+// assigned. Resources without own domain use the default domain.
+func (a dnsAssignment) hostname(defaultDomain string) string {
+	if a.DNSName == "" {
+		return ""
+	}
+	domain := a.DNSDomain
+	if domain == "" {
+		domain = defaultDomain
+	}
+	return strings.TrimSuffix(a.DNSName+"."+strings.TrimSuffix(domain, "."), ".")
+}
+
+// RenderDNSNameTemplate replaces {{name}} and {{namespace}} in the template
+// with the name and namespace of the service.
+func RenderDNSNameTemplate(template string, id model.ServiceIdentifier) string {
+	return strings.NewReplacer(
+		"{{name}}", id.Name,
+		"{{namespace}}", id.Namespace,
+	).Replace(template)
+}
+
+// Split the hostname into the dns_name and dns_domain attributes. The
+// hostname must be within the configured DNS domain.
+func (pm *OpenStackL3PortManager) splitHostname(hostname string) (dnsAssignment, error) {
+	domain := strings.TrimSuffix(pm.cfg.DNSDomain, ".")
+	if domain == "" {
+		return dnsAssignment{}, ErrDNSNotConfigured
+	}
+
+	name := strings.TrimSuffix(hostname, "."+domain)
+	if name == hostname || name == "" {
+		return dnsAssignment{}, ErrDNSNameOutsideDomain
+	}
+
+	return dnsAssignment{DNSName: name, DNSDomain: domain + "."}, nil
+}
+
+// Return the hostname of the port, taken from the DNS attributes of its
+// floating IP or, if it has none or the floating IP has no name, of the port
+// itself. Hostnames are looked up once and remembered afterwards.
+func (pm *OpenStackL3PortManager) getHostname(portID string) (string, error) {
+	if pm.cfg.DNSDomain == "" {
+		return "", nil
+	}
+
+	pm.dnsLock.Lock()
+	defer pm.dnsLock.Unlock()
+
+	if hostname, ok := pm.hostnames[portID]; ok {
+		return hostname, nil
+	}
+
+	_, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		return "", err
+	}
+
+	assignment := dnsAssignment{}
+	if fip != nil {
+		err = floatingipsv2.Get(pm.client, fip.ID).ExtractIntoStructPtr(&assignment, "floatingip")
+		if err != nil {
+			return "", err
+		}
+	}
+	if assignment.DNSName == "" {
+		err = portsv2.Get(pm.client, portID).ExtractIntoStructPtr(&assignment, "port")
+		if err != nil {
+			return "", err
+		}
+	}
+
+	hostname := assignment.hostname(pm.cfg.DNSDomain)
+	if pm.hostnames == nil {
+		pm.hostnames = make(map[string]string)
+	}
+	pm.hostnames[portID] = hostname
+	return hostname, nil
+}
+
+// SetPortDNSName changes the hostname of the port in place. Neutron does not
+// allow changing the DNS attributes of floating IPs, so the name is set on the
+// port, which Neutron also publishes for its floating IP if the floating IP
+// has no name of its own. It fails if the floating IP has an own name.
+func (pm *OpenStackL3PortManager) SetPortDNSName(portID string, hostname string) error {
+	current, err := pm.getHostname(portID)
+	if err != nil {
+		return err
+	}
+	if current == hostname {
+		return nil
+	}
+
+	attrs := dnsAssignment{}
+	if hostname != "" {
+		attrs, err = pm.splitHostname(hostname)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		return err
+	}
+	if fip != nil {
+		fipAttrs := dnsAssignment{}
+		err = floatingipsv2.Get(pm.client, fip.ID).ExtractIntoStructPtr(&fipAttrs, "floatingip")
+		if err != nil {
+			return err
+		}
+		if fipAttrs.DNSName != "" {
+			return ErrFloatingIPDNSImmutable
+		}
+	}
+
+	klog.Infof("Changing DNS name of port %q from %q to %q", portID, current, hostname)
+	_, err = pm.ports.Update(pm.client, portID, portDNSUpdateOpts{attrs})
+	if err != nil {
+		return err
+	}
+
+	pm.rememberHostname(portID, hostname)
+	return nil
+}
+
+func (pm *OpenStackL3PortManager) rememberHostname(portID string, hostname string) {
+	pm.dnsLock.Lock()
+	defer pm.dnsLock.Unlock()
+
+	if hostname == "" {
+		delete(pm.hostnames, portID)
+		return
+	}
+	if pm.hostnames == nil {
+		pm.hostnames = make(map[string]string)
+	}
+	pm.hostnames[portID] = hostname
+}
+
+// Return the hostname of a floating IP.
+func (pm *OpenStackL3PortManager) getFloatingIPHostname(fipID string) (string, error) {
+	assignment := dnsAssignment{}
+	err := floatingipsv2.Get(pm.client, fipID).ExtractIntoStructPtr(&assignment, "floatingip")
+	if err != nil {
+		return "", err
+	}
+	return assignment.hostname(pm.cfg.DNSDomain), nil
+}
@@ -0,0 +1,212 @@
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	th "github.com/gophercloud/gophercloud/testhelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+func TestRenderDNSNameTemplate(t *testing.T) {
+	id := model.ServiceIdentifier{Namespace: "shop", Name: "web"}
+	assert.Equal(t, "web.shop.lb.example.com", RenderDNSNameTemplate("{{name}}.{{namespace}}.lb.example.com", id))
+	assert.Equal(t, "static.example.com", RenderDNSNameTemplate("static.example.com", id))
+}
+
+func TestValidatePortNetworkChecksDNSName(t *testing.T) {
+	cfg := newPortNetworkConfig()
+	pm := &OpenStackL3PortManager{cfg: cfg}
+	id := model.ServiceIdentifier{Namespace: "shop", Name: "web"}
+
+	_, err := pm.ValidatePortNetwork(id, model.PortNetwork{DNSName: "web.example.com"})
+	assert.Equal(t, ErrDNSNotConfigured, err)
+
+	cfg.DNSDomain = "lb.example.com."
+
+	network, err := pm.ValidatePortNetwork(id, model.PortNetwork{DNSName: "Web.LB.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{DNSName: "web.lb.example.com"}, network)
+
+	_, err = pm.ValidatePortNetwork(id, model.PortNetwork{DNSName: "web.example.com"})
+	assert.Equal(t, ErrDNSNameOutsideDomain, err)
+
+	_, err = pm.ValidatePortNetwork(id, model.PortNetwork{DNSName: "lb.example.com"})
+	assert.Equal(t, ErrDNSNameOutsideDomain, err)
+
+	cfg.DNSNameTemplate = "{{name}}-{{namespace}}.lb.example.com"
+
+	network, err = pm.ValidatePortNetwork(id, model.PortNetwork{})
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{DNSName: "web-shop.lb.example.com"}, network)
+
+	network, err = pm.ValidatePortNetwork(id, model.PortNetwork{DNSName: "other.lb.example.com"})
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{DNSName: "other.lb.example.com"}, network)
+}
+
+func TestGetExternalAddressReturnsHostname(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	lookups := 0
+	th.Mux.HandleFunc("/v2.0/floatingips/fip-id", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		lookups++
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "fip-id", "dns_name": "web", "dns_domain": "lb.example.com."}}`)
+	})
+
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id", FloatingIP: "203.0.113.7"}, nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.cfg.DNSDomain = "lb.example.com."
+
+	for i := 0; i < 2; i++ {
+		address, hostname, err := pm.GetExternalAddress("port-id")
+		assert.Nil(t, err)
+		assert.Equal(t, "203.0.113.7", address)
+		assert.Equal(t, "web.lb.example.com", hostname)
+	}
+	assert.Equal(t, 1, lookups)
+}
+
+func TestGetExternalAddressWithoutDNSDomainSkipsLookup(t *testing.T) {
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id", FloatingIP: "203.0.113.7"}, nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+
+	address, hostname, err := pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", address)
+	assert.Equal(t, "", hostname)
+}
+
+func TestProvisionFloatingIPRegistersDNSName(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		th.TestJSONRequest(t, r, `{"floatingip": {
+			"description": "`+DescriptionLBManagedPort+`",
+			"floating_network_id": "public",
+			"port_id": "new-port",
+			"dns_name": "web",
+			"dns_domain": "lb.example.com."
+		}}`)
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"floatingip": {"id": "new-fip"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/new-fip/tags", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tags": ["`+TagLBManagedPort+`"]}`)
+	})
+
+	pm := newTestHelperPortManager()
+	pm.cfg.DNSDomain = "lb.example.com"
+
+	dnsAttrs, err := pm.splitHostname("web.lb.example.com")
+	assert.Nil(t, err)
+
+	err = pm.provisionFloatingIP("new-port", "public", "", dnsAttrs)
+	assert.Nil(t, err)
+}
+
+func TestProvisionFloatingIPRefusesReservationWithOtherDNSName(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "reserved-fip", "floating_network_id": "public", "port_id": null}
+		]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/reserved-fip", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "reserved-fip", "dns_name": "old", "dns_domain": "lb.example.com."}}`)
+	})
+
+	pm := newTestHelperPortManager()
+	pm.cfg.DNSDomain = "lb.example.com"
+
+	dnsAttrs, err := pm.splitHostname("web.lb.example.com")
+	assert.Nil(t, err)
+
+	err = pm.provisionFloatingIP("new-port", "public", "default/web", dnsAttrs)
+	assert.Equal(t, ErrReservationDNSMismatch, err)
+}
+
+func TestSetPortDNSNameUpdatesPortOfUnnamedFloatingIP(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips/fip-id", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "fip-id", "dns_name": "", "dns_domain": ""}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/ports/port-id", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"port": {"id": "port-id", "dns_name": "", "dns_domain": ""}}`)
+	})
+
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id", FloatingIP: "203.0.113.7"}, nil)
+	client.On("Update", mock.Anything, "port-id", portDNSUpdateOpts{dnsAssignment{DNSName: "web", DNSDomain: "lb.example.com."}}).Return(&portsv2.Port{ID: "port-id"}, nil).Once()
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.cfg.DNSDomain = "lb.example.com."
+
+	err := pm.SetPortDNSName("port-id", "web.lb.example.com")
+	assert.Nil(t, err)
+
+	_, hostname, err := pm.GetExternalAddress("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "web.lb.example.com", hostname)
+
+	// unchanged names are not written again
+	err = pm.SetPortDNSName("port-id", "web.lb.example.com")
+	assert.Nil(t, err)
+	client.AssertExpectations(t)
+}
+
+func TestSetPortDNSNameFailsIfFloatingIPHasName(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips/fip-id", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "fip-id", "dns_name": "web", "dns_domain": "lb.example.com."}}`)
+	})
+
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id", FloatingIP: "203.0.113.7"}, nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.cfg.DNSDomain = "lb.example.com."
+
+	err := pm.SetPortDNSName("port-id", "api.lb.example.com")
+	assert.Equal(t, ErrFloatingIPDNSImmutable, err)
+	client.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything)
+}
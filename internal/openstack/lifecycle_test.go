@@ -0,0 +1,260 @@
+package openstack
+
+import (
+	"testing"
+
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+type lifecycleFixture struct {
+	t *testing.T
+
+	cloud  *ostesting.FakeOpenStack
+	client *OpenStackClient
+	cfg    *config.NetworkingOpts
+	agents []config.Agent
+}
+
+func newLifecycleFixture(t *testing.T) *lifecycleFixture {
+	cloud := ostesting.NewFakeOpenStack()
+	t.Cleanup(cloud.Close)
+
+	cloud.AddNetwork("internal", false)
+	cloud.AddNetwork("public", true)
+	cloud.AddSubnet("subnet", "internal", "10.0.0.0/24")
+	for _, id := range []string{"agent-port-1", "agent-port-2"} {
+		cloud.AddPort(portsv2.Port{
+			ID:        id,
+			NetworkID: "internal",
+			AllowedAddressPairs: []portsv2.AddressPair{
+				{IPAddress: "10.0.0.200"},
+			},
+		})
+	}
+
+	client, err := NewClient(&config.AuthOpts{
+		AuthURL:        cloud.AuthURL(),
+		Username:       ostesting.FakeUsername,
+		Password:       ostesting.FakePassword,
+		UserDomainName: "Default",
+		Region:         ostesting.FakeRegion,
+	})
+	require.Nil(t, err)
+	assert.Equal(t, ostesting.FakeProjectID, client.projectID)
+
+	return &lifecycleFixture{
+		t:      t,
+		cloud:  cloud,
+		client: client,
+		cfg: &config.NetworkingOpts{
+			UseFloatingIPs:      true,
+			FloatingIPNetworkID: "public",
+			SubnetID:            "subnet",
+			ClusterID:           "test",
+		},
+		agents: []config.Agent{
+			{URL: "http://agent-1", PortId: "agent-port-1"},
+			{URL: "http://agent-2", PortId: "agent-port-2"},
+		},
+	}
+}
+
+func (f *lifecycleFixture) newPortManager() *OpenStackL3PortManager {
+	pm, err := f.client.NewOpenStackL3PortManager(f.cfg, f.agents, []string{"10.0.0.250"})
+	require.Nil(f.t, err)
+	return pm
+}
+
+func (f *lifecycleFixture) agentAddresses(portID string) []string {
+	port := f.cloud.Port(portID)
+	require.NotNil(f.t, port)
+
+	addresses := []string{}
+	for _, pair := range port.AllowedAddressPairs {
+		addresses = append(addresses, pair.IPAddress)
+	}
+	return addresses
+}
+
+func (f *lifecycleFixture) testLifecycle() {
+	t := f.t
+	pm := f.newPortManager()
+
+	portID, err := pm.ProvisionPort("")
+	require.Nil(t, err)
+
+	port := f.cloud.Port(portID)
+	require.NotNil(t, port)
+	assert.ElementsMatch(t, []string{TagLBManagedPort, ClusterTag("test")}, port.Tags)
+	assert.Equal(t, DescriptionLBManagedPort, port.Description)
+
+	fips := f.cloud.FloatingIPs()
+	require.Len(t, fips, 1)
+	assert.Equal(t, portID, fips[0].PortID)
+	assert.ElementsMatch(t, []string{TagLBManagedPort, ClusterTag("test")}, fips[0].Tags)
+
+	external, _, err := pm.GetExternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, fips[0].FloatingIP, external)
+
+	internal, err := pm.GetInternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", internal)
+
+	for _, agent := range f.agents {
+		assert.ElementsMatch(t, []string{"10.0.0.200", "10.0.0.250", "10.0.0.1"}, f.agentAddresses(agent.PortId))
+	}
+
+	exists, err := pm.CheckPortExists(portID)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	available, err := pm.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{portID}, available)
+
+	err = pm.CleanUnusedPorts(nil)
+	assert.Nil(t, err)
+
+	exists, err = pm.CheckPortExists(portID)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Empty(t, f.cloud.FloatingIPs())
+
+	for _, agent := range f.agents {
+		assert.ElementsMatch(t, []string{"10.0.0.200", "10.0.0.250"}, f.agentAddresses(agent.PortId))
+	}
+}
+
+func TestLifecycleAgainstFakeOpenStack(t *testing.T) {
+	newLifecycleFixture(t).testLifecycle()
+}
+
+func TestLifecycleAgainstFakeOpenStackWithAtomicAddressPairs(t *testing.T) {
+	f := newLifecycleFixture(t)
+	f.cloud.EnableExtension(ExtensionAllowedAddressPairsAtomic)
+
+	f.testLifecycle()
+
+	assert.Contains(t, f.cloud.Requests(), "PUT /v2.0/ports/agent-port-1/add_allowed_address_pairs")
+	assert.Contains(t, f.cloud.Requests(), "PUT /v2.0/ports/agent-port-1/remove_allowed_address_pairs")
+}
+
+func TestAgentAddressPairsAreRemovedAfterRestart(t *testing.T) {
+	f := newLifecycleFixture(t)
+	pm := f.newPortManager()
+
+	portID, err := pm.ProvisionPort("")
+	require.Nil(t, err)
+	for _, agent := range f.agents {
+		assert.ElementsMatch(t, []string{"10.0.0.200", "10.0.0.250", "10.0.0.1"}, f.agentAddresses(agent.PortId))
+		assert.Contains(t, f.cloud.Port(agent.PortId).Tags, TagLBAddressPairPrefix+"10.0.0.1")
+	}
+
+	// the new instance neither has the extra address nor knows the port
+	pm, err = f.client.NewOpenStackL3PortManager(f.cfg, f.agents, nil)
+	require.Nil(t, err)
+	err = pm.CleanUnusedPorts(nil)
+	assert.Nil(t, err)
+
+	exists, err := pm.CheckPortExists(portID)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	for _, agent := range f.agents {
+		assert.Equal(t, []string{"10.0.0.200"}, f.agentAddresses(agent.PortId))
+		assert.Empty(t, f.cloud.Port(agent.PortId).Tags)
+	}
+}
+
+func TestNewClientRejectsWrongCredentials(t *testing.T) {
+	cloud := ostesting.NewFakeOpenStack()
+	defer cloud.Close()
+
+	_, err := NewClient(&config.AuthOpts{
+		AuthURL:        cloud.AuthURL(),
+		Username:       ostesting.FakeUsername,
+		Password:       "wrong",
+		UserDomainName: "Default",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestGetPortsFollowsPagination(t *testing.T) {
+	f := newLifecycleFixture(t)
+	f.cloud.PageSize = 2
+	pm := f.newPortManager()
+
+	provisioned := []string{}
+	for i := 0; i < 5; i++ {
+		portID, err := pm.ProvisionPort("")
+		require.Nil(t, err)
+		provisioned = append(provisioned, portID)
+	}
+
+	available, err := pm.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, provisioned, available)
+
+	err = pm.CleanUnusedPorts(provisioned[:1])
+	assert.Nil(t, err)
+
+	available, err = pm.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, provisioned[:1], available)
+	assert.Len(t, f.cloud.FloatingIPs(), 1)
+}
+
+func TestOtherClustersPortsAreIgnored(t *testing.T) {
+	f := newLifecycleFixture(t)
+	f.cloud.AddPort(portsv2.Port{
+		ID:        "other-cluster-port",
+		NetworkID: "internal",
+		ProjectID: ostesting.FakeProjectID,
+		Tags:      []string{TagLBManagedPort, ClusterTag("other")},
+	})
+	pm := f.newPortManager()
+
+	available, err := pm.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Empty(t, available)
+
+	err = pm.CleanUnusedPorts(nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, f.cloud.Port("other-cluster-port"))
+}
+
+func TestProvisionPortFailsWhenQuotaIsExhausted(t *testing.T) {
+	f := newLifecycleFixture(t)
+	f.cloud.SetQuota("floatingip", 0)
+	pm := f.newPortManager()
+
+	_, err := pm.ProvisionPort("")
+	assert.Equal(t, ErrNoFloatingIPCreated, err)
+
+	// the port without floating IP is cleaned up again
+	assert.Len(t, f.cloud.Ports(), 2)
+}
+
+func TestPreflightAgainstFakeOpenStack(t *testing.T) {
+	f := newLifecycleFixture(t)
+	f.cloud.SetQuota("port", 10)
+
+	networkingclient, err := f.client.NewNetworkV2()
+	require.Nil(t, err)
+
+	headroom, err := Preflight(networkingclient, f.client.projectID, f.cfg, f.agents)
+	assert.Nil(t, err)
+	assert.Equal(t, []QuotaHeadroom{
+		{Resource: "ports", Limit: 10, Used: 2},
+		{Resource: "floating IPs", Limit: -1, Used: 0},
+	}, headroom)
+
+	f.cfg.FloatingIPNetworkID = "internal"
+	_, err = Preflight(networkingclient, f.client.projectID, f.cfg, f.agents)
+	assert.ErrorContains(t, err, `floating IP network "internal" is not an external network`)
+}
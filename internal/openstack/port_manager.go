@@ -16,21 +16,44 @@ package openstack
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/controller"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions"
 	tags "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/dns"
 	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 	subnetsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
 	"github.com/gophercloud/gophercloud/pagination"
+	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog"
 )
 
 const (
 	TagLBManagedPort         = "cah-loadbalancer.k8s.cloudandheat.com/managed"
+	TagLBClusterPrefix       = "cah-loadbalancer-cluster="
+	TagLBNoFloatingIP        = "cah-loadbalancer-floating-ip=none"
+	TagLBReservedFloatingIP  = "cah-loadbalancer-reserved"
 	DescriptionLBManagedPort = "Managed by cah-loadbalancer"
+
+	// The description of a reserved floating IP is this prefix followed by
+	// the key of the reservation
+	DescriptionLBReservedFloatingIPPrefix = "Reserved by cah-loadbalancer for "
+
+	// Neutron limits tags to 60 characters
+	maxTagLength = 60
+	// Neutron limits descriptions to 255 characters
+	maxDescriptionLength = 255
 )
 
 var (
@@ -39,6 +62,22 @@ var (
 	ErrPortIsNil           = errors.New("Port is nil")
 	ErrNoFloatingIPCreated = errors.New("No floating IP was created by OpenStack")
 	ErrVRRPSetupFailed     = errors.New("Failed to update address pairs of all agents")
+	ErrIPFamilyMismatch    = errors.New("Requested IP family does not match the configured subnet")
+	ErrSubnetNotAllowed    = errors.New("Subnet is not allowed for load-balancer ports")
+	ErrNetworkNotAllowed   = errors.New("Floating IP network is not allowed for load-balancer ports")
+
+	ErrReservationWithoutFloatingIP = errors.New("Floating IP reservation requires a floating IP")
+	ErrReservationTooLong           = errors.New("Floating IP reservation key is too long")
+	ErrReservationInUse             = errors.New("Reserved floating IP is attached to another port")
+	ErrReservationNetworkMismatch   = errors.New("Reserved floating IP is not in the selected floating IP network")
+	ErrReservationExists            = errors.New("Floating IP reservation exists already for another floating IP")
+	ErrFloatingIPReserved           = errors.New("Floating IP of the port is reserved already")
+)
+
+// The optional features of the L3 port manager interface
+var (
+	_ controller.L3PortNetworkManager = &OpenStackL3PortManager{}
+	_ controller.L3PortQoSManager     = &OpenStackL3PortManager{}
 )
 
 // We need options which are not included in the default gophercloud struct
@@ -55,6 +94,8 @@ type CustomCreateOpts struct {
 	ProjectID           string                `json:"project_id,omitempty"`
 	SecurityGroups      *[]string             `json:"security_groups,omitempty"`
 	AllowedAddressPairs []portsv2.AddressPair `json:"allowed_address_pairs,omitempty"`
+	DNSName             string                `json:"dns_name,omitempty"`
+	DNSDomain           string                `json:"dns_domain,omitempty"`
 
 	// specifically this one
 	PortSecurityEnabled *bool `json:"port_security_enabled,omitempty"`
@@ -64,14 +105,70 @@ func (opts CustomCreateOpts) ToPortCreateMap() (map[string]interface{}, error) {
 	return gophercloud.BuildRequestBody(opts, "port")
 }
 
+// The properties of a subnet which are needed to create ports in it
+type subnetInfo struct {
+	networkID string
+	ipFamily  corev1.IPFamily
+}
+
 type OpenStackL3PortManager struct {
 	client                 *gophercloud.ServiceClient
-	networkID              string
 	projectID              string
+	subnets                map[string]subnetInfo
 	cfg                    *config.NetworkingOpts
 	additionalAddressPairs []string
 	agents                 []config.Agent
 	ports                  PortClient
+	portCache              *CachedClient
+	tags                   []string
+	atomicAddressPairs     bool
+
+	qosSupported bool
+	// only checked if qosSupported is set
+	qosIngressSupported    bool
+	qosFloatingIPSupported bool
+
+	qosLock         sync.Mutex
+	bandwidthLimits map[string]model.BandwidthLimit
+
+	dnsLock   sync.Mutex
+	hostnames map[string]string
+}
+
+// ClusterTag returns the tag which marks resources as owned by the cluster
+// with the given ID.
+func ClusterTag(clusterID string) string {
+	return TagLBClusterPrefix + clusterID
+}
+
+// ValidateClusterID checks if the cluster ID can be used in a Neutron tag.
+func ValidateClusterID(clusterID string) error {
+	if strings.ContainsAny(clusterID, ",/") {
+		return fmt.Errorf("cluster-id must not contain ',' or '/'")
+	}
+	if len(ClusterTag(clusterID)) > maxTagLength {
+		return fmt.Errorf("cluster-id must not be longer than %d characters",
+			maxTagLength-len(TagLBClusterPrefix))
+	}
+	return nil
+}
+
+// Return the tags which are set on and used to filter for managed resources.
+func managedTags(clusterID string) []string {
+	if clusterID == "" {
+		return []string{TagLBManagedPort}
+	}
+	return []string{TagLBManagedPort, ClusterTag(clusterID)}
+}
+
+// Check if any of the tags assigns the resource to a cluster.
+func hasClusterTag(resourceTags []string) bool {
+	for _, tag := range resourceTags {
+		if strings.HasPrefix(tag, TagLBClusterPrefix) {
+			return true
+		}
+	}
+	return false
 }
 
 func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.NetworkingOpts, agents []config.Agent, additionalAddressPairs []string) (*OpenStackL3PortManager, error) {
@@ -81,38 +178,329 @@ func (client *OpenStackClient) NewOpenStackL3PortManager(networkConfig *config.N
 		return nil, err
 	}
 
-	subnet, err := subnetsv2.Get(networkingclient, networkConfig.SubnetID).Extract()
-	if err != nil {
+	subnets := make(map[string]subnetInfo)
+	for _, subnetID := range append([]string{networkConfig.SubnetID}, networkConfig.AllowedSubnetIDs...) {
+		subnet, err := subnetsv2.Get(networkingclient, subnetID).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("could not get subnet %q: %s", subnetID, err)
+		}
+
+		ipFamily := corev1.IPv4Protocol
+		if subnet.IPVersion == 6 {
+			ipFamily = corev1.IPv6Protocol
+		}
+		subnets[subnetID] = subnetInfo{networkID: subnet.NetworkID, ipFamily: ipFamily}
+	}
+
+	if networkConfig.ClusterID == "" {
+		klog.Warningf("No cluster-id configured. Ports and floating IPs of " +
+			"other clusters in the same project will be treated as managed by " +
+			"this controller.")
+	} else if err := ValidateClusterID(networkConfig.ClusterID); err != nil {
 		return nil, err
 	}
+	managed := managedTags(networkConfig.ClusterID)
 
-	networkID := subnet.NetworkID
+	var ports PortClient = NewPortClient(
+		networkingclient,
+		strings.Join(managed, ","),
+		networkConfig.UseFloatingIPs,
+		client.projectID,
+	)
+	var portCache *CachedClient
+	if networkConfig.PortCacheTTL > 0 {
+		portCache = NewCachedPortClient(ports, time.Duration(networkConfig.PortCacheTTL)*time.Second)
+		ports = portCache
+	}
 
-	return &OpenStackL3PortManager{
+	pm := &OpenStackL3PortManager{
 		client:                 networkingclient,
 		cfg:                    networkConfig,
-		networkID:              networkID,
+		subnets:                subnets,
 		projectID:              client.projectID,
 		additionalAddressPairs: additionalAddressPairs,
 		agents:                 agents,
-		ports: NewPortClient(
-			networkingclient,
-			TagLBManagedPort,
-			networkConfig.UseFloatingIPs,
-			client.projectID,
-		),
-	}, nil
+		ports:                  ports,
+		portCache:              portCache,
+		tags:                   managed,
+	}
+
+	pm.atomicAddressPairs, err = hasExtension(networkingclient, ExtensionAllowedAddressPairsAtomic)
+	if err != nil {
+		return nil, err
+	}
+
+	pm.qosSupported, err = hasExtension(networkingclient, ExtensionQoS)
+	if err != nil {
+		return nil, err
+	}
+	if pm.qosSupported {
+		pm.qosIngressSupported, err = hasExtension(networkingclient, ExtensionQoSBandwidthLimitDirection)
+		if err != nil {
+			return nil, err
+		}
+		if !pm.qosIngressSupported {
+			klog.Warningf("Neutron lacks the %s extension; bandwidth limits only apply to egress traffic", ExtensionQoSBandwidthLimitDirection)
+		}
+		pm.qosFloatingIPSupported, err = hasExtension(networkingclient, ExtensionQoSFloatingIP)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if networkConfig.ClusterID != "" && networkConfig.AdoptLegacyResources {
+		err = pm.adoptLegacyResources()
+		if err != nil {
+			return nil, fmt.Errorf("could not adopt legacy resources: %s", err)
+		}
+	}
+
+	return pm, nil
+}
+
+// Check if Neutron offers the extension with the alias.
+func hasExtension(client *gophercloud.ServiceClient, alias string) (bool, error) {
+	_, err := extensions.Get(client, alias).Extract()
+	if err == nil {
+		return true, nil
+	}
+	if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+		return false, nil
+	}
+	return false, fmt.Errorf("could not check for Neutron extension %s: %s", alias, err)
+}
+
+// Add the cluster tag to all managed ports and floating IPs of the project
+// which are not assigned to any cluster yet. This is meant as a one-time
+// migration for resources created before cluster IDs were introduced and
+// must only be enabled if a single cluster used the project before.
+func (pm *OpenStackL3PortManager) adoptLegacyResources() error {
+	clusterTag := ClusterTag(pm.cfg.ClusterID)
+
+	var portIDs []string
+	err := portsv2.List(
+		pm.client,
+		portsv2.ListOpts{Tags: TagLBManagedPort, ProjectID: pm.projectID},
+	).EachPage(func(page pagination.Page) (bool, error) {
+		ports, err := portsv2.ExtractPorts(page)
+		if err != nil {
+			return false, err
+		}
+		for _, port := range ports {
+			if !hasClusterTag(port.Tags) {
+				portIDs = append(portIDs, port.ID)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var fipIDs []string
+	err = floatingipsv2.List(
+		pm.client,
+		floatingipsv2.ListOpts{Tags: TagLBManagedPort, ProjectID: pm.projectID},
+	).EachPage(func(page pagination.Page) (bool, error) {
+		fips, err := floatingipsv2.ExtractFloatingIPs(page)
+		if err != nil {
+			return false, err
+		}
+		for _, fip := range fips {
+			if !hasClusterTag(fip.Tags) {
+				fipIDs = append(fipIDs, fip.ID)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, portID := range portIDs {
+		klog.Infof("Adopting legacy port %q into cluster %q", portID, pm.cfg.ClusterID)
+		err = tags.Add(pm.client, "ports", portID, clusterTag).ExtractErr()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fipID := range fipIDs {
+		klog.Infof("Adopting legacy floating ip %q into cluster %q", fipID, pm.cfg.ClusterID)
+		err = tags.Add(pm.client, "floatingips", fipID, clusterTag).ExtractErr()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
-	fip, err := floatingipsv2.Create(
+// RunPortCacheRefresh periodically refreshes the port cache until stopCh is
+// closed. Returns immediately if the cache is disabled.
+func (pm *OpenStackL3PortManager) RunPortCacheRefresh(stopCh <-chan struct{}) {
+	if pm.portCache == nil || pm.cfg.PortCacheRefreshInterval <= 0 {
+		return
+	}
+
+	wait.Until(func() {
+		err := pm.portCache.Refresh()
+		if err != nil {
+			klog.Warningf("Failed to refresh port cache: %s", err)
+		}
+	}, time.Duration(pm.cfg.PortCacheRefreshInterval)*time.Second, stopCh)
+}
+
+func reservationDescription(reservation string) string {
+	return DescriptionLBReservedFloatingIPPrefix + reservation
+}
+
+// Return the floating IP of the given reservation or nil if there is none
+// yet.
+func (pm *OpenStackL3PortManager) getReservedFloatingIP(reservation string) (*floatingipsv2.FloatingIP, error) {
+	var result *floatingipsv2.FloatingIP
+	err := floatingipsv2.List(
 		pm.client,
-		floatingipsv2.CreateOpts{
-			Description:       DescriptionLBManagedPort,
-			FloatingNetworkID: pm.cfg.FloatingIPNetworkID,
-			PortID:            portID,
+		floatingipsv2.ListOpts{
+			Tags:        strings.Join(append(append([]string{}, pm.tags...), TagLBReservedFloatingIP), ","),
+			Description: reservationDescription(reservation),
+			ProjectID:   pm.projectID,
 		},
+	).EachPage(func(page pagination.Page) (bool, error) {
+		fips, err := floatingipsv2.ExtractFloatingIPs(page)
+		if err != nil {
+			return false, err
+		}
+		for i := range fips {
+			if result != nil {
+				klog.Warningf("Found multiple floating IPs for reservation %q (%s and %s at least)", reservation, result.ID, fips[i].ID)
+				return false, nil
+			}
+			result = &fips[i]
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Drop the cached state of the port after changes which are not made through
+// the port client, e.g. of its floating IP or tags.
+func (pm *OpenStackL3PortManager) invalidatePort(portID string) {
+	if pm.portCache != nil {
+		pm.portCache.InvalidatePort(portID)
+	}
+}
+
+// SetPortFloatingIPReservation reserves the floating IP of the port in place,
+// so that the port keeps its address and the address outlives the port.
+func (pm *OpenStackL3PortManager) SetPortFloatingIPReservation(portID string, reservation string) error {
+	if len(reservationDescription(reservation)) > maxDescriptionLength {
+		return ErrReservationTooLong
+	}
+
+	_, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		return err
+	}
+	if fip == nil {
+		return ErrReservationWithoutFloatingIP
+	}
+	if slices.Contains(fip.Tags, TagLBReservedFloatingIP) {
+		if fip.Description == reservationDescription(reservation) {
+			return nil
+		}
+		return ErrFloatingIPReserved
+	}
+
+	reserved, err := pm.getReservedFloatingIP(reservation)
+	if err != nil {
+		return err
+	}
+	if reserved != nil && reserved.ID != fip.ID {
+		return ErrReservationExists
+	}
+
+	// the floating IP of the port changes in any case
+	defer pm.invalidatePort(portID)
+
+	// the description is set first, as only the tag makes the floating IP
+	// count as reserved
+	klog.Infof("Reserving floating ip %q of port %q for %q", fip.ID, portID, reservation)
+	description := reservationDescription(reservation)
+	_, err = floatingipsv2.Update(
+		pm.client,
+		fip.ID,
+		floatingipsv2.UpdateOpts{Description: &description},
 	).Extract()
+	if err != nil {
+		return err
+	}
+	return tags.Add(pm.client, "floatingips", fip.ID, TagLBReservedFloatingIP).ExtractErr()
+}
+
+// Attach a floating IP from the given network to the port. If a reservation
+// is given, its floating IP is reused if it exists already; otherwise a new
+// floating IP is created for the reservation.
+func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string, floatingNetworkID string, reservation string, dnsAttrs dnsAssignment) error {
+	// the floating IP of the port changes in any case
+	defer pm.invalidatePort(portID)
+
+	description := DescriptionLBManagedPort
+	fipTags := pm.tags
+
+	if reservation != "" {
+		reserved, err := pm.getReservedFloatingIP(reservation)
+		if err != nil {
+			return err
+		}
+
+		if reserved != nil {
+			if reserved.PortID != "" && reserved.PortID != portID {
+				return ErrReservationInUse
+			}
+			if reserved.FloatingNetworkID != floatingNetworkID {
+				return ErrReservationNetworkMismatch
+			}
+			if pm.cfg.DNSDomain != "" {
+				hostname, err := pm.getFloatingIPHostname(reserved.ID)
+				if err != nil {
+					return err
+				}
+				if hostname != dnsAttrs.hostname(pm.cfg.DNSDomain) {
+					return ErrReservationDNSMismatch
+				}
+			}
+
+			klog.Infof("Attaching reserved floating ip %q of %q to port %q", reserved.ID, reservation, portID)
+			_, err = floatingipsv2.Update(
+				pm.client,
+				reserved.ID,
+				floatingipsv2.UpdateOpts{PortID: &portID},
+			).Extract()
+			return err
+		}
+
+		description = reservationDescription(reservation)
+		fipTags = append(append([]string{}, pm.tags...), TagLBReservedFloatingIP)
+	}
+
+	var createOpts floatingipsv2.CreateOptsBuilder = floatingipsv2.CreateOpts{
+		Description:       description,
+		FloatingNetworkID: floatingNetworkID,
+		PortID:            portID,
+	}
+	if dnsAttrs.DNSName != "" {
+		createOpts = dns.FloatingIPCreateOptsExt{
+			CreateOptsBuilder: createOpts,
+			DNSName:           dnsAttrs.DNSName,
+			DNSDomain:         dnsAttrs.DNSDomain,
+		}
+	}
+
+	fip, err := floatingipsv2.Create(pm.client, createOpts).Extract()
 
 	if err != nil {
 		return err
@@ -129,7 +517,7 @@ func (pm *OpenStackL3PortManager) provisionFloatingIP(portID string) error {
 	}
 
 	_, err = tags.ReplaceAll(pm.client, "floatingips", fip.ID, tags.ReplaceAllOpts{
-		Tags: []string{TagLBManagedPort},
+		Tags: fipTags,
 	}).Extract()
 
 	if err != nil {
@@ -160,18 +548,145 @@ func (pm *OpenStackL3PortManager) CheckPortExists(portID string) (bool, error) {
 	return true, nil
 }
 
-func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
-	port, err := pm.ports.Create(
-		pm.client,
-		CustomCreateOpts{
-			NetworkID:   pm.networkID,
-			Description: DescriptionLBManagedPort,
-			FixedIPs: []portsv2.IP{
-				{SubnetID: pm.cfg.SubnetID},
-			},
-			PortSecurityEnabled: boolPtr(false),
+// Return the floating IP network which is used if a port does not select one.
+func (pm *OpenStackL3PortManager) defaultFloatingIPNetworkID() string {
+	if !pm.cfg.UseFloatingIPs {
+		return model.NoFloatingIP
+	}
+	return pm.cfg.FloatingIPNetworkID
+}
+
+// Clear the fields of the network which select the defaults.
+func (pm *OpenStackL3PortManager) canonicalPortNetwork(network model.PortNetwork) model.PortNetwork {
+	if network.SubnetID == pm.cfg.SubnetID {
+		network.SubnetID = ""
+	}
+	if network.FloatingIPNetworkID == pm.defaultFloatingIPNetworkID() {
+		network.FloatingIPNetworkID = ""
+	}
+	return network
+}
+
+// ValidatePortNetwork checks the subnet and floating IP network against the
+// allowed ones from the configuration. Services without DNS name get one from
+// the configured template.
+func (pm *OpenStackL3PortManager) ValidatePortNetwork(id model.ServiceIdentifier, network model.PortNetwork) (model.PortNetwork, error) {
+	if network.DNSName == "" && pm.cfg.DNSNameTemplate != "" {
+		network.DNSName = RenderDNSNameTemplate(pm.cfg.DNSNameTemplate, id)
+	}
+	return pm.validatePortNetwork(network)
+}
+
+func (pm *OpenStackL3PortManager) validatePortNetwork(network model.PortNetwork) (model.PortNetwork, error) {
+	network = pm.canonicalPortNetwork(network)
+	if network.DNSName != "" {
+		network.DNSName = strings.ToLower(network.DNSName)
+		if _, err := pm.splitHostname(network.DNSName); err != nil {
+			return model.PortNetwork{}, err
+		}
+	}
+	if network.SubnetID != "" && !slices.Contains(pm.cfg.AllowedSubnetIDs, network.SubnetID) {
+		return model.PortNetwork{}, ErrSubnetNotAllowed
+	}
+	if network.FloatingIPNetworkID != "" && !slices.Contains(pm.cfg.AllowedFloatingIPNetworkIDs, network.FloatingIPNetworkID) {
+		return model.PortNetwork{}, ErrNetworkNotAllowed
+	}
+	if network.FloatingIPReservation != "" {
+		if network.FloatingIPNetworkID == model.NoFloatingIP ||
+			(network.FloatingIPNetworkID == "" && !pm.cfg.UseFloatingIPs) {
+			return model.PortNetwork{}, ErrReservationWithoutFloatingIP
+		}
+		if len(reservationDescription(network.FloatingIPReservation)) > maxDescriptionLength {
+			return model.PortNetwork{}, ErrReservationTooLong
+		}
+	}
+	return network, nil
+}
+
+// GetPortNetwork derives the network of the port from its subnet and floating
+// IP.
+func (pm *OpenStackL3PortManager) GetPortNetwork(portID string) (model.PortNetwork, error) {
+	port, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		return model.PortNetwork{}, err
+	}
+	if port == nil {
+		return model.PortNetwork{}, ErrPortIsNil
+	}
+	if len(port.FixedIPs) == 0 {
+		return model.PortNetwork{}, ErrFixedIPMissing
+	}
+
+	network := model.PortNetwork{SubnetID: port.FixedIPs[0].SubnetID}
+	if fip != nil {
+		network.FloatingIPNetworkID = fip.FloatingNetworkID
+		if slices.Contains(fip.Tags, TagLBReservedFloatingIP) {
+			network.FloatingIPReservation = strings.TrimPrefix(fip.Description, DescriptionLBReservedFloatingIPPrefix)
+		}
+	} else if slices.Contains(port.Tags, TagLBNoFloatingIP) {
+		network.FloatingIPNetworkID = model.NoFloatingIP
+	}
+
+	network.DNSName, err = pm.getHostname(portID)
+	if err != nil {
+		return model.PortNetwork{}, err
+	}
+
+	return pm.canonicalPortNetwork(network), nil
+}
+
+// ProvisionPort creates a new port in the configured subnet.
+func (pm *OpenStackL3PortManager) ProvisionPort(family corev1.IPFamily) (string, error) {
+	return pm.ProvisionPortInNetwork(family, model.PortNetwork{})
+}
+
+// ProvisionPortInNetwork creates a new port in the selected subnet with a
+// floating IP from the selected network (or the reserved floating IP). As a
+// port only gets an address from that single subnet, only the subnet's IP
+// family (or no specific family at all) can be requested.
+func (pm *OpenStackL3PortManager) ProvisionPortInNetwork(family corev1.IPFamily, network model.PortNetwork) (string, error) {
+	network, err := pm.validatePortNetwork(network)
+	if err != nil {
+		return "", err
+	}
+
+	var dnsAttrs dnsAssignment
+	if network.DNSName != "" {
+		dnsAttrs, err = pm.splitHostname(network.DNSName)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	subnetID := pm.cfg.SubnetID
+	if network.SubnetID != "" {
+		subnetID = network.SubnetID
+	}
+	floatingNetworkID := pm.defaultFloatingIPNetworkID()
+	if network.FloatingIPNetworkID != "" {
+		floatingNetworkID = network.FloatingIPNetworkID
+	}
+
+	subnet := pm.subnets[subnetID]
+	if family != "" && subnet.ipFamily != "" && family != subnet.ipFamily {
+		return "", ErrIPFamilyMismatch
+	}
+
+	createOpts := CustomCreateOpts{
+		NetworkID:   subnet.networkID,
+		Description: DescriptionLBManagedPort,
+		FixedIPs: []portsv2.IP{
+			{SubnetID: subnetID},
 		},
-	)
+		PortSecurityEnabled: boolPtr(false),
+	}
+	if floatingNetworkID == model.NoFloatingIP {
+		// without floating IP, the name is registered for the fixed IP
+		createOpts.DNSName = dnsAttrs.DNSName
+		createOpts.DNSDomain = dnsAttrs.DNSDomain
+	}
+
+	port, err := pm.ports.Create(pm.client, createOpts)
 	// XXX: this is meh because we can only set the tag after the port was
 	// created. If we get killed between the previous line and setting the
 	// tag, the port will linger, unusedly.
@@ -191,17 +706,24 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 		}
 	}
 
+	portTags := pm.tags
+	if pm.cfg.UseFloatingIPs && floatingNetworkID == model.NoFloatingIP {
+		// remember that the missing floating IP is intended
+		portTags = append(append([]string{}, pm.tags...), TagLBNoFloatingIP)
+	}
+
 	_, err = tags.ReplaceAll(pm.client, "ports", port.ID, tags.ReplaceAllOpts{
-		Tags: []string{TagLBManagedPort},
+		Tags: portTags,
 	}).Extract()
+	pm.invalidatePort(port.ID)
 
 	if err != nil {
 		cleanupPort()
 		return "", err
 	}
 
-	if pm.cfg.UseFloatingIPs {
-		err := pm.provisionFloatingIP(port.ID)
+	if floatingNetworkID != model.NoFloatingIP {
+		err := pm.provisionFloatingIP(port.ID, floatingNetworkID, network.FloatingIPReservation, dnsAttrs)
 		if err != nil {
 			klog.Warningf("Couldn't provide floating ip for port=%v: %s", port.ID, err)
 			cleanupPort()
@@ -209,6 +731,8 @@ func (pm *OpenStackL3PortManager) ProvisionPort() (string, error) {
 		}
 	}
 
+	pm.rememberHostname(port.ID, network.DNSName)
+
 	err = pm.EnsureAgentsState()
 	if err != nil {
 		klog.Warningf("VRRP setup for port=%v failed during provisioning: %s", port.ID, err)
@@ -221,7 +745,7 @@ func (pm *OpenStackL3PortManager) deleteUnusedFloatingIPs() error {
 	pager := floatingipsv2.List(
 		pm.client,
 		floatingipsv2.ListOpts{
-			Tags:      TagLBManagedPort,
+			Tags:      strings.Join(pm.tags, ","),
 			ProjectID: pm.projectID,
 		},
 	)
@@ -233,6 +757,10 @@ func (pm *OpenStackL3PortManager) deleteUnusedFloatingIPs() error {
 			return false, err
 		}
 		for _, fip := range fips {
+			if slices.Contains(fip.Tags, TagLBReservedFloatingIP) {
+				// kept until the reservation is released manually
+				continue
+			}
 			if fip.PortID == "" {
 				// no assigned port, delete
 				toDelete = append(toDelete, fip.ID)
@@ -306,7 +834,10 @@ func (pm *OpenStackL3PortManager) GetAvailablePorts() ([]string, error) {
 
 // Ensures that all fixed IPs of L3 ports as well as additional configured IPs
 // are configured as allowed address pair of all agent nodes. Should be run periodically
-// to ensure a correct setup in case an agent was unresponsive earlier
+// to ensure a correct setup in case an agent was unresponsive earlier.
+//
+// Address pairs which were not added by this controller are left untouched.
+// Addresses of ports deleted by this controller are removed.
 func (pm *OpenStackL3PortManager) EnsureAgentsState() error {
 	ports, err := pm.ports.GetPorts()
 	if err != nil {
@@ -314,11 +845,7 @@ func (pm *OpenStackL3PortManager) EnsureAgentsState() error {
 		return err
 	}
 
-	addressPairs := []portsv2.AddressPair{}
-
-	for _, ip := range pm.additionalAddressPairs {
-		addressPairs = append(addressPairs, portsv2.AddressPair{IPAddress: ip})
-	}
+	desired := append([]string{}, pm.additionalAddressPairs...)
 
 	for _, port := range ports {
 		if len(port.FixedIPs) == 0 {
@@ -326,39 +853,149 @@ func (pm *OpenStackL3PortManager) EnsureAgentsState() error {
 		}
 
 		for _, ip := range port.FixedIPs {
-			addressPairs = append(addressPairs, portsv2.AddressPair{IPAddress: ip.IPAddress})
+			desired = append(desired, ip.IPAddress)
 		}
 	}
 
-	allSucceeded := true
+	var failed int32
 
 	var wg sync.WaitGroup
 	for i := range pm.agents {
 		wg.Add(1)
 		go func(agent *config.Agent) {
-			_, err := pm.ports.Update(
-				pm.client,
-				agent.PortId,
-				portsv2.UpdateOpts{
-					AllowedAddressPairs: &addressPairs,
-				},
-			)
+			defer wg.Done()
+			err := pm.reconcileAgentAddressPairs(agent.PortId, desired)
 			if err != nil {
 				klog.Warningf("Failed to configure VRRP address pairs for agent port %v : %s", agent.PortId, err)
-				allSucceeded = false
+				atomic.AddInt32(&failed, 1)
 			}
-			defer wg.Done()
 		}(&pm.agents[i])
 	}
 
 	wg.Wait()
-	if !allSucceeded {
+	if failed > 0 {
 		return ErrVRRPSetupFailed
 	}
 
 	return nil
 }
 
+// Return the client which bypasses the port cache. It is used for the agent
+// ports, which are changed by others as well.
+func (pm *OpenStackL3PortManager) uncachedPorts() PortClient {
+	if pm.portCache != nil {
+		return pm.portCache.backend
+	}
+	return pm.ports
+}
+
+// Add the desired addresses to the agent port and remove those which the
+// controller added before but which are not desired anymore. If the port is
+// changed by someone else in between, the update is retried.
+func (pm *OpenStackL3PortManager) reconcileAgentAddressPairs(portID string, desired []string) error {
+	var err error
+	for attempt := 0; attempt < maxAddressPairsAttempts; attempt++ {
+		err = pm.tryReconcileAgentAddressPairs(portID, desired)
+		if !isRevisionConflict(err) {
+			return err
+		}
+		klog.Infof("Agent port %q was changed concurrently, retrying to update its address pairs", portID)
+	}
+	return err
+}
+
+func (pm *OpenStackL3PortManager) tryReconcileAgentAddressPairs(portID string, desired []string) error {
+	// A cached and possibly outdated state of the port must not be written
+	// back, so it is always read from Neutron.
+	port, _, err := pm.uncachedPorts().GetPortByID(portID)
+	if err != nil {
+		return err
+	}
+	if port == nil {
+		return ErrPortIsNil
+	}
+
+	// The addresses owned by the controller are recorded in tags of the agent
+	// port, so that they are still known after a restart.
+	owned := ownedAddressPairs(port.Tags)
+	toAdd, toRemove := diffAddressPairs(port.AllowedAddressPairs, desired, owned)
+
+	err = pm.updateAgentAddressPairs(port, toAdd, toRemove)
+	if err != nil {
+		return err
+	}
+
+	// The tags are changed after the address pairs, as each tag change
+	// increases the revision number of the port. Only the pairs added here
+	// are tagged; pairs which existed already belong to someone else, even
+	// if their address is desired. Tags of added addresses are added first,
+	// so that they are not lost if removing the others fails.
+	for _, pair := range toAdd {
+		tag, ok := addressPairTag(pair.IPAddress)
+		if owned[pair.IPAddress] || !ok {
+			continue
+		}
+		err = pm.ports.AddTag(pm.client, portID, tag)
+		if err != nil {
+			return err
+		}
+		owned[pair.IPAddress] = true
+	}
+
+	desiredIPs := make(map[string]bool)
+	for _, ip := range desired {
+		desiredIPs[ip] = true
+	}
+	for ip := range owned {
+		if desiredIPs[ip] {
+			continue
+		}
+		tag, _ := addressPairTag(ip)
+		err = pm.ports.DeleteTag(pm.client, portID, tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (pm *OpenStackL3PortManager) updateAgentAddressPairs(port *portsv2.Port, toAdd, toRemove []portsv2.AddressPair) error {
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		return nil
+	}
+
+	if pm.atomicAddressPairs {
+		if len(toRemove) > 0 {
+			err := pm.ports.RemoveAllowedAddressPairs(pm.client, port.ID, toRemove)
+			if err != nil {
+				return err
+			}
+		}
+		if len(toAdd) > 0 {
+			err := pm.ports.AddAllowedAddressPairs(pm.client, port.ID, toAdd)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Without the extension, the whole list has to be replaced. Neutron
+	// rejects the update if the port was changed since it was read, so that
+	// changes by others are not lost.
+	addressPairs := applyAddressPairsDiff(port.AllowedAddressPairs, toAdd, toRemove)
+	opts := portsv2.UpdateOpts{
+		AllowedAddressPairs: &addressPairs,
+	}
+	if port.RevisionNumber > 0 {
+		// only set if Neutron supports revision numbers
+		opts.RevisionNumber = &port.RevisionNumber
+	}
+	_, err := pm.ports.Update(pm.client, port.ID, opts)
+	return err
+}
+
 func (pm *OpenStackL3PortManager) GetExternalAddress(portID string) (string, string, error) {
 	port, fip, err := pm.ports.GetPortByID(portID)
 	if err != nil {
@@ -370,19 +1007,27 @@ func (pm *OpenStackL3PortManager) GetExternalAddress(portID string) (string, str
 		return "", "", ErrPortIsNil
 	}
 
-	if pm.cfg.UseFloatingIPs {
+	if pm.cfg.UseFloatingIPs && !slices.Contains(port.Tags, TagLBNoFloatingIP) {
 		if fip == nil {
 			return "", "", ErrFloatingIPMissing
 		}
 
-		return fip.FloatingIP, "", nil
+		hostname, err := pm.getHostname(portID)
+		if err != nil {
+			return "", "", err
+		}
+		return fip.FloatingIP, hostname, nil
 	}
 
 	if len(port.FixedIPs) == 0 {
 		return "", "", ErrFixedIPMissing
 	}
 
-	return port.FixedIPs[0].IPAddress, "", nil
+	hostname, err := pm.getHostname(portID)
+	if err != nil {
+		return "", "", err
+	}
+	return port.FixedIPs[0].IPAddress, hostname, nil
 }
 
 func (pm *OpenStackL3PortManager) GetInternalAddress(portID string) (string, error) {
@@ -405,9 +1050,12 @@ func (pm *OpenStackL3PortManager) GetInternalAddress(portID string) (string, err
 func (pm *OpenStackL3PortManager) deletePort(portID string) error {
 	klog.Infof("Trying to delete port %q", portID)
 
+	pm.releaseQoSPolicy(portID)
+
 	err := pm.ports.Delete(pm.client, portID).ExtractErr()
 
 	if err == nil {
+		pm.rememberHostname(portID, "")
 		pm.EnsureAgentsState()
 	}
 
@@ -3,13 +3,22 @@ package openstack
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/gophercloud/gophercloud"
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	th "github.com/gophercloud/gophercloud/testhelper"
+	thclient "github.com/gophercloud/gophercloud/testhelper/client"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	corev1 "k8s.io/api/core/v1"
 
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
 )
 
@@ -93,10 +102,33 @@ func getMatchIpFn(expectedAddressPairs []portsv2.AddressPair) func(opts portsv2.
 	return matchIpsFn
 }
 
+// Return the tags with which the agent ports record that the controller owns
+// the addresses.
+func ownedTags(pairs ...portsv2.AddressPair) []string {
+	result := []string{}
+	for _, pair := range pairs {
+		result = append(result, TagLBAddressPairPrefix+pair.IPAddress)
+	}
+	return result
+}
+
+// Mock the agent ports with the address pairs. The controller owns the
+// expected addresses already.
+func (f *fixture) expectAgentPorts(pairs ...portsv2.AddressPair) {
+	for _, agent := range f.agents {
+		f.client.On("GetPortByID", agent.PortId).Return(
+			&portsv2.Port{ID: agent.PortId, AllowedAddressPairs: pairs, Tags: ownedTags(f.expectedAddressPairs...)},
+			(*floatingipsv2.FloatingIP)(nil),
+			nil,
+		).Times(1)
+	}
+}
+
 func TestEnsureAgentsStateUpdateAddressPairsCorrectly(t *testing.T) {
 	f := newFixture(t)
 
 	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	f.expectAgentPorts()
 
 	for _, agent := range f.agents {
 		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn(f.expectedAddressPairs))).Return(&portsv2.Port{}, nil).Times(1)
@@ -121,6 +153,7 @@ func TestEnsureAgentsStateReturnsErrorIfUpdateFails(t *testing.T) {
 	f := newFixture(t)
 
 	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	f.expectAgentPorts()
 
 	for i, agent := range f.agents {
 		var returnErr error = nil
@@ -135,3 +168,579 @@ func TestEnsureAgentsStateReturnsErrorIfUpdateFails(t *testing.T) {
 	assert.NotNil(t, err)
 	f.client.AssertExpectations(t)
 }
+
+func TestEnsureAgentsStateKeepsForeignAddressPairs(t *testing.T) {
+	f := newFixture(t)
+
+	foreign := portsv2.AddressPair{IPAddress: "192.168.0.1", MACAddress: "fa:16:3e:00:00:01"}
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	f.expectAgentPorts(foreign)
+
+	expected := append([]portsv2.AddressPair{foreign}, f.expectedAddressPairs...)
+	for _, agent := range f.agents {
+		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn(expected))).Return(&portsv2.Port{}, nil).Times(1)
+	}
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestEnsureAgentsStateSkipsUpToDateAgents(t *testing.T) {
+	f := newFixture(t)
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	f.expectAgentPorts(f.expectedAddressPairs...)
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestEnsureAgentsStateRetriesOnRevisionConflict(t *testing.T) {
+	f := newFixture(t)
+	f.agents = f.agents[:1]
+	f.pm.agents = f.agents
+	portID := f.agents[0].PortId
+
+	foreign := portsv2.AddressPair{IPAddress: "192.168.0.1"}
+	matchRevision := func(revision int, expected []portsv2.AddressPair) func(opts portsv2.UpdateOpts) bool {
+		return func(opts portsv2.UpdateOpts) bool {
+			return opts.RevisionNumber != nil && *opts.RevisionNumber == revision && getMatchIpFn(expected)(opts)
+		}
+	}
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	f.client.On("GetPortByID", portID).Return(
+		&portsv2.Port{ID: portID, RevisionNumber: 3, Tags: ownedTags(f.expectedAddressPairs...)},
+		(*floatingipsv2.FloatingIP)(nil),
+		nil,
+	).Once()
+	f.client.On("Update", mock.Anything, portID, mock.MatchedBy(matchRevision(3, f.expectedAddressPairs))).Return(
+		(*portsv2.Port)(nil),
+		gophercloud.ErrUnexpectedResponseCode{Actual: http.StatusPreconditionFailed},
+	).Once()
+	// somebody else added an address pair in the meantime
+	f.client.On("GetPortByID", portID).Return(
+		&portsv2.Port{ID: portID, RevisionNumber: 4, AllowedAddressPairs: []portsv2.AddressPair{foreign}, Tags: ownedTags(f.expectedAddressPairs...)},
+		(*floatingipsv2.FloatingIP)(nil),
+		nil,
+	).Once()
+	expected := append([]portsv2.AddressPair{foreign}, f.expectedAddressPairs...)
+	f.client.On("Update", mock.Anything, portID, mock.MatchedBy(matchRevision(4, expected))).Return(&portsv2.Port{}, nil).Once()
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestEnsureAgentsStateTagsAddedAddresses(t *testing.T) {
+	f := newFixture(t)
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	for _, agent := range f.agents {
+		f.client.On("GetPortByID", agent.PortId).Return(
+			&portsv2.Port{ID: agent.PortId},
+			(*floatingipsv2.FloatingIP)(nil),
+			nil,
+		).Times(1)
+		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn(f.expectedAddressPairs))).Return(&portsv2.Port{}, nil).Times(1)
+		for _, tag := range ownedTags(f.expectedAddressPairs...) {
+			f.client.On("AddTag", mock.Anything, agent.PortId, tag).Return(nil).Times(1)
+		}
+	}
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestEnsureAgentsStateDoesNotOwnExistingForeignAddresses(t *testing.T) {
+	f := newFixture(t)
+
+	// the first desired address has been added to the agent ports by someone
+	// else before
+	foreign := f.expectedAddressPairs[0]
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	for _, agent := range f.agents {
+		f.client.On("GetPortByID", agent.PortId).Return(
+			&portsv2.Port{ID: agent.PortId, AllowedAddressPairs: []portsv2.AddressPair{foreign}},
+			(*floatingipsv2.FloatingIP)(nil),
+			nil,
+		).Times(1)
+		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn(f.expectedAddressPairs))).Return(&portsv2.Port{}, nil).Times(1)
+		for _, tag := range ownedTags(f.expectedAddressPairs[1:]...) {
+			f.client.On("AddTag", mock.Anything, agent.PortId, tag).Return(nil).Times(1)
+		}
+	}
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+	f.client.AssertNotCalled(t, "AddTag", mock.Anything, mock.Anything, ownedTags(foreign)[0])
+
+	// once the address is not desired anymore, the foreign pair is kept
+	f = newFixture(t)
+	f.l3Ports = nil
+	f.pm.additionalAddressPairs = nil
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	for _, agent := range f.agents {
+		f.client.On("GetPortByID", agent.PortId).Return(
+			&portsv2.Port{
+				ID:                  agent.PortId,
+				AllowedAddressPairs: f.expectedAddressPairs,
+				Tags:                ownedTags(f.expectedAddressPairs[1:]...),
+			},
+			(*floatingipsv2.FloatingIP)(nil),
+			nil,
+		).Times(1)
+		f.client.On("Update", mock.Anything, agent.PortId, mock.MatchedBy(getMatchIpFn([]portsv2.AddressPair{foreign}))).Return(&portsv2.Port{}, nil).Times(1)
+		for _, tag := range ownedTags(f.expectedAddressPairs[1:]...) {
+			f.client.On("DeleteTag", mock.Anything, agent.PortId, tag).Return(nil).Times(1)
+		}
+	}
+
+	err = f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestEnsureAgentsStateRemovesOwnedAddressesAtomically(t *testing.T) {
+	f := newFixture(t)
+	f.pm.atomicAddressPairs = true
+
+	// e.g. the address of a port deleted while the controller was not running
+	stale := portsv2.AddressPair{IPAddress: "10.0.0.9"}
+	foreign := portsv2.AddressPair{IPAddress: "192.168.0.1"}
+	current := append([]portsv2.AddressPair{stale, foreign}, f.expectedAddressPairs[1:]...)
+
+	f.client.On("GetPorts").Return(f.l3Ports, nil).Times(1)
+	for _, agent := range f.agents {
+		f.client.On("GetPortByID", agent.PortId).Return(
+			&portsv2.Port{ID: agent.PortId, AllowedAddressPairs: current, Tags: ownedTags(append([]portsv2.AddressPair{stale}, f.expectedAddressPairs[1:]...)...)},
+			(*floatingipsv2.FloatingIP)(nil),
+			nil,
+		).Times(1)
+		f.client.On("RemoveAllowedAddressPairs", mock.Anything, agent.PortId, []portsv2.AddressPair{stale}).Return(nil).Times(1)
+		f.client.On("AddAllowedAddressPairs", mock.Anything, agent.PortId, []portsv2.AddressPair{f.expectedAddressPairs[0]}).Return(nil).Times(1)
+		f.client.On("AddTag", mock.Anything, agent.PortId, ownedTags(f.expectedAddressPairs[0])[0]).Return(nil).Times(1)
+		f.client.On("DeleteTag", mock.Anything, agent.PortId, ownedTags(stale)[0]).Return(nil).Times(1)
+	}
+
+	err := f.pm.EnsureAgentsState()
+	assert.Nil(t, err)
+	f.client.AssertExpectations(t)
+}
+
+func TestDiffAddressPairs(t *testing.T) {
+	current := []portsv2.AddressPair{
+		{IPAddress: "10.0.0.1"},
+		{IPAddress: "10.0.0.2"},
+		{IPAddress: "192.168.0.1"},
+	}
+
+	toAdd, toRemove := diffAddressPairs(current, []string{"10.0.0.1", "10.0.0.3", "10.0.0.3"}, map[string]bool{"10.0.0.2": true, "10.0.0.3": true})
+	assert.Equal(t, []portsv2.AddressPair{{IPAddress: "10.0.0.3"}}, toAdd)
+	assert.Equal(t, []portsv2.AddressPair{{IPAddress: "10.0.0.2"}}, toRemove)
+
+	assert.Equal(t, []portsv2.AddressPair{
+		{IPAddress: "10.0.0.1"},
+		{IPAddress: "192.168.0.1"},
+		{IPAddress: "10.0.0.3"},
+	}, applyAddressPairsDiff(current, toAdd, toRemove))
+}
+
+func TestAddressPairTags(t *testing.T) {
+	tag, ok := addressPairTag("10.0.0.0/24")
+	assert.True(t, ok)
+	assert.Equal(t, TagLBAddressPairPrefix+"10.0.0.0_24", tag)
+
+	tag2, ok := addressPairTag("2001:db8::1")
+	assert.True(t, ok)
+
+	_, ok = addressPairTag("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff/128")
+	assert.False(t, ok)
+
+	assert.Equal(t, map[string]bool{"10.0.0.0/24": true, "2001:db8::1": true}, ownedAddressPairs([]string{tag, TagLBManagedPort, tag2}))
+}
+
+func newPortNetworkConfig() *config.NetworkingOpts {
+	return &config.NetworkingOpts{
+		UseFloatingIPs:              true,
+		SubnetID:                    "default-subnet",
+		FloatingIPNetworkID:         "public",
+		AllowedSubnetIDs:            []string{"internal-subnet"},
+		AllowedFloatingIPNetworkIDs: []string{"transit", model.NoFloatingIP},
+	}
+}
+
+func TestValidatePortNetwork(t *testing.T) {
+	pm := &OpenStackL3PortManager{cfg: newPortNetworkConfig()}
+
+	network, err := pm.validatePortNetwork(model.PortNetwork{SubnetID: "default-subnet", FloatingIPNetworkID: "public"})
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{}, network)
+
+	network, err = pm.validatePortNetwork(model.PortNetwork{SubnetID: "internal-subnet", FloatingIPNetworkID: model.NoFloatingIP})
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{SubnetID: "internal-subnet", FloatingIPNetworkID: model.NoFloatingIP}, network)
+
+	_, err = pm.validatePortNetwork(model.PortNetwork{SubnetID: "other-subnet"})
+	assert.Equal(t, ErrSubnetNotAllowed, err)
+
+	_, err = pm.validatePortNetwork(model.PortNetwork{FloatingIPNetworkID: "other"})
+	assert.Equal(t, ErrNetworkNotAllowed, err)
+}
+
+func TestGetPortNetwork(t *testing.T) {
+	f := newFixture(t)
+	f.pm.cfg = newPortNetworkConfig()
+
+	f.client.On("GetPortByID", "default-port").Return(
+		&portsv2.Port{FixedIPs: []portsv2.IP{{SubnetID: "default-subnet", IPAddress: "10.0.0.1"}}},
+		&floatingipsv2.FloatingIP{FloatingNetworkID: "public"},
+		nil,
+	)
+	f.client.On("GetPortByID", "transit-port").Return(
+		&portsv2.Port{FixedIPs: []portsv2.IP{{SubnetID: "default-subnet", IPAddress: "10.0.0.2"}}},
+		&floatingipsv2.FloatingIP{FloatingNetworkID: "transit"},
+		nil,
+	)
+	f.client.On("GetPortByID", "internal-port").Return(
+		&portsv2.Port{
+			FixedIPs: []portsv2.IP{{SubnetID: "internal-subnet", IPAddress: "10.1.0.1"}},
+			Tags:     []string{TagLBManagedPort, TagLBNoFloatingIP},
+		},
+		(*floatingipsv2.FloatingIP)(nil),
+		nil,
+	)
+
+	f.client.On("GetPortByID", "reserved-port").Return(
+		&portsv2.Port{FixedIPs: []portsv2.IP{{SubnetID: "default-subnet", IPAddress: "10.0.0.3"}}},
+		&floatingipsv2.FloatingIP{
+			FloatingNetworkID: "public",
+			Description:       DescriptionLBReservedFloatingIPPrefix + "default/web",
+			Tags:              []string{TagLBManagedPort, TagLBReservedFloatingIP},
+		},
+		nil,
+	)
+
+	network, err := f.pm.GetPortNetwork("default-port")
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{}, network)
+
+	network, err = f.pm.GetPortNetwork("transit-port")
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{FloatingIPNetworkID: "transit"}, network)
+
+	network, err = f.pm.GetPortNetwork("internal-port")
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{SubnetID: "internal-subnet", FloatingIPNetworkID: model.NoFloatingIP}, network)
+
+	network, err = f.pm.GetPortNetwork("reserved-port")
+	assert.Nil(t, err)
+	assert.Equal(t, model.PortNetwork{FloatingIPReservation: "default/web"}, network)
+
+	// ports without floating IP return their fixed IP as external address
+	address, _, err := f.pm.GetExternalAddress("internal-port")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.1.0.1", address)
+}
+
+func TestProvisionPortInNetworkRejectsFamilyOfOtherSubnet(t *testing.T) {
+	f := newFixture(t)
+	f.pm.cfg = newPortNetworkConfig()
+	f.pm.subnets = map[string]subnetInfo{
+		"default-subnet":  {networkID: "default-network", ipFamily: corev1.IPv6Protocol},
+		"internal-subnet": {networkID: "internal-network", ipFamily: corev1.IPv4Protocol},
+	}
+
+	_, err := f.pm.ProvisionPortInNetwork(corev1.IPv6Protocol, model.PortNetwork{SubnetID: "internal-subnet"})
+	assert.Equal(t, ErrIPFamilyMismatch, err)
+
+	_, err = f.pm.ProvisionPortInNetwork("", model.PortNetwork{SubnetID: "other-subnet"})
+	assert.Equal(t, ErrSubnetNotAllowed, err)
+
+	f.client.AssertNotCalled(t, "Create", mock.Anything, mock.Anything)
+}
+
+func newTestHelperPortManager() *OpenStackL3PortManager {
+	client := thclient.ServiceClient()
+	client.ResourceBase = th.Endpoint() + "v2.0/"
+
+	return &OpenStackL3PortManager{
+		client:    client,
+		projectID: "project",
+		cfg:       &config.NetworkingOpts{UseFloatingIPs: true, FloatingIPNetworkID: "public"},
+		tags:      managedTags(""),
+	}
+}
+
+func TestProvisionFloatingIPReattachesReservedFloatingIP(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		th.TestFormValues(t, r, map[string]string{
+			"tags":        TagLBManagedPort + "," + TagLBReservedFloatingIP,
+			"description": DescriptionLBReservedFloatingIPPrefix + "default/web",
+			"project_id":  "project",
+		})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "reserved-fip", "floating_network_id": "public", "port_id": null}
+		]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/reserved-fip", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		th.TestJSONRequest(t, r, `{"floatingip": {"port_id": "new-port"}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "reserved-fip", "port_id": "new-port"}}`)
+	})
+
+	pm := newTestHelperPortManager()
+
+	err := pm.provisionFloatingIP("new-port", "public", "default/web", dnsAssignment{})
+	assert.Nil(t, err)
+}
+
+func TestProvisionFloatingIPInvalidatesCachedPort(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "POST")
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"floatingip": {"id": "new-fip", "port_id": "port-id"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/new-fip/tags", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tags": ["`+TagLBManagedPort+`"]}`)
+	})
+
+	backend := &ostesting.MockPortClient{}
+	backend.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, (*floatingipsv2.FloatingIP)(nil), nil).Once()
+	backend.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "new-fip"}, nil).Once()
+
+	pm := newTestHelperPortManager()
+	pm.portCache = NewCachedPortClient(backend, time.Hour)
+	pm.ports = pm.portCache
+
+	_, fip, err := pm.ports.GetPortByID("port-id")
+	assert.Nil(t, err)
+	assert.Nil(t, fip)
+
+	err = pm.provisionFloatingIP("port-id", "public", "", dnsAssignment{})
+	assert.Nil(t, err)
+
+	_, fip, err = pm.ports.GetPortByID("port-id")
+	assert.Nil(t, err)
+	assert.Equal(t, "new-fip", fip.ID)
+
+	backend.AssertExpectations(t)
+}
+
+func TestProvisionFloatingIPRefusesReservationInUse(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "reserved-fip", "floating_network_id": "public", "port_id": "other-port"}
+		]}`)
+	})
+
+	pm := newTestHelperPortManager()
+
+	err := pm.provisionFloatingIP("new-port", "public", "default/web", dnsAssignment{})
+	assert.Equal(t, ErrReservationInUse, err)
+}
+
+func TestSetPortFloatingIPReservationReservesFloatingIPInPlace(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		th.TestFormValues(t, r, map[string]string{
+			"tags":        TagLBManagedPort + "," + TagLBReservedFloatingIP,
+			"description": DescriptionLBReservedFloatingIPPrefix + "default/web",
+			"project_id":  "project",
+		})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": []}`)
+	})
+	// the floating IP is kept and only updated
+	th.Mux.HandleFunc("/v2.0/floatingips/current-fip", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		th.TestJSONRequest(t, r, `{"floatingip": {"description": "`+DescriptionLBReservedFloatingIPPrefix+`default/web"}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "current-fip", "floating_ip_address": "203.0.113.1", "port_id": "port-id"}}`)
+	})
+	tagged := false
+	th.Mux.HandleFunc("/v2.0/floatingips/current-fip/tags/"+TagLBReservedFloatingIP, func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		tagged = true
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	backend := &ostesting.MockPortClient{}
+	backend.On("GetPortByID", "port-id").Return(
+		&portsv2.Port{ID: "port-id"},
+		&floatingipsv2.FloatingIP{ID: "current-fip", FloatingIP: "203.0.113.1", Description: DescriptionLBManagedPort, Tags: []string{TagLBManagedPort}},
+		nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = backend
+
+	err := pm.SetPortFloatingIPReservation("port-id", "default/web")
+	assert.Nil(t, err)
+	assert.True(t, tagged)
+}
+
+func TestSetPortFloatingIPReservationRefusesExistingReservation(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "reserved-fip", "floating_network_id": "public", "port_id": null}
+		]}`)
+	})
+
+	backend := &ostesting.MockPortClient{}
+	backend.On("GetPortByID", "port-id").Return(
+		&portsv2.Port{ID: "port-id"},
+		&floatingipsv2.FloatingIP{ID: "current-fip", Tags: []string{TagLBManagedPort}},
+		nil)
+	backend.On("GetPortByID", "reserved-port").Return(
+		&portsv2.Port{ID: "reserved-port"},
+		&floatingipsv2.FloatingIP{
+			ID:          "other-fip",
+			Description: DescriptionLBReservedFloatingIPPrefix + "default/api",
+			Tags:        []string{TagLBManagedPort, TagLBReservedFloatingIP},
+		},
+		nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = backend
+
+	err := pm.SetPortFloatingIPReservation("port-id", "default/web")
+	assert.Equal(t, ErrReservationExists, err)
+
+	err = pm.SetPortFloatingIPReservation("reserved-port", "default/web")
+	assert.Equal(t, ErrFloatingIPReserved, err)
+}
+
+func TestDeleteUnusedFloatingIPsKeepsReservedFloatingIPs(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "unused-fip", "tags": ["`+TagLBManagedPort+`"]},
+			{"id": "reserved-fip", "tags": ["`+TagLBManagedPort+`", "`+TagLBReservedFloatingIP+`"]}
+		]}`)
+	})
+
+	deleted := []string{}
+	th.Mux.HandleFunc("/v2.0/floatingips/unused-fip", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "DELETE")
+		deleted = append(deleted, "unused-fip")
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	pm := newTestHelperPortManager()
+
+	err := pm.deleteUnusedFloatingIPs()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"unused-fip"}, deleted)
+}
+
+func TestValidatePortNetworkRejectsReservationWithoutFloatingIP(t *testing.T) {
+	pm := &OpenStackL3PortManager{cfg: newPortNetworkConfig()}
+
+	network := model.PortNetwork{FloatingIPReservation: "default/web"}
+	result, err := pm.validatePortNetwork(network)
+	assert.Nil(t, err)
+	assert.Equal(t, network, result)
+
+	_, err = pm.validatePortNetwork(model.PortNetwork{FloatingIPNetworkID: model.NoFloatingIP, FloatingIPReservation: "default/web"})
+	assert.Equal(t, ErrReservationWithoutFloatingIP, err)
+
+	_, err = pm.validatePortNetwork(model.PortNetwork{FloatingIPReservation: "default/" + strings.Repeat("x", 250)})
+	assert.Equal(t, ErrReservationTooLong, err)
+}
+
+func TestManagedTags(t *testing.T) {
+	assert.Equal(t, []string{TagLBManagedPort}, managedTags(""))
+	assert.Equal(t, []string{TagLBManagedPort, "cah-loadbalancer-cluster=prod"}, managedTags("prod"))
+}
+
+func TestValidateClusterID(t *testing.T) {
+	assert.Nil(t, ValidateClusterID("prod-eu-1"))
+	assert.NotNil(t, ValidateClusterID("a,b"))
+	assert.NotNil(t, ValidateClusterID("a/b"))
+	assert.NotNil(t, ValidateClusterID(strings.Repeat("x", 36)))
+	assert.Nil(t, ValidateClusterID(strings.Repeat("x", 35)))
+}
+
+func TestAdoptLegacyResourcesTagsOnlyUnassignedResources(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	th.Mux.HandleFunc("/v2.0/ports", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		th.TestFormValues(t, r, map[string]string{"tags": TagLBManagedPort, "project_id": "project"})
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ports": [
+			{"id": "legacy-port", "tags": ["`+TagLBManagedPort+`"]},
+			{"id": "other-port", "tags": ["`+TagLBManagedPort+`", "cah-loadbalancer-cluster=other"]}
+		]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingips": [
+			{"id": "legacy-fip", "tags": ["`+TagLBManagedPort+`"]},
+			{"id": "own-fip", "tags": ["`+TagLBManagedPort+`", "cah-loadbalancer-cluster=prod"]}
+		]}`)
+	})
+
+	adopted := []string{}
+	handleTag := func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "PUT")
+		adopted = append(adopted, r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+	}
+	th.Mux.HandleFunc("/v2.0/ports/legacy-port/tags/cah-loadbalancer-cluster=prod", handleTag)
+	th.Mux.HandleFunc("/v2.0/floatingips/legacy-fip/tags/cah-loadbalancer-cluster=prod", handleTag)
+
+	client := thclient.ServiceClient()
+	client.ResourceBase = th.Endpoint() + "v2.0/"
+
+	pm := &OpenStackL3PortManager{
+		client:    client,
+		projectID: "project",
+		cfg:       &config.NetworkingOpts{ClusterID: "prod", AdoptLegacyResources: true},
+	}
+
+	err := pm.adoptLegacyResources()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"/v2.0/ports/legacy-port/tags/cah-loadbalancer-cluster=prod",
+		"/v2.0/floatingips/legacy-fip/tags/cah-loadbalancer-cluster=prod",
+	}, adopted)
+}
@@ -15,10 +15,15 @@
 package openstack
 
 import (
+	"sync"
+	"time"
+
 	"github.com/gophercloud/gophercloud"
+	tags "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
 	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
 	"github.com/gophercloud/gophercloud/pagination"
+	"golang.org/x/exp/slices"
 
 	"k8s.io/klog"
 )
@@ -26,6 +31,7 @@ import (
 type CachedPort struct {
 	Port       portsv2.Port
 	FloatingIP *floatingipsv2.FloatingIP
+	FetchedAt  time.Time
 }
 
 type UncachedClient struct {
@@ -41,8 +47,16 @@ type PortClient interface {
 	GetPortByID(ID string) (*portsv2.Port, *floatingipsv2.FloatingIP, error)
 	Update(c *gophercloud.ServiceClient, id string, opts portsv2.UpdateOptsBuilder) (*portsv2.Port, error)
 	Delete(c *gophercloud.ServiceClient, id string) portsv2.DeleteResult
+	// AddAllowedAddressPairs and RemoveAllowedAddressPairs require the
+	// allowed-address-pairs-atomic extension
+	AddAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error
+	RemoveAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error
+	AddTag(c *gophercloud.ServiceClient, id string, tag string) error
+	DeleteTag(c *gophercloud.ServiceClient, id string, tag string) error
 }
 
+// NewPortClient creates a client which only sees ports (and floating IPs)
+// carrying all of the given comma-separated tags.
 func NewPortClient(networkingclient *gophercloud.ServiceClient, tag string, useFloatingIPs bool, projectID string) *UncachedClient {
 	return &UncachedClient{
 		client:         networkingclient,
@@ -117,3 +131,242 @@ func (pc *UncachedClient) Update(c *gophercloud.ServiceClient, id string, opts p
 func (pc *UncachedClient) Delete(c *gophercloud.ServiceClient, id string) (r portsv2.DeleteResult) {
 	return portsv2.Delete(c, id)
 }
+
+func (pc *UncachedClient) AddAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	return updateAddressPairs(c, id, "add_allowed_address_pairs", pairs)
+}
+
+func (pc *UncachedClient) RemoveAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	return updateAddressPairs(c, id, "remove_allowed_address_pairs", pairs)
+}
+
+func (pc *UncachedClient) AddTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	return tags.Add(c, "ports", id, tag).ExtractErr()
+}
+
+func (pc *UncachedClient) DeleteTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	return tags.Delete(c, "ports", id, tag).ExtractErr()
+}
+
+// CachedClient wraps another PortClient and caches the results of GetPorts
+// and GetPortByID for a limited time.
+//
+// Writes through the client invalidate the affected entries. As changes made
+// outside of this client are not seen until the entries expire, Refresh should
+// be called periodically.
+type CachedClient struct {
+	backend PortClient
+	ttl     time.Duration
+	now     func() time.Time
+
+	lock          sync.Mutex
+	ports         map[string]CachedPort
+	list          []portsv2.Port
+	listFetchedAt time.Time
+	listValid     bool
+	// incremented by every invalidation, so that the results of fetches
+	// which ran concurrently to an invalidation are not cached
+	epoch uint64
+}
+
+func NewCachedPortClient(backend PortClient, ttl time.Duration) *CachedClient {
+	return &CachedClient{
+		backend: backend,
+		ttl:     ttl,
+		now:     time.Now,
+		ports:   make(map[string]CachedPort),
+	}
+}
+
+func (pc *CachedClient) isFresh(fetchedAt time.Time) bool {
+	return pc.now().Sub(fetchedAt) < pc.ttl
+}
+
+// Remove the port with the given ID from the cache. The port list is only
+// dropped if it contains the port, so that updates of unrelated ports (e.g.
+// of the agents) keep it intact.
+func (pc *CachedClient) invalidate(ID string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.epoch++
+	delete(pc.ports, ID)
+	for _, port := range pc.list {
+		if port.ID == ID {
+			pc.listValid = false
+			break
+		}
+	}
+}
+
+// InvalidatePort drops the cached entry of the port and the port list. It must
+// be called after changes which are not made through this client, e.g. of the
+// floating IP or the tags of the port.
+func (pc *CachedClient) InvalidatePort(ID string) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.epoch++
+	delete(pc.ports, ID)
+	pc.listValid = false
+}
+
+// Invalidate drops all cached entries.
+func (pc *CachedClient) Invalidate() {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	pc.epoch++
+	pc.ports = make(map[string]CachedPort)
+	pc.list = nil
+	pc.listValid = false
+}
+
+// Refresh drops all cached entries and fetches the port list anew.
+func (pc *CachedClient) Refresh() error {
+	pc.Invalidate()
+	_, err := pc.GetPorts()
+	return err
+}
+
+func (pc *CachedClient) Create(c *gophercloud.ServiceClient, opts portsv2.CreateOptsBuilder) (*portsv2.Port, error) {
+	port, err := pc.backend.Create(c, opts)
+
+	pc.lock.Lock()
+	pc.epoch++
+	pc.listValid = false
+	pc.lock.Unlock()
+
+	return port, err
+}
+
+func (pc *CachedClient) GetPorts() ([]portsv2.Port, error) {
+	pc.lock.Lock()
+	if pc.listValid && pc.isFresh(pc.listFetchedAt) {
+		result := copyPorts(pc.list)
+		pc.lock.Unlock()
+		return result, nil
+	}
+	epoch := pc.epoch
+	pc.lock.Unlock()
+
+	fetchedAt := pc.now()
+	ports, err := pc.backend.GetPorts()
+	if err != nil {
+		return nil, err
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	if pc.epoch != epoch {
+		// the list may lack changes which have been made during the fetch
+		return ports, nil
+	}
+	pc.list = copyPorts(ports)
+	pc.listFetchedAt = fetchedAt
+	pc.listValid = true
+
+	return ports, nil
+}
+
+func (pc *CachedClient) GetPortByID(ID string) (*portsv2.Port, *floatingipsv2.FloatingIP, error) {
+	pc.lock.Lock()
+	cached, ok := pc.ports[ID]
+	epoch := pc.epoch
+	pc.lock.Unlock()
+	if ok && pc.isFresh(cached.FetchedAt) {
+		return copyPort(&cached.Port), copyFloatingIP(cached.FloatingIP), nil
+	}
+
+	fetchedAt := pc.now()
+	port, fip, err := pc.backend.GetPortByID(ID)
+	if err != nil {
+		// errors (in particular 404s) are not cached
+		return nil, nil, err
+	}
+
+	pc.lock.Lock()
+	if port != nil && pc.epoch == epoch {
+		pc.ports[ID] = CachedPort{
+			Port:       *copyPort(port),
+			FloatingIP: copyFloatingIP(fip),
+			FetchedAt:  fetchedAt,
+		}
+	}
+	pc.lock.Unlock()
+
+	return port, fip, nil
+}
+
+func (pc *CachedClient) Update(c *gophercloud.ServiceClient, id string, opts portsv2.UpdateOptsBuilder) (*portsv2.Port, error) {
+	port, err := pc.backend.Update(c, id, opts)
+	pc.invalidate(id)
+	return port, err
+}
+
+func (pc *CachedClient) Delete(c *gophercloud.ServiceClient, id string) portsv2.DeleteResult {
+	result := pc.backend.Delete(c, id)
+	pc.invalidate(id)
+
+	pc.lock.Lock()
+	pc.epoch++
+	pc.listValid = false
+	pc.lock.Unlock()
+
+	return result
+}
+
+func (pc *CachedClient) AddAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	err := pc.backend.AddAllowedAddressPairs(c, id, pairs)
+	pc.invalidate(id)
+	return err
+}
+
+func (pc *CachedClient) RemoveAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	err := pc.backend.RemoveAllowedAddressPairs(c, id, pairs)
+	pc.invalidate(id)
+	return err
+}
+
+func (pc *CachedClient) AddTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	err := pc.backend.AddTag(c, id, tag)
+	pc.invalidate(id)
+	return err
+}
+
+func (pc *CachedClient) DeleteTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	err := pc.backend.DeleteTag(c, id, tag)
+	pc.invalidate(id)
+	return err
+}
+
+// Return a deep copy of the port, so that callers cannot modify the slices of
+// cached ports.
+func copyPort(port *portsv2.Port) *portsv2.Port {
+	if port == nil {
+		return nil
+	}
+	result := *port
+	result.FixedIPs = slices.Clone(port.FixedIPs)
+	result.AllowedAddressPairs = slices.Clone(port.AllowedAddressPairs)
+	result.SecurityGroups = slices.Clone(port.SecurityGroups)
+	result.Tags = slices.Clone(port.Tags)
+	return &result
+}
+
+func copyPorts(ports []portsv2.Port) []portsv2.Port {
+	result := make([]portsv2.Port, len(ports))
+	for i := range ports {
+		result[i] = *copyPort(&ports[i])
+	}
+	return result
+}
+
+func copyFloatingIP(fip *floatingipsv2.FloatingIP) *floatingipsv2.FloatingIP {
+	if fip == nil {
+		return nil
+	}
+	result := *fip
+	result.Tags = slices.Clone(fip.Tags)
+	return &result
+}
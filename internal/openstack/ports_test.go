@@ -0,0 +1,285 @@
+package openstack
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+type cacheFixture struct {
+	backend *ostesting.MockPortClient
+	cache   *CachedClient
+	now     time.Time
+}
+
+func newCacheFixture() *cacheFixture {
+	f := &cacheFixture{
+		backend: &ostesting.MockPortClient{},
+		now:     time.Unix(1000, 0),
+	}
+	f.cache = NewCachedPortClient(f.backend, 30*time.Second)
+	f.cache.now = func() time.Time { return f.now }
+	return f
+}
+
+func TestCachedClientCachesPortByID(t *testing.T) {
+	f := newCacheFixture()
+
+	port := &portsv2.Port{ID: "port-1"}
+	fip := &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.1"}
+	f.backend.On("GetPortByID", "port-1").Return(port, fip, nil).Times(1)
+
+	for i := 0; i < 3; i++ {
+		cachedPort, cachedFip, err := f.cache.GetPortByID("port-1")
+		assert.Nil(t, err)
+		assert.Equal(t, "port-1", cachedPort.ID)
+		assert.Equal(t, "203.0.113.1", cachedFip.FloatingIP)
+	}
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientRefetchesExpiredPort(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, (*floatingipsv2.FloatingIP)(nil), nil).Times(2)
+
+	_, _, err := f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.now = f.now.Add(31 * time.Second)
+
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientDoesNotCacheErrors(t *testing.T) {
+	f := newCacheFixture()
+
+	someError := errors.New("not found")
+	f.backend.On("GetPortByID", "port-1").Return((*portsv2.Port)(nil), (*floatingipsv2.FloatingIP)(nil), someError).Times(2)
+
+	_, _, err := f.cache.GetPortByID("port-1")
+	assert.Equal(t, someError, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Equal(t, someError, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientCachesPortList(t *testing.T) {
+	f := newCacheFixture()
+
+	ports := []portsv2.Port{{ID: "port-1"}, {ID: "port-2"}}
+	f.backend.On("GetPorts").Return(ports, nil).Times(1)
+
+	for i := 0; i < 3; i++ {
+		result, err := f.cache.GetPorts()
+		assert.Nil(t, err)
+		assert.Equal(t, ports, result)
+	}
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientInvalidatesOnDelete(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{{ID: "port-1"}}, nil).Times(2)
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, (*floatingipsv2.FloatingIP)(nil), nil).Times(2)
+	f.backend.On("Delete", mock.Anything, "port-1").Return(portsv2.DeleteResult{}).Times(1)
+
+	_, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.cache.Delete(nil, "port-1")
+
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientInvalidatesListOnCreate(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{}, nil).Times(2)
+	f.backend.On("Create", mock.Anything, mock.Anything).Return(&portsv2.Port{ID: "port-1"}, nil).Times(1)
+
+	_, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+
+	_, err = f.cache.Create(nil, portsv2.CreateOpts{})
+	assert.Nil(t, err)
+
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientDoesNotCacheListFetchedDuringInvalidation(t *testing.T) {
+	f := newCacheFixture()
+
+	// the port is created while the list is fetched, so the fetched list
+	// lacks it
+	f.backend.On("Create", mock.Anything, mock.Anything).Return(&portsv2.Port{ID: "port-1"}, nil).Times(1)
+	f.backend.On("GetPorts").Return([]portsv2.Port{}, nil).Run(func(mock.Arguments) {
+		_, err := f.cache.Create(nil, portsv2.CreateOpts{})
+		assert.Nil(t, err)
+	}).Times(1)
+
+	ports, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+	assert.Empty(t, ports)
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{{ID: "port-1"}}, nil).Times(1)
+
+	ports, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []portsv2.Port{{ID: "port-1"}}, ports)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientDoesNotCachePortFetchedDuringInvalidation(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, (*floatingipsv2.FloatingIP)(nil), nil).Run(func(mock.Arguments) {
+		f.cache.InvalidatePort("port-1")
+	}).Times(1)
+
+	_, fip, err := f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+	assert.Nil(t, fip)
+
+	fip = &floatingipsv2.FloatingIP{FloatingIP: "203.0.113.1"}
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, fip, nil).Times(1)
+
+	_, cachedFip, err := f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.1", cachedFip.FloatingIP)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientKeepsListOnUpdateOfUnrelatedPort(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{{ID: "port-1"}}, nil).Times(2)
+	f.backend.On("Update", mock.Anything, mock.Anything, mock.Anything).Return(&portsv2.Port{}, nil).Times(2)
+
+	_, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+
+	// e.g. the port of an agent
+	_, err = f.cache.Update(nil, "agent-port", portsv2.UpdateOpts{})
+	assert.Nil(t, err)
+
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+
+	_, err = f.cache.Update(nil, "port-1", portsv2.UpdateOpts{})
+	assert.Nil(t, err)
+
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientRefreshRefetchesEverything(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{{ID: "port-1"}}, nil).Times(1)
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, (*floatingipsv2.FloatingIP)(nil), nil).Times(2)
+
+	_, _, err := f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	err = f.cache.Refresh()
+	assert.Nil(t, err)
+
+	// the list was fetched by the refresh, the port is fetched again
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientInvalidatePortDropsPortAndList(t *testing.T) {
+	f := newCacheFixture()
+
+	f.backend.On("GetPorts").Return([]portsv2.Port{}, nil).Times(2)
+	f.backend.On("GetPortByID", "port-1").Return(&portsv2.Port{ID: "port-1"}, (*floatingipsv2.FloatingIP)(nil), nil).Times(2)
+
+	_, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	// e.g. after tagging the port or attaching a floating IP
+	f.cache.InvalidatePort("port-1")
+
+	_, err = f.cache.GetPorts()
+	assert.Nil(t, err)
+	_, _, err = f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+
+	f.backend.AssertExpectations(t)
+}
+
+func TestCachedClientReturnsDeepCopies(t *testing.T) {
+	f := newCacheFixture()
+
+	newPort := func() portsv2.Port {
+		return portsv2.Port{
+			ID:                  "port-1",
+			FixedIPs:            []portsv2.IP{{IPAddress: "10.0.0.1"}},
+			AllowedAddressPairs: []portsv2.AddressPair{{IPAddress: "10.0.0.2"}},
+			Tags:                []string{TagLBManagedPort},
+		}
+	}
+	port := newPort()
+	f.backend.On("GetPortByID", "port-1").Return(&port, (*floatingipsv2.FloatingIP)(nil), nil).Times(1)
+	f.backend.On("GetPorts").Return([]portsv2.Port{newPort()}, nil).Times(1)
+
+	for i := 0; i < 2; i++ {
+		cachedPort, _, err := f.cache.GetPortByID("port-1")
+		assert.Nil(t, err)
+		cachedPort.FixedIPs[0].IPAddress = "changed"
+		cachedPort.AllowedAddressPairs[0].IPAddress = "changed"
+		cachedPort.Tags[0] = "changed"
+
+		ports, err := f.cache.GetPorts()
+		assert.Nil(t, err)
+		ports[0].Tags[0] = "changed"
+	}
+
+	cachedPort, _, err := f.cache.GetPortByID("port-1")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.1", cachedPort.FixedIPs[0].IPAddress)
+	assert.Equal(t, "10.0.0.2", cachedPort.AllowedAddressPairs[0].IPAddress)
+	assert.Equal(t, []string{TagLBManagedPort}, cachedPort.Tags)
+
+	ports, err := f.cache.GetPorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{TagLBManagedPort}, ports[0].Tags)
+
+	f.backend.AssertExpectations(t)
+}
@@ -0,0 +1,153 @@
+package openstack
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/quotas"
+	networksv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/networks"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	subnetsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/subnets"
+	"golang.org/x/exp/slices"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+// The properties of a network which are checked during the preflight
+type networkInfo struct {
+	ID       string `json:"id"`
+	External bool   `json:"router:external"`
+}
+
+// QuotaHeadroom describes how many resources of a kind the project may still
+// create.
+type QuotaHeadroom struct {
+	Resource string
+	// Limit of the project; -1 means unlimited
+	Limit int
+	Used  int
+}
+
+// Free returns the number of resources which can still be created or -1 if
+// the quota is unlimited.
+func (q QuotaHeadroom) Free() int {
+	if q.Limit < 0 {
+		return -1
+	}
+	if q.Used > q.Limit {
+		return 0
+	}
+	return q.Limit - q.Used
+}
+
+func (q QuotaHeadroom) String() string {
+	if q.Limit < 0 {
+		return fmt.Sprintf("%s: %d used, unlimited", q.Resource, q.Used)
+	}
+	return fmt.Sprintf("%s: %d of %d used, %d free", q.Resource, q.Used, q.Limit, q.Free())
+}
+
+func getNetworkInfo(client *gophercloud.ServiceClient, networkID string) (networkInfo, error) {
+	network := networkInfo{}
+	err := networksv2.Get(client, networkID).ExtractIntoStructPtr(&network, "network")
+	return network, err
+}
+
+// Preflight checks the networking configuration and the agent ports against
+// Neutron and returns the quota headroom for ports and floating IPs. All
+// problems found are reported together in the returned error.
+//
+// The headroom is nil if Neutron does not report quota usage.
+func Preflight(client *gophercloud.ServiceClient, projectID string, cfg *config.NetworkingOpts, agents []config.Agent) ([]QuotaHeadroom, error) {
+	var errs []error
+
+	networkIDs := make([]string, 0)
+	for _, subnetID := range append([]string{cfg.SubnetID}, cfg.AllowedSubnetIDs...) {
+		subnet, err := subnetsv2.Get(client, subnetID).Extract()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("subnet %q: %s", subnetID, err))
+			continue
+		}
+		if _, err := getNetworkInfo(client, subnet.NetworkID); err != nil {
+			errs = append(errs, fmt.Errorf("network %q of subnet %q: %s", subnet.NetworkID, subnetID, err))
+			continue
+		}
+		networkIDs = append(networkIDs, subnet.NetworkID)
+	}
+
+	if cfg.UseFloatingIPs {
+		for _, networkID := range append([]string{cfg.FloatingIPNetworkID}, cfg.AllowedFloatingIPNetworkIDs...) {
+			if networkID == model.NoFloatingIP {
+				continue
+			}
+			network, err := getNetworkInfo(client, networkID)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("floating IP network %q: %s", networkID, err))
+			} else if !network.External {
+				errs = append(errs, fmt.Errorf("floating IP network %q is not an external network", networkID))
+			}
+		}
+	}
+
+	for _, agent := range agents {
+		port, err := portsv2.Get(client, agent.PortId).Extract()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("port %q of agent %s: %s", agent.PortId, agent.URL, err))
+		} else if len(networkIDs) > 0 && !slices.Contains(networkIDs, port.NetworkID) {
+			errs = append(errs, fmt.Errorf("port %q of agent %s is not in the network of any configured subnet", agent.PortId, agent.URL))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	details, err := quotas.GetDetail(client, projectID).Extract()
+	if err != nil {
+		if _, notFound := err.(gophercloud.ErrDefault404); notFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not get quota of project %q: %s", projectID, err)
+	}
+
+	headroom := []QuotaHeadroom{
+		{Resource: "ports", Limit: details.Port.Limit, Used: details.Port.Used + details.Port.Reserved},
+	}
+	if cfg.UseFloatingIPs {
+		headroom = append(headroom, QuotaHeadroom{
+			Resource: "floating IPs",
+			Limit:    details.FloatingIP.Limit,
+			Used:     details.FloatingIP.Used + details.FloatingIP.Reserved,
+		})
+	}
+	return headroom, nil
+}
+
+// Preflight runs the preflight checks against the networking service of the
+// client and logs the quota headroom.
+func (client *OpenStackClient) Preflight(cfg *config.NetworkingOpts, agents []config.Agent) error {
+	networkingclient, err := client.NewNetworkV2()
+	if err != nil {
+		return err
+	}
+
+	headroom, err := Preflight(networkingclient, client.projectID, cfg, agents)
+	if err != nil {
+		return err
+	}
+
+	if headroom == nil {
+		klog.Warningf("Neutron does not report quota usage, cannot check quota headroom")
+	}
+	for _, quota := range headroom {
+		if quota.Free() == 0 {
+			klog.Warningf("Quota exhausted, no new load-balancers can be provisioned: %s", quota)
+		} else {
+			klog.Infof("Quota headroom of %s", quota)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	th "github.com/gophercloud/gophercloud/testhelper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/config"
+)
+
+func handlePreflightResources(t *testing.T) {
+	th.Mux.HandleFunc("/v2.0/subnets/subnet", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"subnet": {"id": "subnet", "network_id": "internal", "ip_version": 4}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/networks/internal", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"network": {"id": "internal", "router:external": false}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/networks/public", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"network": {"id": "public", "router:external": true}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/ports/agent-port", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"port": {"id": "agent-port", "network_id": "internal"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/ports/foreign-port", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"port": {"id": "foreign-port", "network_id": "other"}}`)
+	})
+}
+
+func TestPreflightReportsQuotaHeadroom(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+	handlePreflightResources(t)
+
+	th.Mux.HandleFunc("/v2.0/quotas/project/details.json", func(w http.ResponseWriter, r *http.Request) {
+		th.TestMethod(t, r, "GET")
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"quota": {
+			"port": {"used": 40, "reserved": 2, "limit": 50},
+			"floatingip": {"used": 3, "reserved": 0, "limit": -1}
+		}}`)
+	})
+
+	pm := newTestHelperPortManager()
+	cfg := &config.NetworkingOpts{UseFloatingIPs: true, FloatingIPNetworkID: "public", SubnetID: "subnet"}
+	agents := []config.Agent{{URL: "http://agent-1", PortId: "agent-port"}}
+
+	headroom, err := Preflight(pm.client, "project", cfg, agents)
+	assert.Nil(t, err)
+	assert.Equal(t, []QuotaHeadroom{
+		{Resource: "ports", Limit: 50, Used: 42},
+		{Resource: "floating IPs", Limit: -1, Used: 3},
+	}, headroom)
+	assert.Equal(t, 8, headroom[0].Free())
+	assert.Equal(t, -1, headroom[1].Free())
+}
+
+func TestPreflightReportsAllProblems(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+	handlePreflightResources(t)
+
+	pm := newTestHelperPortManager()
+	cfg := &config.NetworkingOpts{
+		UseFloatingIPs:      true,
+		FloatingIPNetworkID: "internal",
+		SubnetID:            "subnet",
+		AllowedSubnetIDs:    []string{"missing-subnet"},
+	}
+	agents := []config.Agent{
+		{URL: "http://agent-1", PortId: "missing-port"},
+		{URL: "http://agent-2", PortId: "foreign-port"},
+	}
+
+	_, err := Preflight(pm.client, "project", cfg, agents)
+	assert.NotNil(t, err)
+	assert.ErrorContains(t, err, `subnet "missing-subnet"`)
+	assert.ErrorContains(t, err, `floating IP network "internal" is not an external network`)
+	assert.ErrorContains(t, err, `port "missing-port" of agent http://agent-1`)
+	assert.ErrorContains(t, err, `port "foreign-port" of agent http://agent-2 is not in the network of any configured subnet`)
+}
+
+func TestPreflightWithoutQuotaDetails(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+	handlePreflightResources(t)
+
+	pm := newTestHelperPortManager()
+	cfg := &config.NetworkingOpts{SubnetID: "subnet"}
+
+	headroom, err := Preflight(pm.client, "project", cfg, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, headroom)
+}
@@ -0,0 +1,253 @@
+package openstack
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	tags "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/qos/policies"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/qos/rules"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/gophercloud/gophercloud/pagination"
+	"k8s.io/klog"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+)
+
+const (
+	// Alias of the Neutron QoS extension
+	ExtensionQoS = "qos"
+	// Alias of the Neutron extension which allows bandwidth limit rules for
+	// ingress traffic; without it, all rules limit egress traffic
+	ExtensionQoSBandwidthLimitDirection = "qos-bw-limit-direction"
+	// Alias of the Neutron extension which allows QoS policies on floating IPs
+	ExtensionQoSFloatingIP = "qos-fip"
+
+	// The name of the QoS policy of an L3 port is this prefix followed by the
+	// port ID
+	QoSPolicyNamePrefix = "cah-loadbalancer-qos-"
+)
+
+var (
+	ErrQoSNotSupported = errors.New("Neutron does not support QoS policies")
+)
+
+// gophercloud does not know about the QoS policy of floating IPs
+type floatingIPQoSUpdateOpts struct {
+	QoSPolicyID *string `json:"qos_policy_id"`
+}
+
+func (opts floatingIPQoSUpdateOpts) ToFloatingIPUpdateMap() (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"floatingip": map[string]interface{}{"qos_policy_id": opts.QoSPolicyID},
+	}, nil
+}
+
+func qosPolicyName(portID string) string {
+	return QoSPolicyNamePrefix + portID
+}
+
+// Return the QoS policy of the port or nil if it has none.
+func (pm *OpenStackL3PortManager) getQoSPolicy(portID string) (*policies.Policy, error) {
+	var result *policies.Policy
+	err := policies.List(
+		pm.client,
+		policies.ListOpts{
+			Name:      qosPolicyName(portID),
+			Tags:      strings.Join(pm.tags, ","),
+			ProjectID: pm.projectID,
+		},
+	).EachPage(func(page pagination.Page) (bool, error) {
+		found, err := policies.ExtractPolicies(page)
+		if err != nil {
+			return false, err
+		}
+		if len(found) > 0 {
+			result = &found[0]
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Return the directions of the bandwidth limit rules. Bandwidth limits apply
+// to both directions if Neutron supports it; otherwise a single rule without
+// direction limits the egress traffic.
+func (pm *OpenStackL3PortManager) bandwidthLimitDirections() []string {
+	if pm.qosIngressSupported {
+		return []string{"ingress", "egress"}
+	}
+	return []string{""}
+}
+
+// Attach the QoS policy to the floating IP of the port or, if it has none or
+// Neutron does not support policies on floating IPs, to the port itself. An
+// empty policy ID detaches the current policy.
+func (pm *OpenStackL3PortManager) setQoSPolicyOf(portID string, policyID string) error {
+	_, fip, err := pm.ports.GetPortByID(portID)
+	if err != nil {
+		return err
+	}
+
+	if fip != nil && pm.qosFloatingIPSupported {
+		opts := floatingIPQoSUpdateOpts{}
+		if policyID != "" {
+			opts.QoSPolicyID = &policyID
+		}
+		_, err = floatingipsv2.Update(pm.client, fip.ID, opts).Extract()
+		pm.invalidatePort(portID)
+		return err
+	}
+
+	_, err = pm.ports.Update(pm.client, portID, policies.PortUpdateOptsExt{
+		UpdateOptsBuilder: portsv2.UpdateOpts{},
+		QoSPolicyID:       &policyID,
+	})
+	return err
+}
+
+// Create or update the QoS policy of the port so that it has bandwidth limit
+// rules matching the limit and attach it.
+func (pm *OpenStackL3PortManager) applyQoSPolicy(portID string, limit model.BandwidthLimit) error {
+	policy, err := pm.getQoSPolicy(portID)
+	if err != nil {
+		return err
+	}
+
+	if policy == nil {
+		policy, err = policies.Create(pm.client, policies.CreateOpts{
+			Name:        qosPolicyName(portID),
+			Description: DescriptionLBManagedPort,
+		}).Extract()
+		if err != nil {
+			return err
+		}
+
+		_, err = tags.ReplaceAll(pm.client, "policies", policy.ID, tags.ReplaceAllOpts{
+			Tags: pm.tags,
+		}).Extract()
+		if err != nil {
+			deleteErr := policies.Delete(pm.client, policy.ID).ExtractErr()
+			if deleteErr != nil {
+				klog.Warningf(
+					"resource leak: could not delete dysfunctional QoS policy %q: %s",
+					policy.ID,
+					deleteErr)
+			}
+			return err
+		}
+	}
+
+	pages, err := rules.ListBandwidthLimitRules(pm.client, policy.ID, rules.BandwidthLimitRulesListOpts{}).AllPages()
+	if err != nil {
+		return err
+	}
+	existing, err := rules.ExtractBandwidthLimitRules(pages)
+	if err != nil {
+		return err
+	}
+
+	byDirection := make(map[string]rules.BandwidthLimitRule)
+	for _, rule := range existing {
+		byDirection[rule.Direction] = rule
+	}
+
+	for _, direction := range pm.bandwidthLimitDirections() {
+		rule, ok := byDirection[direction]
+		if !ok {
+			_, err = rules.CreateBandwidthLimitRule(pm.client, policy.ID, rules.CreateBandwidthLimitRuleOpts{
+				MaxKBps:      limit.MaxKbps,
+				MaxBurstKBps: limit.MaxBurstKbps,
+				Direction:    direction,
+			}).ExtractBandwidthLimitRule()
+		} else if rule.MaxKBps != limit.MaxKbps || rule.MaxBurstKBps != limit.MaxBurstKbps {
+			_, err = rules.UpdateBandwidthLimitRule(pm.client, policy.ID, rule.ID, rules.UpdateBandwidthLimitRuleOpts{
+				MaxKBps:      &limit.MaxKbps,
+				MaxBurstKBps: &limit.MaxBurstKbps,
+			}).ExtractBandwidthLimitRule()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return pm.setQoSPolicyOf(portID, policy.ID)
+}
+
+// Detach and delete the QoS policy of the port, if it has one.
+func (pm *OpenStackL3PortManager) removeQoSPolicy(portID string) error {
+	policy, err := pm.getQoSPolicy(portID)
+	if err != nil || policy == nil {
+		return err
+	}
+
+	err = pm.setQoSPolicyOf(portID, "")
+	if _, notFound := err.(gophercloud.ErrDefault404); err != nil && !notFound {
+		return err
+	}
+
+	return policies.Delete(pm.client, policy.ID).ExtractErr()
+}
+
+// SetPortBandwidthLimit applies the limit via a QoS policy of the port with
+// one bandwidth limit rule per direction. The policy is attached to the
+// floating IP of the port or, if it has none or Neutron lacks the qos-fip
+// extension, to the port itself.
+//
+// Applied limits are remembered, so that Neutron is only contacted if the
+// limit of a port changes.
+func (pm *OpenStackL3PortManager) SetPortBandwidthLimit(portID string, limit model.BandwidthLimit) error {
+	if !pm.qosSupported {
+		if limit.MaxKbps != 0 {
+			return ErrQoSNotSupported
+		}
+		return nil
+	}
+
+	pm.qosLock.Lock()
+	defer pm.qosLock.Unlock()
+
+	if applied, ok := pm.bandwidthLimits[portID]; ok && applied == limit {
+		return nil
+	}
+
+	var err error
+	if limit.MaxKbps == 0 {
+		err = pm.removeQoSPolicy(portID)
+	} else {
+		klog.Infof("Limiting bandwidth of port %q to %d kbit/s", portID, limit.MaxKbps)
+		err = pm.applyQoSPolicy(portID, limit)
+	}
+	if err != nil {
+		return err
+	}
+
+	if pm.bandwidthLimits == nil {
+		pm.bandwidthLimits = make(map[string]model.BandwidthLimit)
+	}
+	pm.bandwidthLimits[portID] = limit
+	return nil
+}
+
+// Remove the QoS policy of a port which is about to be deleted.
+func (pm *OpenStackL3PortManager) releaseQoSPolicy(portID string) {
+	if !pm.qosSupported {
+		return
+	}
+
+	pm.qosLock.Lock()
+	defer pm.qosLock.Unlock()
+
+	err := pm.removeQoSPolicy(portID)
+	if err != nil {
+		klog.Warningf("Failed to delete QoS policy of port %q: %s", portID, err)
+		return
+	}
+	delete(pm.bandwidthLimits, portID)
+}
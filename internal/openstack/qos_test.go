@@ -0,0 +1,195 @@
+package openstack
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/qos/policies"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	th "github.com/gophercloud/gophercloud/testhelper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
+	ostesting "github.com/cloudandheat/ch-k8s-lbaas/internal/openstack/testing"
+)
+
+func TestSetPortBandwidthLimitCreatesAndAttachesPolicy(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	requests := []string{}
+	record := func(r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}
+
+	th.Mux.HandleFunc("/v2.0/qos/policies", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Add("Content-Type", "application/json")
+		if r.Method == "GET" {
+			th.TestFormValues(t, r, map[string]string{
+				"name":       QoSPolicyNamePrefix + "port-id",
+				"tags":       TagLBManagedPort,
+				"project_id": "project",
+			})
+			fmt.Fprint(w, `{"policies": []}`)
+			return
+		}
+		th.TestJSONRequest(t, r, `{"policy": {"name": "`+QoSPolicyNamePrefix+`port-id", "description": "`+DescriptionLBManagedPort+`"}}`)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"policy": {"id": "policy-id"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/policies/policy-id/tags", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"tags": ["`+TagLBManagedPort+`"]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/qos/policies/policy-id/bandwidth_limit_rules", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Add("Content-Type", "application/json")
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"bandwidth_limit_rules": [
+				{"id": "rule-id", "direction": "egress", "max_kbps": 1000, "max_burst_kbps": 0}
+			]}`)
+			return
+		}
+		th.TestJSONRequest(t, r, `{"bandwidth_limit_rule": {"max_kbps": 5000, "max_burst_kbps": 500, "direction": "ingress"}}`)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"bandwidth_limit_rule": {"id": "new-rule-id"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/qos/policies/policy-id/bandwidth_limit_rules/rule-id", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		th.TestJSONRequest(t, r, `{"bandwidth_limit_rule": {"max_kbps": 5000, "max_burst_kbps": 500}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"bandwidth_limit_rule": {"id": "rule-id"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/fip-id", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		th.TestJSONRequest(t, r, `{"floatingip": {"qos_policy_id": "policy-id"}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "fip-id"}}`)
+	})
+
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id"}, nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.qosSupported = true
+	pm.qosIngressSupported = true
+	pm.qosFloatingIPSupported = true
+
+	limit := model.BandwidthLimit{MaxKbps: 5000, MaxBurstKbps: 500}
+	err := pm.SetPortBandwidthLimit("port-id", limit)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"GET /v2.0/qos/policies",
+		"POST /v2.0/qos/policies",
+		"PUT /v2.0/policies/policy-id/tags",
+		"GET /v2.0/qos/policies/policy-id/bandwidth_limit_rules",
+		"POST /v2.0/qos/policies/policy-id/bandwidth_limit_rules",
+		"PUT /v2.0/qos/policies/policy-id/bandwidth_limit_rules/rule-id",
+		"PUT /v2.0/floatingips/fip-id",
+	}, requests)
+
+	// unchanged limits are not applied again
+	requests = []string{}
+	err = pm.SetPortBandwidthLimit("port-id", limit)
+	assert.Nil(t, err)
+	assert.Empty(t, requests)
+}
+
+func TestSetPortBandwidthLimitWithoutDirectionAndFloatingIPExtensions(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	requests := []string{}
+	record := func(r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+	}
+
+	th.Mux.HandleFunc("/v2.0/qos/policies", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"policies": [{"id": "policy-id"}]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/qos/policies/policy-id/bandwidth_limit_rules", func(w http.ResponseWriter, r *http.Request) {
+		record(r)
+		w.Header().Add("Content-Type", "application/json")
+		if r.Method == "GET" {
+			fmt.Fprint(w, `{"bandwidth_limit_rules": []}`)
+			return
+		}
+		th.TestJSONRequest(t, r, `{"bandwidth_limit_rule": {"max_kbps": 5000}}`)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"bandwidth_limit_rule": {"id": "rule-id"}}`)
+	})
+
+	policyID := "policy-id"
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id"}, nil)
+	client.On("Update", mock.Anything, "port-id", policies.PortUpdateOptsExt{
+		UpdateOptsBuilder: portsv2.UpdateOpts{},
+		QoSPolicyID:       &policyID,
+	}).Return(&portsv2.Port{ID: "port-id"}, nil).Once()
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.qosSupported = true
+
+	err := pm.SetPortBandwidthLimit("port-id", model.BandwidthLimit{MaxKbps: 5000})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"GET /v2.0/qos/policies",
+		"GET /v2.0/qos/policies/policy-id/bandwidth_limit_rules",
+		"POST /v2.0/qos/policies/policy-id/bandwidth_limit_rules",
+	}, requests)
+	client.AssertExpectations(t)
+}
+
+func TestRemoveQoSPolicyDetachesAndDeletesPolicy(t *testing.T) {
+	th.SetupHTTP()
+	defer th.TeardownHTTP()
+
+	requests := []string{}
+	th.Mux.HandleFunc("/v2.0/qos/policies", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"policies": [{"id": "policy-id"}]}`)
+	})
+	th.Mux.HandleFunc("/v2.0/floatingips/fip-id", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		th.TestJSONRequest(t, r, `{"floatingip": {"qos_policy_id": null}}`)
+		w.Header().Add("Content-Type", "application/json")
+		fmt.Fprint(w, `{"floatingip": {"id": "fip-id"}}`)
+	})
+	th.Mux.HandleFunc("/v2.0/qos/policies/policy-id", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	client := &ostesting.MockPortClient{}
+	client.On("GetPortByID", "port-id").Return(&portsv2.Port{ID: "port-id"}, &floatingipsv2.FloatingIP{ID: "fip-id"}, nil)
+
+	pm := newTestHelperPortManager()
+	pm.ports = client
+	pm.qosSupported = true
+	pm.qosFloatingIPSupported = true
+
+	err := pm.SetPortBandwidthLimit("port-id", model.BandwidthLimit{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"GET /v2.0/qos/policies",
+		"PUT /v2.0/floatingips/fip-id",
+		"DELETE /v2.0/qos/policies/policy-id",
+	}, requests)
+}
+
+func TestSetPortBandwidthLimitWithoutQoSExtension(t *testing.T) {
+	pm := &OpenStackL3PortManager{}
+
+	assert.Equal(t, ErrQoSNotSupported, pm.SetPortBandwidthLimit("port-id", model.BandwidthLimit{MaxKbps: 1000}))
+	assert.Nil(t, pm.SetPortBandwidthLimit("port-id", model.BandwidthLimit{}))
+}
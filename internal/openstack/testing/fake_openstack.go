@@ -0,0 +1,692 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
+	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	FakeUsername  = "lbaas"
+	FakePassword  = "secret"
+	FakeProjectID = "fake-project"
+	FakeRegion    = "RegionOne"
+
+	fakeToken = "fake-token"
+)
+
+// The singular names of the resources in request and response bodies
+var fakeCollections = map[string]string{
+	"ports":       "port",
+	"floatingips": "floatingip",
+	"subnets":     "subnet",
+	"networks":    "network",
+}
+
+// Query parameters which are no attribute filters
+var fakeListParameters = []string{"limit", "marker", "sort_key", "sort_dir", "fields", "page_reverse"}
+
+type fakeResource map[string]interface{}
+
+// FakeOpenStack is an in-memory fake of the Keystone and Neutron APIs, as far
+// as they are used by the OpenStack port manager. It implements token
+// creation with password authentication and ports, floating IPs, subnets,
+// networks, tags, extensions and quota details of Neutron.
+//
+// Resources are plain JSON objects; attributes which are not interpreted by
+// the fake are stored and returned as they were sent.
+type FakeOpenStack struct {
+	server *httptest.Server
+
+	// PageSize limits the number of resources per page of list responses;
+	// 0 returns all resources on a single page.
+	PageSize int
+
+	lock       sync.Mutex
+	resources  map[string]map[string]fakeResource
+	order      map[string][]string
+	nextID     int
+	nextAddr   map[string]netip.Addr
+	extensions map[string]bool
+	quotas     map[string]int
+	requests   []string
+}
+
+// NewFakeOpenStack starts a new fake server. It must be closed with Close.
+func NewFakeOpenStack() *FakeOpenStack {
+	f := &FakeOpenStack{
+		resources:  make(map[string]map[string]fakeResource),
+		order:      make(map[string][]string),
+		nextAddr:   make(map[string]netip.Addr),
+		extensions: make(map[string]bool),
+		quotas:     map[string]int{"port": -1, "floatingip": -1},
+	}
+	for collection := range fakeCollections {
+		f.resources[collection] = make(map[string]fakeResource)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identity/v3/auth/tokens", f.handleTokens)
+	mux.HandleFunc("/network/v2.0/", f.handleNetwork)
+	f.server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *FakeOpenStack) Close() {
+	f.server.Close()
+}
+
+// AuthURL returns the Keystone URL of the fake server.
+func (f *FakeOpenStack) AuthURL() string {
+	return f.server.URL + "/identity/v3/"
+}
+
+// EnableExtension makes the Neutron extension with the alias available.
+func (f *FakeOpenStack) EnableExtension(alias string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.extensions[alias] = true
+}
+
+// SetQuota limits the number of resources ("port" or "floatingip") of the
+// project; -1 means unlimited.
+func (f *FakeOpenStack) SetQuota(resource string, limit int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.quotas[resource] = limit
+}
+
+// AddNetwork creates a network.
+func (f *FakeOpenStack) AddNetwork(id string, external bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.store("networks", fakeResource{"id": id, "router:external": external, "project_id": FakeProjectID})
+}
+
+// AddSubnet creates a subnet with the given CIDR in the network. Fixed IPs of
+// new ports are allocated from the CIDR in ascending order.
+func (f *FakeOpenStack) AddSubnet(id string, networkID string, cidr string) {
+	prefix := netip.MustParsePrefix(cidr)
+	ipVersion := 4
+	if prefix.Addr().Is6() {
+		ipVersion = 6
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.store("subnets", fakeResource{
+		"id":         id,
+		"network_id": networkID,
+		"cidr":       prefix.String(),
+		"ip_version": ipVersion,
+		"project_id": FakeProjectID,
+	})
+	f.nextAddr[id] = prefix.Masked().Addr().Next()
+}
+
+// AddPort creates a port, e.g. the port of an agent, which was not created
+// through the API.
+func (f *FakeOpenStack) AddPort(port portsv2.Port) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.store("ports", toFakeResource(port))
+}
+
+// Ports returns all ports.
+func (f *FakeOpenStack) Ports() []portsv2.Port {
+	var ports []portsv2.Port
+	f.export("ports", &ports)
+	return ports
+}
+
+// Port returns the port with the given ID or nil if it does not exist.
+func (f *FakeOpenStack) Port(id string) *portsv2.Port {
+	for _, port := range f.Ports() {
+		if port.ID == id {
+			return &port
+		}
+	}
+	return nil
+}
+
+// FloatingIPs returns all floating IPs.
+func (f *FakeOpenStack) FloatingIPs() []floatingipsv2.FloatingIP {
+	var fips []floatingipsv2.FloatingIP
+	f.export("floatingips", &fips)
+	return fips
+}
+
+// Requests returns the method and path of all Neutron requests so far.
+func (f *FakeOpenStack) Requests() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.requests...)
+}
+
+func toFakeResource(v interface{}) fakeResource {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	resource := fakeResource{}
+	if err := json.Unmarshal(data, &resource); err != nil {
+		panic(err)
+	}
+	return resource
+}
+
+// Copy all resources of the collection in creation order into the slice.
+func (f *FakeOpenStack) export(collection string, into interface{}) {
+	f.lock.Lock()
+	resources := []fakeResource{}
+	for _, id := range f.order[collection] {
+		resources = append(resources, f.resources[collection][id])
+	}
+	data, err := json.Marshal(resources)
+	f.lock.Unlock()
+
+	if err == nil {
+		err = json.Unmarshal(data, into)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (f *FakeOpenStack) store(collection string, resource fakeResource) {
+	id := resource["id"].(string)
+	if _, exists := f.resources[collection][id]; !exists {
+		f.order[collection] = append(f.order[collection], id)
+	}
+	if _, ok := resource["tags"].([]interface{}); !ok {
+		resource["tags"] = []interface{}{}
+	}
+	if _, ok := resource["revision_number"].(float64); !ok {
+		resource["revision_number"] = float64(1)
+	}
+	f.resources[collection][id] = resource
+}
+
+// Like Neutron, every change of a resource increases its revision number.
+func bumpRevision(resource fakeResource) {
+	revision, _ := resource["revision_number"].(float64)
+	resource["revision_number"] = revision + 1
+}
+
+func (f *FakeOpenStack) remove(collection string, id string) {
+	delete(f.resources[collection], id)
+	f.order[collection] = slices.DeleteFunc(f.order[collection], func(other string) bool {
+		return other == id
+	})
+}
+
+func (f *FakeOpenStack) newID(collection string) string {
+	f.nextID++
+	return fmt.Sprintf("%s-%d", fakeCollections[collection], f.nextID)
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, kind string, message string) {
+	writeJSON(w, status, map[string]interface{}{
+		"NeutronError": map[string]string{"type": kind, "message": message},
+	})
+}
+
+type fakeAuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Password struct {
+				User struct {
+					ID       string `json:"id"`
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+		} `json:"identity"`
+	} `json:"auth"`
+}
+
+func (f *FakeOpenStack) handleTokens(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req fakeAuthRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	user := req.Auth.Identity.Password.User
+	if (user.Name != FakeUsername && user.ID != FakeUsername) || user.Password != FakePassword {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": map[string]interface{}{"code": 401, "message": "The request you have made requires authentication."},
+		})
+		return
+	}
+
+	w.Header().Set("X-Subject-Token", fakeToken)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token": map[string]interface{}{
+			"expires_at": "2099-01-01T00:00:00.000000Z",
+			"methods":    []string{"password"},
+			"project":    map[string]interface{}{"id": FakeProjectID, "name": "fake"},
+			"user":       map[string]interface{}{"id": FakeUsername, "name": FakeUsername},
+			"catalog": []interface{}{
+				map[string]interface{}{
+					"id":   "neutron",
+					"name": "neutron",
+					"type": "network",
+					"endpoints": []interface{}{
+						map[string]interface{}{
+							"id":        "neutron-public",
+							"interface": "public",
+							"region":    FakeRegion,
+							"region_id": FakeRegion,
+							"url":       f.server.URL + "/network/",
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (f *FakeOpenStack) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Auth-Token") != fakeToken {
+		writeError(w, http.StatusUnauthorized, "NotAuthorized", "invalid token")
+		return
+	}
+
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/network/v2.0/"), "/")
+	parts := strings.Split(path, "/")
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.Method+" /v2.0/"+path)
+
+	switch {
+	case parts[0] == "extensions" && len(parts) == 2 && r.Method == http.MethodGet:
+		if !f.extensions[parts[1]] {
+			writeError(w, http.StatusNotFound, "ExtensionNotFound", "extension not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"extension": map[string]string{"alias": parts[1], "name": parts[1]},
+		})
+	case parts[0] == "quotas" && len(parts) == 3 && parts[2] == "details.json" && r.Method == http.MethodGet:
+		f.handleQuotaDetails(w)
+	case fakeCollections[parts[0]] == "":
+		writeError(w, http.StatusNotFound, "HTTPNotFound", "unknown resource")
+	case len(parts) == 1:
+		f.handleCollection(w, r, parts[0])
+	case f.resources[parts[0]][parts[1]] == nil:
+		writeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %s could not be found", fakeCollections[parts[0]], parts[1]))
+	case len(parts) == 2:
+		f.handleResource(w, r, parts[0], parts[1])
+	case len(parts) >= 3 && parts[2] == "tags":
+		f.handleTags(w, r, f.resources[parts[0]][parts[1]], parts[3:])
+	case len(parts) == 3 && parts[0] == "ports" && r.Method == http.MethodPut &&
+		(parts[2] == "add_allowed_address_pairs" || parts[2] == "remove_allowed_address_pairs"):
+		f.handleAddressPairs(w, r, f.resources["ports"][parts[1]], parts[2] == "add_allowed_address_pairs")
+	default:
+		writeError(w, http.StatusNotFound, "HTTPNotFound", "unknown resource")
+	}
+}
+
+func (f *FakeOpenStack) handleQuotaDetails(w http.ResponseWriter) {
+	detail := func(resource string, collection string) map[string]int {
+		return map[string]int{"used": len(f.resources[collection]), "reserved": 0, "limit": f.quotas[resource]}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"quota": map[string]interface{}{
+			"port":       detail("port", "ports"),
+			"floatingip": detail("floatingip", "floatingips"),
+		},
+	})
+}
+
+// Check if the resource matches all attribute filters of the query. Tags
+// must all be present.
+func matchesQuery(resource fakeResource, query url.Values) bool {
+	for key, values := range query {
+		if slices.Contains(fakeListParameters, key) {
+			continue
+		}
+		if key == "tags" {
+			for _, tag := range strings.Split(values[0], ",") {
+				if !slices.Contains(resource["tags"].([]interface{}), interface{}(tag)) {
+					return false
+				}
+			}
+			continue
+		}
+
+		value := resource[key]
+		actual := ""
+		if value != nil {
+			actual = fmt.Sprint(value)
+		}
+		if actual != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeOpenStack) handleCollection(w http.ResponseWriter, r *http.Request, collection string) {
+	switch r.Method {
+	case http.MethodGet:
+		f.handleList(w, r, collection)
+	case http.MethodPost:
+		f.handleCreate(w, r, collection)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *FakeOpenStack) handleList(w http.ResponseWriter, r *http.Request, collection string) {
+	query := r.URL.Query()
+
+	matching := []fakeResource{}
+	for _, id := range f.order[collection] {
+		resource := f.resources[collection][id]
+		if matchesQuery(resource, query) {
+			matching = append(matching, resource)
+		}
+	}
+
+	if marker := query.Get("marker"); marker != "" {
+		for i, resource := range matching {
+			if resource["id"] == marker {
+				matching = matching[i+1:]
+				break
+			}
+		}
+	}
+
+	pageSize := f.PageSize
+	if limit, err := strconv.Atoi(query.Get("limit")); err == nil && (pageSize == 0 || limit < pageSize) {
+		pageSize = limit
+	}
+
+	body := map[string]interface{}{}
+	if pageSize > 0 && len(matching) > pageSize {
+		matching = matching[:pageSize]
+		next := *r.URL
+		nextQuery := next.Query()
+		nextQuery.Set("marker", matching[len(matching)-1]["id"].(string))
+		next.RawQuery = nextQuery.Encode()
+		body[collection+"_links"] = []map[string]string{
+			{"rel": "next", "href": f.server.URL + next.String()},
+		}
+	}
+	body[collection] = matching
+	writeJSON(w, http.StatusOK, body)
+}
+
+// Decode the request body {"<singular>": {...}}.
+func decodeResource(r *http.Request, collection string) (fakeResource, error) {
+	var body map[string]fakeResource
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	resource, ok := body[fakeCollections[collection]]
+	if !ok {
+		return nil, fmt.Errorf("missing %q in request body", fakeCollections[collection])
+	}
+	return resource, nil
+}
+
+func (f *FakeOpenStack) checkQuota(resource string, collection string) bool {
+	limit := f.quotas[resource]
+	return limit < 0 || len(f.resources[collection]) < limit
+}
+
+func (f *FakeOpenStack) handleCreate(w http.ResponseWriter, r *http.Request, collection string) {
+	resource, err := decodeResource(r, collection)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	switch collection {
+	case "ports":
+		if !f.checkQuota("port", collection) {
+			writeError(w, http.StatusConflict, "OverQuota", "quota exceeded for resources: ['port']")
+			return
+		}
+		err = f.initPort(resource)
+	case "floatingips":
+		if !f.checkQuota("floatingip", collection) {
+			writeError(w, http.StatusConflict, "OverQuota", "quota exceeded for resources: ['floatingip']")
+			return
+		}
+		err = f.initFloatingIP(resource)
+	default:
+		writeError(w, http.StatusBadRequest, "BadRequest", "cannot create "+collection)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	resource["id"] = f.newID(collection)
+	resource["project_id"] = FakeProjectID
+	resource["tenant_id"] = FakeProjectID
+	f.store(collection, resource)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{fakeCollections[collection]: resource})
+}
+
+// Allocate the fixed IPs of a new port from the requested subnets.
+func (f *FakeOpenStack) initPort(port fakeResource) error {
+	networkID, _ := port["network_id"].(string)
+	if f.resources["networks"][networkID] == nil {
+		return fmt.Errorf("network %q not found", networkID)
+	}
+
+	fixedIPs := []interface{}{}
+	requested, _ := port["fixed_ips"].([]interface{})
+	for _, item := range requested {
+		ip, _ := item.(map[string]interface{})
+		subnetID, _ := ip["subnet_id"].(string)
+		subnet := f.resources["subnets"][subnetID]
+		if subnet == nil || subnet["network_id"] != networkID {
+			return fmt.Errorf("subnet %q not found in network %q", subnetID, networkID)
+		}
+
+		addr := f.nextAddr[subnetID]
+		if !netip.MustParsePrefix(subnet["cidr"].(string)).Contains(addr) {
+			return fmt.Errorf("subnet %q is exhausted", subnetID)
+		}
+		f.nextAddr[subnetID] = addr.Next()
+		fixedIPs = append(fixedIPs, map[string]interface{}{"subnet_id": subnetID, "ip_address": addr.String()})
+	}
+
+	port["fixed_ips"] = fixedIPs
+	if _, ok := port["allowed_address_pairs"]; !ok {
+		port["allowed_address_pairs"] = []interface{}{}
+	}
+	port["status"] = "DOWN"
+	return nil
+}
+
+// Allocate the address of a new floating IP and associate it.
+func (f *FakeOpenStack) initFloatingIP(fip fakeResource) error {
+	networkID, _ := fip["floating_network_id"].(string)
+	network := f.resources["networks"][networkID]
+	if network == nil || network["router:external"] != true {
+		return fmt.Errorf("external network %q not found", networkID)
+	}
+
+	f.nextID++
+	fip["floating_ip_address"] = fmt.Sprintf("203.0.113.%d", f.nextID%250+1)
+	fip["status"] = "ACTIVE"
+	return f.associate(fip)
+}
+
+// Set the fixed IP of the floating IP according to its port.
+func (f *FakeOpenStack) associate(fip fakeResource) error {
+	portID, _ := fip["port_id"].(string)
+	if portID == "" {
+		fip["port_id"] = nil
+		fip["fixed_ip_address"] = ""
+		return nil
+	}
+
+	port := f.resources["ports"][portID]
+	if port == nil {
+		return fmt.Errorf("port %q not found", portID)
+	}
+	fixedIPs, _ := port["fixed_ips"].([]interface{})
+	if len(fixedIPs) == 0 {
+		return fmt.Errorf("port %q has no fixed IP", portID)
+	}
+	fip["fixed_ip_address"] = fixedIPs[0].(map[string]interface{})["ip_address"]
+	return nil
+}
+
+func (f *FakeOpenStack) handleResource(w http.ResponseWriter, r *http.Request, collection string, id string) {
+	resource := f.resources[collection][id]
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{fakeCollections[collection]: resource})
+	case http.MethodPut:
+		if expected := r.Header.Get("If-Match"); expected != "" &&
+			expected != fmt.Sprintf("revision_number=%v", resource["revision_number"]) {
+			writeError(w, http.StatusPreconditionFailed, "RevisionNumberConstraintFailed",
+				fmt.Sprintf("constrained to %s but the revision is %v", expected, resource["revision_number"]))
+			return
+		}
+		update, err := decodeResource(r, collection)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		for key, value := range update {
+			resource[key] = value
+		}
+		bumpRevision(resource)
+		if _, ok := update["port_id"]; ok && collection == "floatingips" {
+			if err := f.associate(resource); err != nil {
+				writeError(w, http.StatusNotFound, "NotFound", err.Error())
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{fakeCollections[collection]: resource})
+	case http.MethodDelete:
+		f.remove(collection, id)
+		if collection == "ports" {
+			// like Neutron, disassociate the floating IPs of the port
+			for _, fip := range f.resources["floatingips"] {
+				if fip["port_id"] == id {
+					fip["port_id"] = nil
+					fip["fixed_ip_address"] = ""
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *FakeOpenStack) handleTags(w http.ResponseWriter, r *http.Request, resource fakeResource, tag []string) {
+	switch {
+	case len(tag) == 0 && r.Method == http.MethodPut:
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		tags := []interface{}{}
+		for _, tag := range body.Tags {
+			tags = append(tags, tag)
+		}
+		resource["tags"] = tags
+		bumpRevision(resource)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tags": tags})
+	case len(tag) == 0 && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tags": resource["tags"]})
+	case len(tag) == 1 && r.Method == http.MethodPut:
+		tags := resource["tags"].([]interface{})
+		if !slices.Contains(tags, interface{}(tag[0])) {
+			resource["tags"] = append(tags, tag[0])
+			bumpRevision(resource)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case len(tag) == 1 && r.Method == http.MethodDelete:
+		resource["tags"] = slices.DeleteFunc(resource["tags"].([]interface{}), func(other interface{}) bool {
+			return other == tag[0]
+		})
+		bumpRevision(resource)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *FakeOpenStack) handleAddressPairs(w http.ResponseWriter, r *http.Request, port fakeResource, add bool) {
+	if !f.extensions["allowed-address-pairs-atomic"] {
+		writeError(w, http.StatusNotFound, "HTTPNotFound", "unknown resource")
+		return
+	}
+
+	update, err := decodeResource(r, "ports")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	changed, _ := update["allowed_address_pairs"].([]interface{})
+
+	current, _ := port["allowed_address_pairs"].([]interface{})
+	pairs := []interface{}{}
+	for _, pair := range current {
+		address := pair.(map[string]interface{})["ip_address"]
+		if !slices.ContainsFunc(changed, func(other interface{}) bool {
+			return other.(map[string]interface{})["ip_address"] == address
+		}) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if add {
+		pairs = append(pairs, changed...)
+	}
+
+	port["allowed_address_pairs"] = pairs
+	bumpRevision(port)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"port": port})
+}
@@ -17,6 +17,9 @@ package testing
 import (
 	"github.com/gophercloud/gophercloud"
 	"github.com/stretchr/testify/mock"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/model"
 
 	floatingipsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/layer3/floatingips"
 	portsv2 "github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
@@ -28,6 +31,16 @@ type MockL3PortManager struct {
 	mock.Mock
 }
 
+// MockL3PortNetworkManager is a MockL3PortManager which also supports
+// selecting the network of ports.
+type MockL3PortNetworkManager struct {
+	MockL3PortManager
+}
+
+type MockL3PortQoSManager struct {
+	mock.Mock
+}
+
 type MockPortClient struct {
 	mock.Mock
 }
@@ -36,13 +49,17 @@ func NewMockL3PortManager() *MockL3PortManager {
 	return new(MockL3PortManager)
 }
 
+func NewMockL3PortNetworkManager() *MockL3PortNetworkManager {
+	return new(MockL3PortNetworkManager)
+}
+
 func (m *MockL3PortManager) CheckPortExists(portID string) (bool, error) {
 	a := m.Called(portID)
 	return a.Bool(0), a.Error(1)
 }
 
-func (m *MockL3PortManager) ProvisionPort() (string, error) {
-	a := m.Called()
+func (m *MockL3PortManager) ProvisionPort(family corev1.IPFamily) (string, error) {
+	a := m.Called(family)
 	return a.String(0), a.Error(1)
 }
 
@@ -71,6 +88,36 @@ func (m *MockL3PortManager) GetInternalAddress(portID string) (string, error) {
 	return a.String(0), a.Error(1)
 }
 
+func (m *MockL3PortNetworkManager) ValidatePortNetwork(id model.ServiceIdentifier, network model.PortNetwork) (model.PortNetwork, error) {
+	a := m.Called(id, network)
+	return a.Get(0).(model.PortNetwork), a.Error(1)
+}
+
+func (m *MockL3PortNetworkManager) ProvisionPortInNetwork(family corev1.IPFamily, network model.PortNetwork) (string, error) {
+	a := m.Called(family, network)
+	return a.String(0), a.Error(1)
+}
+
+func (m *MockL3PortNetworkManager) GetPortNetwork(portID string) (model.PortNetwork, error) {
+	a := m.Called(portID)
+	return a.Get(0).(model.PortNetwork), a.Error(1)
+}
+
+func (m *MockL3PortNetworkManager) SetPortDNSName(portID string, dnsName string) error {
+	a := m.Called(portID, dnsName)
+	return a.Error(0)
+}
+
+func (m *MockL3PortNetworkManager) SetPortFloatingIPReservation(portID string, reservation string) error {
+	a := m.Called(portID, reservation)
+	return a.Error(0)
+}
+
+func (m *MockL3PortQoSManager) SetPortBandwidthLimit(portID string, limit model.BandwidthLimit) error {
+	a := m.Called(portID, limit)
+	return a.Error(0)
+}
+
 func (mpc *MockPortClient) Create(c *gophercloud.ServiceClient, opts portsv2.CreateOptsBuilder) (*portsv2.Port, error) {
 	a := mpc.Called(c, opts)
 	return a.Get(0).(*portsv2.Port), a.Error(1)
@@ -95,3 +142,23 @@ func (mpc *MockPortClient) Delete(c *gophercloud.ServiceClient, id string) (r po
 	a := mpc.Called(c, id)
 	return a.Get(0).(portsv2.DeleteResult)
 }
+
+func (mpc *MockPortClient) AddAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	a := mpc.Called(c, id, pairs)
+	return a.Error(0)
+}
+
+func (mpc *MockPortClient) RemoveAllowedAddressPairs(c *gophercloud.ServiceClient, id string, pairs []portsv2.AddressPair) error {
+	a := mpc.Called(c, id, pairs)
+	return a.Error(0)
+}
+
+func (mpc *MockPortClient) AddTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	a := mpc.Called(c, id, tag)
+	return a.Error(0)
+}
+
+func (mpc *MockPortClient) DeleteTag(c *gophercloud.ServiceClient, id string, tag string) error {
+	a := mpc.Called(c, id, tag)
+	return a.Error(0)
+}
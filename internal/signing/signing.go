@@ -0,0 +1,227 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package signing
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Signing methods of the tokens sent from the controller to the agents
+const (
+	// HS256 with a secret shared by the controller and all agents
+	MethodHMAC = "hmac"
+	// EdDSA with an Ed25519 key pair
+	MethodEd25519 = "ed25519"
+	// RS256 with an RSA key pair
+	MethodRS256 = "rs256"
+)
+
+var (
+	ErrUnknownMethod = errors.New("unknown signing method")
+	ErrMissingKey    = errors.New("no key configured for the signing method")
+	ErrUnknownKey    = errors.New("token is signed by an unknown key")
+)
+
+// Return the JWT signing method for the configured method; an empty method
+// selects HMAC.
+func jwtMethod(method string) (jwt.SigningMethod, error) {
+	switch method {
+	case "", MethodHMAC:
+		return jwt.SigningMethodHS256, nil
+	case MethodEd25519:
+		return jwt.SigningMethodEdDSA, nil
+	case MethodRS256:
+		return jwt.SigningMethodRS256, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+}
+
+// IsAsymmetric returns true if the method uses a key pair instead of a shared
+// secret.
+func IsAsymmetric(method string) bool {
+	return method == MethodEd25519 || method == MethodRS256
+}
+
+// ValidateMethod checks if the method is known.
+func ValidateMethod(method string) error {
+	_, err := jwtMethod(method)
+	return err
+}
+
+// Key is a key for signing or verifying tokens. Tokens carry the ID of the key
+// in their kid header; the key with the empty ID is used for tokens without
+// kid.
+type Key struct {
+	ID           string
+	SharedSecret []byte
+	// PEM file with the private key for signing or the public key for
+	// verification
+	KeyFile string
+}
+
+func readPEMFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, ErrMissingKey
+	}
+	return os.ReadFile(path)
+}
+
+// Load the key material for the method; private selects whether KeyFile
+// contains a private or a public key.
+func (k Key) load(method jwt.SigningMethod, private bool) (interface{}, error) {
+	if method == jwt.SigningMethodHS256 {
+		if len(k.SharedSecret) == 0 {
+			return nil, ErrMissingKey
+		}
+		return k.SharedSecret, nil
+	}
+
+	pem, err := readPEMFile(k.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch {
+	case method == jwt.SigningMethodEdDSA && private:
+		key, err = jwt.ParseEdPrivateKeyFromPEM(pem)
+	case method == jwt.SigningMethodEdDSA:
+		key, err = jwt.ParseEdPublicKeyFromPEM(pem)
+	case private:
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(pem)
+	default:
+		key, err = jwt.ParseRSAPublicKeyFromPEM(pem)
+	}
+	if err != nil {
+		kind := "public"
+		if private {
+			kind = "private"
+		}
+		return nil, fmt.Errorf("failed to parse %s key %s: %s", kind, k.KeyFile, err)
+	}
+	return key, nil
+}
+
+// Signer signs tokens with the configured method.
+type Signer struct {
+	method jwt.SigningMethod
+	keyID  string
+	key    interface{}
+}
+
+// NewSigner creates a signer for the method. HMAC uses the shared secret of
+// the key, the asymmetric methods the private key from its file.
+func NewSigner(method string, key Key) (*Signer, error) {
+	jwtMethod, err := jwtMethod(method)
+	if err != nil {
+		return nil, err
+	}
+
+	material, err := key.load(jwtMethod, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{method: jwtMethod, keyID: key.ID, key: material}, nil
+}
+
+// NewHMACSigner creates a signer for HMAC with the shared secret.
+func NewHMACSigner(sharedSecret []byte) *Signer {
+	return &Signer{method: jwt.SigningMethodHS256, key: sharedSecret}
+}
+
+// Sign returns the signed token with the claims.
+func (s *Signer) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(s.method, claims)
+	if s.keyID != "" {
+		token.Header["kid"] = s.keyID
+	}
+	return token.SignedString(s.key)
+}
+
+// Verifier verifies tokens signed with the configured method by one of its
+// keys. Tokens signed with any other method or by an unknown key are rejected.
+type Verifier struct {
+	method jwt.SigningMethod
+	keys   map[string]interface{}
+}
+
+// NewVerifier creates a verifier for the method. HMAC uses the shared secrets
+// of the keys, the asymmetric methods the public keys from their files.
+func NewVerifier(method string, keys []Key) (*Verifier, error) {
+	jwtMethod, err := jwtMethod(method)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, ErrMissingKey
+	}
+
+	v := &Verifier{method: jwtMethod, keys: make(map[string]interface{})}
+	for _, key := range keys {
+		if _, exists := v.keys[key.ID]; exists {
+			return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+		}
+		v.keys[key.ID], err = key.load(jwtMethod, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// NewHMACVerifier creates a verifier for HMAC with the shared secret.
+func NewHMACVerifier(sharedSecret []byte) *Verifier {
+	return &Verifier{
+		method: jwt.SigningMethodHS256,
+		keys:   map[string]interface{}{"": sharedSecret},
+	}
+}
+
+// Parse parses and verifies the token into the claims. The alg header of the
+// token must match the configured method and the kid header one of the keys.
+func (v *Verifier) Parse(token string, claims jwt.Claims) (*jwt.Token, error) {
+	parser := &jwt.Parser{ValidMethods: []string{v.method.Alg()}}
+	parsed, err := parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, _ := token.Header["kid"].(string)
+		key, ok := v.keys[keyID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+		}
+		return key, nil
+	})
+
+	// the validation errors of jwt do not unwrap to the error of the key
+	// lookup
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) && errors.Is(validationErr.Inner, ErrUnknownKey) {
+		return parsed, validationErr.Inner
+	}
+	return parsed, err
+}
+
+// IsMalformed returns true if the error of Parse means that the token could
+// not be decoded at all, as opposed to a token which failed verification.
+func IsMalformed(err error) bool {
+	var validationErr *jwt.ValidationError
+	if errors.As(err, &validationErr) {
+		return validationErr.Errors&jwt.ValidationErrorMalformed != 0
+	}
+	return false
+}
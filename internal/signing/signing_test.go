@@ -0,0 +1,212 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	path := filepath.Join(t.TempDir(), "key.pem")
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	require.Nil(t, err)
+	return path
+}
+
+// Return the paths of the PEM files of a new key pair for the method
+func generateKeyPair(t *testing.T, method string) (privateKeyFile, publicKeyFile string) {
+	var private, public interface{}
+	switch method {
+	case MethodEd25519:
+		publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+		require.Nil(t, err)
+		private, public = privateKey, publicKey
+	case MethodRS256:
+		privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.Nil(t, err)
+		private, public = privateKey, &privateKey.PublicKey
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	require.Nil(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	require.Nil(t, err)
+	return writePEM(t, "PRIVATE KEY", privateDER), writePEM(t, "PUBLIC KEY", publicDER)
+}
+
+func newClaims() *jwt.StandardClaims {
+	return &jwt.StandardClaims{
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		Subject:   "config",
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	for _, method := range []string{MethodEd25519, MethodRS256} {
+		t.Run(method, func(t *testing.T) {
+			privateKeyFile, publicKeyFile := generateKeyPair(t, method)
+
+			signer, err := NewSigner(method, Key{KeyFile: privateKeyFile})
+			require.Nil(t, err)
+			verifier, err := NewVerifier(method, []Key{{KeyFile: publicKeyFile}})
+			require.Nil(t, err)
+
+			token, err := signer.Sign(newClaims())
+			require.Nil(t, err)
+
+			claims := &jwt.StandardClaims{}
+			parsed, err := verifier.Parse(token, claims)
+			assert.Nil(t, err)
+			assert.True(t, parsed.Valid)
+			assert.Equal(t, "config", claims.Subject)
+		})
+	}
+}
+
+func TestSignAndVerifyWithHMAC(t *testing.T) {
+	signer, err := NewSigner("", Key{SharedSecret: []byte("0123456789ab")})
+	require.Nil(t, err)
+	verifier, err := NewVerifier(MethodHMAC, []Key{{SharedSecret: []byte("0123456789ab")}})
+	require.Nil(t, err)
+
+	token, err := signer.Sign(newClaims())
+	require.Nil(t, err)
+
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.Nil(t, err)
+
+	_, err = NewHMACVerifier([]byte("other-secret")).Parse(token, &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+	assert.False(t, IsMalformed(err))
+}
+
+func TestVerifierRejectsOtherAlgorithms(t *testing.T) {
+	_, publicKeyFile := generateKeyPair(t, MethodEd25519)
+	verifier, err := NewVerifier(MethodEd25519, []Key{{KeyFile: publicKeyFile}})
+	require.Nil(t, err)
+
+	token, err := NewHMACSigner([]byte("0123456789ab")).Sign(newClaims())
+	require.Nil(t, err)
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+	assert.False(t, IsMalformed(err))
+
+	rsaPrivateKeyFile, _ := generateKeyPair(t, MethodRS256)
+	rsaSigner, err := NewSigner(MethodRS256, Key{KeyFile: rsaPrivateKeyFile})
+	require.Nil(t, err)
+	token, err = rsaSigner.Sign(newClaims())
+	require.Nil(t, err)
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+
+	// a HS256 token keyed with the public key must not pass as RS256
+	_, rsaPublicKeyFile := generateKeyPair(t, MethodRS256)
+	rsaVerifier, err := NewVerifier(MethodRS256, []Key{{KeyFile: rsaPublicKeyFile}})
+	require.Nil(t, err)
+	publicPEM, err := os.ReadFile(rsaPublicKeyFile)
+	require.Nil(t, err)
+	token, err = NewHMACSigner(publicPEM).Sign(newClaims())
+	require.Nil(t, err)
+	_, err = rsaVerifier.Parse(token, &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+}
+
+func TestParseReportsMalformedTokens(t *testing.T) {
+	_, err := NewHMACVerifier([]byte("0123456789ab")).Parse("not-a-token", &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+	assert.True(t, IsMalformed(err))
+}
+
+func TestNewSignerRequiresKeys(t *testing.T) {
+	_, err := NewSigner(MethodHMAC, Key{})
+	assert.Equal(t, ErrMissingKey, err)
+
+	_, err = NewSigner(MethodEd25519, Key{SharedSecret: []byte("0123456789ab")})
+	assert.Equal(t, ErrMissingKey, err)
+
+	_, err = NewVerifier(MethodRS256, nil)
+	assert.Equal(t, ErrMissingKey, err)
+
+	_, err = NewSigner("hs512", Key{})
+	assert.ErrorIs(t, err, ErrUnknownMethod)
+
+	// an Ed25519 key is not accepted for RS256
+	privateKeyFile, publicKeyFile := generateKeyPair(t, MethodEd25519)
+	_, err = NewSigner(MethodRS256, Key{KeyFile: privateKeyFile})
+	assert.NotNil(t, err)
+	_, err = NewVerifier(MethodRS256, []Key{{KeyFile: publicKeyFile}})
+	assert.NotNil(t, err)
+}
+
+func TestVerifierSelectsKeyByID(t *testing.T) {
+	oldKey := Key{ID: "2024", SharedSecret: []byte("old-secret-0123")}
+	newKey := Key{ID: "2025", SharedSecret: []byte("new-secret-0123")}
+
+	verifier, err := NewVerifier(MethodHMAC, []Key{oldKey, newKey})
+	require.Nil(t, err)
+
+	for _, key := range []Key{oldKey, newKey} {
+		signer, err := NewSigner(MethodHMAC, key)
+		require.Nil(t, err)
+		token, err := signer.Sign(newClaims())
+		require.Nil(t, err)
+
+		parsed, err := verifier.Parse(token, &jwt.StandardClaims{})
+		assert.Nil(t, err)
+		assert.Equal(t, key.ID, parsed.Header["kid"])
+	}
+
+	// the secret of one key does not verify tokens claiming to be signed
+	// by the other
+	signer, err := NewSigner(MethodHMAC, Key{ID: newKey.ID, SharedSecret: oldKey.SharedSecret})
+	require.Nil(t, err)
+	token, err := signer.Sign(newClaims())
+	require.Nil(t, err)
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.NotNil(t, err)
+
+	signer, err = NewSigner(MethodHMAC, Key{ID: "2023", SharedSecret: oldKey.SharedSecret})
+	require.Nil(t, err)
+	token, err = signer.Sign(newClaims())
+	require.Nil(t, err)
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	// tokens without kid need a key without ID
+	token, err = NewHMACSigner(oldKey.SharedSecret).Sign(newClaims())
+	require.Nil(t, err)
+	_, err = verifier.Parse(token, &jwt.StandardClaims{})
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestNewVerifierRejectsDuplicateKeyIDs(t *testing.T) {
+	_, err := NewVerifier(MethodHMAC, []Key{
+		{ID: "a", SharedSecret: []byte("0123456789ab")},
+		{ID: "a", SharedSecret: []byte("ba9876543210")},
+	})
+	assert.ErrorContains(t, err, "duplicate key ID")
+}
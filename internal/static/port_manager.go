@@ -1,48 +1,158 @@
 package static
 
 import (
+	"errors"
 	"fmt"
 	"net/netip"
+	"strings"
+	"sync"
 
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/ippool"
 	"golang.org/x/exp/slices"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+var (
+	ErrNoRangeConfigured = errors.New("cannot provision new ports without a matching address range")
+	ErrRangeExhausted    = errors.New("no free address left in the configured address ranges")
 )
 
 type Config struct {
-	IPv4Addresses []netip.Addr `toml:"ipv4-addresses"`
-	// TODO: Add ipv6 support
-	// IPv6Addresses []netip.Addr `toml:"ipv6-addresses"`
+	IPv4Addresses []netip.Addr   `toml:"ipv4-addresses"`
+	IPv6Addresses []netip.Addr   `toml:"ipv6-addresses"`
+	IPv4Ranges    []netip.Prefix `toml:"ipv4-ranges"`
+	IPv6Ranges    []netip.Prefix `toml:"ipv6-ranges"`
+	// HostnameTemplate is the hostname published for each address;
+	// {{address}} is replaced by the address with "." and ":" replaced by
+	// "-". Empty publishes no hostname.
+	HostnameTemplate string `toml:"hostname-template"`
 }
 
+// StaticL3PortManager uses load-balancer IP addresses from a static
+// configuration. The ID of a port is its address.
+//
+// Enumerated addresses are always available. Addresses from the configured
+// ranges are handed out one by one when a port is provisioned and are
+// returned to the ranges by the cleanup once no service uses them anymore.
 type StaticL3PortManager struct {
 	cfg *Config
+
+	lock    sync.Mutex
+	claimed map[netip.Addr]bool
 }
 
 func NewStaticL3PortManager(config *Config) (*StaticL3PortManager, error) {
 	return &StaticL3PortManager{
-		cfg: config,
+		cfg:     config,
+		claimed: make(map[netip.Addr]bool),
 	}, nil
 }
 
+func (pm *StaticL3PortManager) isEnumerated(addr netip.Addr) bool {
+	return slices.Contains(pm.cfg.IPv4Addresses, addr) ||
+		slices.Contains(pm.cfg.IPv6Addresses, addr)
+}
+
+func (pm *StaticL3PortManager) isInRange(addr netip.Addr) bool {
+	if addr.Is6() {
+		return ippool.RangesContain(pm.cfg.IPv6Ranges, addr)
+	}
+	return ippool.RangesContain(pm.cfg.IPv4Ranges, addr)
+}
+
 func (pm *StaticL3PortManager) CheckPortExists(portID string) (bool, error) {
-	// TODO: Add ipv6 support
 	addr, err := netip.ParseAddr(portID)
-
 	if err != nil {
 		return false, nil
 	}
 
-	if !slices.Contains(pm.cfg.IPv4Addresses, addr) {
+	if pm.isEnumerated(addr) {
+		return true, nil
+	}
+
+	if !pm.isInRange(addr) {
 		return false, nil
 	}
 
+	// the address is in use by a service (e.g. after a restart), so it must
+	// not be handed out again
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+	pm.claimed[addr] = true
+
 	return true, nil
 }
 
-func (pm *StaticL3PortManager) ProvisionPort() (string, error) {
-	return "", fmt.Errorf("cannot provision new ports when using static port manager")
+// ClaimPorts marks the addresses from the ranges as in use. The controller
+// calls it with the addresses of all services after a restart, before any
+// port is provisioned. Enumerated and unknown addresses are ignored.
+func (pm *StaticL3PortManager) ClaimPorts(portIDs []string) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for _, portID := range portIDs {
+		addr, err := netip.ParseAddr(portID)
+		if err != nil || pm.isEnumerated(addr) || !pm.isInRange(addr) {
+			continue
+		}
+		pm.claimed[addr] = true
+	}
+	return nil
 }
 
+// ProvisionPort hands out the next free address of the given family from the
+// configured ranges. If no family is given, IPv4 ranges are tried first.
+func (pm *StaticL3PortManager) ProvisionPort(family corev1.IPFamily) (string, error) {
+	var ranges []netip.Prefix
+	switch family {
+	case corev1.IPv4Protocol:
+		ranges = pm.cfg.IPv4Ranges
+	case corev1.IPv6Protocol:
+		ranges = pm.cfg.IPv6Ranges
+	default:
+		ranges = append(append(ranges, pm.cfg.IPv4Ranges...), pm.cfg.IPv6Ranges...)
+	}
+
+	if len(ranges) == 0 {
+		return "", ErrNoRangeConfigured
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	addr, ok := ippool.NextFreeAddress(ranges, func(addr netip.Addr) bool {
+		return pm.claimed[addr] || pm.isEnumerated(addr)
+	})
+	if ok {
+		pm.claimed[addr] = true
+		return addr.String(), nil
+	}
+
+	return "", ErrRangeExhausted
+}
+
+// CleanUnusedPorts returns all addresses handed out from the ranges which are
+// not in use to the ranges. Enumerated addresses are never released.
 func (pm *StaticL3PortManager) CleanUnusedPorts(usedPorts []string) error {
+	used := make(map[netip.Addr]bool)
+	for _, portID := range usedPorts {
+		addr, err := netip.ParseAddr(portID)
+		if err != nil {
+			continue
+		}
+		used[addr] = true
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	for addr := range pm.claimed {
+		if !used[addr] {
+			klog.Infof("releasing unused address %s to the ranges", addr)
+			delete(pm.claimed, addr)
+		}
+	}
 	return nil
 }
 
@@ -50,12 +160,31 @@ func (pm *StaticL3PortManager) EnsureAgentsState() error {
 	return nil
 }
 
+// GetAvailablePorts returns the enumerated addresses and all addresses which
+// have been handed out from the ranges so far.
 func (pm *StaticL3PortManager) GetAvailablePorts() ([]string, error) {
 	var ports []string
 
 	for _, addr := range pm.cfg.IPv4Addresses {
 		ports = append(ports, addr.String())
 	}
+	for _, addr := range pm.cfg.IPv6Addresses {
+		ports = append(ports, addr.String())
+	}
+
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	claimed := make([]netip.Addr, 0, len(pm.claimed))
+	for addr := range pm.claimed {
+		claimed = append(claimed, addr)
+	}
+	slices.SortFunc(claimed, func(a, b netip.Addr) int {
+		return a.Compare(b)
+	})
+	for _, addr := range claimed {
+		ports = append(ports, addr.String())
+	}
 
 	return ports, nil
 }
@@ -66,7 +195,17 @@ func (pm *StaticL3PortManager) GetExternalAddress(portID string) (string, string
 		return "", "", fmt.Errorf("%s is not a valid load-balancer address", portID)
 	}
 
-	return portID, "", nil
+	return portID, RenderHostnameTemplate(pm.cfg.HostnameTemplate, portID), nil
+}
+
+// RenderHostnameTemplate returns the hostname of the address according to
+// the template.
+func RenderHostnameTemplate(template string, address string) string {
+	if template == "" {
+		return ""
+	}
+	label := strings.NewReplacer(".", "-", ":", "-").Replace(address)
+	return strings.ReplaceAll(template, "{{address}}", label)
 }
 
 func (pm *StaticL3PortManager) GetInternalAddress(portID string) (string, error) {
@@ -2,6 +2,7 @@ package static
 
 import (
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
 	"net/netip"
 	"testing"
 )
@@ -41,7 +42,7 @@ func TestCheckPortExists(t *testing.T) {
 func TestProvisionPort(t *testing.T) {
 	man := newStaticPortManagerFixture(t)
 
-	_, err := man.ProvisionPort()
+	_, err := man.ProvisionPort(corev1.IPv4Protocol)
 	assert.NotNil(t, err)
 }
 
@@ -72,6 +73,18 @@ func TestGetExternalAddress(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestGetExternalAddressRendersHostname(t *testing.T) {
+	man := newStaticPortManagerFixture(t)
+	man.cfg.HostnameTemplate = "lb-{{address}}.example.com"
+
+	addr, hostname, err := man.GetExternalAddress("203.0.113.113")
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.113", addr)
+	assert.Equal(t, "lb-203-0-113-113.example.com", hostname)
+
+	assert.Equal(t, "lb-2001-db8--1.example.com", RenderHostnameTemplate("lb-{{address}}.example.com", "2001:db8::1"))
+}
+
 func TestGetInternalAddress(t *testing.T) {
 	man := newStaticPortManagerFixture(t)
 
@@ -82,3 +95,124 @@ func TestGetInternalAddress(t *testing.T) {
 	_, err = man.GetInternalAddress("222.222.222.222")
 	assert.NotNil(t, err)
 }
+
+func newStaticRangePortManagerFixture(t *testing.T) *StaticL3PortManager {
+	cfg := Config{
+		IPv4Addresses: []netip.Addr{netip.MustParseAddr("203.0.113.1")},
+		IPv6Addresses: []netip.Addr{netip.MustParseAddr("2001:db8::1")},
+		IPv4Ranges:    []netip.Prefix{netip.MustParsePrefix("203.0.113.0/30")},
+		IPv6Ranges:    []netip.Prefix{netip.MustParsePrefix("2001:db8::/64")},
+	}
+
+	man, err := NewStaticL3PortManager(&cfg)
+	assert.Nil(t, err)
+
+	return man
+}
+
+func TestCheckPortExistsWithIPv6AndRanges(t *testing.T) {
+	man := newStaticRangePortManagerFixture(t)
+
+	for _, portID := range []string{"2001:db8::1", "203.0.113.2", "2001:db8::ffff"} {
+		exists, err := man.CheckPortExists(portID)
+		assert.Nil(t, err)
+		assert.True(t, exists, portID)
+	}
+
+	// network and broadcast addresses as well as addresses outside of the
+	// ranges are not usable
+	for _, portID := range []string{"203.0.113.0", "203.0.113.3", "2001:db8::", "2001:db8:1::1"} {
+		exists, err := man.CheckPortExists(portID)
+		assert.Nil(t, err)
+		assert.False(t, exists, portID)
+	}
+}
+
+func TestProvisionPortFromRanges(t *testing.T) {
+	man := newStaticRangePortManagerFixture(t)
+
+	// 203.0.113.1 is enumerated and thus skipped
+	portID, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", portID)
+
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Equal(t, ErrRangeExhausted, err)
+
+	portID, err = man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::2", portID)
+
+	portID, err = man.ProvisionPort("")
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::3", portID)
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"203.0.113.1", "2001:db8::1", "203.0.113.2", "2001:db8::2", "2001:db8::3"}, ports)
+}
+
+func TestProvisionPortSkipsAddressesInUse(t *testing.T) {
+	man := newStaticRangePortManagerFixture(t)
+
+	exists, err := man.CheckPortExists("2001:db8::2")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	portID, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::3", portID)
+}
+
+func TestCleanUnusedPortsReleasesRangeAddresses(t *testing.T) {
+	man := newStaticRangePortManagerFixture(t)
+
+	portID, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", portID)
+
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Equal(t, ErrRangeExhausted, err)
+
+	err = man.CleanUnusedPorts([]string{"203.0.113.1"})
+	assert.Nil(t, err)
+
+	portID, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.2", portID)
+
+	// addresses in use are kept
+	err = man.CleanUnusedPorts([]string{"203.0.113.2"})
+	assert.Nil(t, err)
+
+	_, err = man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Equal(t, ErrRangeExhausted, err)
+}
+
+func TestProvisionPortWithoutMatchingRange(t *testing.T) {
+	man := newStaticPortManagerFixture(t)
+
+	_, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Equal(t, ErrNoRangeConfigured, err)
+}
+
+func TestProvisionPortSkipsAddressesClaimedAfterRestart(t *testing.T) {
+	man := newStaticRangePortManagerFixture(t)
+
+	portID, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::2", portID)
+
+	// the claims are lost on restart and restored from the services
+	man = newStaticRangePortManagerFixture(t)
+	err = man.ClaimPorts([]string{"2001:db8::2", "2001:db8::1", "198.51.100.1", "not-an-ip"})
+	assert.Nil(t, err)
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"203.0.113.1", "2001:db8::1", "2001:db8::2"}, ports)
+
+	portID, err = man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::3", portID)
+}
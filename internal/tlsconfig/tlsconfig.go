@@ -0,0 +1,230 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caPEM, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("CA file %q contains no certificates", path)
+	}
+	return pool, nil
+}
+
+// reloader caches a TLS config built from files and rebuilds it whenever the
+// modification time of one of the files changes. This picks up certificates
+// rotated on disk, e.g. by cert-manager.
+type reloader struct {
+	files []string
+	build func() (*tls.Config, error)
+
+	mutex    sync.Mutex
+	config   *tls.Config
+	modTimes []time.Time
+}
+
+func newReloader(build func() (*tls.Config, error), files ...string) (*reloader, error) {
+	r := &reloader{build: build}
+	for _, file := range files {
+		if file != "" {
+			r.files = append(r.files, file)
+		}
+	}
+
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := build()
+	if err != nil {
+		return nil, err
+	}
+	r.config, r.modTimes = config, modTimes
+	return r, nil
+}
+
+func (r *reloader) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, len(r.files))
+	for i, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// get returns the current config. If rebuilding the config after a change
+// fails, e.g. because only the certificate but not yet the key was replaced,
+// the previous config is kept and the rebuild is retried on the next call.
+func (r *reloader) get() *tls.Config {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		klog.Warningf("Failed to check TLS files for changes: %s", err.Error())
+		return r.config
+	}
+
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return r.config
+	}
+
+	config, err := r.build()
+	if err != nil {
+		klog.Warningf("Failed to reload TLS files, keeping the previous ones: %s", err.Error())
+		return r.config
+	}
+	klog.Infof("Reloaded TLS files %v", r.files)
+	r.config, r.modTimes = config, modTimes
+	return config
+}
+
+// NewServerConfig returns the TLS config of a server with the certificate and
+// key from the files. If clientCAFile is not empty, clients may present a
+// certificate signed by one of the CAs from the file, which is verified; see
+// RequireClientCertificate. All files are reloaded when they change.
+func NewServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	build := func() (*tls.Config, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config := &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+		if clientCAFile != "" {
+			config.ClientCAs, err = loadCertPool(clientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+		return config, nil
+	}
+
+	r, err := newReloader(build, certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.get(), nil
+		},
+	}, nil
+}
+
+// RequireClientCertificate only passes requests to the handler if the client
+// presented a verified certificate.
+func RequireClientCertificate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			klog.V(5).Infof("rejecting request from %s without client certificate", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// reloadingTransport sends requests via a transport with the current TLS
+// config and replaces the transport when the config was reloaded.
+type reloadingTransport struct {
+	reloader *reloader
+
+	mutex     sync.Mutex
+	config    *tls.Config
+	transport *http.Transport
+}
+
+func (t *reloadingTransport) current() *http.Transport {
+	config := t.reloader.get()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if config != t.config {
+		if t.transport != nil {
+			t.transport.CloseIdleConnections()
+		}
+		t.transport = http.DefaultTransport.(*http.Transport).Clone()
+		t.transport.TLSClientConfig = config
+		t.config = config
+	}
+	return t.transport
+}
+
+func (t *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current().RoundTrip(req)
+}
+
+// NewClientTransport returns a transport which verifies servers against the
+// CAs from caFile (or the system CAs if it is empty) and presents the client
+// certificate from certFile and keyFile if they are not empty. All files are
+// reloaded when they change.
+func NewClientTransport(caFile, certFile, keyFile string) (http.RoundTripper, error) {
+	build := func() (*tls.Config, error) {
+		config := &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		}
+		if caFile != "" {
+			var err error
+			config.RootCAs, err = loadCertPool(caFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if certFile != "" {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		return config, nil
+	}
+
+	r, err := newReloader(build, caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingTransport{reloader: r}, nil
+}
@@ -0,0 +1,210 @@
+/* Copyright 2020 CLOUD&HEAT Technologies GmbH
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// Issue a certificate for 127.0.0.1 and return the PEM of it and its key
+func (ca *testCA) issue(t *testing.T, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.Nil(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+}
+
+// Write the file with a modification time in the future, so that a rewrite
+// within the same second is noticed as well
+func writeFile(t *testing.T, path string, data []byte, age time.Duration) {
+	require.Nil(t, os.WriteFile(path, data, 0600))
+	modTime := time.Now().Add(age)
+	require.Nil(t, os.Chtimes(path, modTime, modTime))
+}
+
+type tlsFixture struct {
+	t   *testing.T
+	dir string
+	url string
+}
+
+func (f *tlsFixture) path(name string) string {
+	return filepath.Join(f.dir, name)
+}
+
+func (f *tlsFixture) writeServerCert(ca *testCA, age time.Duration) {
+	cert, key := ca.issue(f.t, x509.ExtKeyUsageServerAuth)
+	writeFile(f.t, f.path("server.crt"), cert, age)
+	writeFile(f.t, f.path("server.key"), key, age)
+}
+
+func (f *tlsFixture) writeClientCert(ca *testCA, age time.Duration) {
+	cert, key := ca.issue(f.t, x509.ExtKeyUsageClientAuth)
+	writeFile(f.t, f.path("client.crt"), cert, age)
+	writeFile(f.t, f.path("client.key"), key, age)
+}
+
+func (f *tlsFixture) startServer() {
+	config, err := NewServerConfig(f.path("server.crt"), f.path("server.key"), f.path("client-ca.crt"))
+	require.Nil(f.t, err)
+
+	srv := httptest.NewUnstartedServer(RequireClientCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+	srv.Listener = tls.NewListener(srv.Listener, config)
+	srv.Start()
+	f.t.Cleanup(srv.Close)
+	f.url = "https://" + srv.Listener.Addr().String()
+}
+
+func (f *tlsFixture) get(transport http.RoundTripper) (int, error) {
+	resp, err := (&http.Client{Transport: transport}).Get(f.url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func newTLSFixture(t *testing.T, serverCA, clientCA *testCA) *tlsFixture {
+	f := &tlsFixture{t: t, dir: t.TempDir()}
+	writeFile(t, f.path("ca.crt"), serverCA.pem, 0)
+	writeFile(t, f.path("client-ca.crt"), clientCA.pem, 0)
+	f.writeServerCert(serverCA, 0)
+	f.writeClientCert(clientCA, 0)
+	f.startServer()
+	return f
+}
+
+func TestMutualTLS(t *testing.T) {
+	f := newTLSFixture(t, newTestCA(t), newTestCA(t))
+
+	transport, err := NewClientTransport(f.path("ca.crt"), f.path("client.crt"), f.path("client.key"))
+	require.Nil(t, err)
+	status, err := f.get(transport)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// without a client certificate the handler rejects the request
+	transport, err = NewClientTransport(f.path("ca.crt"), "", "")
+	require.Nil(t, err)
+	status, err = f.get(transport)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	// a server certificate of an unknown CA is rejected
+	writeFile(t, f.path("other-ca.crt"), newTestCA(t).pem, 0)
+	transport, err = NewClientTransport(f.path("other-ca.crt"), f.path("client.crt"), f.path("client.key"))
+	require.Nil(t, err)
+	_, err = f.get(transport)
+	assert.NotNil(t, err)
+}
+
+func TestCertificatesAreReloaded(t *testing.T) {
+	clientCA := newTestCA(t)
+	f := newTLSFixture(t, newTestCA(t), clientCA)
+
+	transport, err := NewClientTransport(f.path("ca.crt"), f.path("client.crt"), f.path("client.key"))
+	require.Nil(t, err)
+	status, err := f.get(transport)
+	require.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// rotate the server certificate to a new CA on both sides
+	newCA := newTestCA(t)
+	f.writeServerCert(newCA, time.Minute)
+	writeFile(t, f.path("ca.crt"), newCA.pem, time.Minute)
+
+	status, err = f.get(transport)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// a broken key keeps the previous certificate in use
+	writeFile(t, f.path("server.key"), []byte("garbage"), 2*time.Minute)
+	status, err = f.get(transport)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestNewServerConfigFailsForMissingFiles(t *testing.T) {
+	_, err := NewServerConfig("/nonexistent/server.crt", "/nonexistent/server.key", "")
+	assert.NotNil(t, err)
+
+	_, err = NewClientTransport("/nonexistent/ca.crt", "", "")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,64 @@
+package webhook
+
+// This file describes the JSON-over-HTTP contract between the webhook port
+// manager and an external IPAM adapter. See docs/controller/webhook.md.
+
+const (
+	PathProvisionPort      = "/v1/provision-port"
+	PathCleanUnusedPorts   = "/v1/clean-unused-ports"
+	PathEnsureAgentsState  = "/v1/ensure-agents-state"
+	PathGetAvailablePorts  = "/v1/get-available-ports"
+	PathGetExternalAddress = "/v1/get-external-address"
+	PathGetInternalAddress = "/v1/get-internal-address"
+	PathCheckPortExists    = "/v1/check-port-exists"
+)
+
+const (
+	ContentTypeJSON          = "application/json"
+	HeaderAuthorization      = "Authorization"
+	AuthorizationBearerStart = "Bearer "
+
+	// Error code which signals that the requested port does not exist
+	ErrorCodePortNotFound = "port-not-found"
+)
+
+type ProvisionPortRequest struct {
+	// Either "IPv4", "IPv6" or empty if the IPAM may choose
+	IPFamily string `json:"ip_family"`
+}
+
+type ProvisionPortResponse struct {
+	PortID string `json:"port_id"`
+}
+
+type CleanUnusedPortsRequest struct {
+	UsedPorts []string `json:"used_ports"`
+}
+
+type GetAvailablePortsResponse struct {
+	PortIDs []string `json:"port_ids"`
+}
+
+type PortRequest struct {
+	PortID string `json:"port_id"`
+}
+
+type GetExternalAddressResponse struct {
+	Address  string `json:"address"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+type GetInternalAddressResponse struct {
+	Address string `json:"address"`
+}
+
+type CheckPortExistsResponse struct {
+	Exists bool `json:"exists"`
+}
+
+// ErrorResponse is returned by the adapter with any non-2xx status code
+type ErrorResponse struct {
+	Error string `json:"error"`
+	// Machine-readable reason of the error, e.g. ErrorCodePortNotFound
+	Code string `json:"code,omitempty"`
+}
@@ -0,0 +1,201 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Maximum size of a response body which is read from the adapter
+	maxResponseSize = 1 << 20
+)
+
+var (
+	ErrPortNotFound = errors.New("port not found")
+)
+
+type Config struct {
+	URL         string `toml:"url"`
+	BearerToken string `toml:"bearer-token"`
+	Username    string `toml:"username"`
+	Password    string `toml:"password"`
+	CAFile      string `toml:"ca-file"`
+	TLSInsecure bool   `toml:"tls-insecure"`
+	// Timeout of a single request in seconds
+	Timeout int `toml:"timeout"`
+}
+
+// WebhookL3PortManager delegates all port management to an external adapter
+// via a JSON-over-HTTP contract.
+type WebhookL3PortManager struct {
+	cfg    *Config
+	url    string
+	client *http.Client
+}
+
+func NewWebhookL3PortManager(config *Config) (*WebhookL3PortManager, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.TLSInsecure,
+	}
+
+	if config.CAFile != "" {
+		caPEM, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read webhook CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("webhook CA file %q contains no certificates", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	return &WebhookL3PortManager{
+		cfg: config,
+		url: strings.TrimRight(config.URL, "/"),
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(config.Timeout) * time.Second,
+		},
+	}, nil
+}
+
+// Send a request with the given body to the adapter and decode the response
+// into result (if not nil).
+//
+// Returns ErrPortNotFound if the adapter answers with 404 Not Found and the
+// port-not-found error code. Any other 404 (e.g. of a wrong URL) is a hard
+// error, so that a misconfiguration does not make all ports appear missing.
+func (pm *WebhookL3PortManager) call(path string, body interface{}, result interface{}) error {
+	if body == nil {
+		body = struct{}{}
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, pm.url+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	req.Header.Set("Accept", ContentTypeJSON)
+	if pm.cfg.BearerToken != "" {
+		req.Header.Set(HeaderAuthorization, AuthorizationBearerStart+pm.cfg.BearerToken)
+	} else if pm.cfg.Username != "" {
+		req.SetBasicAuth(pm.cfg.Username, pm.cfg.Password)
+	}
+
+	resp, err := pm.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook request to %s failed: %s", path, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("could not read webhook response of %s: %s", path, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errResp := ErrorResponse{}
+		decodeErr := json.Unmarshal(data, &errResp)
+		if decodeErr == nil && resp.StatusCode == http.StatusNotFound && errResp.Code == ErrorCodePortNotFound {
+			return ErrPortNotFound
+		}
+		if decodeErr == nil && errResp.Error != "" {
+			return fmt.Errorf("webhook %s failed with HTTP status %d: %s", path, resp.StatusCode, errResp.Error)
+		}
+		return fmt.Errorf("webhook %s failed with HTTP status %d", path, resp.StatusCode)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return fmt.Errorf("invalid webhook response of %s: %s", path, err)
+	}
+	return nil
+}
+
+func (pm *WebhookL3PortManager) ProvisionPort(family corev1.IPFamily) (string, error) {
+	resp := ProvisionPortResponse{}
+	err := pm.call(PathProvisionPort, &ProvisionPortRequest{IPFamily: string(family)}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if resp.PortID == "" {
+		return "", fmt.Errorf("webhook %s returned no port id", PathProvisionPort)
+	}
+	return resp.PortID, nil
+}
+
+func (pm *WebhookL3PortManager) CleanUnusedPorts(usedPorts []string) error {
+	if usedPorts == nil {
+		usedPorts = []string{}
+	}
+	return pm.call(PathCleanUnusedPorts, &CleanUnusedPortsRequest{UsedPorts: usedPorts}, nil)
+}
+
+func (pm *WebhookL3PortManager) EnsureAgentsState() error {
+	return pm.call(PathEnsureAgentsState, nil, nil)
+}
+
+func (pm *WebhookL3PortManager) GetAvailablePorts() ([]string, error) {
+	resp := GetAvailablePortsResponse{}
+	err := pm.call(PathGetAvailablePorts, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.PortIDs, nil
+}
+
+func (pm *WebhookL3PortManager) GetExternalAddress(portID string) (string, string, error) {
+	resp := GetExternalAddressResponse{}
+	err := pm.call(PathGetExternalAddress, &PortRequest{PortID: portID}, &resp)
+	if err != nil {
+		return "", "", err
+	}
+	return resp.Address, resp.Hostname, nil
+}
+
+func (pm *WebhookL3PortManager) GetInternalAddress(portID string) (string, error) {
+	resp := GetInternalAddressResponse{}
+	err := pm.call(PathGetInternalAddress, &PortRequest{PortID: portID}, &resp)
+	if err != nil {
+		return "", err
+	}
+	return resp.Address, nil
+}
+
+// CheckPortExists asks the adapter whether the port exists. An answer with
+// 404 Not Found and the port-not-found error code is treated the same as
+// {"exists": false}.
+func (pm *WebhookL3PortManager) CheckPortExists(portID string) (bool, error) {
+	resp := CheckPortExistsResponse{}
+	err := pm.call(PathCheckPortExists, &PortRequest{PortID: portID}, &resp)
+	if err == ErrPortNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.Exists, nil
+}
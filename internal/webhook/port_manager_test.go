@@ -0,0 +1,201 @@
+package webhook_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/webhook"
+	whtesting "github.com/cloudandheat/ch-k8s-lbaas/internal/webhook/testing"
+)
+
+func newWebhookPortManagerFixture(t *testing.T, addresses ...string) (*webhook.WebhookL3PortManager, *whtesting.Server) {
+	server := whtesting.NewServer("s3cr3t", addresses...)
+	t.Cleanup(server.Close)
+
+	man, err := webhook.NewWebhookL3PortManager(&webhook.Config{
+		URL:         server.URL + "/",
+		BearerToken: "s3cr3t",
+		Timeout:     5,
+	})
+	assert.Nil(t, err)
+
+	return man, server
+}
+
+func TestProvisionPortAndLookupAddresses(t *testing.T) {
+	man, server := newWebhookPortManagerFixture(t, "203.0.113.1", "2001:db8::1")
+
+	portID, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.Nil(t, err)
+	assert.Equal(t, "port-1", portID)
+
+	exists, err := man.CheckPortExists(portID)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+
+	addr, hostname, err := man.GetExternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+	assert.Equal(t, "", hostname)
+
+	addr, err = man.GetInternalAddress(portID)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", addr)
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"port-1"}, ports)
+
+	assert.Equal(t, []string{
+		webhook.PathProvisionPort,
+		webhook.PathCheckPortExists,
+		webhook.PathGetExternalAddress,
+		webhook.PathGetInternalAddress,
+		webhook.PathGetAvailablePorts,
+	}, server.Requests())
+}
+
+func TestProvisionPortPropagatesAdapterError(t *testing.T) {
+	man, _ := newWebhookPortManagerFixture(t, "203.0.113.1")
+
+	_, err := man.ProvisionPort(corev1.IPv6Protocol)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "HTTP status 409")
+	assert.Contains(t, err.Error(), "no free address")
+}
+
+func TestCheckPortExistsForUnknownPort(t *testing.T) {
+	man, _ := newWebhookPortManagerFixture(t)
+
+	exists, err := man.CheckPortExists("port-42")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	_, _, err = man.GetExternalAddress("port-42")
+	assert.Equal(t, webhook.ErrPortNotFound, err)
+}
+
+func TestCheckPortExistsTreatsNotFoundAsMissing(t *testing.T) {
+	man, server := newWebhookPortManagerFixture(t)
+	server.FailWithCode(webhook.PathCheckPortExists, http.StatusNotFound, webhook.ErrorCodePortNotFound)
+
+	exists, err := man.CheckPortExists("port-1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestCheckPortExistsFailsOnOtherNotFound(t *testing.T) {
+	man, server := newWebhookPortManagerFixture(t)
+	server.FailWith(webhook.PathCheckPortExists, http.StatusNotFound)
+
+	_, err := man.CheckPortExists("port-1")
+	assert.NotNil(t, err)
+	assert.NotEqual(t, webhook.ErrPortNotFound, err)
+	assert.Contains(t, err.Error(), "HTTP status 404")
+}
+
+func TestCheckPortExistsFailsWithWrongURL(t *testing.T) {
+	_, server := newWebhookPortManagerFixture(t)
+	man, err := webhook.NewWebhookL3PortManager(&webhook.Config{
+		URL:         server.URL + "/wrong",
+		BearerToken: "s3cr3t",
+		Timeout:     5,
+	})
+	assert.Nil(t, err)
+
+	_, err = man.CheckPortExists("port-1")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "HTTP status 404")
+}
+
+func TestCleanUnusedPortsReleasesPorts(t *testing.T) {
+	man, server := newWebhookPortManagerFixture(t, "203.0.113.1", "203.0.113.2")
+
+	port1, err := man.ProvisionPort(corev1.IPv4Protocol)
+	assert.Nil(t, err)
+	port2, err := man.ProvisionPort("")
+	assert.Nil(t, err)
+
+	err = man.CleanUnusedPorts([]string{port2})
+	assert.Nil(t, err)
+
+	assert.Equal(t, map[string]string{port2: "203.0.113.2"}, server.Ports())
+
+	exists, err := man.CheckPortExists(port1)
+	assert.Nil(t, err)
+	assert.False(t, exists)
+}
+
+func TestEnsureAgentsState(t *testing.T) {
+	man, server := newWebhookPortManagerFixture(t)
+
+	assert.Nil(t, man.EnsureAgentsState())
+
+	server.FailWith(webhook.PathEnsureAgentsState, http.StatusInternalServerError)
+	assert.NotNil(t, man.EnsureAgentsState())
+}
+
+func TestRequestsWithoutValidTokenAreRejected(t *testing.T) {
+	server := whtesting.NewServer("s3cr3t", "203.0.113.1")
+	defer server.Close()
+
+	man, err := webhook.NewWebhookL3PortManager(&webhook.Config{
+		URL:         server.URL,
+		BearerToken: "wrong",
+		Timeout:     5,
+	})
+	assert.Nil(t, err)
+
+	_, err = man.GetAvailablePorts()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "HTTP status 401")
+}
+
+func TestBasicAuthIsSent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "user" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"port_ids": ["a"]}`))
+	}))
+	defer server.Close()
+
+	man, err := webhook.NewWebhookL3PortManager(&webhook.Config{
+		URL:      server.URL,
+		Username: "user",
+		Password: "pass",
+		Timeout:  5,
+	})
+	assert.Nil(t, err)
+
+	ports, err := man.GetAvailablePorts()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a"}, ports)
+}
+
+func TestRequestsTimeOut(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	}))
+	defer server.Close()
+	defer close(done)
+
+	man, err := webhook.NewWebhookL3PortManager(&webhook.Config{
+		URL:     server.URL,
+		Timeout: 1,
+	})
+	assert.Nil(t, err)
+
+	start := time.Now()
+	_, err = man.GetAvailablePorts()
+	assert.NotNil(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
@@ -0,0 +1,198 @@
+// Package testing provides an in-memory stand-in for an IPAM adapter which
+// implements the webhook port manager contract. It can be used in tests and
+// serves as a reference for writing adapters.
+package testing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+
+	"github.com/cloudandheat/ch-k8s-lbaas/internal/webhook"
+)
+
+type Server struct {
+	*httptest.Server
+
+	// If set, requests must carry this bearer token
+	Token string
+
+	lock      sync.Mutex
+	free      []string
+	ports     map[string]string
+	nextID    int
+	requests  []string
+	failPaths map[string]int
+	failCodes map[string]string
+}
+
+// NewServer starts a stand-in adapter which hands out the given addresses as
+// ports. The ID of a port is "port-<n>", its internal and external address
+// are the same.
+func NewServer(token string, addresses ...string) *Server {
+	s := &Server{
+		Token:     token,
+		free:      append([]string{}, addresses...),
+		ports:     make(map[string]string),
+		failPaths: make(map[string]int),
+		failCodes: make(map[string]string),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Requests returns the paths of all requests received so far.
+func (s *Server) Requests() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.requests...)
+}
+
+// Ports returns a copy of the currently provisioned ports, mapping port IDs
+// to addresses.
+func (s *Server) Ports() map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	result := make(map[string]string)
+	for id, addr := range s.ports {
+		result[id] = addr
+	}
+	return result
+}
+
+// FailWith makes all further requests to path fail with the given status.
+func (s *Server) FailWith(path string, status int) {
+	s.FailWithCode(path, status, "")
+}
+
+// FailWithCode makes all further requests to path fail with the given status
+// and error code.
+func (s *Server) FailWithCode(path string, status int, code string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.failPaths[path] = status
+	s.failCodes[path] = code
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", webhook.ContentTypeJSON)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeErrorCode(w, status, "", format, args...)
+}
+
+func writeErrorCode(w http.ResponseWriter, status int, code string, format string, args ...interface{}) {
+	writeJSON(w, status, &webhook.ErrorResponse{Error: fmt.Sprintf(format, args...), Code: code})
+}
+
+func addressFamily(address string) string {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return ""
+	}
+	if addr.Is4() {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.requests = append(s.requests, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	if s.Token != "" && r.Header.Get(webhook.HeaderAuthorization) != webhook.AuthorizationBearerStart+s.Token {
+		writeError(w, http.StatusUnauthorized, "invalid token")
+		return
+	}
+
+	if status, ok := s.failPaths[r.URL.Path]; ok {
+		writeErrorCode(w, status, s.failCodes[r.URL.Path], "injected failure")
+		return
+	}
+
+	switch r.URL.Path {
+	case webhook.PathProvisionPort:
+		req := webhook.ProvisionPortRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: %s", err)
+			return
+		}
+		for i, addr := range s.free {
+			if req.IPFamily != "" && addressFamily(addr) != req.IPFamily {
+				continue
+			}
+			s.free = append(s.free[:i], s.free[i+1:]...)
+			s.nextID++
+			id := fmt.Sprintf("port-%d", s.nextID)
+			s.ports[id] = addr
+			writeJSON(w, http.StatusOK, &webhook.ProvisionPortResponse{PortID: id})
+			return
+		}
+		writeError(w, http.StatusConflict, "no free address of family %q", req.IPFamily)
+
+	case webhook.PathCleanUnusedPorts:
+		req := webhook.CleanUnusedPortsRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: %s", err)
+			return
+		}
+		used := make(map[string]bool)
+		for _, id := range req.UsedPorts {
+			used[id] = true
+		}
+		for id, addr := range s.ports {
+			if !used[id] {
+				delete(s.ports, id)
+				s.free = append(s.free, addr)
+			}
+		}
+		writeJSON(w, http.StatusOK, struct{}{})
+
+	case webhook.PathEnsureAgentsState:
+		writeJSON(w, http.StatusOK, struct{}{})
+
+	case webhook.PathGetAvailablePorts:
+		resp := webhook.GetAvailablePortsResponse{PortIDs: []string{}}
+		for id := range s.ports {
+			resp.PortIDs = append(resp.PortIDs, id)
+		}
+		writeJSON(w, http.StatusOK, &resp)
+
+	case webhook.PathGetExternalAddress, webhook.PathGetInternalAddress, webhook.PathCheckPortExists:
+		req := webhook.PortRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: %s", err)
+			return
+		}
+		addr, exists := s.ports[req.PortID]
+		if r.URL.Path == webhook.PathCheckPortExists {
+			writeJSON(w, http.StatusOK, &webhook.CheckPortExistsResponse{Exists: exists})
+			return
+		}
+		if !exists {
+			writeErrorCode(w, http.StatusNotFound, webhook.ErrorCodePortNotFound, "port %q not found", req.PortID)
+			return
+		}
+		if r.URL.Path == webhook.PathGetExternalAddress {
+			writeJSON(w, http.StatusOK, &webhook.GetExternalAddressResponse{Address: addr})
+		} else {
+			writeJSON(w, http.StatusOK, &webhook.GetInternalAddressResponse{Address: addr})
+		}
+
+	default:
+		writeError(w, http.StatusNotFound, "unknown path %s", r.URL.Path)
+	}
+}